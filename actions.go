@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/stevemurr/fastmail-agent/jmap"
+)
+
+// MutationResult represents the outcome of a mutating command
+type MutationResult struct {
+	Action   string            `json:"action"`
+	Changed  []string          `json:"changed"`
+	Failed   map[string]string `json:"failed,omitempty"` // email ID -> reason
+	NewState string            `json:"new_state,omitempty"`
+}
+
+// mutateCommand returns the entry point for one of the mutating commands
+func mutateCommand(action string) func(args []string) {
+	return func(args []string) {
+		runMutate(action, args)
+	}
+}
+
+// runMutate applies an Email/set action to every email of the given threads
+// and/or email IDs
+func runMutate(action string, args []string) {
+	fs := flag.NewFlagSet(action, flag.ExitOnError)
+	ids := fs.String("ids", "", "Comma-separated email IDs to change, in addition to any thread handles")
+	to := fs.String("to", "", "Destination mailbox name or role (only for move)")
+	ifInState := fs.String("if-in-state", "", "Only apply if the mailbox is unchanged since the query that reported this state")
+	yes := fs.Bool("yes", false, "Confirm permanent deletion (only for delete)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: fastmail-agent %s [flags] <handle|index>...\n\n", action)
+		fmt.Fprintln(os.Stderr, "Applies the action to every email in each thread. Outputs JSON.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if action == "move" && *to == "" {
+		fatal("", usageError{fmt.Errorf("move requires -to <mailbox>")})
+	}
+	if action == "delete" && !*yes {
+		fatal("", usageError{fmt.Errorf("delete is permanent; pass -yes to confirm, or use trash instead")})
+	}
+
+	emailIDs := splitList(*ids)
+	if fs.NArg() == 0 && len(emailIDs) == 0 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+
+	client := connect()
+
+	for _, ref := range fs.Args() {
+		handle, err := resolveThreadRef(ref)
+		if err != nil {
+			fatal("", err)
+		}
+		threadIDs, err := client.ThreadEmailIDsContext(cmdCtx, handle)
+		if err != nil {
+			fatal("resolving "+ref, err)
+		}
+		emailIDs = append(emailIDs, threadIDs...)
+	}
+
+	opts := jmap.SetOptions{IfInState: *ifInState}
+
+	var res *jmap.SetResult
+	var err error
+	switch action {
+	case "read", "unread":
+		res, err = client.MarkReadContext(cmdCtx, emailIDs, action == "read", opts)
+	case "flag", "unflag":
+		res, err = client.SetFlaggedContext(cmdCtx, emailIDs, action == "flag", opts)
+	case "archive":
+		res, err = client.ArchiveEmailsContext(cmdCtx, emailIDs, opts)
+	case "move":
+		res, err = client.MoveEmailsContext(cmdCtx, emailIDs, *to, opts)
+	case "trash":
+		res, err = client.TrashEmailsContext(cmdCtx, emailIDs, opts)
+	case "delete":
+		res, err = client.DestroyEmailsContext(cmdCtx, emailIDs, opts)
+	}
+
+	// Batches applied before a failure stay applied, so report them along
+	// with the state they left before failing
+	if err != nil && res != nil && len(res.Updated)+len(res.Destroyed) > 0 {
+		printMutation(action, res)
+	}
+	if errors.Is(err, jmap.ErrStateMismatch) {
+		fatal("", fmt.Errorf("mailbox changed since the query; search again and retry with the new state: %w", err))
+	}
+	if err != nil {
+		fatal("", fmt.Errorf("%s failed: %w", action, err))
+	}
+
+	printMutation(action, res)
+	if len(res.Failed) > 0 {
+		os.Exit(exitFailure)
+	}
+}
+
+// printMutation writes the outcome of a mutating command as JSON
+func printMutation(action string, res *jmap.SetResult) {
+	result := MutationResult{
+		Action:   action,
+		Changed:  append(res.Updated, res.Destroyed...),
+		NewState: res.NewState,
+	}
+	if result.Changed == nil {
+		result.Changed = []string{}
+	}
+	if len(res.Failed) > 0 {
+		result.Failed = make(map[string]string, len(res.Failed))
+		for id, e := range res.Failed {
+			result.Failed[id] = e.Error()
+		}
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(result)
+}
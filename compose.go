@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"strings"
+
+	"github.com/stevemurr/fastmail-agent/jmap"
+)
+
+// SendOutput represents the result of a send or reply command
+type SendOutput struct {
+	Sent         bool   `json:"sent"`
+	EmailID      string `json:"email_id"`
+	SubmissionID string `json:"submission_id"`
+	To           string `json:"to"`
+	Subject      string `json:"subject"`
+}
+
+// runReply replies to the newest message of a thread that is not a draft
+func runReply(args []string) {
+	fs := flag.NewFlagSet("reply", flag.ExitOnError)
+	threadRef := fs.String("t", "", "Thread handle (or result index) to reply to")
+	body := fs.String("body", "", "Reply text")
+	bodyFile := fs.String("body-file", "", "Read reply text from a file (- for stdin)")
+	replyAll := fs.Bool("all", false, "Reply to all recipients")
+	from := fs.String("from", "", "Send from this identity address (default: the account's first identity)")
+	dryRun := fs.Bool("dry-run", false, "Print the JMAP request instead of sending")
+	yes := fs.Bool("yes", false, "Send without the interactive confirmation")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: fastmail-agent reply -t <handle> -body <text> [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *threadRef == "" {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	text := readBody(*body, *bodyFile)
+
+	client := connect()
+
+	identity, err := client.FindIdentityContext(cmdCtx, *from)
+	if err != nil {
+		exitSendError(err)
+	}
+
+	orig, own := fetchReplyTarget(client, *threadRef)
+	draft := jmap.NewReply(orig, identity.Address(), text, *replyAll, own...)
+	sendDraft(client, draft, identity, *dryRun, *yes)
+}
+
+// runSend sends a new message
+func runSend(args []string) {
+	fs := flag.NewFlagSet("send", flag.ExitOnError)
+	to := fs.String("to", "", "Comma-separated recipients")
+	cc := fs.String("cc", "", "Comma-separated CC recipients")
+	bcc := fs.String("bcc", "", "Comma-separated BCC recipients")
+	subject := fs.String("subject", "", "Subject line")
+	body := fs.String("body", "", "Message text")
+	bodyFile := fs.String("body-file", "", "Read message text from a file (- for stdin)")
+	from := fs.String("from", "", "Send from this identity address (default: the account's first identity)")
+	dryRun := fs.Bool("dry-run", false, "Print the JMAP request instead of sending")
+	yes := fs.Bool("yes", false, "Send without the interactive confirmation")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: fastmail-agent send -to <addr> -subject <text> -body <text> [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	draft := jmap.Draft{Subject: *subject}
+	var err error
+	if draft.To, err = parseAddressList(*to); err == nil {
+		if draft.CC, err = parseAddressList(*cc); err == nil {
+			draft.BCC, err = parseAddressList(*bcc)
+		}
+	}
+	if err != nil {
+		fatal("", usageError{err})
+	}
+	if len(draft.To) == 0 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	draft.Body = readBody(*body, *bodyFile)
+
+	client := connect()
+
+	identity, err := client.FindIdentityContext(cmdCtx, *from)
+	if err != nil {
+		exitSendError(err)
+	}
+	draft.From = identity.Address()
+
+	sendDraft(client, draft, identity, *dryRun, *yes)
+}
+
+// fetchReplyTarget returns the newest message of the referenced thread that
+// is not a draft, and the user's own addresses, which the reply should not
+// go back to
+func fetchReplyTarget(client *jmap.Client, ref string) (jmap.Email, []string) {
+	handle, err := resolveThreadRef(ref)
+	if err != nil {
+		fatal("", err)
+	}
+
+	emails, err := client.GetThreadByHandleContext(cmdCtx, handle)
+	if err != nil {
+		fatal("fetching emails", err)
+	}
+	if len(emails) == 0 {
+		fatal("", fmt.Errorf("thread %s %w", ref, jmap.ErrNotFound))
+	}
+
+	// GetThreadByHandle returns oldest first
+	orig, ok := client.ReplyTargetContext(cmdCtx, emails)
+	if !ok {
+		fatal("", fmt.Errorf("thread %s has only drafts to reply to", ref))
+	}
+	return orig, client.OwnAddressesContext(cmdCtx)
+}
+
+// sendDraft confirms and sends a draft, or prints the request for a dry run
+func sendDraft(client *jmap.Client, draft jmap.Draft, identity jmap.Identity, dryRun, yes bool) {
+	result, err := client.SendEmailContext(cmdCtx, draft, identity, jmap.SendOptions{DryRun: true})
+	if err != nil {
+		exitSendError(err)
+	}
+
+	if dryRun {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(result.Request)
+		return
+	}
+
+	if !yes && !confirmSend(draft) {
+		fmt.Fprintln(os.Stderr, "Not sent.")
+		os.Exit(exitFailure)
+	}
+
+	result, err = client.SendEmailContext(cmdCtx, draft, identity, jmap.SendOptions{})
+	if err != nil {
+		exitSendError(err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(SendOutput{
+		Sent:         result.Sent,
+		EmailID:      result.EmailID,
+		SubmissionID: result.SubmissionID,
+		To:           formatEmailsOnly(draft.To),
+		Subject:      draft.Subject,
+	})
+}
+
+// confirmSend shows the message and asks on the terminal whether to send it.
+// Without a terminal the caller has to pass -yes.
+func confirmSend(d jmap.Draft) bool {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error: no terminal to confirm on; pass -yes to send non-interactively")
+		return false
+	}
+	defer tty.Close()
+
+	fmt.Fprintf(tty, "From: %s\nTo: %s\n", d.From.String(), formatEmailsOnly(d.To))
+	if len(d.CC) > 0 {
+		fmt.Fprintf(tty, "CC: %s\n", formatEmailsOnly(d.CC))
+	}
+	if len(d.BCC) > 0 {
+		fmt.Fprintf(tty, "BCC: %s\n", formatEmailsOnly(d.BCC))
+	}
+	fmt.Fprintf(tty, "Subject: %s\n\n%s\n\nSend this email? [y/N] ", d.Subject, d.Body)
+
+	answer, _ := bufio.NewReader(tty).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// readBody returns the message text from -body or -body-file
+func readBody(body, bodyFile string) string {
+	if bodyFile == "" {
+		if body == "" {
+			fatal("", usageError{fmt.Errorf("message text required (-body or -body-file)")})
+		}
+		return body
+	}
+
+	var data []byte
+	var err error
+	if bodyFile == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(bodyFile)
+	}
+	if err != nil {
+		fatal("reading body", err)
+	}
+	return string(data)
+}
+
+// parseAddressList parses a comma-separated list of addresses such as
+// "Alice <alice@example.com>, bob@example.com"
+func parseAddressList(s string) ([]jmap.EmailAddress, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+
+	addrs, err := mail.ParseAddressList(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address list %q: %w", s, err)
+	}
+
+	result := make([]jmap.EmailAddress, len(addrs))
+	for i, addr := range addrs {
+		result[i] = jmap.EmailAddress{Name: addr.Name, Email: addr.Address}
+	}
+	return result, nil
+}
+
+// exitSendError reports a send failure, spelling out missing permissions
+func exitSendError(err error) {
+	if errors.Is(err, jmap.ErrNoSubmission) {
+		fatal("", fmt.Errorf("%w; create an API token with the Email submission scope to send mail", err))
+	}
+	fatal("sending", err)
+}
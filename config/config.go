@@ -2,36 +2,120 @@ package config
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
+	"time"
 )
 
+// ErrNoToken is returned by Load when no API token is configured
+var ErrNoToken = errors.New("no API token configured")
+
 type Config struct {
 	APIToken string `json:"api_token"`
+
+	// SessionURL is the JMAP session resource of the server to use. Empty
+	// means Fastmail; set it for other servers such as Stalwart or Cyrus.
+	SessionURL string `json:"session_url,omitempty"`
+
+	// DraftFrom is the From address for agent-composed drafts, e.g.
+	// "Support <support@example.com>". Empty means the account default.
+	DraftFrom string `json:"draft_from,omitempty"`
+
+	// Timeout bounds each API request to the JMAP server, and how long blob
+	// downloads wait for it to respond, as a Go duration such as "30s".
+	// Empty means jmap.DefaultTimeout.
+	Timeout string `json:"timeout,omitempty"`
+
+	// MaxRetries is how often a request that failed transiently is retried.
+	// Nil means the jmap.DefaultRetryPolicy count; 0 disables retrying.
+	MaxRetries *int `json:"max_retries,omitempty"`
+
+	// ServeToken is the bearer token local callers must present to the
+	// serve HTTP API. It is unrelated to the Fastmail APIToken.
+	ServeToken string `json:"serve_token,omitempty"`
+
+	// ExportDir is the only directory serve-mcp's export_thread writes to.
+	// Empty means fastmail-agent-exports in the home directory.
+	ExportDir string `json:"export_dir,omitempty"`
 }
 
+// Load reads ~/.config/fastmail-agent/config.json if it exists, then applies
+// FASTMAIL_* environment variables on top
 func Load() (*Config, error) {
-	// First try environment variable
-	if token := os.Getenv("FASTMAIL_API_TOKEN"); token != "" {
-		return &Config{APIToken: token}, nil
-	}
+	var cfg Config
 
-	// Fallback to config file
 	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		return nil, err
+	if err == nil {
+		configPath := filepath.Join(homeDir, ".config", "fastmail-agent", "config.json")
+		data, err := os.ReadFile(configPath)
+		if err == nil {
+			if err := json.Unmarshal(data, &cfg); err != nil {
+				return nil, fmt.Errorf("%s: %w", configPath, err)
+			}
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
 	}
 
-	configPath := filepath.Join(homeDir, ".config", "fastmail-agent", "config.json")
-	data, err := os.ReadFile(configPath)
-	if err != nil {
-		return nil, err
+	if token := os.Getenv("FASTMAIL_API_TOKEN"); token != "" {
+		cfg.APIToken = token
+	}
+	if url := os.Getenv("FASTMAIL_SESSION_URL"); url != "" {
+		cfg.SessionURL = url
+	}
+	if from := os.Getenv("FASTMAIL_DRAFT_FROM"); from != "" {
+		cfg.DraftFrom = from
+	}
+	if timeout := os.Getenv("FASTMAIL_TIMEOUT"); timeout != "" {
+		cfg.Timeout = timeout
+	}
+	if retries := os.Getenv("FASTMAIL_MAX_RETRIES"); retries != "" {
+		n, err := strconv.Atoi(retries)
+		if err != nil {
+			return nil, fmt.Errorf("invalid FASTMAIL_MAX_RETRIES %q", retries)
+		}
+		cfg.MaxRetries = &n
+	}
+	if token := os.Getenv("FASTMAIL_SERVE_TOKEN"); token != "" {
+		cfg.ServeToken = token
+	}
+	if dir := os.Getenv("FASTMAIL_EXPORT_DIR"); dir != "" {
+		cfg.ExportDir = dir
 	}
 
-	var cfg Config
-	if err := json.Unmarshal(data, &cfg); err != nil {
-		return nil, err
+	if cfg.APIToken == "" {
+		return nil, ErrNoToken
+	}
+	if cfg.Timeout != "" {
+		if _, err := time.ParseDuration(cfg.Timeout); err != nil {
+			return nil, fmt.Errorf("invalid timeout %q: %w", cfg.Timeout, err)
+		}
+	}
+	if cfg.MaxRetries != nil && *cfg.MaxRetries < 0 {
+		return nil, fmt.Errorf("invalid max_retries %d", *cfg.MaxRetries)
 	}
 
 	return &cfg, nil
 }
+
+// ExportDirectory returns ExportDir, or its default when unset
+func (c *Config) ExportDirectory() string {
+	if c.ExportDir != "" {
+		return c.ExportDir
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "fastmail-agent-exports"
+	}
+	return filepath.Join(homeDir, "fastmail-agent-exports")
+}
+
+// RequestTimeout returns Timeout as a duration, or 0 if unset. Load has
+// already validated it.
+func (c *Config) RequestTimeout() time.Duration {
+	d, _ := time.ParseDuration(c.Timeout)
+	return d
+}
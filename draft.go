@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/stevemurr/fastmail-agent/export"
+	"github.com/stevemurr/fastmail-agent/jmap"
+)
+
+// DraftOutput represents the result of the draft command
+type DraftOutput struct {
+	EmailID string `json:"email_id"`
+	Mailbox string `json:"mailbox"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+	CC      string `json:"cc,omitempty"`
+	Subject string `json:"subject"`
+	CanSend bool   `json:"can_send"` // whether the token could also submit mail
+}
+
+// WhoamiOutput describes the connected account and token permissions
+type WhoamiOutput struct {
+	Username     string   `json:"username"`
+	AccountID    string   `json:"account_id"`
+	ReadOnly     bool     `json:"read_only"`
+	CanSend      bool     `json:"can_send"`
+	Capabilities []string `json:"capabilities"`
+}
+
+// runDraft writes a reply into the Drafts mailbox for a human to review.
+// It never submits anything, so it works with tokens lacking the submission
+// scope.
+func runDraft(args []string) {
+	fs := flag.NewFlagSet("draft", flag.ExitOnError)
+	threadRef := fs.String("t", "", "Thread handle (or result index) to reply to")
+	body := fs.String("body", "", "Reply text")
+	bodyFile := fs.String("body-file", "", "Read reply text from a file (- for stdin)")
+	replyAll := fs.Bool("all", false, "Address the draft to all recipients")
+	from := fs.String("from", "", "From address, e.g. \"Support <support@example.com>\" (default: draft_from config, then the account)")
+	noQuote := fs.Bool("no-quote", false, "Don't quote the message being replied to")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: fastmail-agent draft -t <handle> -body <text> [flags]")
+		fmt.Fprintln(os.Stderr, "\nSaves a reply in Drafts for review in Fastmail. Never sends.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *threadRef == "" {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	text := readBody(*body, *bodyFile)
+
+	cfg := loadConfig()
+	client := connectWith(cfg)
+
+	if account := client.Session().Accounts[client.AccountID()]; account.IsReadOnly {
+		fmt.Fprintln(os.Stderr, "Error: the API token is read-only; create a token with write access to save drafts")
+		os.Exit(exitAuth)
+	}
+
+	if *from == "" {
+		*from = cfg.DraftFrom
+	}
+	sender, err := draftSender(client, *from)
+	if err != nil {
+		fatal("", err)
+	}
+
+	orig, own := fetchReplyTarget(client, *threadRef)
+	if !*noQuote {
+		text = export.QuoteReply(text, orig)
+	}
+	draft := jmap.NewReply(orig, sender, text, *replyAll, own...)
+
+	id, err := client.CreateDraftContext(cmdCtx, draft)
+	if err != nil {
+		fatal("saving draft", err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(DraftOutput{
+		EmailID: id,
+		Mailbox: "Drafts",
+		From:    draft.From.String(),
+		To:      formatEmailsOnly(draft.To),
+		CC:      formatEmailsOnly(draft.CC),
+		Subject: draft.Subject,
+		CanSend: client.HasCapability(jmap.CapabilitySubmission),
+	})
+}
+
+// draftSender picks the From address for a draft: the explicit address if
+// given, else the first sending identity, else the account username. Identities
+// are only readable with the submission scope, so the fallback matters.
+func draftSender(client *jmap.Client, from string) (jmap.EmailAddress, error) {
+	if from != "" {
+		addrs, err := parseAddressList(from)
+		if err != nil {
+			return jmap.EmailAddress{}, err
+		}
+		if len(addrs) != 1 {
+			return jmap.EmailAddress{}, fmt.Errorf("-from needs exactly one address")
+		}
+		return addrs[0], nil
+	}
+
+	if client.HasCapability(jmap.CapabilitySubmission) {
+		if identity, err := client.FindIdentityContext(cmdCtx, ""); err == nil {
+			return identity.Address(), nil
+		}
+	}
+
+	return jmap.EmailAddress{Email: client.Session().Username}, nil
+}
+
+// runWhoami reports the account and what the API token is allowed to do
+func runWhoami(args []string) {
+	fs := flag.NewFlagSet("whoami", flag.ExitOnError)
+	fs.Parse(args)
+
+	client := connect()
+	session := client.Session()
+	account := session.Accounts[client.AccountID()]
+
+	result := WhoamiOutput{
+		Username:  session.Username,
+		AccountID: client.AccountID(),
+		ReadOnly:  account.IsReadOnly,
+		CanSend:   client.HasCapability(jmap.CapabilitySubmission),
+	}
+	for uri := range account.AccountCapabilities {
+		result.Capabilities = append(result.Capabilities, uri)
+	}
+	sort.Strings(result.Capabilities)
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(result)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/stevemurr/fastmail-agent/config"
+	"github.com/stevemurr/fastmail-agent/jmap"
+	"github.com/stevemurr/fastmail-agent/store"
+)
+
+// Exit codes, so scripts and agents can tell failures apart without parsing
+// messages
+const (
+	exitFailure     = 1 // anything not covered below
+	exitUsage       = 2 // bad flags or arguments
+	exitAuth        = 3 // token missing, expired or revoked, or lacking a permission
+	exitInvalid     = 4 // the server rejected the request, e.g. a bad filter
+	exitNotFound    = 5 // the thread or email does not exist
+	exitConflict    = 6 // mail changed since it was read (-if-in-state)
+	exitUnavailable = 7 // network failure, timeout, rate limit or outage; try again later
+)
+
+// errorCodes names each exit code in JSON error objects
+var errorCodes = map[int]string{
+	exitFailure:     "error",
+	exitUsage:       "usage",
+	exitAuth:        "auth",
+	exitInvalid:     "invalid_request",
+	exitNotFound:    "not_found",
+	exitConflict:    "conflict",
+	exitUnavailable: "unavailable",
+}
+
+// ErrorInfo is the JSON form of a failed command, written to stderr when it
+// is not a terminal:
+//
+//	{"error": {"code": "invalid_request", "exit_code": 4, ...}}
+type ErrorInfo struct {
+	Code        string   `json:"code"`
+	ExitCode    int      `json:"exit_code"`
+	Message     string   `json:"message"`
+	Type        string   `json:"type,omitempty"`        // JMAP method error or problem type
+	Description string   `json:"description,omitempty"` // server's explanation, if any
+	Properties  []string `json:"properties,omitempty"`  // arguments the server objected to
+	Status      int      `json:"status,omitempty"`      // HTTP status of a rejected request
+}
+
+// usageError is a mistake in the flags or arguments a command was given
+type usageError struct{ error }
+
+func (e usageError) Unwrap() error { return e.error }
+
+// methodErrorExits maps JMAP method error types to exit codes. Types not
+// listed mean the request itself was at fault.
+var methodErrorExits = map[string]int{
+	"forbidden":                   exitAuth,
+	"accountNotFound":             exitAuth,
+	"accountNotSupportedByMethod": exitAuth,
+	"accountReadOnly":             exitAuth,
+	"notFound":                    exitNotFound,
+	"stateMismatch":               exitConflict,
+	"serverFail":                  exitUnavailable,
+	"serverPartialFail":           exitUnavailable,
+	"serverUnavailable":           exitUnavailable,
+	"rateLimit":                   exitUnavailable,
+}
+
+// describeError classifies err for reporting
+func describeError(err error) ErrorInfo {
+	info := ErrorInfo{ExitCode: exitFailure, Message: err.Error()}
+
+	var methodErr *jmap.MethodError
+	var requestErr *jmap.RequestError
+	var netErr net.Error
+	var usageErr usageError
+	switch {
+	case errors.As(err, &usageErr):
+		info.ExitCode = exitUsage
+
+	case errors.As(err, &methodErr):
+		info.Type = methodErr.Type
+		info.Description = methodErr.Description
+		info.Properties = methodErr.Properties
+		info.ExitCode = exitInvalid
+		if code, ok := methodErrorExits[methodErr.Type]; ok {
+			info.ExitCode = code
+		}
+
+	case errors.As(err, &requestErr):
+		info.Type = requestErr.Type
+		info.Description = requestErr.Detail
+		info.Status = requestErr.Status
+		switch {
+		case requestErr.Unauthorized():
+			info.ExitCode = exitAuth
+		case requestErr.Status == http.StatusNotFound:
+			info.ExitCode = exitNotFound
+		case requestErr.Status == http.StatusTooManyRequests || requestErr.Status >= 500:
+			info.ExitCode = exitUnavailable
+		default:
+			info.ExitCode = exitInvalid
+		}
+
+	case errors.Is(err, jmap.ErrStateMismatch):
+		info.ExitCode = exitConflict
+	case errors.Is(err, jmap.ErrNotFound), errors.Is(err, store.ErrNotIndexed):
+		info.ExitCode = exitNotFound
+	case errors.Is(err, store.ErrBusy):
+		info.ExitCode = exitUnavailable
+	case errors.Is(err, jmap.ErrNoSubmission), errors.Is(err, config.ErrNoToken):
+		info.ExitCode = exitAuth
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr):
+		info.ExitCode = exitUnavailable
+	}
+
+	info.Code = errorCodes[info.ExitCode]
+	return info
+}
+
+// fatal reports err and exits with the code its kind maps to. what, if not
+// empty, says what was being done: "Error fetching emails: ...".
+func fatal(what string, err error) {
+	info := describeError(err)
+
+	if stderrIsTerminal() {
+		if what != "" {
+			what = " " + what
+		}
+		fmt.Fprintf(os.Stderr, "Error%s: %v\n", what, err)
+	} else {
+		if what != "" {
+			info.Message = what + ": " + info.Message
+		}
+		json.NewEncoder(os.Stderr).Encode(map[string]ErrorInfo{"error": info})
+	}
+	os.Exit(info.ExitCode)
+}
+
+// stderrIsTerminal reports whether a person is likely reading stderr, as
+// opposed to a script or agent
+func stderrIsTerminal() bool {
+	fi, err := os.Stderr.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
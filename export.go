@@ -0,0 +1,562 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stevemurr/fastmail-agent/export"
+	"github.com/stevemurr/fastmail-agent/jmap"
+	"github.com/stevemurr/fastmail-agent/tui"
+)
+
+// exportIndexFile lists what a batch export produced, in the output directory
+const exportIndexFile = "index.json"
+
+// ExportIndex describes a batch export: the query and one entry per thread
+type ExportIndex struct {
+	Query      string        `json:"query"`
+	Format     string        `json:"format"`
+	ExportedAt string        `json:"exported_at"`
+	Exported   int           `json:"exported"` // written by this run
+	Skipped    int           `json:"skipped"`  // already present from an earlier run
+	Failed     int           `json:"failed"`
+	BatesNext  int           `json:"bates_next,omitempty"` // where the Bates numbers of a later export continue
+	Threads    []ExportEntry `json:"threads"`
+}
+
+// ExportEntry is one thread of a batch export
+type ExportEntry struct {
+	Handle     string `json:"handle"`
+	Subject    string `json:"subject"`
+	From       string `json:"from"`
+	Date       string `json:"date"`
+	EmailCount int    `json:"email_count"`
+	Path       string `json:"path"`   // relative to the output directory
+	Status     string `json:"status"` // exported, skipped or failed
+	Pages      int    `json:"pages,omitempty"`
+	BatesFirst string `json:"bates_first,omitempty"`
+	BatesLast  string `json:"bates_last,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// exportFormats maps -format values to the extension of what they produce;
+// folder produces a directory
+var exportFormats = map[string]string{
+	"pdf":    ".pdf",
+	"txt":    ".txt",
+	"md":     ".md",
+	"folder": "",
+	"eml":    "",
+	"mbox":   ".mbox",
+}
+
+// runExport exports every thread matching a query into a directory
+func runExport(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	query := fs.String("q", "", "Search query selecting the threads to export")
+	format := fs.String("format", "pdf", "Output per thread: pdf, txt, md, folder (thread.txt plus attachments), eml (original messages) or mbox")
+	markdown := fs.Bool("md", false, "With -format folder, write thread.md instead of thread.txt")
+	out := fs.String("out", "", "Directory to export into, created if needed")
+	parallel := fs.Int("parallel", 4, "Threads to export at once")
+	inMailbox := fs.String("in", "", "Only export from this mailbox, by name or role")
+	exclude := fs.String("exclude", "spam,trash", "Comma-separated mailboxes to leave out unless the query uses in:")
+	group := fs.String("group", "thread", "How to group results into threads: thread or subject")
+	quiet := fs.Bool("quiet", false, "Don't report progress on stderr")
+	combine := fs.Bool("combine", false, "With -format mbox, write every matching email into one messages.mbox instead of a file per thread")
+	pdfOptions := pdfFlags(fs, "with -format pdf")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, `Usage: fastmail-agent export -q "<query>" -out <dir> [flags]`)
+		fmt.Fprintln(os.Stderr, "\nExports every thread matching the query, one file or folder per thread,")
+		fmt.Fprintln(os.Stderr, "and writes index.json listing them. Threads already in the directory are")
+		fmt.Fprintln(os.Stderr, "skipped, so an interrupted export can be resumed by running it again.")
+		fmt.Fprintln(os.Stderr, "\neml and mbox keep the messages exactly as the server received them, with")
+		fmt.Fprintln(os.Stderr, "every header, and list their SHA-256 in SHA256SUMS.")
+		fmt.Fprintln(os.Stderr, "\nEach thread gets a manifest recording where it came from and the SHA-256")
+		fmt.Fprintln(os.Stderr, "of what was written, and manifest.json covers the whole directory. Check")
+		fmt.Fprintln(os.Stderr, "them later with: fastmail-agent verify <dir>")
+		fmt.Fprintln(os.Stderr, "\nBates numbers run on from one PDF to the next in thread order. Running the")
+		fmt.Fprintln(os.Stderr, "export again numbers new threads after the highest number already used.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *query == "" || *out == "" {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	ext, ok := exportFormats[*format]
+	if !ok {
+		fatal("", usageError{fmt.Errorf("unknown format %q (use pdf, txt, md, folder, eml or mbox)", *format)})
+	}
+	if *combine && *format != "mbox" {
+		fatal("", usageError{fmt.Errorf("-combine needs -format mbox")})
+	}
+	if *markdown && *format != "folder" {
+		fatal("", usageError{fmt.Errorf("-md needs -format folder; use -format md for Markdown files")})
+	}
+	// The same text options as -t, so both produce the same Markdown
+	textOpts := export.DefaultLLMOptions()
+	textOpts.Markdown = *markdown
+	pdfOpts := pdfOptions()
+	if *format != "pdf" {
+		fs.Visit(func(f *flag.Flag) {
+			if pdfFlagNames[f.Name] {
+				fatal("", usageError{fmt.Errorf("-%s needs -format pdf", f.Name)})
+			}
+		})
+	}
+	mode, err := tui.ParseGroupMode(*group)
+	if err != nil {
+		fatal("", usageError{err})
+	}
+	if *parallel < 1 {
+		*parallel = 1
+	}
+
+	client := connect()
+
+	emails, err := searchAll(client, *query, jmap.SearchOptions{
+		InMailbox:        *inMailbox,
+		ExcludeMailboxes: splitList(*exclude),
+	})
+	if err != nil {
+		fatal("searching", err)
+	}
+	if err := os.MkdirAll(*out, 0755); err != nil {
+		fatal("", err)
+	}
+	if *combine {
+		exportCombinedMbox(client, emails, *query, *out)
+		return
+	}
+	threads := groupThreads(emails, mode)
+
+	// Name each thread after its first email, so that a reply arriving
+	// between runs neither renames it nor has it exported again
+	byID := make(map[string]jmap.Email, len(emails))
+	for _, email := range emails {
+		byID[email.ID] = email
+	}
+	names := make([]string, len(threads))
+	for i, thread := range threads {
+		names[i] = exportName(thread, byID[thread.EmailIDs[0]], ext)
+	}
+
+	index := ExportIndex{
+		Query:      *query,
+		Format:     *format,
+		ExportedAt: time.Now().UTC().Format(time.RFC3339),
+		Threads:    make([]ExportEntry, len(threads)),
+	}
+
+	// An earlier run's index says which Bates numbers are taken
+	var previous ExportIndex
+	if data, err := os.ReadFile(filepath.Join(*out, exportIndexFile)); err == nil {
+		json.Unmarshal(data, &previous)
+	}
+	var bates *batesSequence
+	if first := pdfOpts.FirstBates(); first > 0 {
+		bates = newBatesSequence(len(threads), max(first, previous.BatesNext))
+	}
+
+	var progress func()
+	if !*quiet {
+		var mu sync.Mutex
+		done := 0
+		progress = func() {
+			mu.Lock()
+			defer mu.Unlock()
+			done++
+			fmt.Fprintf(os.Stderr, "\rExported %d/%d threads", done, len(threads))
+			if done == len(threads) {
+				fmt.Fprintln(os.Stderr)
+			}
+		}
+	}
+
+	// Export in parallel; each worker fills in its thread's index entry
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < *parallel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				pdf := &threadPDF{opts: pdfOpts, previous: &previous}
+				if bates != nil {
+					pdf.turn = &batesTurn{seq: bates, idx: i}
+				}
+				index.Threads[i] = exportThread(client, threads[i], names[i], *query, *out, *format, textOpts, pdf)
+				if progress != nil {
+					progress()
+				}
+			}
+		}()
+	}
+	for i := range threads {
+		if cmdCtx.Err() != nil {
+			break
+		}
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	for i, entry := range index.Threads {
+		switch entry.Status {
+		case "exported":
+			index.Exported++
+		case "skipped":
+			index.Skipped++
+		case "failed":
+			index.Failed++
+		default: // never started because the command timed out
+			index.Threads[i] = newExportEntry(threads[i], names[i])
+			index.Threads[i].Status = "failed"
+			index.Threads[i].Error = cmdCtx.Err().Error()
+			index.Failed++
+		}
+	}
+
+	index.BatesNext = previous.BatesNext
+	if bates != nil {
+		index.BatesNext = max(index.BatesNext, bates.next)
+	}
+
+	if *format == "mbox" {
+		if err := writeExportChecksums(*out, index.Threads); err != nil {
+			fatal("writing checksums", err)
+		}
+	}
+
+	data, _ := json.MarshalIndent(index, "", "  ")
+	if err := os.WriteFile(filepath.Join(*out, exportIndexFile), append(data, '\n'), 0644); err != nil {
+		fatal("writing index", err)
+	}
+
+	// The directory's manifest covers every thread's output and manifest;
+	// the threads' manifests identify their emails
+	handles := make([]string, len(threads))
+	for i, thread := range threads {
+		handles[i] = thread.Handle
+	}
+	manifest, err := export.NewManifest(cmdCtx, client, nil, export.Provenance{Query: *query, Handles: handles})
+	if err == nil {
+		err = manifest.AddFiles(*out, ".")
+	}
+	if err == nil {
+		err = manifest.Write(filepath.Join(*out, export.ManifestFile))
+	}
+	if err != nil {
+		fatal("writing manifest", err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(struct {
+		Index    string `json:"index"`
+		Manifest string `json:"manifest"`
+		Threads  int    `json:"threads"`
+		Exported int    `json:"exported"`
+		Skipped  int    `json:"skipped"`
+		Failed   int    `json:"failed"`
+	}{filepath.Join(*out, exportIndexFile), filepath.Join(*out, export.ManifestFile), len(threads), index.Exported, index.Skipped, index.Failed})
+
+	if index.Failed > 0 {
+		os.Exit(exitFailure)
+	}
+}
+
+// searchAll returns every email matching query, fetching page after page
+func searchAll(client *jmap.Client, query string, opts jmap.SearchOptions) ([]jmap.Email, error) {
+	opts.Limit = client.Limits().MaxObjectsInGet
+
+	var emails []jmap.Email
+	for {
+		page, err := client.SearchEmailsContext(cmdCtx, query, opts)
+		if err != nil {
+			return nil, err
+		}
+		emails = append(emails, page.Emails...)
+
+		next := page.NextCursor()
+		if next == "" {
+			return emails, nil
+		}
+		cursor, err := jmap.ParseSearchCursor(next)
+		if err != nil {
+			return nil, err
+		}
+		opts = cursor.Options(opts.Limit)
+	}
+}
+
+// exportThread writes one thread into dir as name unless an earlier run
+// already did. Output is written under a temporary name and renamed when
+// complete, and its manifest last, so an interrupted export never leaves a
+// thread that looks finished.
+func exportThread(client *jmap.Client, thread ThreadInfo, name, query, dir, format string, opts export.ExportOptions, pdf *threadPDF) ExportEntry {
+	entry := newExportEntry(thread, name)
+	path := filepath.Join(dir, entry.Path)
+	if pdf.turn != nil {
+		defer func() { pdf.turn.done(pdf.pages) }()
+	}
+
+	if _, err := os.Stat(export.ManifestPath(path)); err == nil {
+		entry.Status = "skipped"
+		for _, prev := range pdf.previous.Threads {
+			if prev.Path == entry.Path {
+				entry.Pages, entry.BatesFirst, entry.BatesLast = prev.Pages, prev.BatesFirst, prev.BatesLast
+			}
+		}
+		return entry
+	}
+
+	prov := export.Provenance{Query: query, Handles: []string{thread.Handle}}
+	err := writeThreadExport(client, thread, path, format, opts, prov, pdf)
+	entry.Pages = pdf.pages
+	entry.BatesFirst, entry.BatesLast = pdf.opts.BatesRange(pdf.pages)
+	if err != nil {
+		entry.Status = "failed"
+		entry.Error = err.Error()
+		return entry
+	}
+	entry.Status = "exported"
+	return entry
+}
+
+// threadPDF carries the PDF options of a batch export to one thread, and
+// back the pages it was given
+type threadPDF struct {
+	opts     export.PDFOptions
+	turn     *batesTurn   // nil without Bates numbers
+	previous *ExportIndex // the index of an earlier run, for skipped threads
+	pages    int          // written, and so numbered
+}
+
+// write renders a thread to path, stamping it once its turn for Bates
+// numbers comes, so that threads render in parallel but are numbered in
+// order
+func (p *threadPDF) write(client *jmap.Client, path string, emails []jmap.Email) error {
+	data, err := export.RenderPDFContext(cmdCtx, emails, client, p.opts)
+	if err != nil {
+		return err
+	}
+	if p.turn != nil {
+		p.opts.BatesStart = p.turn.take()
+	}
+	data, pages, err := export.StampPDF(data, p.opts)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return err
+	}
+	p.pages = pages
+	return nil
+}
+
+// batesSequence hands out Bates numbers to the threads of a batch export in
+// order: each thread takes the first number from the one before it and
+// passes on the number after its last page
+type batesSequence struct {
+	turns []chan int
+	next  int // after the last thread numbered so far
+}
+
+func newBatesSequence(threads, first int) *batesSequence {
+	s := &batesSequence{turns: make([]chan int, threads+1), next: first}
+	for i := range s.turns {
+		s.turns[i] = make(chan int, 1)
+	}
+	s.turns[0] <- first
+	return s
+}
+
+// batesTurn is one thread's place in a batesSequence. Every thread started
+// must call done, numbered or not, or the threads after it wait forever.
+type batesTurn struct {
+	seq   *batesSequence
+	idx   int
+	first int
+	taken bool
+}
+
+// take waits for the threads before this one and returns its first number
+func (t *batesTurn) take() int {
+	if !t.taken {
+		t.first = <-t.seq.turns[t.idx]
+		t.taken = true
+	}
+	return t.first
+}
+
+// done passes on the number after the thread's pages
+func (t *batesTurn) done(pages int) {
+	t.seq.next = t.take() + pages
+	t.seq.turns[t.idx+1] <- t.seq.next
+}
+
+// writeThreadExport fetches a thread and writes it to path in format, with
+// its manifest. opts formats md and folder.
+func writeThreadExport(client *jmap.Client, thread ThreadInfo, path, format string, opts export.ExportOptions, prov export.Provenance, pdf *threadPDF) error {
+	handle, err := jmap.ParseThreadHandle(thread.Handle)
+	if err != nil {
+		return err
+	}
+	emails, err := client.GetThreadByHandleContext(cmdCtx, handle)
+	if err != nil {
+		return err
+	}
+	if len(emails) == 0 {
+		return fmt.Errorf("thread %w", jmap.ErrNotFound)
+	}
+	prov.RetrievedAt = time.Now()
+	prov.Hashes = make(export.BlobHashes)
+	pdf.opts.Hashes = prov.Hashes
+
+	partial := path + ".partial"
+	os.RemoveAll(partial)
+
+	switch format {
+	case "pdf":
+		err = pdf.write(client, partial, emails)
+	case "txt":
+		err = export.ExportToFile(emails, partial)
+	case "md":
+		err = os.WriteFile(partial, []byte(export.FormatThreadMarkdown(emails, opts)), 0644)
+	case "folder":
+		err = export.WriteFolder(partial, emails, client, opts)
+	case "eml":
+		err = export.WriteEMLFolder(cmdCtx, partial, emails, client)
+	case "mbox":
+		_, err = export.WriteMboxFile(cmdCtx, partial, emails, client)
+	default:
+		err = errors.New("unknown format " + format)
+	}
+	if err != nil {
+		os.RemoveAll(partial)
+		return err
+	}
+
+	// A folder holds its own manifest, so it is complete once renamed; a
+	// file's manifest goes beside it afterwards
+	if exportFormats[format] == "" {
+		if _, err := export.WriteManifest(cmdCtx, client, emails, partial, prov); err != nil {
+			os.RemoveAll(partial)
+			return err
+		}
+		os.RemoveAll(path) // left by a run from before manifests
+		return os.Rename(partial, path)
+	}
+	if err := os.Rename(partial, path); err != nil {
+		return err
+	}
+	_, err = export.WriteManifest(cmdCtx, client, emails, path, prov)
+	return err
+}
+
+// writeExportChecksums lists the SHA-256 of every per-thread file in the
+// output directory, from this run or an earlier one, in SHA256SUMS
+func writeExportChecksums(dir string, entries []ExportEntry) error {
+	sums := make(map[string]string)
+	for _, entry := range entries {
+		if entry.Status == "failed" {
+			continue
+		}
+		sum, err := export.HashFile(filepath.Join(dir, entry.Path))
+		if err != nil {
+			return err
+		}
+		sums[entry.Path] = sum
+	}
+	return export.WriteChecksums(dir, sums)
+}
+
+// exportCombinedMbox writes every email of a query, oldest first, into one
+// mbox file in dir, with the directory's manifest
+func exportCombinedMbox(client *jmap.Client, emails []jmap.Email, query, dir string) {
+	sort.SliceStable(emails, func(i, j int) bool {
+		ti, _ := time.Parse(time.RFC3339, emails[i].ReceivedAt)
+		tj, _ := time.Parse(time.RFC3339, emails[j].ReceivedAt)
+		return ti.Before(tj)
+	})
+
+	name := export.MboxName
+	path := filepath.Join(dir, name)
+	sum, err := export.WriteMboxFile(cmdCtx, path+".partial", emails, client)
+	if err != nil {
+		os.Remove(path + ".partial")
+		fatal("exporting messages", err)
+	}
+	if err := os.Rename(path+".partial", path); err != nil {
+		fatal("", err)
+	}
+	if err := export.WriteChecksums(dir, map[string]string{name: sum}); err != nil {
+		fatal("writing checksums", err)
+	}
+	manifest, err := export.WriteManifest(cmdCtx, client, emails, dir, export.Provenance{Query: query})
+	if err != nil {
+		fatal("writing manifest", err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(struct {
+		Mbox     string `json:"mbox"`
+		Manifest string `json:"manifest"`
+		Emails   int    `json:"emails"`
+		SHA256   string `json:"sha256"`
+	}{path, manifest, len(emails), sum})
+}
+
+func newExportEntry(thread ThreadInfo, path string) ExportEntry {
+	return ExportEntry{
+		Handle:     thread.Handle,
+		Subject:    thread.Subject,
+		From:       thread.From,
+		Date:       thread.Date,
+		EmailCount: thread.EmailCount,
+		Path:       path,
+	}
+}
+
+// unsafeFilenameChars are replaced in exported file names
+var unsafeFilenameChars = regexp.MustCompile(`[^\pL\pN._-]+`)
+
+// exportName is a thread's file or folder name: the date and subject of its
+// first email for browsing, plus a hash of its threadId, or of the first
+// email's ID for a subject group, so that the same thread gets the same name
+// on every run however many replies it gains
+func exportName(thread ThreadInfo, first jmap.Email, ext string) string {
+	date := "undated"
+	if t, err := time.Parse(time.RFC3339, first.ReceivedAt); err == nil {
+		date = t.Format("2006-01-02")
+	}
+
+	subject := strings.Trim(unsafeFilenameChars.ReplaceAllString(first.Subject, "_"), "_.")
+	if runes := []rune(subject); len(runes) > 60 {
+		subject = strings.TrimRight(string(runes[:60]), "_.")
+	}
+	if subject == "" {
+		subject = "no-subject"
+	}
+
+	key := thread.ThreadID
+	if key == "" {
+		key = first.ID
+	}
+	sum := sha256.Sum256([]byte(key))
+	return fmt.Sprintf("%s_%s_%s%s", date, subject, hex.EncodeToString(sum[:4]), ext)
+}
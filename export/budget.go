@@ -0,0 +1,316 @@
+package export
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/stevemurr/fastmail-agent/jmap"
+)
+
+// Elision records how a message was cut to fit a token budget
+type Elision struct {
+	MessageIdx int    `json:"message_idx"`
+	Action     string `json:"action"` // shortened, stripped, omitted or truncated
+}
+
+// BudgetReport describes how a thread was fitted to a token budget
+type BudgetReport struct {
+	MaxTokens  int       `json:"max_tokens"`
+	Tokenizer  string    `json:"tokenizer"`
+	FullTokens int       `json:"full_tokens"` // the thread before anything was cut
+	Tokens     int       `json:"tokens"`      // what was written, report included
+	Elided     []Elision `json:"elided,omitempty"`
+
+	// OverBudget is set when even the most that could be cut left the thread
+	// over MaxTokens, usually because headers alone exceed it
+	OverBudget bool `json:"over_budget,omitempty"`
+}
+
+// budgetMessage is one message of a thread being fitted to a budget
+type budgetMessage struct {
+	email  jmap.Email
+	idx    int
+	body   string
+	action string // latest elision, "" while whole
+	text   string // rendered message
+	tokens int
+}
+
+// elisionNote marks where content was cut, so the reader knows it is missing
+const elisionNote = "[... %s ...]"
+
+// FormatThreadForLLMBudget formats a thread as FormatThreadForLLM does, cut
+// to fit opts.MaxTokens. Content is given up in priority order: older
+// messages are shortened to their headers and first paragraph, then quotes
+// and signatures are stripped from the rest, then messages from the middle
+// of the thread are omitted, and finally the remaining bodies are truncated.
+// The output starts with a summary of what was cut, and each cut is marked
+// where it was made. If the thread cannot be made to fit, the report says
+// so, and if cutting would not even make it smaller, nothing is cut.
+func FormatThreadForLLMBudget(emails []jmap.Email, opts ExportOptions) (string, BudgetReport) {
+	tok := opts.Tokenizer
+	if tok == nil {
+		tok = NewCL100KEstimator()
+	}
+	report := BudgetReport{MaxTokens: opts.MaxTokens, Tokenizer: tok.Name()}
+
+	msgs := make([]*budgetMessage, len(emails))
+	for i, email := range emails {
+		m := &budgetMessage{email: email, idx: i + 1, body: getCleanBody(email, opts)}
+		m.render(tok)
+		msgs[i] = m
+	}
+	report.FullTokens = totalTokens(msgs)
+
+	fits := func() bool {
+		report.Tokens = totalTokens(msgs) + tok.CountTokens(budgetHeader(msgs, report))
+		for _, run := range omittedRuns(msgs) {
+			report.Tokens += tok.CountTokens(omittedNote(run))
+		}
+		return report.Tokens <= opts.MaxTokens
+	}
+
+	// Older messages down to headers and the first paragraph, oldest first
+	for _, m := range msgs[:max(len(msgs)-1, 0)] {
+		if fits() {
+			break
+		}
+		if short := firstParagraph(m.body); short != m.body {
+			m.cut("shortened", short+"\n"+fmt.Sprintf(elisionNote, "shortened to the first paragraph"), tok)
+		}
+	}
+
+	// Quotes and signatures, for messages still whole
+	strip := ExportOptions{StripQuotes: true, StripSignatures: true}
+	for _, m := range msgs {
+		if fits() {
+			break
+		}
+		if m.action != "" {
+			continue
+		}
+		if body := getCleanBody(m.email, strip); body != m.body {
+			m.cut("stripped", body, tok)
+		}
+	}
+
+	// Messages from the middle outwards, keeping the first and the last
+	for _, i := range middleOut(len(msgs)) {
+		if fits() {
+			break
+		}
+		msgs[i].omit()
+	}
+
+	// Truncate what is left, the newest message last
+	for _, m := range msgs {
+		if fits() {
+			break
+		}
+		if m.action == "omitted" {
+			continue
+		}
+		over := report.Tokens - opts.MaxTokens
+		m.truncate(tok.CountTokens(m.body)-over, tok)
+	}
+	if !fits() {
+		report.OverBudget = true
+	}
+
+	// The summary and the cut markers cost tokens too; when they outweigh
+	// what was saved, the whole thread is the better answer
+	if report.Tokens >= report.FullTokens {
+		var sb strings.Builder
+		for i, email := range emails {
+			sb.WriteString(FormatEmailForLLM(email, i+1, opts))
+		}
+		report.Tokens = report.FullTokens
+		return sb.String(), report
+	}
+
+	for _, m := range msgs {
+		if m.action != "" {
+			report.Elided = append(report.Elided, Elision{MessageIdx: m.idx, Action: m.action})
+		}
+	}
+
+	// The first and last messages are never omitted, so each run of omitted
+	// messages has one after it
+	runs := omittedRuns(msgs)
+	var sb strings.Builder
+	sb.WriteString(budgetHeader(msgs, report))
+	for _, m := range msgs {
+		if len(runs) > 0 && runs[0][len(runs[0])-1].idx == m.idx-1 {
+			sb.WriteString(omittedNote(runs[0]))
+			runs = runs[1:]
+		}
+		sb.WriteString(m.text)
+	}
+	return sb.String(), report
+}
+
+// render formats the message with its current body and counts its tokens
+func (m *budgetMessage) render(tok Tokenizer) {
+	m.text = formatLLMHeader(m.email, m.idx) + m.body + "\n\n"
+	m.tokens = tok.CountTokens(m.text)
+}
+
+// cut replaces the message body, recording why
+func (m *budgetMessage) cut(action, body string, tok Tokenizer) {
+	m.action = action
+	m.body = body
+	m.render(tok)
+}
+
+// omit drops the message; omittedNote stands in for it
+func (m *budgetMessage) omit() {
+	m.action = "omitted"
+	m.text = ""
+	m.tokens = 0
+}
+
+// truncate cuts the body to about keep tokens, at the end of a line or,
+// within a line too long to keep whole, of a word
+func (m *budgetMessage) truncate(keep int, tok Tokenizer) {
+	var kept []string
+	used := 0
+	for _, line := range strings.Split(m.body, "\n") {
+		n := tok.CountTokens(line + "\n")
+		if used+n <= keep {
+			kept = append(kept, line)
+			used += n
+			continue
+		}
+
+		var words []string
+		for _, word := range strings.Fields(line) {
+			n := tok.CountTokens(" " + word)
+			if used+n > keep {
+				break
+			}
+			words = append(words, word)
+			used += n
+		}
+		kept = append(kept, strings.Join(words, " "))
+		break
+	}
+	body := strings.TrimSpace(strings.Join(kept, "\n"))
+	if body != "" {
+		body += "\n"
+	}
+	m.cut("truncated", body+fmt.Sprintf(elisionNote, "truncated"), tok)
+}
+
+func totalTokens(msgs []*budgetMessage) int {
+	n := 0
+	for _, m := range msgs {
+		n += m.tokens
+	}
+	return n
+}
+
+// budgetHeader summarizes what was cut, in the same header style as the
+// messages
+func budgetHeader(msgs []*budgetMessage, report BudgetReport) string {
+	byAction := make(map[string][]int)
+	for _, m := range msgs {
+		if m.action != "" {
+			byAction[m.action] = append(byAction[m.action], m.idx)
+		}
+	}
+	if len(byAction) == 0 {
+		return ""
+	}
+
+	var sb strings.Builder
+	sb.WriteString("---\n")
+	sb.WriteString(fmt.Sprintf("TokenBudget: %d (%s)\n", report.MaxTokens, report.Tokenizer))
+	sb.WriteString(fmt.Sprintf("FullThreadTokens: %d\n", report.FullTokens))
+	for _, action := range []string{"shortened", "stripped", "omitted", "truncated"} {
+		if idxs := byAction[action]; len(idxs) > 0 {
+			sb.WriteString(fmt.Sprintf("%s: MessageIdx %s\n", strings.ToUpper(action[:1])+action[1:], formatRanges(idxs)))
+		}
+	}
+	sb.WriteString("\n")
+	return sb.String()
+}
+
+// omittedRuns groups consecutive omitted messages
+func omittedRuns(msgs []*budgetMessage) [][]*budgetMessage {
+	var runs [][]*budgetMessage
+	var run []*budgetMessage
+	for _, m := range msgs {
+		if m.action == "omitted" {
+			run = append(run, m)
+		} else if len(run) > 0 {
+			runs = append(runs, run)
+			run = nil
+		}
+	}
+	if len(run) > 0 {
+		runs = append(runs, run)
+	}
+	return runs
+}
+
+// omittedNote stands in for a run of omitted messages
+func omittedNote(run []*budgetMessage) string {
+	idxs := make([]int, len(run))
+	for i, m := range run {
+		idxs[i] = m.idx
+	}
+	what := fmt.Sprintf("%d messages omitted: MessageIdx %s", len(run), formatRanges(idxs))
+	if len(run) == 1 {
+		what = fmt.Sprintf("1 message omitted: MessageIdx %d", run[0].idx)
+	}
+	return "---\n" + fmt.Sprintf(elisionNote, what) + "\n\n"
+}
+
+// formatRanges formats ascending numbers compactly: 1-3, 5, 7-9
+func formatRanges(ns []int) string {
+	var parts []string
+	for i := 0; i < len(ns); {
+		j := i
+		for j+1 < len(ns) && ns[j+1] == ns[j]+1 {
+			j++
+		}
+		if j > i {
+			parts = append(parts, strconv.Itoa(ns[i])+"-"+strconv.Itoa(ns[j]))
+		} else {
+			parts = append(parts, strconv.Itoa(ns[i]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ", ")
+}
+
+// firstParagraph returns the text up to the first blank line
+func firstParagraph(body string) string {
+	body = strings.TrimSpace(strings.ReplaceAll(body, "\r\n", "\n"))
+	if i := strings.Index(body, "\n\n"); i >= 0 {
+		return body[:i]
+	}
+	return body
+}
+
+// middleOut lists the indexes of n messages other than the first and the
+// last, starting at the middle and alternating outwards
+func middleOut(n int) []int {
+	if n < 3 {
+		return nil
+	}
+	var order []int
+	lo, hi := (n-1)/2, (n-1)/2+1
+	for lo >= 1 || hi <= n-2 {
+		if lo >= 1 {
+			order = append(order, lo)
+			lo--
+		}
+		if hi <= n-2 {
+			order = append(order, hi)
+			hi++
+		}
+	}
+	return order
+}
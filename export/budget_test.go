@@ -0,0 +1,74 @@
+package export
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stevemurr/fastmail-agent/jmap"
+	"github.com/stevemurr/fastmail-agent/jmaptest"
+)
+
+// longThread returns a thread of n messages, each with a long body of
+// several paragraphs
+func longThread(n int) []jmap.Email {
+	base := jmaptest.SampleFixture().Emails[0]
+	paragraph := strings.Repeat("The quarterly figures are in the attached sheet. ", 20)
+	emails := make([]jmap.Email, n)
+	for i := range emails {
+		e := base
+		e.BodyValues = map[string]jmap.BodyValue{"1": {Value: strings.Repeat(paragraph+"\n\n", 4)}}
+		emails[i] = e
+	}
+	return emails
+}
+
+func TestBudgetFits(t *testing.T) {
+	emails := longThread(5)
+	opts := ExportOptions{MaxTokens: 800, Tokenizer: CharTokenizer{}}
+
+	text, report := FormatThreadForLLMBudget(emails, opts)
+	if report.OverBudget || report.Tokens > opts.MaxTokens {
+		t.Fatalf("report = %+v, want within %d tokens", report, opts.MaxTokens)
+	}
+	if got := opts.Tokenizer.CountTokens(text); got > opts.MaxTokens {
+		t.Errorf("output is %d tokens, over the budget of %d", got, opts.MaxTokens)
+	}
+	if report.FullTokens <= opts.MaxTokens || len(report.Elided) == 0 {
+		t.Errorf("nothing cut from a thread of %d tokens", report.FullTokens)
+	}
+	// The newest message is cut last
+	for _, e := range report.Elided {
+		if e.MessageIdx == len(emails) && e.Action == "omitted" {
+			t.Error("the last message was omitted")
+		}
+	}
+	if !strings.Contains(text, "[...") {
+		t.Error("cuts are not marked in the output")
+	}
+}
+
+func TestBudgetLargeEnough(t *testing.T) {
+	emails := longThread(2)
+	opts := ExportOptions{MaxTokens: 1 << 20, Tokenizer: CharTokenizer{}}
+
+	text, report := FormatThreadForLLMBudget(emails, opts)
+	if len(report.Elided) != 0 || report.OverBudget {
+		t.Errorf("report = %+v, want nothing cut", report)
+	}
+	if want := FormatThreadForLLM(emails, opts); text != want {
+		t.Error("output differs from the thread formatted without a budget")
+	}
+	if report.Tokens != report.FullTokens {
+		t.Errorf("tokens %d, full %d", report.Tokens, report.FullTokens)
+	}
+}
+
+func TestBudgetOverBudget(t *testing.T) {
+	emails := longThread(3)
+	opts := ExportOptions{MaxTokens: 10, Tokenizer: CharTokenizer{}}
+
+	_, report := FormatThreadForLLMBudget(emails, opts)
+	if !report.OverBudget {
+		t.Errorf("report = %+v, want OverBudget for a budget smaller than the headers", report)
+	}
+}
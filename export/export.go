@@ -17,6 +17,12 @@ import (
 type ExportOptions struct {
 	StripQuotes     bool
 	StripSignatures bool
+	Markdown        bool // format threads as Markdown instead of the LLM text format
+
+	// MaxTokens, if set, cuts the LLM text format down to fit; see
+	// FormatThreadForLLMBudget
+	MaxTokens int
+	Tokenizer Tokenizer // counts tokens for MaxTokens; nil for the cl100k estimate
 }
 
 // DefaultLLMOptions returns options optimized for LLM consumption
@@ -30,49 +36,76 @@ func DefaultLLMOptions() ExportOptions {
 // FormatThread formats a thread as readable text
 func FormatThread(emails []jmap.Email) string {
 	var sb strings.Builder
-
 	for i, email := range emails {
-		sb.WriteString(fmt.Sprintf("=== Email %d of %d ===\n", i+1, len(emails)))
-		sb.WriteString(fmt.Sprintf("From: %s\n", formatAddresses(email.From)))
-		sb.WriteString(fmt.Sprintf("To: %s\n", formatAddresses(email.To)))
-		if len(email.CC) > 0 {
-			sb.WriteString(fmt.Sprintf("CC: %s\n", formatAddresses(email.CC)))
-		}
-		sb.WriteString(fmt.Sprintf("Date: %s\n", formatDate(email.ReceivedAt)))
-		sb.WriteString(fmt.Sprintf("Subject: %s\n", email.Subject))
-		sb.WriteString("\n")
+		sb.WriteString(FormatEmail(email, i+1, len(emails)))
+	}
+	return sb.String()
+}
 
-		body := email.GetBodyText()
-		// Convert HTML to text if needed
-		if strings.Contains(body, "<") && strings.Contains(body, ">") {
-			body = HTMLToText(body)
-		}
-		sb.WriteString(body)
-		sb.WriteString("\n\n")
+// FormatEmail formats message idx (1-based) of a thread of total messages as
+// FormatThread does
+func FormatEmail(email jmap.Email, idx, total int) string {
+	var sb strings.Builder
+
+	sb.WriteString(fmt.Sprintf("=== Email %d of %d ===\n", idx, total))
+	sb.WriteString(fmt.Sprintf("From: %s\n", formatAddresses(email.From)))
+	sb.WriteString(fmt.Sprintf("To: %s\n", formatAddresses(email.To)))
+	if len(email.CC) > 0 {
+		sb.WriteString(fmt.Sprintf("CC: %s\n", formatAddresses(email.CC)))
 	}
+	sb.WriteString(fmt.Sprintf("Date: %s\n", formatDate(email.ReceivedAt)))
+	sb.WriteString(fmt.Sprintf("Subject: %s\n", email.Subject))
+	sb.WriteString("\n")
+
+	body := email.GetBodyText()
+	// Convert HTML to text if needed
+	if strings.Contains(body, "<") && strings.Contains(body, ">") {
+		body = HTMLToText(body)
+	}
+	sb.WriteString(body)
+	sb.WriteString("\n\n")
 
 	return sb.String()
 }
 
 // FormatThreadForLLM formats a thread in LLM-optimized format with quote/signature stripping
 func FormatThreadForLLM(emails []jmap.Email, opts ExportOptions) string {
-	var sb strings.Builder
+	if opts.MaxTokens > 0 {
+		text, _ := FormatThreadForLLMBudget(emails, opts)
+		return text
+	}
 
+	var sb strings.Builder
 	for i, email := range emails {
-		sb.WriteString("---\n")
-		sb.WriteString(fmt.Sprintf("MessageIdx: %d\n", i+1))
-		sb.WriteString(fmt.Sprintf("From: %s\n", formatEmailsOnly(email.From)))
-		sb.WriteString(fmt.Sprintf("To: %s\n", formatEmailsOnly(email.To)))
-		if len(email.CC) > 0 {
-			sb.WriteString(fmt.Sprintf("CC: %s\n", formatEmailsOnly(email.CC)))
-		}
-		sb.WriteString(fmt.Sprintf("Date: %s\n", formatDate(email.ReceivedAt)))
-		sb.WriteString("\n")
+		sb.WriteString(FormatEmailForLLM(email, i+1, opts))
+	}
+	return sb.String()
+}
 
-		body := getCleanBody(email, opts)
-		sb.WriteString(body)
-		sb.WriteString("\n\n")
+// FormatEmailForLLM formats message idx (1-based) of a thread as
+// FormatThreadForLLM does, so long threads can be written one message at a
+// time
+func FormatEmailForLLM(email jmap.Email, idx int, opts ExportOptions) string {
+	return formatLLMHeader(email, idx) + getCleanBody(email, opts) + "\n\n"
+}
+
+// formatLLMHeader formats the header lines of a message in the LLM format,
+// through the blank line before the body
+func formatLLMHeader(email jmap.Email, idx int) string {
+	var sb strings.Builder
+
+	sb.WriteString("---\n")
+	sb.WriteString(fmt.Sprintf("MessageIdx: %d\n", idx))
+	sb.WriteString(fmt.Sprintf("From: %s\n", formatEmailsOnly(email.From)))
+	sb.WriteString(fmt.Sprintf("To: %s\n", formatEmailsOnly(email.To)))
+	if len(email.CC) > 0 {
+		sb.WriteString(fmt.Sprintf("CC: %s\n", formatEmailsOnly(email.CC)))
+	}
+	sb.WriteString(fmt.Sprintf("Date: %s\n", formatDate(email.ReceivedAt)))
+	if len(email.MailboxNames) > 0 {
+		sb.WriteString(fmt.Sprintf("Mailbox: %s\n", strings.Join(email.MailboxNames, ", ")))
 	}
+	sb.WriteString("\n")
 
 	return sb.String()
 }
@@ -116,10 +149,23 @@ func formatEmailsOnly(addrs []jmap.EmailAddress) string {
 	return strings.Join(emails, ", ")
 }
 
+// FormatThreadContent formats a thread as Markdown or in the LLM text format,
+// as opts.Markdown selects
+func FormatThreadContent(emails []jmap.Email, opts ExportOptions) string {
+	if opts.Markdown {
+		return FormatThreadMarkdown(emails, opts)
+	}
+	return FormatThreadForLLM(emails, opts)
+}
+
 // CopyToClipboard copies the formatted thread to clipboard (LLM format)
 func CopyToClipboard(emails []jmap.Email) error {
-	opts := DefaultLLMOptions()
-	text := FormatThreadForLLM(emails, opts)
+	return CopyThread(emails, DefaultLLMOptions())
+}
+
+// CopyThread copies the thread to clipboard in the format opts selects
+func CopyThread(emails []jmap.Email, opts ExportOptions) error {
+	text := FormatThreadContent(emails, opts)
 	return clipboard.WriteAll(text)
 }
 
@@ -156,35 +202,44 @@ func FormatAttachmentInfo(emails []jmap.Email) string {
 
 // CopyFullThread copies thread content + attachment metadata to clipboard
 func CopyFullThread(emails []jmap.Email, opts ExportOptions) error {
-	content := FormatThreadForLLM(emails, opts)
+	content := FormatThreadContent(emails, opts)
 	attachInfo := FormatAttachmentInfo(emails)
 	return clipboard.WriteAll(content + "\n" + attachInfo)
 }
 
-// ExportToFolder creates a folder with thread.txt and downloaded attachments
+// ExportToFolder creates a folder with thread.txt (thread.md with
+// opts.Markdown) and downloaded attachments
 func ExportToFolder(emails []jmap.Email, client *jmap.Client, opts ExportOptions) (string, error) {
 	if len(emails) == 0 {
 		return "", fmt.Errorf("no emails to export")
 	}
 
-	// Create export directory
-	subject := sanitizeFilename(emails[0].Subject)
-	timestamp := time.Now().Format("2006-01-02_150405")
-	dirName := fmt.Sprintf("%s_%s", subject, timestamp)
-
-	if err := os.MkdirAll(dirName, 0755); err != nil {
+	dirName := GenerateFolderName(emails[0].Subject)
+	if err := WriteFolder(dirName, emails, client, opts); err != nil {
 		return "", err
 	}
+	return dirName, nil
+}
+
+// WriteFolder writes thread.txt, or thread.md with opts.Markdown, and the
+// downloaded attachments into dir, creating it if needed
+func WriteFolder(dir string, emails []jmap.Email, client *jmap.Client, opts ExportOptions) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
 
-	// Write thread.txt
-	threadContent := FormatThreadForLLM(emails, opts)
-	threadPath := filepath.Join(dirName, "thread.txt")
+	// Write thread.txt or thread.md
+	threadContent := FormatThreadContent(emails, opts)
+	threadPath := filepath.Join(dir, "thread.txt")
+	if opts.Markdown {
+		threadPath = filepath.Join(dir, "thread.md")
+	}
 	if err := os.WriteFile(threadPath, []byte(threadContent), 0644); err != nil {
-		return "", err
+		return err
 	}
 
 	// Download and save attachments
-	attachDir := filepath.Join(dirName, "attachments")
+	attachDir := filepath.Join(dir, "attachments")
 	hasAttachments := false
 	usedNames := make(map[string]int)
 
@@ -196,26 +251,26 @@ func ExportToFolder(emails []jmap.Email, client *jmap.Client, opts ExportOptions
 
 			if !hasAttachments {
 				if err := os.MkdirAll(attachDir, 0755); err != nil {
-					return "", err
+					return err
 				}
 				hasAttachments = true
 			}
 
 			data, err := client.DownloadBlob(att.BlobID, att.Name, att.Type)
 			if err != nil {
-				return "", fmt.Errorf("failed to download %s: %w", att.Name, err)
+				return fmt.Errorf("failed to download %s: %w", att.Name, err)
 			}
 
 			// Handle filename conflicts
 			filename := deduplicateFilename(att.Name, usedNames)
 			attPath := filepath.Join(attachDir, filename)
 			if err := os.WriteFile(attPath, data, 0644); err != nil {
-				return "", err
+				return err
 			}
 		}
 	}
 
-	return dirName, nil
+	return nil
 }
 
 // deduplicateFilename ensures unique filenames by appending _1, _2, etc.
@@ -252,17 +307,23 @@ func formatSize(bytes uint64) string {
 func ExportToFile(emails []jmap.Email, filename string) error {
 	if filename == "" {
 		// Auto-generate filename from subject and date
-		subject := "email"
+		subject := ""
 		if len(emails) > 0 {
-			subject = sanitizeFilename(emails[0].Subject)
+			subject = emails[0].Subject
 		}
-		filename = fmt.Sprintf("%s_%s.txt", subject, time.Now().Format("2006-01-02_150405"))
+		filename = GenerateTextFilename(subject)
 	}
 
 	text := FormatThread(emails)
 	return os.WriteFile(filename, []byte(text), 0644)
 }
 
+// GenerateTextFilename generates a filename for a text export from the subject
+// and the current time
+func GenerateTextFilename(subject string) string {
+	return fmt.Sprintf("%s_%s.txt", sanitizeFilename(subject), time.Now().Format("2006-01-02_150405"))
+}
+
 // formatAddresses formats a list of email addresses
 func formatAddresses(addrs []jmap.EmailAddress) string {
 	parts := make([]string, len(addrs))
@@ -0,0 +1,588 @@
+package export
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/html"
+)
+
+// HTMLToMarkdown converts an HTML email body to Markdown, keeping links as
+// [text](url), headings, emphasis, bullet and numbered lists, block quotes,
+// code and simple tables. Tables used for layout, as most newsletters do,
+// are flattened into paragraphs.
+func HTMLToMarkdown(htmlStr string) string {
+	doc, err := html.Parse(strings.NewReader(htmlStr))
+	if err != nil {
+		return stripHTMLRegex(htmlStr)
+	}
+
+	w := &mdWriter{}
+	w.node(doc)
+	return cleanMarkdown(w.sb.String())
+}
+
+// mdWriter renders HTML nodes as Markdown. Text is written a word at a time
+// so that whitespace can be collapsed the way a browser would; line
+// prefixes for quotes and list items are written when a line gets content.
+type mdWriter struct {
+	sb       strings.Builder
+	prefix   []string // per-line prefixes, outermost first
+	newlines int      // line ends due since the last write
+	flushed  int      // how many of them have been written
+	started  bool     // anything written yet
+	space    bool     // a space is due before the next word
+	glue     bool     // drop the due space, after an opening marker
+	pre      int      // depth of <pre> elements
+	tight    int      // depth of list items, where blocks are not separated by blank lines
+	inline   int      // depth of headings and table cells, which must stay on one line
+}
+
+// lineStart reports whether the next write begins a new line
+func (w *mdWriter) lineStart() bool {
+	return !w.started || w.newlines > 0
+}
+
+// write appends s to the current line, starting the line and adding any due
+// space first
+func (w *mdWriter) write(s string) {
+	if s == "" {
+		return
+	}
+	if w.lineStart() {
+		w.flushBlankLines()
+		w.sb.WriteString(strings.Join(w.prefix, ""))
+	} else if w.space && !w.glue {
+		w.sb.WriteByte(' ')
+	}
+	w.sb.WriteString(s)
+	w.started = true
+	w.newlines = 0
+	w.flushed = 0
+	w.space = false
+	w.glue = false
+}
+
+// newline ends the current line
+func (w *mdWriter) newline() {
+	if !w.started {
+		return
+	}
+	if w.inline > 0 {
+		w.space = true
+		return
+	}
+	w.newlines++
+	w.space = false
+	w.glue = false
+}
+
+// flushBlankLines writes the line ends due. They are written late, so that
+// they carry the prefix of the line that follows rather than of one that has
+// since ended, and before a prefix is added, so that a quote does not start
+// with an empty quoted line.
+func (w *mdWriter) flushBlankLines() {
+	prefix := strings.TrimRight(strings.Join(w.prefix, ""), " ")
+	for ; w.flushed < w.newlines; w.flushed++ {
+		if w.flushed > 0 {
+			w.sb.WriteString(prefix)
+		}
+		w.sb.WriteByte('\n')
+	}
+}
+
+// lineBreak makes sure the next write starts on a new line
+func (w *mdWriter) lineBreak() {
+	// A block opening a list item goes on the marker's line
+	if w.newlines == 0 && !w.glue {
+		w.newline()
+	}
+}
+
+// blankLine separates blocks, except inside list items where a line break
+// keeps the list tight
+func (w *mdWriter) blankLine() {
+	if w.tight > 0 {
+		w.lineBreak()
+		return
+	}
+	for w.started && w.newlines < 2 && w.inline == 0 {
+		w.newline()
+	}
+}
+
+// text writes a text node, collapsing whitespace outside <pre>
+func (w *mdWriter) text(s string) {
+	if w.pre > 0 {
+		lines := strings.Split(s, "\n")
+		for i, line := range lines {
+			if i > 0 {
+				w.newline()
+			}
+			if line != "" {
+				w.write(line)
+			}
+		}
+		return
+	}
+
+	if s == "" {
+		return
+	}
+	if unicode.IsSpace(rune(s[0])) {
+		w.space = true
+	}
+	for _, word := range strings.Fields(s) {
+		w.write(escapeMarkdownWord(word, w.lineStart()))
+		w.space = true
+	}
+	if !unicode.IsSpace(lastRune(s)) {
+		w.space = false
+	}
+}
+
+// lastRune returns the last rune of s, or 0 if s is empty
+func lastRune(s string) rune {
+	r := []rune(s)
+	if len(r) == 0 {
+		return 0
+	}
+	return r[len(r)-1]
+}
+
+// node renders n and its children
+func (w *mdWriter) node(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		w.text(n.Data)
+		return
+	case html.DocumentNode:
+		w.children(n)
+		return
+	case html.ElementNode:
+	default:
+		return
+	}
+
+	switch n.Data {
+	case "head", "script", "style", "title", "template", "noscript":
+		// Not content
+
+	case "br":
+		if w.pre > 0 || w.newlines < 2 {
+			w.newline()
+		}
+
+	case "p":
+		w.blankLine()
+		w.children(n)
+		w.blankLine()
+
+	case "div", "section", "article", "header", "footer", "main", "center", "address", "figure", "dl", "dt", "dd":
+		w.lineBreak()
+		w.children(n)
+		w.lineBreak()
+
+	case "h1", "h2", "h3", "h4", "h5", "h6":
+		level, _ := strconv.Atoi(n.Data[1:])
+		w.blankLine()
+		w.write(strings.Repeat("#", level))
+		w.space = true
+		w.inline++
+		w.children(n)
+		w.inline--
+		w.blankLine()
+
+	case "hr":
+		w.blankLine()
+		w.write("---")
+		w.blankLine()
+
+	case "strong", "b":
+		w.wrap(n, "**")
+	case "em", "i", "cite":
+		w.wrap(n, "*")
+	case "del", "s", "strike":
+		w.wrap(n, "~~")
+
+	case "code", "kbd", "samp", "tt":
+		if w.pre > 0 {
+			w.children(n)
+			return
+		}
+		code := strings.Join(strings.Fields(textContent(n)), " ")
+		if code == "" {
+			return
+		}
+		fence := "`"
+		if strings.Contains(code, "`") {
+			fence = "`` "
+		}
+		w.write(fence + code + reverse(fence))
+
+	case "pre":
+		w.blankLine()
+		w.write("```")
+		w.newline()
+		w.pre++
+		w.children(n)
+		w.pre--
+		w.lineBreak()
+		w.write("```")
+		w.blankLine()
+
+	case "blockquote":
+		w.blankLine()
+		w.flushBlankLines()
+		w.prefix = append(w.prefix, "> ")
+		w.children(n)
+		w.prefix = w.prefix[:len(w.prefix)-1]
+		w.blankLine()
+
+	case "ul", "ol":
+		w.list(n)
+
+	case "li":
+		// Outside a list; render as a bullet anyway
+		w.listItem(n, "- ")
+
+	case "a":
+		w.link(n)
+
+	case "img":
+		w.image(n)
+
+	case "table":
+		w.table(n)
+
+	default:
+		w.children(n)
+	}
+}
+
+func (w *mdWriter) children(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		w.node(c)
+	}
+}
+
+// wrap renders n between emphasis markers, leaving surrounding spaces
+// outside them. Elements without text are rendered bare.
+func (w *mdWriter) wrap(n *html.Node, marker string) {
+	if strings.TrimSpace(textContent(n)) == "" || w.pre > 0 {
+		w.children(n)
+		return
+	}
+	if s := textContent(n); unicode.IsSpace(rune(s[0])) {
+		w.space = true
+	}
+	w.write(marker)
+	w.glue = true
+	w.children(n)
+	space := w.space
+	w.space = false
+	w.write(marker)
+	w.space = space
+}
+
+// list renders a bullet or numbered list
+func (w *mdWriter) list(n *html.Node) {
+	if w.tight == 0 {
+		w.blankLine()
+	} else {
+		w.lineBreak()
+	}
+
+	number := 1
+	if start, err := strconv.Atoi(getAttr(n, "start")); err == nil {
+		number = start
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode {
+			continue
+		}
+		if c.Data != "li" {
+			w.node(c) // a nested list placed directly in the list
+			continue
+		}
+		marker := "- "
+		if n.Data == "ol" {
+			marker = strconv.Itoa(number) + ". "
+			number++
+		}
+		w.listItem(c, marker)
+	}
+
+	if w.tight == 0 {
+		w.blankLine()
+	}
+}
+
+// listItem renders one item, indenting its continuation lines under the
+// marker
+func (w *mdWriter) listItem(n *html.Node, marker string) {
+	w.lineBreak()
+	w.write(marker)
+	w.glue = true
+	w.prefix = append(w.prefix, strings.Repeat(" ", len(marker)))
+	w.tight++
+	w.children(n)
+	w.tight--
+	w.prefix = w.prefix[:len(w.prefix)-1]
+	w.lineBreak()
+}
+
+// link renders an anchor as [text](url), or as <url> when the text is the
+// URL itself
+func (w *mdWriter) link(n *html.Node) {
+	href := strings.TrimSpace(getAttr(n, "href"))
+	if href == "" || strings.HasPrefix(href, "#") || strings.HasPrefix(strings.ToLower(href), "javascript:") {
+		w.children(n)
+		return
+	}
+
+	inner := w.sub(n)
+	if inner == "" {
+		if hasImage(n) {
+			return // an image link without alt text, typically a logo or tracker
+		}
+		inner = href
+	}
+
+	target := strings.TrimPrefix(href, "mailto:")
+	switch {
+	case inner == href || inner == target || strings.TrimSuffix(inner, "/") == strings.TrimSuffix(href, "/"):
+		w.write("<" + href + ">")
+	default:
+		w.write("[" + inner + "](" + markdownURL(href) + ")")
+	}
+	if unicode.IsSpace(lastRune(textContent(n))) {
+		w.space = true
+	}
+}
+
+// image renders an image as ![alt](src). Tracking pixels are dropped, and
+// images embedded in the message, which have no useful URL, become their
+// alt text.
+func (w *mdWriter) image(n *html.Node) {
+	src := strings.TrimSpace(getAttr(n, "src"))
+	alt := strings.Join(strings.Fields(getAttr(n, "alt")), " ")
+	if getAttr(n, "width") == "1" || getAttr(n, "height") == "1" || getAttr(n, "width") == "0" {
+		return
+	}
+
+	lower := strings.ToLower(src)
+	switch {
+	case src == "":
+		return
+	case strings.HasPrefix(lower, "cid:"), strings.HasPrefix(lower, "data:"):
+		if alt != "" {
+			w.write("[image: " + escapeMarkdownText(alt) + "]")
+		}
+	default:
+		w.write("![" + escapeMarkdownText(alt) + "](" + markdownURL(src) + ")")
+	}
+}
+
+// table renders a data table as a Markdown table, and a layout table as the
+// paragraphs in its cells
+func (w *mdWriter) table(n *html.Node) {
+	rows := tableRows(n)
+	if isLayoutTable(n, rows) {
+		for _, row := range rows {
+			for _, cell := range row {
+				w.lineBreak()
+				w.children(cell)
+				w.lineBreak()
+			}
+		}
+		return
+	}
+
+	columns := 0
+	for _, row := range rows {
+		if len(row) > columns {
+			columns = len(row)
+		}
+	}
+
+	w.blankLine()
+	for i, row := range rows {
+		cells := make([]string, columns)
+		for j, cell := range row {
+			cells[j] = strings.ReplaceAll(w.sub(cell), "|", `\|`)
+		}
+		w.lineBreak()
+		w.write("| " + strings.Join(cells, " | ") + " |")
+		if i == 0 {
+			w.newline()
+			w.write("|" + strings.Repeat(" --- |", columns))
+		}
+	}
+	w.blankLine()
+}
+
+// sub renders n's children on their own, as a single line
+func (w *mdWriter) sub(n *html.Node) string {
+	inner := &mdWriter{inline: 1}
+	inner.children(n)
+	return strings.TrimSpace(inner.sb.String())
+}
+
+// tableRows returns the cells of each row of a table, not descending into
+// nested tables
+func tableRows(table *html.Node) [][]*html.Node {
+	var rows [][]*html.Node
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode {
+				continue
+			}
+			switch c.Data {
+			case "thead", "tbody", "tfoot":
+				walk(c)
+			case "tr":
+				var cells []*html.Node
+				for cell := c.FirstChild; cell != nil; cell = cell.NextSibling {
+					if cell.Type == html.ElementNode && (cell.Data == "td" || cell.Data == "th") {
+						cells = append(cells, cell)
+					}
+				}
+				if len(cells) > 0 {
+					rows = append(rows, cells)
+				}
+			}
+		}
+	}
+	walk(table)
+	return rows
+}
+
+// layoutElements are elements that do not fit in a Markdown table cell
+var layoutElements = map[string]bool{
+	"table": true, "p": true, "div": true, "ul": true, "ol": true, "blockquote": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true, "pre": true, "img": true,
+}
+
+// isLayoutTable guesses whether a table positions content rather than
+// holding data: one column or one row, block content in cells, or
+// role="presentation"
+func isLayoutTable(table *html.Node, rows [][]*html.Node) bool {
+	if getAttr(table, "role") == "presentation" || len(rows) < 2 {
+		return true
+	}
+	multiColumn := false
+	for _, row := range rows {
+		if len(row) > 1 {
+			multiColumn = true
+		}
+		for _, cell := range row {
+			if containsElement(cell, layoutElements) {
+				return true
+			}
+		}
+	}
+	return !multiColumn
+}
+
+func containsElement(n *html.Node, names map[string]bool) bool {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && (names[c.Data] || containsElement(c, names)) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasImage(n *html.Node) bool {
+	return containsElement(n, map[string]bool{"img": true})
+}
+
+// textContent returns the text of n and its descendants
+func textContent(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var sb strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		sb.WriteString(textContent(c))
+	}
+	return sb.String()
+}
+
+func getAttr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func reverse(s string) string {
+	r := []rune(s)
+	for i, j := 0, len(r)-1; i < j; i, j = i+1, j-1 {
+		r[i], r[j] = r[j], r[i]
+	}
+	return string(r)
+}
+
+// markdownURL makes a URL safe inside (...)
+func markdownURL(u string) string {
+	if strings.ContainsAny(u, " ()<>") {
+		return "<" + strings.NewReplacer("<", "%3C", ">", "%3E").Replace(u) + ">"
+	}
+	return u
+}
+
+// escapeMarkdownText escapes characters that would start inline markup
+func escapeMarkdownText(s string) string {
+	return markdownTextEscaper.Replace(s)
+}
+
+var markdownTextEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "`", "\\`", "[", `\[`, "]", `\]`)
+
+// orderedMarker matches a word that would start a numbered list
+var orderedMarker = regexp.MustCompile(`^\d+[.)]$`)
+
+// escapeMarkdownWord escapes one word of text. URLs and addresses are left
+// alone so they stay usable; underscores are only escaped at word edges,
+// where they could start emphasis.
+func escapeMarkdownWord(word string, lineStart bool) string {
+	if strings.Contains(word, "://") || strings.Contains(word, "@") {
+		return word
+	}
+	word = escapeMarkdownText(word)
+	if strings.HasPrefix(word, "_") {
+		word = `\` + word
+	}
+	if strings.HasSuffix(word, "_") && !strings.HasSuffix(word, `\_`) {
+		word = word[:len(word)-1] + `\_`
+	}
+
+	if lineStart {
+		switch {
+		case strings.HasPrefix(word, "#"), strings.HasPrefix(word, ">"),
+			word == "-", word == "+", word == "=":
+			word = `\` + word
+		case orderedMarker.MatchString(word):
+			// A backslash only escapes punctuation, so it goes before the . or )
+			word = word[:len(word)-1] + `\` + word[len(word)-1:]
+		}
+	}
+	return word
+}
+
+// cleanMarkdown trims trailing spaces and runs of blank lines
+func cleanMarkdown(s string) string {
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t\u00a0\r")
+	}
+	s = strings.Join(lines, "\n")
+	s = regexp.MustCompile(`\n{3,}`).ReplaceAllString(s, "\n\n")
+	return strings.TrimSpace(s)
+}
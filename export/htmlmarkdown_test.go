@@ -0,0 +1,28 @@
+package export
+
+import "testing"
+
+func TestHTMLToMarkdown(t *testing.T) {
+	tests := []struct {
+		html, want string
+	}{
+		{"<h2>Title</h2><p>one</p><p>two</p>", "## Title\n\none\n\ntwo"},
+		{"<ol><li>one</li><li>two</li></ol>", "1. one\n2. two"},
+		{"<ul><li>a</li><li>b <b>bold</b></li></ul>", "- a\n- b **bold**"},
+		{`<p>See <a href="https://example.com/x">the docs</a></p>`, "See [the docs](https://example.com/x)"},
+		{"<blockquote>quoted</blockquote>", "> quoted"},
+		{"<pre>code *x*</pre>", "```\ncode *x*\n```"},
+		{"<p>x <code>a`b</code></p>", "x `` a`b ``"},
+
+		// Text that would read as Markdown syntax is escaped
+		{"<p>*stars* [x]</p>", `\*stars\* \[x\]`},
+		{"<p># not a heading</p>", `\# not a heading`},
+		{"<p>1. not a list</p>", `1\. not a list`},
+		{"<p>2) nor this</p>", `2\) nor this`},
+	}
+	for _, tt := range tests {
+		if got := HTMLToMarkdown(tt.html); got != tt.want {
+			t.Errorf("HTMLToMarkdown(%q) = %q, want %q", tt.html, got, tt.want)
+		}
+	}
+}
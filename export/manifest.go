@@ -0,0 +1,323 @@
+package export
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/stevemurr/fastmail-agent/jmap"
+)
+
+// ManifestFile is the manifest of an export directory. A file exported on
+// its own gets a manifest beside it, named with ManifestSuffix.
+const (
+	ManifestFile   = "manifest.json"
+	ManifestSuffix = ".manifest.json"
+)
+
+// ToolVersion is recorded in manifests; main sets it to the build's version
+var ToolVersion = "dev"
+
+// Manifest records where an export came from and the SHA-256 of everything
+// it produced, for chain of custody. It is written as indented JSON with a
+// fixed field order, so the file can be signed as it is (for example with
+// gpg --detach-sign) and checked later with VerifyManifest.
+type Manifest struct {
+	Tool        string          `json:"tool"`
+	ToolVersion string          `json:"tool_version"`
+	AccountID   string          `json:"account_id,omitempty"`
+	Query       string          `json:"query,omitempty"`
+	Threads     []string        `json:"thread_handles,omitempty"`
+	RetrievedAt string          `json:"retrieved_at"` // when the mail was fetched from the server
+	CreatedAt   string          `json:"created_at"`
+	Emails      []ManifestEmail `json:"emails,omitempty"`
+	Files       []ManifestEntry `json:"files"`
+}
+
+// ManifestEmail identifies one exported email on the server
+type ManifestEmail struct {
+	ID          string               `json:"id"`
+	BlobID      string               `json:"blob_id,omitempty"` // the original message
+	ThreadID    string               `json:"thread_id,omitempty"`
+	MessageID   []string             `json:"message_id,omitempty"`
+	Subject     string               `json:"subject"`
+	ReceivedAt  string               `json:"received_at"`
+	Attachments []ManifestAttachment `json:"attachments,omitempty"`
+}
+
+// ManifestAttachment identifies an attachment and the SHA-256 of its content
+// as downloaded
+type ManifestAttachment struct {
+	BlobID string `json:"blob_id"`
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Size   uint64 `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// ManifestEntry is a produced file, relative to the manifest's directory
+type ManifestEntry struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Provenance says what an export was made from
+type Provenance struct {
+	Query       string    // search query, for exports of a query
+	Handles     []string  // thread handles
+	RetrievedAt time.Time // when the mail was fetched; zero for now
+
+	// Hashes are the attachment hashes already computed for the export,
+	// such as PDFOptions.Hashes, so they aren't downloaded twice; nil if none
+	Hashes BlobHashes
+}
+
+// NewManifest starts a manifest for emails, hashing each attachment as it
+// downloads. With a nil client, as for mail read from the local store,
+// attachments are listed without hashes.
+func NewManifest(ctx context.Context, client *jmap.Client, emails []jmap.Email, prov Provenance) (*Manifest, error) {
+	now := time.Now().UTC()
+	retrieved := prov.RetrievedAt
+	if retrieved.IsZero() {
+		retrieved = now
+	}
+	m := &Manifest{
+		Tool:        "fastmail-agent",
+		ToolVersion: ToolVersion,
+		Query:       prov.Query,
+		Threads:     prov.Handles,
+		RetrievedAt: retrieved.UTC().Format(time.RFC3339),
+		CreatedAt:   now.Format(time.RFC3339),
+		Files:       []ManifestEntry{},
+	}
+	if client != nil {
+		m.AccountID = client.AccountID()
+	}
+
+	hashes := prov.Hashes
+	if hashes == nil {
+		hashes = make(BlobHashes)
+	}
+	for _, email := range emails {
+		me := ManifestEmail{
+			ID:         email.ID,
+			BlobID:     email.BlobID,
+			ThreadID:   email.ThreadID,
+			MessageID:  email.MessageID,
+			Subject:    email.Subject,
+			ReceivedAt: email.ReceivedAt,
+		}
+		for _, att := range email.Attachments {
+			ma := ManifestAttachment{BlobID: att.BlobID, Name: att.Name, Type: att.Type, Size: att.Size}
+			if client != nil {
+				sum, err := hashes.hash(ctx, client, att)
+				if err != nil {
+					return nil, fmt.Errorf("hashing %s: %w", att.Name, err)
+				}
+				ma.SHA256 = sum
+			}
+			me.Attachments = append(me.Attachments, ma)
+		}
+		m.Emails = append(m.Emails, me)
+	}
+	return m, nil
+}
+
+// BlobHashes maps attachment blob IDs to their SHA-256, so attachments
+// sent more than once, or needed by both an export and its manifest, are
+// downloaded once
+type BlobHashes map[string]string
+
+// hash returns the SHA-256 of att, downloading it if it isn't known
+func (h BlobHashes) hash(ctx context.Context, client *jmap.Client, att jmap.Attachment) (string, error) {
+	if sum, ok := h[att.BlobID]; ok {
+		return sum, nil
+	}
+	sum, err := hashBlob(ctx, client, att)
+	if err != nil {
+		return "", err
+	}
+	h[att.BlobID] = sum
+	return sum, nil
+}
+
+// hashBlob downloads an attachment and returns its SHA-256
+func hashBlob(ctx context.Context, client *jmap.Client, att jmap.Attachment) (string, error) {
+	body, err := client.OpenBlobContext(ctx, att.BlobID, att.Name, att.Type)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// AddFiles hashes paths, relative to root, into the manifest. Directories are
+// added file by file, leaving out a manifest of root itself.
+func (m *Manifest) AddFiles(root string, paths ...string) error {
+	for _, p := range paths {
+		err := filepath.WalkDir(filepath.Join(root, p), func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				return nil
+			}
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			if isOwnManifest(rel) {
+				return nil
+			}
+
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			sum, err := HashFile(path)
+			if err != nil {
+				return err
+			}
+			m.Files = append(m.Files, ManifestEntry{Path: filepath.ToSlash(rel), Size: info.Size(), SHA256: sum})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	sort.Slice(m.Files, func(i, j int) bool { return m.Files[i].Path < m.Files[j].Path })
+	return nil
+}
+
+// isOwnManifest reports whether rel, relative to an export directory, is that
+// directory's manifest or a detached signature of it
+func isOwnManifest(rel string) bool {
+	return rel == ManifestFile || strings.HasPrefix(rel, ManifestFile+".")
+}
+
+// Write saves the manifest to path. It is written under a temporary name
+// first, so a manifest that exists is complete.
+func (m *Manifest) Write(path string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".partial", append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".partial", path)
+}
+
+// ManifestPath returns where the manifest of an export belongs: inside it
+// for a directory, beside it for a file
+func ManifestPath(output string) string {
+	if info, err := os.Stat(output); err == nil && info.IsDir() {
+		return filepath.Join(output, ManifestFile)
+	}
+	return output + ManifestSuffix
+}
+
+// WriteManifest writes the manifest of an export of emails to output, a file
+// or directory, hashing everything it contains, and returns the manifest's
+// path
+func WriteManifest(ctx context.Context, client *jmap.Client, emails []jmap.Email, output string, prov Provenance) (string, error) {
+	m, err := NewManifest(ctx, client, emails, prov)
+	if err != nil {
+		return "", err
+	}
+
+	path := ManifestPath(output)
+	root, name := filepath.Dir(path), filepath.Base(output)
+	if path == filepath.Join(output, ManifestFile) {
+		root, name = output, "."
+	}
+	if err := m.AddFiles(root, name); err != nil {
+		return "", err
+	}
+	return path, m.Write(path)
+}
+
+// VerifyResult is the outcome of checking an export against its manifest
+type VerifyResult struct {
+	Manifest string   `json:"manifest"`
+	Files    int      `json:"files"` // listed in the manifest
+	OK       bool     `json:"ok"`
+	Modified []string `json:"modified,omitempty"` // hash or size differs
+	Missing  []string `json:"missing,omitempty"`
+	Extra    []string `json:"extra,omitempty"` // in a manifest's directory but not listed
+}
+
+// VerifyManifest re-hashes the files a manifest lists. path is the manifest,
+// an export directory or an exported file. For a directory manifest, files
+// added to the directory since are reported too.
+func VerifyManifest(path string) (*VerifyResult, error) {
+	manifestPath := path
+	if !strings.HasSuffix(path, ManifestSuffix) && filepath.Base(path) != ManifestFile {
+		manifestPath = ManifestPath(path)
+	}
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("%s: %w", manifestPath, err)
+	}
+
+	root := filepath.Dir(manifestPath)
+	result := &VerifyResult{Manifest: manifestPath, Files: len(m.Files)}
+	listed := make(map[string]bool)
+	for _, f := range m.Files {
+		listed[f.Path] = true
+		file := filepath.Join(root, filepath.FromSlash(f.Path))
+		info, err := os.Stat(file)
+		if err != nil {
+			result.Missing = append(result.Missing, f.Path)
+			continue
+		}
+		sum, err := HashFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if sum != f.SHA256 || info.Size() != f.Size {
+			result.Modified = append(result.Modified, f.Path)
+		}
+	}
+
+	if filepath.Base(manifestPath) == ManifestFile {
+		err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			rel, err := filepath.Rel(root, p)
+			if err != nil {
+				return err
+			}
+			if rel = filepath.ToSlash(rel); !listed[rel] && !isOwnManifest(rel) {
+				result.Extra = append(result.Extra, rel)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result.OK = len(result.Modified) == 0 && len(result.Missing) == 0 && len(result.Extra) == 0
+	return result, nil
+}
@@ -0,0 +1,69 @@
+package export
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/stevemurr/fastmail-agent/jmaptest"
+)
+
+func TestManifest(t *testing.T) {
+	_, client := newTestClient(t)
+	emails, err := client.GetThread("T1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := WriteEMLFolder(context.Background(), dir, emails, client); err != nil {
+		t.Fatal(err)
+	}
+
+	path, err := WriteManifest(context.Background(), client, emails, dir, Provenance{Query: "invoice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != filepath.Join(dir, ManifestFile) {
+		t.Errorf("manifest written to %s", path)
+	}
+	m, err := NewManifest(context.Background(), client, emails, Provenance{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(jmaptest.SampleFixture().Blobs["B1"])
+	if got := m.Emails[0].Attachments[0].SHA256; got != hex.EncodeToString(sum[:]) {
+		t.Errorf("attachment hash %s is not of its content", got)
+	}
+
+	result, err := VerifyManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.OK || result.Files != len(emails)+1 {
+		t.Fatalf("fresh export: %+v", result)
+	}
+
+	// Change one file, remove another and add a third
+	first, second := EMLName(emails[0], 1), EMLName(emails[1], 2)
+	if err := os.WriteFile(filepath.Join(dir, first), []byte("tampered"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "extra.txt"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	result, err = VerifyManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.OK || !reflect.DeepEqual(result.Modified, []string{first}) ||
+		!reflect.DeepEqual(result.Missing, []string{second}) || !reflect.DeepEqual(result.Extra, []string{"extra.txt"}) {
+		t.Errorf("tampered export: %+v", result)
+	}
+}
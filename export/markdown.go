@@ -0,0 +1,92 @@
+package export
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/stevemurr/fastmail-agent/jmap"
+)
+
+// FormatThreadMarkdown formats a thread as a Markdown document: the subject
+// as a title, then one section per message. HTML bodies keep their links,
+// lists, headings, emphasis and tables.
+func FormatThreadMarkdown(emails []jmap.Email, opts ExportOptions) string {
+	var sb strings.Builder
+	if len(emails) > 0 {
+		sb.WriteString(fmt.Sprintf("# %s\n\n", markdownEscape(emails[len(emails)-1].Subject)))
+	}
+	for i, email := range emails {
+		sb.WriteString(FormatEmailMarkdown(email, i+1, len(emails), opts))
+	}
+	return sb.String()
+}
+
+// FormatEmailMarkdown formats message idx (1-based) of a thread of total
+// messages as FormatThreadMarkdown does
+func FormatEmailMarkdown(email jmap.Email, idx, total int, opts ExportOptions) string {
+	var sb strings.Builder
+
+	sb.WriteString(fmt.Sprintf("## Email %d of %d\n\n", idx, total))
+	sb.WriteString(fmt.Sprintf("- **From:** %s\n", markdownEscape(formatAddresses(email.From))))
+	sb.WriteString(fmt.Sprintf("- **To:** %s\n", markdownEscape(formatAddresses(email.To))))
+	if len(email.CC) > 0 {
+		sb.WriteString(fmt.Sprintf("- **CC:** %s\n", markdownEscape(formatAddresses(email.CC))))
+	}
+	sb.WriteString(fmt.Sprintf("- **Date:** %s\n", formatDate(email.ReceivedAt)))
+	sb.WriteString(fmt.Sprintf("- **Subject:** %s\n", markdownEscape(email.Subject)))
+	for _, att := range email.Attachments {
+		if !att.IsInline {
+			sb.WriteString(fmt.Sprintf("- **Attachment:** %s (%s)\n", markdownEscape(att.Name), formatSize(att.Size)))
+		}
+	}
+	sb.WriteString("\n")
+
+	sb.WriteString(strings.TrimSpace(MarkdownBody(email, opts)))
+	sb.WriteString("\n\n")
+
+	return sb.String()
+}
+
+// MarkdownBody returns an email's body as Markdown, converted from its HTML
+// part when it has one and cleaned according to opts
+func MarkdownBody(email jmap.Email, opts ExportOptions) string {
+	htmlStr := htmlBodyValue(email)
+	if htmlStr == "" {
+		return CleanBody(email.GetBodyText(), opts)
+	}
+
+	if opts.StripQuotes {
+		htmlStr = StripQuotesFromHTML(htmlStr)
+	}
+	body := HTMLToMarkdown(htmlStr)
+	if opts.StripSignatures {
+		body = StripSignature(body)
+	}
+	return body
+}
+
+// htmlBodyValue returns the HTML version of an email's body, or "" if it only
+// has plain text
+func htmlBodyValue(email jmap.Email) string {
+	var parts []string
+	for _, part := range email.HTMLBody {
+		if part.Type != "text/html" {
+			continue
+		}
+		if val, ok := email.BodyValues[part.PartID]; ok {
+			parts = append(parts, val.Value)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// markdownEscape escapes the characters that would start Markdown markup
+// inside a line of header text
+func markdownEscape(s string) string {
+	return markdownEscaper.Replace(s)
+}
+
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "*", `\*`, "_", `\_`, "`", "\\`",
+	"[", `\[`, "]", `\]`, "<", `\<`, ">", `\>`, "#", `\#`,
+)
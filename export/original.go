@@ -0,0 +1,257 @@
+package export
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/stevemurr/fastmail-agent/jmap"
+)
+
+// ChecksumFile lists the SHA-256 of every file an original-message export
+// writes, in the format of sha256sum, so `sha256sum -c SHA256SUMS` checks it
+const ChecksumFile = "SHA256SUMS"
+
+// OpenOriginal starts downloading the original RFC 5322 message an email was
+// parsed from, byte for byte as the server stores it. The caller must close
+// it.
+func OpenOriginal(ctx context.Context, client *jmap.Client, email jmap.Email) (io.ReadCloser, error) {
+	if email.BlobID == "" {
+		return nil, fmt.Errorf("email %s has no blobId; fetch it again with the blobId property", email.ID)
+	}
+	return client.OpenBlobContext(ctx, email.BlobID, email.ID+".eml", "message/rfc822")
+}
+
+// ExportToEML creates a folder named after the subject holding the original
+// messages of a thread, as WriteEMLFolder writes them
+func ExportToEML(ctx context.Context, emails []jmap.Email, client *jmap.Client) (string, error) {
+	if len(emails) == 0 {
+		return "", fmt.Errorf("no emails to export")
+	}
+
+	dirName := fmt.Sprintf("%s_%s", sanitizeFilename(emails[len(emails)-1].Subject), time.Now().Format("2006-01-02_150405"))
+	if err := WriteEMLFolder(ctx, dirName, emails, client); err != nil {
+		os.RemoveAll(dirName)
+		return "", err
+	}
+	return dirName, nil
+}
+
+// MboxName is the name of the mbox file in a folder of original messages
+const MboxName = "messages.mbox"
+
+// ExportToMbox creates a folder named after the subject holding the original
+// messages of a thread in one mbox file, MboxName, with a SHA256SUMS file,
+// and returns the folder's name and the mbox file's SHA-256
+func ExportToMbox(ctx context.Context, emails []jmap.Email, client *jmap.Client) (string, string, error) {
+	if len(emails) == 0 {
+		return "", "", fmt.Errorf("no emails to export")
+	}
+
+	dirName := fmt.Sprintf("%s_%s", sanitizeFilename(emails[len(emails)-1].Subject), time.Now().Format("2006-01-02_150405"))
+	if err := os.MkdirAll(dirName, 0755); err != nil {
+		return "", "", err
+	}
+	sum, err := WriteMboxFile(ctx, filepath.Join(dirName, MboxName), emails, client)
+	if err == nil {
+		err = WriteChecksums(dirName, map[string]string{MboxName: sum})
+	}
+	if err != nil {
+		os.RemoveAll(dirName)
+		return "", "", err
+	}
+	return dirName, sum, nil
+}
+
+// EMLName is the file name of an email in an .eml export: its position in
+// the thread, date and ID, so that files sort in thread order
+func EMLName(email jmap.Email, idx int) string {
+	date := "unknown-date"
+	if t, err := time.Parse(time.RFC3339, email.ReceivedAt); err == nil {
+		date = t.UTC().Format("2006-01-02_150405")
+	}
+	return fmt.Sprintf("%03d_%s_%s.eml", idx, date, sanitizeFilename(email.ID))
+}
+
+// WriteEMLFolder writes each email's original message into dir as a
+// byte-exact .eml file, plus a SHA256SUMS file, creating dir if needed
+func WriteEMLFolder(ctx context.Context, dir string, emails []jmap.Email, client *jmap.Client) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	sums := make(map[string]string)
+	for i, email := range emails {
+		name := EMLName(email, i+1)
+		sum, err := writeOriginal(ctx, filepath.Join(dir, name), email, client)
+		if err != nil {
+			return fmt.Errorf("email %s: %w", email.ID, err)
+		}
+		sums[name] = sum
+	}
+	return WriteChecksums(dir, sums)
+}
+
+// writeOriginal downloads an email's original message to path and returns
+// its SHA-256
+func writeOriginal(ctx context.Context, path string, email jmap.Email, client *jmap.Client) (string, error) {
+	body, err := OpenOriginal(ctx, client, email)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), body); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// WriteMbox writes the emails' original messages to w in mboxrd format: each
+// message follows a "From " separator line, and lines of the message that
+// match >*From are quoted with one more >, which readers remove again. The
+// messages are otherwise unchanged, line endings included. It returns the
+// SHA-256 of each original message, by email ID, before quoting.
+func WriteMbox(ctx context.Context, w io.Writer, emails []jmap.Email, client *jmap.Client) (map[string]string, error) {
+	bw := bufio.NewWriter(w)
+	sums := make(map[string]string)
+	for _, email := range emails {
+		sum, err := writeMboxMessage(ctx, bw, email, client)
+		if err != nil {
+			return nil, fmt.Errorf("email %s: %w", email.ID, err)
+		}
+		sums[email.ID] = sum
+	}
+	return sums, bw.Flush()
+}
+
+// WriteMboxFile writes the emails to path as WriteMbox does and returns the
+// SHA-256 of the file
+func WriteMboxFile(ctx context.Context, path string, emails []jmap.Email, client *jmap.Client) (string, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := WriteMbox(ctx, io.MultiWriter(f, h), emails, client); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeMboxMessage writes one message with its separator line
+func writeMboxMessage(ctx context.Context, w *bufio.Writer, email jmap.Email, client *jmap.Client) (string, error) {
+	body, err := OpenOriginal(ctx, client, email)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	sender := "MAILER-DAEMON"
+	if len(email.From) > 0 && email.From[0].Email != "" {
+		sender = strings.ReplaceAll(email.From[0].Email, " ", "_")
+	}
+	date := time.Now()
+	if t, err := time.Parse(time.RFC3339, email.ReceivedAt); err == nil {
+		date = t
+	}
+	fmt.Fprintf(w, "From %s %s\n", sender, date.UTC().Format(time.ANSIC))
+
+	h := sha256.New()
+	r := bufio.NewReader(body)
+	last := byte('\n')
+	for {
+		line, err := r.ReadSlice('\n')
+		if len(line) > 0 {
+			h.Write(line)
+			if isMboxFromLine(line) {
+				w.WriteByte('>')
+			}
+			w.Write(line)
+			last = line[len(line)-1]
+		}
+		if err == bufio.ErrBufferFull {
+			// A line longer than the buffer: write the rest of it unquoted
+			for err == bufio.ErrBufferFull {
+				line, err = r.ReadSlice('\n')
+				h.Write(line)
+				w.Write(line)
+				if len(line) > 0 {
+					last = line[len(line)-1]
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// Every message ends with a line break and a blank line before the next
+	// separator
+	if last != '\n' {
+		w.WriteByte('\n')
+	}
+	w.WriteByte('\n')
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// isMboxFromLine reports whether line matches >*From , which mboxrd quotes
+func isMboxFromLine(line []byte) bool {
+	return bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From "))
+}
+
+// WriteChecksums writes SHA256SUMS into dir from a map of file names, relative
+// to dir, to their hex SHA-256
+func WriteChecksums(dir string, sums map[string]string) error {
+	names := make([]string, 0, len(sums))
+	for name := range sums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	for _, name := range names {
+		sb.WriteString(fmt.Sprintf("%s  %s\n", sums[name], filepath.ToSlash(name)))
+	}
+	return os.WriteFile(filepath.Join(dir, ChecksumFile), []byte(sb.String()), 0644)
+}
+
+// HashFile returns the hex SHA-256 of a file
+func HashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
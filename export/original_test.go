@@ -0,0 +1,103 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stevemurr/fastmail-agent/jmap"
+	"github.com/stevemurr/fastmail-agent/jmaptest"
+)
+
+// newTestClient starts a fake server with the sample fixture and connects
+// to it
+func newTestClient(t *testing.T) (*jmaptest.Server, *jmap.Client) {
+	t.Helper()
+	srv := jmaptest.NewServer(jmaptest.SampleFixture())
+	t.Cleanup(srv.Close)
+	client, err := srv.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv, client
+}
+
+func TestWriteMbox(t *testing.T) {
+	srv, client := newTestClient(t)
+
+	raw := "Subject: Quoting\r\n\r\nFrom the desk of Alice\r\n>From an earlier mbox\r\nFromage is not quoted\r\n From indented\r\nno final line break"
+	email := jmaptest.SampleFixture().Emails[0]
+	email.ID, email.BlobID = "M6", "RM6"
+	srv.AddEmail(email, []byte(raw))
+
+	var buf bytes.Buffer
+	sums, err := WriteMbox(context.Background(), &buf, []jmap.Email{email}, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "From alice@example.com Fri Mar  1 09:00:00 2024\n" +
+		"Subject: Quoting\r\n\r\n>From the desk of Alice\r\n>>From an earlier mbox\r\nFromage is not quoted\r\n From indented\r\nno final line break\n\n"
+	if got := buf.String(); got != want {
+		t.Errorf("mbox =\n%q\nwant\n%q", got, want)
+	}
+	sum := sha256.Sum256([]byte(raw))
+	if sums["M6"] != hex.EncodeToString(sum[:]) {
+		t.Errorf("checksum %s is not of the original message", sums["M6"])
+	}
+}
+
+func TestWriteEMLFolder(t *testing.T) {
+	_, client := newTestClient(t)
+	emails, err := client.GetThread("T1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	if err := WriteEMLFolder(context.Background(), dir, emails, client); err != nil {
+		t.Fatal(err)
+	}
+	sums, err := os.ReadFile(filepath.Join(dir, ChecksumFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs := jmaptest.SampleFixture().Blobs
+	for i, email := range emails {
+		name := EMLName(email, i+1)
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, blobs[email.BlobID]) {
+			t.Errorf("%s differs from the original message", name)
+		}
+		sum := sha256.Sum256(data)
+		if !strings.Contains(string(sums), hex.EncodeToString(sum[:])+"  "+name+"\n") {
+			t.Errorf("%s has no line for %s:\n%s", ChecksumFile, name, sums)
+		}
+	}
+}
+
+func TestExportToEMLCleansUp(t *testing.T) {
+	_, client := newTestClient(t)
+	emails, err := client.GetThread("T1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The second message's original can't be downloaded
+	emails[1].BlobID = "missing"
+
+	t.Chdir(t.TempDir())
+	if _, err := ExportToEML(context.Background(), emails, client); err == nil {
+		t.Fatal("exported a thread with a missing original")
+	}
+	if entries, _ := os.ReadDir("."); len(entries) != 0 {
+		t.Errorf("left %s behind", entries[0].Name())
+	}
+}
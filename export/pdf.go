@@ -7,11 +7,10 @@ import (
 	"html"
 	"html/template"
 	"os"
+	"strconv"
 	"strings"
 	"time"
-
-	"github.com/chromedp/cdproto/page"
-	"github.com/chromedp/chromedp"
+	"unicode"
 
 	"github.com/stevemurr/fastmail-agent/jmap"
 )
@@ -20,13 +19,14 @@ const pdfTemplate = `<!DOCTYPE html>
 <html>
 <head>
     <meta charset="UTF-8">
+    <meta http-equiv="Content-Security-Policy" content="default-src 'none'; img-src data:; style-src 'unsafe-inline'">
     <style>
         * {
             box-sizing: border-box;
         }
         body {
-            font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, "Helvetica Neue", Arial, sans-serif;
-            font-size: 11pt;
+            font-family: {{.FontFamily}};
+            font-size: {{.FontSize}}pt;
             line-height: 1.5;
             color: #333;
             margin: 0;
@@ -118,6 +118,60 @@ const pdfTemplate = `<!DOCTYPE html>
             color: #0066cc;
             text-decoration: none;
         }
+        .cover {
+            page-break-after: always;
+        }
+        .cover h1 {
+            font-size: 18pt;
+            margin: 0 0 10px 0;
+            color: #000;
+        }
+        .cover h2 {
+            font-size: 12pt;
+            margin: 25px 0 10px 0;
+        }
+        .toc {
+            width: 100%;
+            border-collapse: collapse;
+            font-size: 9pt;
+        }
+        .toc th, .toc td {
+            text-align: left;
+            vertical-align: top;
+            padding: 4px 6px;
+            border-bottom: 1px solid #ddd;
+        }
+        .toc th {
+            border-bottom: 2px solid #333;
+        }
+        .email-body img {
+            max-width: 100%;
+            height: auto;
+        }
+        .inline-image {
+            display: block;
+            margin-top: 10px;
+        }
+        .image-placeholder {
+            font-size: 9pt;
+            color: #999;
+        }
+        .appendix {
+            page-break-before: always;
+        }
+        .appendix h1 {
+            font-size: 14pt;
+            margin: 0 0 10px 0;
+            color: #000;
+        }
+        .appendix .toc td {
+            word-break: break-all;
+        }
+        .thumb {
+            max-width: 1.5in;
+            max-height: 1.5in;
+            margin-top: 4px;
+        }
         @media print {
             body {
                 padding: 0;
@@ -129,6 +183,28 @@ const pdfTemplate = `<!DOCTYPE html>
     </style>
 </head>
 <body>
+    {{if .Cover}}
+    <div class="cover">
+        <h1>{{.Subject}}</h1>
+        <div class="thread-meta">
+            <div>Export Date: {{.ExportDate}}</div>
+            <div>Total Emails: {{.EmailCount}}</div>
+        </div>
+        <h2>Contents</h2>
+        <table class="toc">
+            <tr><th>#</th><th>Date</th><th>From</th><th>Subject</th></tr>
+            {{range .Emails}}
+            <tr>
+                <td><a href="#email-{{.Number}}">{{.Number}}</a></td>
+                <td>{{.ShortDate}}</td>
+                <td>{{.From}}</td>
+                <td><a href="#email-{{.Number}}">{{.Subject}}</a></td>
+            </tr>
+            {{end}}
+        </table>
+    </div>
+    {{end}}
+
     <div class="thread-header">
         <h1>Email Thread Export</h1>
         <div class="thread-meta">
@@ -139,7 +215,7 @@ const pdfTemplate = `<!DOCTYPE html>
     </div>
 
     {{range $idx, $email := .Emails}}
-    <div class="email">
+    <div class="email" id="email-{{$email.Number}}">
         <div class="email-header">
             <div class="email-number">Email {{$email.Number}} of {{$.EmailCount}}</div>
             <div class="email-header-row">
@@ -170,6 +246,12 @@ const pdfTemplate = `<!DOCTYPE html>
                 <span class="header-value message-id">{{$email.MessageID}}</span>
             </div>
             {{end}}
+            {{if $email.Attachments}}
+            <div class="email-header-row">
+                <span class="header-label">Attachments:</span>
+                <span class="header-value">{{$email.Attachments}}</span>
+            </div>
+            {{end}}
         </div>
         <div class="email-body">
             {{$email.Body}}
@@ -177,6 +259,25 @@ const pdfTemplate = `<!DOCTYPE html>
     </div>
     {{end}}
 
+    {{if .Appendix}}
+    <div class="appendix">
+        <h1>Attachments</h1>
+        <table class="toc">
+            <tr><th>#</th><th>Email</th><th>Name</th><th>Type</th><th>Size</th><th>SHA-256</th></tr>
+            {{range .Appendix}}
+            <tr>
+                <td>{{.ID}}</td>
+                <td><a href="#email-{{.Email}}">{{.Email}}</a></td>
+                <td>{{.Name}}{{if .Thumb}}<br><img class="thumb" src="{{.Thumb}}" alt="{{.Name}}">{{end}}</td>
+                <td>{{.Type}}</td>
+                <td>{{.Size}}</td>
+                <td class="message-id">{{if .SHA256}}{{.SHA256}}{{else}}not downloaded{{end}}</td>
+            </tr>
+            {{end}}
+        </table>
+    </div>
+    {{end}}
+
     <div class="footer">
         This document was exported from Fastmail on {{.ExportDate}}<br>
         Generated by fastmail-agent
@@ -185,21 +286,273 @@ const pdfTemplate = `<!DOCTYPE html>
 </html>`
 
 type pdfEmailData struct {
-	Number    int
-	From      string
-	To        string
-	CC        string
-	Date      string
-	Subject   string
-	MessageID string
-	Body      template.HTML
+	Number      int
+	From        string
+	To          string
+	CC          string
+	Date        string
+	ShortDate   string
+	Subject     string
+	MessageID   string
+	Attachments string // listed in the appendix
+	Body        template.HTML
+}
+
+// pdfAppendixRow is an attachment in the appendix
+type pdfAppendixRow struct {
+	ID     string
+	Email  int
+	Name   string
+	Type   string
+	Size   string
+	SHA256 string
+	Thumb  template.URL // data: URI of an image attachment
 }
 
 type pdfTemplateData struct {
 	ExportDate string
 	Subject    string
 	EmailCount int
+	Cover      bool
+	FontFamily template.CSS
+	FontSize   string
 	Emails     []pdfEmailData
+	Appendix   []pdfAppendixRow
+}
+
+// PDFOptions controls how a thread is laid out as a PDF, and the page
+// furniture added for documents produced in litigation. Pages get Bates
+// numbers when BatesPrefix or BatesStart is set, counting from 1 if only the
+// prefix is. Header and Footer may contain {page}, {pages} and {bates},
+// which are replaced on each page.
+type PDFOptions struct {
+	BatesPrefix string // put before each Bates number, e.g. "ACME"
+	BatesStart  int    // Bates number of the first page
+	BatesDigits int    // zero-padded width of Bates numbers; 0 for 6
+	Header      string // centered at the top of every page
+	Footer      string // at the bottom left of every page
+	Exhibit     string // label in a box at the top right of the first page, e.g. "Exhibit 12"
+	Cover       bool   // start with a cover page listing and linking to each message
+
+	Renderer PDFRenderer // nil for Chrome if it is installed, the built-in renderer otherwise
+	Paper    PageSize    // zero for US Letter
+	Margins  Margins     // zero for 0.5" on every side
+	Font     string      // helvetica, times or courier, or with Chrome any CSS font family; "" for the default
+	FontSize float64     // of body text, in points; 0 for 11
+
+	// SnapshotImages downloads the remote images messages show when the
+	// PDF is made, to embed them. Otherwise they are blocked, since
+	// fetching them tells the sender the mail was read.
+	SnapshotImages bool
+
+	// Hashes collects the SHA-256 of each attachment as it is downloaded.
+	// Pass the same map as Provenance.Hashes so the manifest reuses them;
+	// nil to keep them to the PDF.
+	Hashes BlobHashes
+
+	attachments *pdfAttachments // downloaded by RenderPDFContext
+}
+
+// PDFRenderer lays out a thread as PDF pages: a header for the export, then
+// each message's headers and body, after a cover page if opts asks for one.
+// Stamps are left to StampPDF.
+type PDFRenderer interface {
+	Name() string
+	Render(emails []jmap.Email, opts PDFOptions) ([]byte, error)
+}
+
+// PDFRendererFor returns the renderer called name: chrome, builtin, or auto
+// (or "") for Chrome when it is installed and builtin otherwise. The
+// fallback fails on text it would have to print as ?, rather than make a
+// PDF the caller didn't expect.
+func PDFRendererFor(name string) (PDFRenderer, error) {
+	switch strings.ToLower(name) {
+	case "", "auto":
+		if ChromeAvailable() {
+			return ChromeRenderer{}, nil
+		}
+		return BuiltinRenderer{Strict: true}, nil
+	case "chrome":
+		return ChromeRenderer{}, nil
+	case "builtin":
+		return BuiltinRenderer{}, nil
+	}
+	return nil, fmt.Errorf("unknown PDF renderer %q (use auto, chrome or builtin)", name)
+}
+
+// PageSize is a paper size in points
+type PageSize struct {
+	Width, Height float64
+}
+
+// PageSizes are the paper sizes known by name
+var PageSizes = map[string]PageSize{
+	"letter": {612, 792},
+	"legal":  {612, 1008},
+	"a4":     {595.28, 841.89},
+}
+
+// ParsePageSize looks up a paper size by name, such as a4 or letter
+func ParsePageSize(name string) (PageSize, error) {
+	size, ok := PageSizes[strings.ToLower(name)]
+	if !ok {
+		return PageSize{}, fmt.Errorf("unknown paper size %q (use letter, legal or a4)", name)
+	}
+	return size, nil
+}
+
+// Margins are the page margins in points
+type Margins struct {
+	Top, Right, Bottom, Left float64
+}
+
+// ParseMargins reads one to four lengths, as the CSS margin property does:
+// all sides, vertical and horizontal, top, horizontal and bottom, or top,
+// right, bottom and left. Lengths take a unit of in, mm, cm or pt; a bare
+// number is inches.
+func ParseMargins(s string) (Margins, error) {
+	fields := strings.Fields(strings.ReplaceAll(s, ",", " "))
+	lengths := make([]float64, len(fields))
+	for i, f := range fields {
+		n, err := parseLength(f)
+		if err != nil {
+			return Margins{}, err
+		}
+		lengths[i] = n
+	}
+	switch len(lengths) {
+	case 1:
+		return Margins{lengths[0], lengths[0], lengths[0], lengths[0]}, nil
+	case 2:
+		return Margins{lengths[0], lengths[1], lengths[0], lengths[1]}, nil
+	case 3:
+		return Margins{lengths[0], lengths[1], lengths[2], lengths[1]}, nil
+	case 4:
+		return Margins{lengths[0], lengths[1], lengths[2], lengths[3]}, nil
+	}
+	return Margins{}, fmt.Errorf("margins %q: expected one to four lengths", s)
+}
+
+// pointsPer converts lengths in each unit to points
+var pointsPer = map[string]float64{"in": 72, "mm": 72 / 25.4, "cm": 72 / 2.54, "pt": 1}
+
+// parseLength reads a length such as 0.5in or 12mm, in points
+func parseLength(s string) (float64, error) {
+	unit := "in"
+	for u := range pointsPer {
+		if strings.HasSuffix(strings.ToLower(s), u) {
+			unit = u
+			s = s[:len(s)-len(u)]
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid length %q", s+unit)
+	}
+	return n * pointsPer[unit], nil
+}
+
+// paper returns the paper size, defaulting to US Letter
+func (o PDFOptions) paper() PageSize {
+	if o.Paper.Width <= 0 || o.Paper.Height <= 0 {
+		return PageSizes["letter"]
+	}
+	return o.Paper
+}
+
+// margins returns the margins, defaulting to 0.5"
+func (o PDFOptions) margins() Margins {
+	if o.Margins == (Margins{}) {
+		return Margins{36, 36, 36, 36}
+	}
+	return o.Margins
+}
+
+// fontSize returns the body font size, defaulting to 11pt
+func (o PDFOptions) fontSize() float64 {
+	if o.FontSize <= 0 {
+		return 11
+	}
+	return o.FontSize
+}
+
+// FirstBates returns the Bates number of the first page, or 0 without Bates
+// numbering
+func (o PDFOptions) FirstBates() int {
+	if o.BatesStart <= 0 && o.BatesPrefix != "" {
+		return 1
+	}
+	return max(o.BatesStart, 0)
+}
+
+// BatesNumber formats the Bates number n
+func (o PDFOptions) BatesNumber(n int) string {
+	digits := o.BatesDigits
+	if digits <= 0 {
+		digits = 6
+	}
+	return fmt.Sprintf("%s%0*d", o.BatesPrefix, digits, n)
+}
+
+// BatesRange returns the first and last Bates numbers of a PDF of pages
+// pages, or empty strings without Bates numbering
+func (o PDFOptions) BatesRange(pages int) (string, string) {
+	first := o.FirstBates()
+	if first == 0 || pages == 0 {
+		return "", ""
+	}
+	return o.BatesNumber(first), o.BatesNumber(first + pages - 1)
+}
+
+// stamped reports whether anything is drawn onto the rendered pages
+func (o PDFOptions) stamped() bool {
+	return o.FirstBates() > 0 || o.Header != "" || o.Footer != "" || o.Exhibit != ""
+}
+
+// stampFontSize is the size of header, footer and Bates text
+const stampFontSize = 9
+
+// stampOps returns the content stream that draws the stamps of page idx,
+// counted from 0, of a PDF of total pages with the given visible area.
+// Stamps sit in the page margins, clear of the content: the header and
+// exhibit label halfway down the top margin, the footer and Bates number
+// halfway up the bottom one.
+func (o PDFOptions) stampOps(idx, total int, box [4]float64, font pdfName) string {
+	left, bottom, right, top := box[0], box[1], box[2], box[3]
+	m := o.margins()
+	headerY := top - m.Top/2 - stampFontSize/3
+	footerY := bottom + m.Bottom/2 - stampFontSize/3
+
+	bates := ""
+	if first := o.FirstBates(); first > 0 {
+		bates = o.BatesNumber(first + idx)
+	}
+	fill := strings.NewReplacer("{page}", strconv.Itoa(idx+1), "{pages}", strconv.Itoa(total), "{bates}", bates)
+
+	var sb strings.Builder
+	sb.WriteString("0 g\n")
+	text := func(s string, size, x, y float64) {
+		fmt.Fprintf(&sb, "BT /%s %.2f Tf %.2f %.2f Td %s Tj ET\n", font, size, x, y, pdfString(s))
+	}
+	if o.Header != "" {
+		header := fill.Replace(o.Header)
+		text(header, stampFontSize, (left+right-textWidth(header, stampFontSize))/2, headerY)
+	}
+	if o.Footer != "" {
+		text(fill.Replace(o.Footer), stampFontSize, left+m.Left, footerY)
+	}
+	if bates != "" {
+		text(bates, stampFontSize, right-m.Right-textWidth(bates, stampFontSize), footerY)
+	}
+	if o.Exhibit != "" && idx == 0 {
+		const size, pad = 11, 6
+		w, h := textWidth(o.Exhibit, size)+2*pad, float64(size+2*pad)
+		x, y := right-m.Right-w, top-m.Top/2-h/2
+		fmt.Fprintf(&sb, "0.75 w %.2f %.2f %.2f %.2f re S\n", x, y, w, h)
+		text(o.Exhibit, size, x+pad, y+pad+2)
+	}
+	return sb.String()
 }
 
 // ExportToPDF renders a thread as a PDF file
@@ -215,13 +568,78 @@ func ExportToPDF(emails []jmap.Email, filename string) error {
 		filename = fmt.Sprintf("%s_%s.pdf", subject, timestamp)
 	}
 
+	_, err := WritePDF(filename, emails, PDFOptions{})
+	return err
+}
+
+// WritePDF renders a thread as a PDF file with opts' page furniture and
+// returns its number of pages
+func WritePDF(filename string, emails []jmap.Email, opts PDFOptions) (int, error) {
+	return WritePDFContext(context.Background(), filename, emails, nil, opts)
+}
+
+// WritePDFContext is WritePDF with the thread's attachments downloaded
+// through client, as RenderPDFContext does
+func WritePDFContext(ctx context.Context, filename string, emails []jmap.Email, client *jmap.Client, opts PDFOptions) (int, error) {
+	pdf, err := RenderPDFContext(ctx, emails, client, opts)
+	if err != nil {
+		return 0, err
+	}
+	pdf, pages, err := StampPDF(pdf, opts)
+	if err != nil {
+		return 0, fmt.Errorf("failed to stamp PDF: %w", err)
+	}
+
+	// Write PDF to file
+	if err := writeFile(filename, pdf); err != nil {
+		return 0, fmt.Errorf("failed to write PDF: %w", err)
+	}
+	return pages, nil
+}
+
+// RenderPDF renders a thread as a PDF with opts.Renderer, with a cover page
+// if opts asks for one. Stamps are left to StampPDF, so that a set of PDFs
+// can be rendered in parallel and then numbered in order. Without a client
+// to download them, images attached to messages show as placeholders.
+func RenderPDF(emails []jmap.Email, opts PDFOptions) ([]byte, error) {
+	return RenderPDFContext(context.Background(), emails, nil, opts)
+}
+
+// RenderPDFContext renders a thread as a PDF like RenderPDF, downloading its
+// attachments through client first: images a message shows are embedded in
+// it, and other attachments are listed with their SHA-256 in an appendix,
+// image attachments with a thumbnail. client may be nil, as for mail read
+// from the local store.
+func RenderPDFContext(ctx context.Context, emails []jmap.Email, client *jmap.Client, opts PDFOptions) ([]byte, error) {
+	if len(emails) == 0 {
+		return nil, fmt.Errorf("no emails to export")
+	}
+	attachments, err := loadPDFAttachments(ctx, client, emails, opts)
+	if err != nil {
+		return nil, err
+	}
+	opts.attachments = attachments
+
+	renderer := opts.Renderer
+	if renderer == nil {
+		renderer, _ = PDFRendererFor("auto")
+	}
+	return renderer.Render(emails, opts)
+}
+
+// pdfHTML lays out a thread as the HTML page a browser prints
+func pdfHTML(emails []jmap.Email, opts PDFOptions) (string, error) {
 	// Build template data
 	data := pdfTemplateData{
 		ExportDate: time.Now().Format("January 2, 2006 at 3:04 PM MST"),
 		Subject:    emails[0].Subject,
 		EmailCount: len(emails),
+		Cover:      opts.Cover,
+		FontFamily: cssFontFamily(opts.Font),
+		FontSize:   strconv.FormatFloat(opts.fontSize(), 'f', -1, 64),
 		Emails:     make([]pdfEmailData, len(emails)),
 	}
+	appendix := opts.attachments.appendix(emails)
 
 	for i, email := range emails {
 		messageID := ""
@@ -229,98 +647,71 @@ func ExportToPDF(emails []jmap.Email, filename string) error {
 			messageID = email.MessageID[0]
 		}
 
-		body := getEmailBodyHTML(email)
+		body, _ := opts.attachments.body(email)
 
 		data.Emails[i] = pdfEmailData{
-			Number:    i + 1,
-			From:      formatAddressesForPDF(email.From),
-			To:        formatAddressesForPDF(email.To),
-			CC:        formatAddressesForPDF(email.CC),
-			Date:      formatDateForPDF(email.ReceivedAt),
-			Subject:   email.Subject,
-			MessageID: messageID,
-			Body:      template.HTML(body),
+			Number:      i + 1,
+			From:        formatAddressesForPDF(email.From),
+			To:          formatAddressesForPDF(email.To),
+			CC:          formatAddressesForPDF(email.CC),
+			Date:        formatDateForPDF(email.ReceivedAt),
+			ShortDate:   formatShortDateForPDF(email.ReceivedAt),
+			Subject:     email.Subject,
+			MessageID:   messageID,
+			Attachments: attachmentList(appendix, i),
+			Body:        template.HTML(body),
+		}
+	}
+	for _, e := range appendix {
+		row := pdfAppendixRow{
+			ID:     e.id,
+			Email:  e.email + 1,
+			Name:   e.att.Name,
+			Type:   e.att.Type,
+			Size:   formatSize(e.att.Size),
+			SHA256: e.sum,
+		}
+		if e.thumb != nil && e.thumb.data != nil {
+			row.Thumb = template.URL(dataURI(*e.thumb))
 		}
+		data.Appendix = append(data.Appendix, row)
 	}
 
 	// Render HTML template
 	tmpl, err := template.New("pdf").Parse(pdfTemplate)
 	if err != nil {
-		return fmt.Errorf("failed to parse template: %w", err)
+		return "", fmt.Errorf("failed to parse template: %w", err)
 	}
 
 	var htmlBuf bytes.Buffer
 	if err := tmpl.Execute(&htmlBuf, data); err != nil {
-		return fmt.Errorf("failed to execute template: %w", err)
-	}
-
-	// Use chromedp to render PDF
-	ctx, cancel := chromedp.NewContext(context.Background())
-	defer cancel()
-
-	// Set timeout
-	ctx, cancel = context.WithTimeout(ctx, 30*time.Second)
-	defer cancel()
-
-	var pdfBuf []byte
-	if err := chromedp.Run(ctx,
-		chromedp.Navigate("about:blank"),
-		chromedp.ActionFunc(func(ctx context.Context) error {
-			frameTree, err := page.GetFrameTree().Do(ctx)
-			if err != nil {
-				return err
-			}
-			return page.SetDocumentContent(frameTree.Frame.ID, htmlBuf.String()).Do(ctx)
-		}),
-		chromedp.ActionFunc(func(ctx context.Context) error {
-			var err error
-			pdfBuf, _, err = page.PrintToPDF().
-				WithPrintBackground(true).
-				WithMarginTop(0.5).
-				WithMarginBottom(0.5).
-				WithMarginLeft(0.5).
-				WithMarginRight(0.5).
-				WithPaperWidth(8.5).
-				WithPaperHeight(11).
-				Do(ctx)
-			return err
-		}),
-	); err != nil {
-		return fmt.Errorf("failed to generate PDF: %w", err)
-	}
-
-	// Write PDF to file
-	if err := writeFile(filename, pdfBuf); err != nil {
-		return fmt.Errorf("failed to write PDF: %w", err)
+		return "", fmt.Errorf("failed to execute template: %w", err)
 	}
+	return htmlBuf.String(), nil
+}
 
-	return nil
+// cssFamilies are the CSS font stacks for the built-in renderer's families
+var cssFamilies = map[string]string{
+	"":          `-apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, "Helvetica Neue", Arial, sans-serif`,
+	"helvetica": `"Helvetica Neue", Helvetica, Arial, sans-serif`,
+	"times":     `"Times New Roman", Times, serif`,
+	"courier":   `"Courier New", Courier, monospace`,
 }
 
-// getEmailBodyHTML returns the email body as HTML
-func getEmailBodyHTML(email jmap.Email) string {
-	// Prefer HTML body for PDF rendering
-	for _, part := range email.HTMLBody {
-		if val, ok := email.BodyValues[part.PartID]; ok {
-			return sanitizeHTMLBody(val.Value)
-		}
+// cssFontFamily returns the CSS font-family for a font name. Other names
+// are kept to letters, digits, spaces and dashes, since they go into the
+// style sheet as they are.
+func cssFontFamily(font string) template.CSS {
+	if family, ok := cssFamilies[strings.ToLower(font)]; ok {
+		return template.CSS(family)
 	}
-
-	// Fall back to text body, convert to HTML
-	for _, part := range email.TextBody {
-		if val, ok := email.BodyValues[part.PartID]; ok {
-			return textToHTML(val.Value)
+	name := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == ' ' || r == '-' {
+			return r
 		}
-	}
-
-	return html.EscapeString(email.Preview)
-}
-
-// sanitizeHTMLBody cleans up HTML for PDF rendering
-func sanitizeHTMLBody(htmlContent string) string {
-	// Remove potentially problematic elements but keep the content structure
-	// This is a basic sanitization - the chromedp renderer will handle most HTML
-	return htmlContent
+		return -1
+	}, font)
+	return template.CSS(`"` + name + `", sans-serif`)
 }
 
 // textToHTML converts plain text to HTML with proper escaping and line breaks
@@ -355,11 +746,25 @@ func formatDateForPDF(dateStr string) string {
 	return t.Local().Format("Monday, January 2, 2006 at 3:04:05 PM MST")
 }
 
+// formatShortDateForPDF formats a JMAP date for the cover page's contents
+func formatShortDateForPDF(dateStr string) string {
+	t, err := time.Parse(time.RFC3339, dateStr)
+	if err != nil {
+		return dateStr
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
+
 // writeFile writes data to a file
 func writeFile(filename string, data []byte) error {
 	return os.WriteFile(filename, data, 0644)
 }
 
+// GenerateFolderName generates an export folder name from subject
+func GenerateFolderName(subject string) string {
+	return fmt.Sprintf("%s_%s", sanitizeFilename(subject), time.Now().Format("2006-01-02_150405"))
+}
+
 // GeneratePDFFilename generates a PDF filename from subject
 func GeneratePDFFilename(subject string) string {
 	sanitized := sanitizeFilename(subject)
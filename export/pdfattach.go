@@ -0,0 +1,488 @@
+package export
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	xhtml "golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+
+	"github.com/stevemurr/fastmail-agent/jmap"
+)
+
+// maxPDFImage is the largest image a PDF embeds, in a message or as a
+// thumbnail. Larger ones are listed but not shown.
+const maxPDFImage = 10 << 20
+
+// remoteImageTimeout bounds the download of each remote image snapshotted
+const remoteImageTimeout = 15 * time.Second
+
+// maxImageRedirects is how many redirects a remote image may go through
+const maxImageRedirects = 3
+
+// snapshotClient fetches remote images. Messages choose the URLs, so it only
+// connects to public addresses, never to this machine or its network, and
+// ignores proxy settings, which would hide where it connects.
+var snapshotClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: dialPublicOnly,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: remoteImageTimeout,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxImageRedirects {
+			return fmt.Errorf("more than %d redirects", maxImageRedirects)
+		}
+		return nil
+	},
+}
+
+// dialPublicOnly refuses connections to loopback, private, link-local and
+// other addresses that aren't on the public internet. It runs after DNS
+// resolution, so a public name can't resolve to them either.
+func dialPublicOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	ip = ip.Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() || sharedAddressSpace.Contains(ip) {
+		return fmt.Errorf("refusing to fetch from non-public address %s", ip)
+	}
+	return nil
+}
+
+// sharedAddressSpace is carrier-grade NAT space (RFC 6598), which IsPrivate
+// leaves out
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// pdfImage is an image to show in a PDF. Without data it could not be
+// shown, and a placeholder stands in for it.
+type pdfImage struct {
+	name string // what the placeholder calls it
+	mime string
+	data []byte
+	blob string // blob ID, for an attachment
+}
+
+// pdfAttachments is what a PDF shows of a thread's attachments: the content
+// of images, the SHA-256 of every attachment, and snapshots of remote
+// images. A nil *pdfAttachments has none of them.
+type pdfAttachments struct {
+	images map[string][]byte   // blob ID to content
+	sums   BlobHashes          // of every attachment
+	remote map[string]pdfImage // URL to snapshot, for those retrieved
+}
+
+// loadPDFAttachments downloads what a PDF of emails shows of their
+// attachments, hashing each one into opts.Hashes so a manifest made after
+// doesn't download them again. Remote images are snapshotted if opts asks
+// for it; one that can't be retrieved is left out rather than failing the
+// export. With a nil client, as for mail read from the local store, no
+// attachments are downloaded.
+func loadPDFAttachments(ctx context.Context, client *jmap.Client, emails []jmap.Email, opts PDFOptions) (*pdfAttachments, error) {
+	a := &pdfAttachments{
+		images: make(map[string][]byte),
+		sums:   opts.Hashes,
+		remote: make(map[string]pdfImage),
+	}
+	if a.sums == nil {
+		a.sums = make(BlobHashes)
+	}
+	if client != nil {
+		for _, email := range emails {
+			for _, att := range email.Attachments {
+				if !isImageAttachment(att) || att.Size > maxPDFImage {
+					if _, err := a.sums.hash(ctx, client, att); err != nil {
+						return nil, fmt.Errorf("hashing %s: %w", att.Name, err)
+					}
+					continue
+				}
+				if _, ok := a.images[att.BlobID]; ok {
+					continue
+				}
+				data, err := client.DownloadBlobContext(ctx, att.BlobID, att.Name, att.Type)
+				if err != nil {
+					return nil, fmt.Errorf("downloading %s: %w", att.Name, err)
+				}
+				sum := sha256.Sum256(data)
+				a.sums[att.BlobID] = hex.EncodeToString(sum[:])
+				a.images[att.BlobID] = data
+			}
+		}
+	}
+
+	if opts.SnapshotImages {
+		for _, email := range emails {
+			for _, src := range remoteImageURLs(email) {
+				if _, ok := a.remote[src]; ok {
+					continue
+				}
+				if img, err := snapshotImage(ctx, src); err == nil {
+					a.remote[src] = img
+				} else if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+			}
+		}
+	}
+	return a, nil
+}
+
+// sum returns the SHA-256 of an attachment, or "" if it wasn't downloaded
+func (a *pdfAttachments) sum(att jmap.Attachment) string {
+	if a == nil {
+		return ""
+	}
+	return a.sums[att.BlobID]
+}
+
+// image returns an attachment as an image to show
+func (a *pdfAttachments) image(att jmap.Attachment) pdfImage {
+	img := pdfImage{name: att.Name, mime: att.Type, blob: att.BlobID}
+	if img.name == "" {
+		img.name = "image"
+	}
+	if a != nil {
+		img.data = a.images[att.BlobID]
+	}
+	return img
+}
+
+// resolve returns the image an <img> in email's body shows: an attachment
+// for a cid: reference, or a snapshot for a remote image
+func (a *pdfAttachments) resolve(email jmap.Email, src string) (pdfImage, bool) {
+	if strings.HasPrefix(strings.ToLower(src), "cid:") {
+		cid := src[len("cid:"):]
+		if unescaped, err := url.PathUnescape(cid); err == nil {
+			cid = unescaped
+		}
+		for _, att := range email.Attachments {
+			if att.CID != "" && strings.Trim(att.CID, "<>") == strings.Trim(cid, "<>") {
+				return a.image(att), true
+			}
+		}
+		return pdfImage{name: "missing image " + cid}, true
+	}
+	if remote := remoteURL(src); remote != "" {
+		if a != nil {
+			if img, ok := a.remote[src]; ok {
+				return img, true
+			}
+		}
+		host := remote
+		if u, err := url.Parse(remote); err == nil {
+			host = u.Host
+		}
+		return pdfImage{name: "remote image from " + host}, true
+	}
+	return pdfImage{}, false
+}
+
+// body returns an email's body as HTML for a PDF, with its images
+// resolved: cid: references to the attachments' content, and remote images
+// to their snapshots. Images that can't be shown become a placeholder
+// naming them, so nothing is fetched at render time. Inline images the body
+// doesn't refer to are added at the end. images lists each image in order.
+func (a *pdfAttachments) body(email jmap.Email) (body string, images []pdfImage) {
+	shown := make(map[string]bool) // blob IDs
+	body, images = a.bodyHTML(email, shown)
+
+	for _, att := range email.Attachments {
+		if !isInlineImage(att) || shown[att.BlobID] {
+			continue
+		}
+		img := a.image(att)
+		images = append(images, img)
+		body += imageHTML(img, "inline-image")
+	}
+	return body, images
+}
+
+// bodyHTML returns the email body as HTML, preferring the HTML body with
+// its images resolved, marking the attachments shown, and without what
+// would run or load anything when the page is printed
+func (a *pdfAttachments) bodyHTML(email jmap.Email, shown map[string]bool) (string, []pdfImage) {
+	var body string
+	for _, part := range email.HTMLBody {
+		if val, ok := email.BodyValues[part.PartID]; ok {
+			// Without an HTML version, the HTML body is the text one
+			if strings.HasPrefix(part.Type, "text/plain") {
+				return textToHTML(val.Value), nil
+			}
+			body = val.Value
+			break
+		}
+	}
+	if body == "" {
+		// Fall back to text body, convert to HTML
+		for _, part := range email.TextBody {
+			if val, ok := email.BodyValues[part.PartID]; ok {
+				return textToHTML(val.Value), nil
+			}
+		}
+		return html.EscapeString(email.Preview), nil
+	}
+
+	root := &xhtml.Node{Type: xhtml.ElementNode, Data: "div", DataAtom: atom.Div}
+	nodes, err := xhtml.ParseFragment(strings.NewReader(body), root)
+	if err != nil {
+		return textToHTML(HTMLToText(body)), nil
+	}
+	for _, n := range nodes {
+		root.AppendChild(n)
+	}
+
+	var images []pdfImage
+	var walk func(n *xhtml.Node)
+	walk = func(n *xhtml.Node) {
+		for c := n.FirstChild; c != nil; {
+			next := c.NextSibling
+			if c.Type == xhtml.ElementNode {
+				switch c.DataAtom {
+				case atom.Script, atom.Iframe, atom.Object, atom.Embed, atom.Link, atom.Base, atom.Meta:
+					n.RemoveChild(c)
+				case atom.Img:
+					if img, ok := a.imageNode(email, c, shown); ok {
+						images = append(images, img)
+					} else {
+						n.RemoveChild(c)
+					}
+				default:
+					walk(c)
+				}
+			}
+			c = next
+		}
+	}
+
+	walk(root)
+
+	var sb strings.Builder
+	for c := root.FirstChild; c != nil; c = c.NextSibling {
+		xhtml.Render(&sb, c)
+	}
+	return sb.String(), images
+}
+
+// imageNode points an <img> at the image it shows, or turns it into a
+// placeholder if that can't be shown. It returns false for an <img> to
+// remove: a tracking pixel, or one whose source it doesn't know.
+func (a *pdfAttachments) imageNode(email jmap.Email, n *xhtml.Node, shown map[string]bool) (pdfImage, bool) {
+	if isTrackingPixel(n) {
+		return pdfImage{}, false
+	}
+	src := strings.TrimSpace(getAttr(n, "src"))
+	if img, ok := parseDataURI(src); ok {
+		return img, true
+	}
+	img, ok := a.resolve(email, src)
+	if !ok {
+		return pdfImage{}, false
+	}
+	if img.blob != "" {
+		shown[img.blob] = true
+	}
+
+	attrs := n.Attr[:0]
+	for _, attr := range n.Attr {
+		if attr.Key != "src" && attr.Key != "srcset" {
+			attrs = append(attrs, attr)
+		}
+	}
+	n.Attr = attrs
+	if img.data == nil {
+		n.Type, n.Data, n.DataAtom = xhtml.ElementNode, "span", atom.Span
+		n.Attr = []xhtml.Attribute{{Key: "class", Val: "image-placeholder"}}
+		n.AppendChild(&xhtml.Node{Type: xhtml.TextNode, Data: "[" + img.name + " not shown]"})
+		return img, true
+	}
+	n.Attr = append(n.Attr, xhtml.Attribute{Key: "src", Val: dataURI(img)})
+	return img, true
+}
+
+// imageHTML shows img as an <img>, or as a placeholder if it has no content
+func imageHTML(img pdfImage, class string) string {
+	if img.data == nil {
+		return `<div class="image-placeholder">[` + html.EscapeString(img.name) + ` not shown]</div>`
+	}
+	return fmt.Sprintf(`<img class="%s" src="%s" alt="%s">`, class, dataURI(img), html.EscapeString(img.name))
+}
+
+// dataURI encodes an image's content as a data: URI
+func dataURI(img pdfImage) string {
+	return "data:" + img.mime + ";base64," + base64.StdEncoding.EncodeToString(img.data)
+}
+
+// parseDataURI decodes an image given as a base64 data: URI
+func parseDataURI(src string) (pdfImage, bool) {
+	meta, data, ok := strings.Cut(src, ",")
+	mediaType, ok64 := strings.CutSuffix(strings.TrimPrefix(strings.ToLower(meta), "data:"), ";base64")
+	if !ok || !ok64 || !strings.HasPrefix(meta, "data:image/") {
+		return pdfImage{}, false
+	}
+	content, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(data), ""))
+	if err != nil {
+		return pdfImage{}, false
+	}
+	return pdfImage{name: "image", mime: mediaType, data: content}, true
+}
+
+// remoteImageURLs returns the remote images an email's HTML body shows,
+// leaving out tracking pixels
+func remoteImageURLs(email jmap.Email) []string {
+	var urls []string
+	for _, part := range email.HTMLBody {
+		val, ok := email.BodyValues[part.PartID]
+		if !ok || strings.HasPrefix(part.Type, "text/plain") {
+			continue
+		}
+		doc, err := xhtml.Parse(strings.NewReader(val.Value))
+		if err != nil {
+			return nil
+		}
+		var walk func(n *xhtml.Node)
+		walk = func(n *xhtml.Node) {
+			if n.Type == xhtml.ElementNode && n.DataAtom == atom.Img && !isTrackingPixel(n) {
+				if src := strings.TrimSpace(getAttr(n, "src")); remoteURL(src) != "" {
+					urls = append(urls, src)
+				}
+			}
+			for c := n.FirstChild; c != nil; c = c.NextSibling {
+				walk(c)
+			}
+		}
+		walk(doc)
+		break
+	}
+	return urls
+}
+
+// remoteURL returns the URL to fetch for an image source on the web, or ""
+func remoteURL(src string) string {
+	lower := strings.ToLower(src)
+	switch {
+	case strings.HasPrefix(lower, "http://"), strings.HasPrefix(lower, "https://"):
+		return src
+	case strings.HasPrefix(src, "//"):
+		return "https:" + src
+	}
+	return ""
+}
+
+// isTrackingPixel reports whether an <img> is sized to be invisible, as the
+// pixels senders use to see when mail is opened are
+func isTrackingPixel(n *xhtml.Node) bool {
+	for _, dim := range []string{"width", "height"} {
+		if v := strings.TrimSuffix(strings.TrimSpace(getAttr(n, dim)), "px"); v == "0" || v == "1" {
+			return true
+		}
+	}
+	return false
+}
+
+// snapshotImage downloads a remote image as it is now
+func snapshotImage(ctx context.Context, src string) (pdfImage, error) {
+	ctx, cancel := context.WithTimeout(ctx, remoteImageTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, remoteURL(src), nil)
+	if err != nil {
+		return pdfImage{}, err
+	}
+	resp, err := snapshotClient.Do(req)
+	if err != nil {
+		return pdfImage{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return pdfImage{}, fmt.Errorf("%s: %s", src, resp.Status)
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if !strings.HasPrefix(mediaType, "image/") {
+		return pdfImage{}, fmt.Errorf("%s: not an image (%s)", src, mediaType)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxPDFImage+1))
+	if err != nil {
+		return pdfImage{}, err
+	}
+	if len(data) > maxPDFImage {
+		return pdfImage{}, fmt.Errorf("%s: larger than %s", src, formatSize(maxPDFImage))
+	}
+	return pdfImage{name: src, mime: mediaType, data: data}, nil
+}
+
+func isImageAttachment(att jmap.Attachment) bool {
+	return strings.HasPrefix(strings.ToLower(att.Type), "image/")
+}
+
+// isInlineImage reports whether an attachment is shown in its message's
+// body rather than attached to it
+func isInlineImage(att jmap.Attachment) bool {
+	return att.IsInline && att.CID != "" && isImageAttachment(att)
+}
+
+// pdfAppendixEntry is an attachment listed in a PDF's appendix
+type pdfAppendixEntry struct {
+	id    string // A1, A2, ...
+	email int    // index of the message it came with
+	att   jmap.Attachment
+	sum   string    // SHA-256; "" if not downloaded
+	thumb *pdfImage // for an image
+}
+
+// appendix lists the attachments of emails that aren't shown in a body,
+// numbered in order
+func (a *pdfAttachments) appendix(emails []jmap.Email) []pdfAppendixEntry {
+	var entries []pdfAppendixEntry
+	for i, email := range emails {
+		for _, att := range email.Attachments {
+			if isInlineImage(att) {
+				continue
+			}
+			entry := pdfAppendixEntry{
+				id:    fmt.Sprintf("A%d", len(entries)+1),
+				email: i,
+				att:   att,
+				sum:   a.sum(att),
+			}
+			if isImageAttachment(att) {
+				img := a.image(att)
+				entry.thumb = &img
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// attachmentList names the appendix entries of message idx, for its headers
+func attachmentList(entries []pdfAppendixEntry, idx int) string {
+	var names []string
+	for _, e := range entries {
+		if e.email == idx {
+			names = append(names, fmt.Sprintf("%s %s (%s)", e.id, e.att.Name, formatSize(e.att.Size)))
+		}
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,124 @@
+package export
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/stevemurr/fastmail-agent/jmap"
+	"github.com/stevemurr/fastmail-agent/jmaptest"
+)
+
+// htmlEmail returns an email whose only body is html
+func htmlEmail(html string) jmap.Email {
+	return jmap.Email{
+		ID:         "M1",
+		HTMLBody:   []jmap.BodyPart{{PartID: "1", Type: "text/html"}},
+		BodyValues: map[string]jmap.BodyValue{"1": {Value: html}},
+	}
+}
+
+func TestRemoteImageURLs(t *testing.T) {
+	email := htmlEmail(`<p><img src="https://example.com/logo.png">
+		<img src="//cdn.example.com/chart.gif">
+		<img src="cid:part1@example.com">
+		<img src="data:image/png;base64,iVBORw0KGgo=">
+		<img src="https://track.example.com/open.gif" width="1" height="1"></p>`)
+	want := []string{"https://example.com/logo.png", "//cdn.example.com/chart.gif"}
+	if got := remoteImageURLs(email); !reflect.DeepEqual(got, want) {
+		t.Errorf("remote images = %v, want %v", got, want)
+	}
+	if got := remoteURL("//cdn.example.com/chart.gif"); got != "https://cdn.example.com/chart.gif" {
+		t.Errorf("protocol-relative URL fetched as %q", got)
+	}
+}
+
+func TestParseDataURI(t *testing.T) {
+	img, ok := parseDataURI("data:image/png;base64,aGVs\nbG8=")
+	if !ok || img.mime != "image/png" || string(img.data) != "hello" {
+		t.Errorf("parsed %+v, %v", img, ok)
+	}
+	for _, src := range []string{"data:text/plain;base64,aGVsbG8=", "data:image/png,hello", "data:image/png;base64,!!"} {
+		if _, ok := parseDataURI(src); ok {
+			t.Errorf("parseDataURI(%q) succeeded", src)
+		}
+	}
+}
+
+func TestLoadPDFAttachments(t *testing.T) {
+	_, client := newTestClient(t)
+	emails, err := client.GetThread("T1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := loadPDFAttachments(context.Background(), client, emails, PDFOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(jmaptest.SampleFixture().Blobs["B1"])
+	if got := a.sum(emails[0].Attachments[0]); got != hex.EncodeToString(sum[:]) {
+		t.Errorf("attachment hash %s is not of its content", got)
+	}
+	if len(a.images) != 0 || len(a.remote) != 0 {
+		t.Errorf("downloaded %d images and %d remote images for a CSV", len(a.images), len(a.remote))
+	}
+}
+
+func TestSnapshotImages(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "image/gif")
+		w.Write([]byte("GIF89a"))
+	}))
+	defer srv.Close()
+	emails := []jmap.Email{htmlEmail(`<img src="` + srv.URL + `/chart.gif">`)}
+
+	// Remote images are blocked unless asked for
+	a, err := loadPDFAttachments(context.Background(), nil, emails, PDFOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests != 0 || len(a.remote) != 0 {
+		t.Fatalf("fetched a remote image without SnapshotImages")
+	}
+
+	// Nor is one on this machine, even when asked for
+	a, err = loadPDFAttachments(context.Background(), nil, emails, PDFOptions{SnapshotImages: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests != 0 || len(a.remote) != 0 {
+		t.Errorf("snapshotted an image from a loopback address")
+	}
+}
+
+func TestDialPublicOnly(t *testing.T) {
+	tests := []struct {
+		address string
+		ok      bool
+	}{
+		{"93.184.216.34:443", true},
+		{"[2606:2800:220:1:248:1893:25c8:1946]:443", true},
+		{"127.0.0.1:80", false},
+		{"[::1]:80", false},
+		{"10.1.2.3:80", false},
+		{"192.168.0.1:80", false},
+		{"169.254.169.254:80", false},
+		{"100.64.0.1:80", false},
+		{"0.0.0.0:80", false},
+		{"[::ffff:127.0.0.1]:80", false},
+		{"[fe80::1]:80", false},
+	}
+	for _, tt := range tests {
+		err := dialPublicOnly("tcp", tt.address, nil)
+		if (err == nil) != tt.ok {
+			t.Errorf("dialPublicOnly(%q) = %v", tt.address, err)
+		}
+	}
+}
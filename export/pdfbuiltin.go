@@ -0,0 +1,612 @@
+package export
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stevemurr/fastmail-agent/jmap"
+)
+
+// BuiltinRenderer lays out threads itself, in pure Go, so PDFs can be made
+// where no browser is installed. It follows the HTML layout: the export's
+// header, then each message's headers in a shaded box and its body. Bodies
+// are set as plain text, with HTML converted to text first, in one of the
+// standard PDF fonts. Those cover Western European text; other characters
+// show as ?, unless Strict is set. The images a message shows follow its
+// text; PNG, JPEG and GIF are embedded, and other formats become
+// placeholders.
+type BuiltinRenderer struct {
+	// Strict fails instead of printing characters the fonts can't show as ?.
+	// PDFRendererFor sets it when auto falls back to this renderer, so a
+	// missing browser doesn't quietly garble a PDF.
+	Strict bool
+}
+
+func (BuiltinRenderer) Name() string { return "builtin" }
+
+func (r BuiltinRenderer) Render(emails []jmap.Email, opts PDFOptions) ([]byte, error) {
+	name := strings.ToLower(opts.Font)
+	if name == "" {
+		name = "helvetica"
+	}
+	font, ok := pdfFonts[name]
+	if !ok {
+		return nil, fmt.Errorf("the builtin PDF renderer has no font %q (use helvetica, times or courier)", opts.Font)
+	}
+
+	l := &pdfLayout{paper: opts.paper(), m: opts.margins(), font: font, size: opts.fontSize(),
+		attachments: opts.attachments, appendix: opts.attachments.appendix(emails)}
+	exportDate := time.Now().Format("January 2, 2006 at 3:04 PM MST")
+	if opts.Cover {
+		l.cover(emails, exportDate)
+	}
+	l.threadHeader(emails, exportDate)
+	for i, email := range emails {
+		l.email(email, i, len(emails))
+	}
+	l.attachmentAppendix()
+	l.closing(exportDate)
+	if r.Strict && len(l.missing) > 0 {
+		return nil, missingCharsError(l.missing)
+	}
+	return l.document(emails[0].Subject), nil
+}
+
+// missingCharsError explains that Chrome is needed for characters the
+// built-in renderer can't show
+func missingCharsError(missing map[rune]bool) error {
+	chars := make([]rune, 0, len(missing))
+	for r := range missing {
+		chars = append(chars, r)
+	}
+	sort.Slice(chars, func(i, j int) bool { return chars[i] < chars[j] })
+	examples := make([]string, 0, 5)
+	for _, r := range chars[:min(len(chars), 5)] {
+		examples = append(examples, fmt.Sprintf("%q", r))
+	}
+	return fmt.Errorf("the builtin PDF renderer, used because Chrome is not installed, can't show %d of the characters in this thread (%s); install Chrome, or choose the builtin renderer explicitly to print them as ?",
+		len(chars), strings.Join(examples, ", "))
+}
+
+// pdfLayout flows text down pages. Positions are in points from the bottom
+// left of the page, as PDF has them.
+type pdfLayout struct {
+	paper   PageSize
+	m       Margins
+	font    *pdfFont
+	size    float64 // body text
+	pages   []*layoutPage
+	y       float64     // top of the next line
+	anchors []pdfAnchor // where each message starts
+	images  []*layoutImage
+
+	attachments *pdfAttachments
+	appendix    []pdfAppendixEntry
+	missing     map[rune]bool // characters set that the font can't show
+}
+
+// layoutImage is an image decoded to be embedded, as 8-bit RGB
+type layoutImage struct {
+	width, height int
+	rgb           []byte
+}
+
+// layoutPage is the content of one page and the links on it
+type layoutPage struct {
+	ops   strings.Builder
+	links []layoutLink
+}
+
+// layoutLink is an area of a page linking to where a message starts
+type layoutLink struct {
+	rect   [4]float64
+	target int
+}
+
+// pdfAnchor is a position in the document
+type pdfAnchor struct {
+	page int
+	y    float64
+}
+
+// lineHeight is the leading, as a multiple of the font size
+const lineHeight = 1.35
+
+// width is the width of the text area
+func (l *pdfLayout) width() float64 {
+	return l.paper.Width - l.m.Left - l.m.Right
+}
+
+func (l *pdfLayout) newPage() {
+	l.pages = append(l.pages, &layoutPage{})
+	l.y = l.paper.Height - l.m.Top
+}
+
+// page returns the page being filled
+func (l *pdfLayout) page() *layoutPage {
+	if len(l.pages) == 0 {
+		l.newPage()
+	}
+	return l.pages[len(l.pages)-1]
+}
+
+// need starts a new page unless h more points fit on this one
+func (l *pdfLayout) need(h float64) {
+	if len(l.pages) == 0 || l.y-h < l.m.Bottom {
+		l.newPage()
+	}
+}
+
+// line sets one line of text at x from the left margin, in a shade of gray
+// from 0 (black) to 1, and returns its baseline
+func (l *pdfLayout) line(s string, size, x, gray float64) float64 {
+	l.need(size * lineHeight)
+	baseline := l.y - size
+	for _, r := range s {
+		if _, ok := winAnsiByte(r); !ok {
+			if l.missing == nil {
+				l.missing = make(map[rune]bool)
+			}
+			l.missing[r] = true
+		}
+	}
+	if s != "" {
+		fmt.Fprintf(&l.page().ops, "%.2f g BT /F1 %.2f Tf %.2f %.2f Td %s Tj ET\n",
+			gray, size, l.m.Left+x, baseline, pdfString(s))
+	}
+	l.y -= size * lineHeight
+	return baseline
+}
+
+// paragraph sets text wrapped to the width left after indent
+func (l *pdfLayout) paragraph(s string, size, indent, gray float64) {
+	for _, line := range l.wrap(s, size, l.width()-2*indent) {
+		l.line(line, size, indent, gray)
+	}
+}
+
+// centered sets one line centered across the text area
+func (l *pdfLayout) centered(s string, size, gray float64) {
+	s = l.fit(s, size, l.width())
+	l.line(s, size, (l.width()-l.font.width(s, size))/2, gray)
+}
+
+// rule draws a horizontal line across the text area
+func (l *pdfLayout) rule(weight, gray float64) {
+	l.need(weight + 8)
+	y := l.y - 4
+	fmt.Fprintf(&l.page().ops, "%.2f G %.2f w %.2f %.2f m %.2f %.2f l S\n",
+		gray, weight, l.m.Left, y, l.m.Left+l.width(), y)
+	l.y -= weight + 8
+}
+
+// wrap breaks text into lines no wider than width, at spaces where it can
+// and within words too long for a line
+func (l *pdfLayout) wrap(s string, size, width float64) []string {
+	s = strings.NewReplacer("\r\n", "\n", "\r", "\n", "\t", "    ").Replace(s)
+	var lines []string
+	for _, para := range strings.Split(s, "\n") {
+		line := ""
+		for _, word := range strings.SplitAfter(strings.TrimRight(para, " "), " ") {
+			if l.font.width(strings.TrimRight(line+word, " "), size) <= width {
+				line += word
+				continue
+			}
+			if line != "" {
+				lines = append(lines, strings.TrimRight(line, " "))
+			}
+			for l.font.width(strings.TrimRight(word, " "), size) > width {
+				cut := l.fitRunes(word, size, width)
+				lines = append(lines, word[:cut])
+				word = word[cut:]
+			}
+			line = word
+		}
+		lines = append(lines, strings.TrimRight(line, " "))
+	}
+	return lines
+}
+
+// fitRunes returns the length in bytes of the longest start of s, at least
+// one character, no wider than width
+func (l *pdfLayout) fitRunes(s string, size, width float64) int {
+	end := 0
+	for i, r := range s {
+		next := i + len(string(r))
+		if end > 0 && l.font.width(s[:next], size) > width {
+			break
+		}
+		end = next
+	}
+	return end
+}
+
+// fit shortens s with an ellipsis to fit width
+func (l *pdfLayout) fit(s string, size, width float64) string {
+	if l.font.width(s, size) <= width {
+		return s
+	}
+	runes := []rune(s)
+	for len(runes) > 0 && l.font.width(string(runes)+"…", size) > width {
+		runes = runes[:len(runes)-1]
+	}
+	return string(runes) + "…"
+}
+
+// cover sets the cover page: the subject, and a table of contents with a
+// row linking to each message
+func (l *pdfLayout) cover(emails []jmap.Email, exportDate string) {
+	small := l.size * 9 / 11
+	l.newPage()
+	l.paragraph(emails[0].Subject, l.size*18/11, 0, 0)
+	l.line("Export Date: "+exportDate, small, 0, 0.4)
+	l.line(fmt.Sprintf("Total Emails: %d", len(emails)), small, 0, 0.4)
+	l.y -= l.size
+	l.line("Contents", l.size*12/11, 0, 0)
+
+	// Columns: number, date, sender, and the subject in what is left
+	cols := []float64{0, small * 3, small * 13}
+	cols = append(cols, cols[2]+(l.width()-cols[2])*0.4)
+	row := func(cells ...string) float64 {
+		l.need(small * lineHeight)
+		for i, cell := range cells {
+			end := l.width()
+			if i+1 < len(cols) {
+				end = cols[i+1] - small
+			}
+			cells[i] = l.fit(cell, small, end-cols[i])
+		}
+		var baseline float64
+		y := l.y
+		for i, cell := range cells {
+			l.y = y
+			baseline = l.line(cell, small, cols[i], 0)
+		}
+		return baseline
+	}
+	row("#", "Date", "From", "Subject")
+	l.rule(1, 0.2)
+	for i, email := range emails {
+		baseline := row(strconv.Itoa(i+1), formatShortDateForPDF(email.ReceivedAt), formatAddresses(email.From), email.Subject)
+		page := l.page()
+		page.links = append(page.links, layoutLink{
+			rect:   [4]float64{l.m.Left, baseline - small*0.3, l.m.Left + l.width(), baseline + small},
+			target: i,
+		})
+	}
+	l.newPage()
+}
+
+// threadHeader sets the title block of the export
+func (l *pdfLayout) threadHeader(emails []jmap.Email, exportDate string) {
+	small := l.size * 9 / 11
+	l.line("Email Thread Export", l.size*14/11, 0, 0)
+	l.line("Export Date: "+exportDate, small, 0, 0.4)
+	l.paragraph("Subject: "+emails[0].Subject, small, 0, 0.4)
+	l.line(fmt.Sprintf("Total Emails: %d", len(emails)), small, 0, 0.4)
+	l.rule(2, 0.2)
+	l.y -= l.size
+}
+
+// email sets one message: its headers in a shaded box, then its body
+func (l *pdfLayout) email(email jmap.Email, idx, total int) {
+	small, pad := l.size*10/11, l.size
+	label := small * 7
+
+	type headerRow struct {
+		label string
+		lines []string
+	}
+	rows := []headerRow{{lines: []string{fmt.Sprintf("Email %d of %d", idx+1, total)}}}
+	add := func(name, value string) {
+		if value != "" {
+			rows = append(rows, headerRow{name + ":", l.wrap(value, small, l.width()-2*pad-label)})
+		}
+	}
+	add("From", formatAddresses(email.From))
+	add("To", formatAddresses(email.To))
+	add("CC", formatAddresses(email.CC))
+	add("Date", formatDateForPDF(email.ReceivedAt))
+	add("Subject", email.Subject)
+	if len(email.MessageID) > 0 {
+		add("Message-ID", email.MessageID[0])
+	}
+	add("Attachments", attachmentList(l.appendix, idx))
+
+	lines := 0
+	for _, row := range rows {
+		lines += len(row.lines)
+	}
+	height := float64(lines)*small*lineHeight + 2*pad/2
+
+	// Keep the box together with the start of the body, if a page holds it
+	if full := l.paper.Height - l.m.Top - l.m.Bottom; height+3*l.size*lineHeight <= full {
+		l.need(height + 3*l.size*lineHeight)
+	} else {
+		l.need(small * lineHeight * 2)
+	}
+	l.anchors = append(l.anchors, pdfAnchor{len(l.pages) - 1, l.y})
+
+	if l.y-height >= l.m.Bottom {
+		fmt.Fprintf(&l.page().ops, "0.96 g 0.8 G 0.5 w %.2f %.2f %.2f %.2f re B\n",
+			l.m.Left, l.y-height, l.width(), height)
+	}
+	l.y -= pad / 2
+	for _, row := range rows {
+		if row.label != "" {
+			l.need(small * lineHeight)
+			y := l.y
+			l.line(row.label, small, pad, 0.33)
+			l.y = y
+		}
+		for _, line := range row.lines {
+			x := pad
+			if row.label != "" {
+				x += label
+			}
+			l.line(line, small, x, 0)
+		}
+	}
+	l.y -= pad / 2
+	l.y -= pad
+
+	l.paragraph(strings.TrimSpace(getCleanBody(email, ExportOptions{})), l.size, pad, 0)
+	_, images := l.attachments.body(email)
+	for _, img := range images {
+		l.y -= pad / 2
+		l.image(img, pad, l.width()-2*pad, l.paper.Height-l.m.Top-l.m.Bottom-pad, 1200)
+	}
+	l.y -= pad / 2
+	l.rule(0.5, 0.8)
+	l.y -= l.size
+}
+
+// attachmentAppendix lists the attachments not shown in a message, each
+// with its SHA-256 and a link to its message, and a thumbnail of images
+func (l *pdfLayout) attachmentAppendix() {
+	if len(l.appendix) == 0 {
+		return
+	}
+	small := l.size * 9 / 11
+	col := small * 4
+	l.newPage()
+	l.line("Attachments", l.size*14/11, 0, 0)
+	l.rule(2, 0.2)
+	for _, e := range l.appendix {
+		l.need(l.size*lineHeight + 2*small*lineHeight)
+		y := l.y
+		l.line(e.id, l.size, 0, 0)
+		l.y = y
+		for _, line := range l.wrap(e.att.Name, l.size, l.width()-col) {
+			l.line(line, l.size, col, 0)
+		}
+
+		detail := fmt.Sprintf("%s, %s, from Email %d", e.att.Type, formatSize(e.att.Size), e.email+1)
+		baseline := l.line(l.fit(detail, small, l.width()-col), small, col, 0.4)
+		page := l.page()
+		page.links = append(page.links, layoutLink{
+			rect:   [4]float64{l.m.Left + col, baseline - small*0.3, l.m.Left + col + l.font.width(detail, small), baseline + small},
+			target: e.email,
+		})
+
+		sum := e.sum
+		if sum == "" {
+			sum = "not downloaded"
+		}
+		for _, line := range l.wrap("SHA-256: "+sum, small, l.width()-col) {
+			l.line(line, small, col, 0.4)
+		}
+		if e.thumb != nil {
+			l.y -= small / 2
+			l.image(*e.thumb, col, 108, 108, 300)
+		}
+		l.y -= small / 2
+		l.rule(0.5, 0.8)
+	}
+}
+
+// image sets an image at x from the left margin, scaled down to fit within
+// maxW by maxH points, or a placeholder if it can't be shown. Images are
+// embedded at up to maxPx pixels on their longer side.
+func (l *pdfLayout) image(img pdfImage, x, maxW, maxH float64, maxPx int) {
+	var decoded *layoutImage
+	if img.data != nil {
+		decoded, _ = decodeLayoutImage(img.data, maxPx)
+	}
+	if decoded == nil {
+		l.line(l.fit("["+img.name+" not shown]", l.size*9/11, maxW), l.size*9/11, x, 0.6)
+		return
+	}
+
+	// Images are sized as a browser would show them, at 96 pixels an inch
+	w, h := float64(decoded.width)*0.75, float64(decoded.height)*0.75
+	if scale := min(maxW/w, maxH/h); scale < 1 {
+		w, h = w*scale, h*scale
+	}
+	l.need(h)
+	l.images = append(l.images, decoded)
+	fmt.Fprintf(&l.page().ops, "q %.2f 0 0 %.2f %.2f %.2f cm /Im%d Do Q\n",
+		w, h, l.m.Left+x, l.y-h, len(l.images))
+	l.y -= h
+}
+
+// decodeLayoutImage decodes a PNG, JPEG or GIF, shrinking it to maxPx pixels
+// on its longer side and flattening any transparency onto white
+func decodeLayoutImage(data []byte, maxPx int) (*layoutImage, error) {
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	b := src.Bounds()
+	if b.Empty() {
+		return nil, fmt.Errorf("empty image")
+	}
+	w, h := b.Dx(), b.Dy()
+	if long := max(w, h); long > maxPx {
+		w, h = max(w*maxPx/long, 1), max(h*maxPx/long, 1)
+	}
+
+	// Each pixel averages the block of source pixels it covers
+	out := &layoutImage{width: w, height: h, rgb: make([]byte, 0, w*h*3)}
+	for y := 0; y < h; y++ {
+		y0, y1 := b.Min.Y+y*b.Dy()/h, b.Min.Y+max((y+1)*b.Dy()/h, y*b.Dy()/h+1)
+		for x := 0; x < w; x++ {
+			x0, x1 := b.Min.X+x*b.Dx()/w, b.Min.X+max((x+1)*b.Dx()/w, x*b.Dx()/w+1)
+			var r, g, bl, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					white := 0xffff - uint64(ca)
+					r += uint64(cr) + white
+					g += uint64(cg) + white
+					bl += uint64(cb) + white
+					n++
+				}
+			}
+			out.rgb = append(out.rgb, byte(r/n>>8), byte(g/n>>8), byte(bl/n>>8))
+		}
+	}
+	return out, nil
+}
+
+// closing sets the note at the end of the export
+func (l *pdfLayout) closing(exportDate string) {
+	small := l.size * 8 / 11
+	l.y -= l.size
+	l.rule(0.5, 0.8)
+	l.centered("This document was exported from Fastmail on "+exportDate, small, 0.6)
+	l.centered("Generated by fastmail-agent", small, 0.6)
+}
+
+// document assembles the pages into a PDF
+func (l *pdfLayout) document(title string) []byte {
+	w := &pdfWriter{}
+	catalog, pages := w.reserve(), w.reserve()
+	font := w.add(pdfDictOf("Type", pdfName("Font"), "Subtype", pdfName("Type1"),
+		"BaseFont", pdfName(l.font.name), "Encoding", pdfName("WinAnsiEncoding")))
+	resources := pdfDictOf("Font", pdfDictOf("F1", font))
+	if len(l.images) > 0 {
+		xobjects := newPDFDict()
+		for i, img := range l.images {
+			xobjects.set(pdfName(fmt.Sprintf("Im%d", i+1)), w.addImage(img))
+		}
+		resources.set("XObject", xobjects)
+	}
+	res := w.add(resources)
+
+	refs := make(pdfArray, len(l.pages))
+	for i := range l.pages {
+		refs[i] = w.reserve()
+	}
+	for i, p := range l.pages {
+		page := pdfDictOf("Type", pdfName("Page"), "Parent", pages,
+			"MediaBox", pdfArray{pdfNum(0), pdfNum(0), pdfNum(l.paper.Width), pdfNum(l.paper.Height)},
+			"Resources", res,
+			"Contents", w.addStream([]byte(p.ops.String())))
+		if len(p.links) > 0 {
+			annots := pdfArray{}
+			for _, link := range p.links {
+				to := l.anchors[link.target]
+				annots = append(annots, w.add(pdfDictOf("Type", pdfName("Annot"), "Subtype", pdfName("Link"),
+					"Rect", pdfArray{pdfNum(link.rect[0]), pdfNum(link.rect[1]), pdfNum(link.rect[2]), pdfNum(link.rect[3])},
+					"Border", pdfArray{pdfNum(0), pdfNum(0), pdfNum(0)},
+					"Dest", pdfArray{refs[to.page], pdfName("XYZ"), pdfRaw("null"), pdfNum(to.y), pdfRaw("null")})))
+			}
+			page.set("Annots", annots)
+		}
+		w.set(refs[i].(pdfRef), page)
+	}
+	w.set(pages, pdfDictOf("Type", pdfName("Pages"), "Kids", refs, "Count", pdfNum(float64(len(l.pages)))))
+	w.set(catalog, pdfDictOf("Type", pdfName("Catalog"), "Pages", pages))
+	info := w.add(pdfDictOf("Title", pdfRaw(pdfString(title)), "Producer", pdfRaw(pdfString("fastmail-agent")),
+		"CreationDate", pdfRaw(pdfString(time.Now().Format("D:20060102150405")))))
+	return w.bytes(catalog, info)
+}
+
+// pdfNum formats a number to two decimal places at most
+func pdfNum(f float64) pdfRaw {
+	return pdfRaw(strconv.FormatFloat(math.Round(f*100)/100, 'f', -1, 64))
+}
+
+// pdfWriter assembles a new PDF, numbering objects as they are added
+type pdfWriter struct {
+	objects [][]byte // object i+1, serialized
+}
+
+// reserve numbers an object to be set later, so others can refer to it
+func (w *pdfWriter) reserve() pdfRef {
+	w.objects = append(w.objects, nil)
+	return pdfRef{len(w.objects), 0}
+}
+
+func (w *pdfWriter) set(ref pdfRef, v pdfValue) {
+	var sb strings.Builder
+	writePDFValue(&sb, v)
+	w.objects[ref.num-1] = []byte(sb.String())
+}
+
+func (w *pdfWriter) add(v pdfValue) pdfRef {
+	ref := w.reserve()
+	w.set(ref, v)
+	return ref
+}
+
+// addStream adds a compressed stream
+func (w *pdfWriter) addStream(data []byte) pdfRef {
+	return w.addCompressed(newPDFDict(), data)
+}
+
+// addImage adds an image XObject
+func (w *pdfWriter) addImage(img *layoutImage) pdfRef {
+	return w.addCompressed(pdfDictOf("Type", pdfName("XObject"), "Subtype", pdfName("Image"),
+		"Width", pdfNum(float64(img.width)), "Height", pdfNum(float64(img.height)),
+		"ColorSpace", pdfName("DeviceRGB"), "BitsPerComponent", pdfNum(8)), img.rgb)
+}
+
+// addCompressed adds a stream with dict, compressing data
+func (w *pdfWriter) addCompressed(dict *pdfDict, data []byte) pdfRef {
+	var z bytes.Buffer
+	zw := zlib.NewWriter(&z)
+	zw.Write(data)
+	zw.Close()
+
+	dict.set("Length", pdfNum(float64(z.Len())))
+	dict.set("Filter", pdfName("FlateDecode"))
+	var sb strings.Builder
+	writePDFValue(&sb, dict)
+	ref := w.reserve()
+	w.objects[ref.num-1] = fmt.Appendf(nil, "%s\nstream\n%s\nendstream", sb.String(), z.Bytes())
+	return ref
+}
+
+// bytes writes out the PDF
+func (w *pdfWriter) bytes(root, info pdfRef) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	offsets := make([]int, len(w.objects))
+	for i, obj := range w.objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n", i+1)
+		buf.Write(obj)
+		buf.WriteString("\nendobj\n")
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(w.objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&buf, "trailer\n<</Size %d /Root %d 0 R /Info %d 0 R>>\nstartxref\n%d\n%%%%EOF\n",
+		len(w.objects)+1, root.num, info.num, xref)
+	return buf.Bytes()
+}
@@ -0,0 +1,97 @@
+package export
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stevemurr/fastmail-agent/jmap"
+)
+
+func TestBuiltinRender(t *testing.T) {
+	data, err := BuiltinRenderer{}.Render(longThread(5), PDFOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte("%PDF-")) {
+		t.Fatalf("output starts %q", data[:min(len(data), 8)])
+	}
+	pages, err := PDFPageCount(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pages < 2 {
+		t.Fatalf("rendered %d pages, want several", pages)
+	}
+
+	// The renderer's output can be stamped like any other PDF
+	stamped, n, err := StampPDF(data, PDFOptions{BatesPrefix: "ACME"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, last := (PDFOptions{BatesPrefix: "ACME"}).BatesRange(n); n != pages || !bytes.Contains(stamped, []byte(last)) {
+		t.Errorf("stamped %d of %d pages", n, pages)
+	}
+
+	// A smaller page holds less, so the same thread takes more pages
+	a4, err := ParsePageSize("a4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	margins, err := ParseMargins("2in")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = BuiltinRenderer{}.Render(longThread(5), PDFOptions{Paper: a4, Margins: margins})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if more, err := PDFPageCount(data); err != nil || more <= pages {
+		t.Errorf("with 2in margins: %d pages (%v), want more than %d", more, err, pages)
+	}
+}
+
+func TestBuiltinRenderStrict(t *testing.T) {
+	emails := longThread(1)
+	emails[0].BodyValues = map[string]jmap.BodyValue{"1": {Value: "Prices in € and ¥, or 円"}}
+
+	if _, err := (BuiltinRenderer{}).Render(emails, PDFOptions{}); err != nil {
+		t.Fatalf("render without Strict: %v", err)
+	}
+	_, err := BuiltinRenderer{Strict: true}.Render(emails, PDFOptions{})
+	if err == nil || !strings.Contains(err.Error(), "'円'") {
+		t.Errorf("strict render = %v, want it to fail on 円", err)
+	}
+
+	// Text the fonts cover renders either way
+	emails[0].BodyValues["1"] = jmap.BodyValue{Value: "Prices in € and ¥"}
+	if _, err := (BuiltinRenderer{Strict: true}).Render(emails, PDFOptions{}); err != nil {
+		t.Errorf("strict render of Western text: %v", err)
+	}
+}
+
+func TestParseMargins(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Margins
+	}{
+		{"1", Margins{72, 72, 72, 72}},
+		{"1in 36pt", Margins{72, 36, 72, 36}},
+		{"0.5in, 1in, 2in", Margins{36, 72, 144, 72}},
+		{"1 2 3 4", Margins{72, 144, 216, 288}},
+	}
+	for _, tt := range tests {
+		got, err := ParseMargins(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseMargins(%q) = %+v, %v; want %+v", tt.in, got, err, tt.want)
+		}
+	}
+	for _, in := range []string{"", "1 2 3 4 5", "1furlong"} {
+		if _, err := ParseMargins(in); err == nil {
+			t.Errorf("ParseMargins(%q) succeeded", in)
+		}
+	}
+	if _, err := ParsePageSize("tabloid"); err == nil {
+		t.Error("ParsePageSize accepted an unknown size")
+	}
+}
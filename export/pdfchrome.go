@@ -0,0 +1,102 @@
+package export
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/chromedp/cdproto/page"
+	"github.com/chromedp/chromedp"
+
+	"github.com/stevemurr/fastmail-agent/jmap"
+)
+
+// ChromeRenderer prints the HTML layout with a local Chrome or Chromium,
+// through chromedp. HTML bodies keep their formatting, so it is the high
+// fidelity choice where a browser is installed.
+type ChromeRenderer struct{}
+
+func (ChromeRenderer) Name() string { return "chrome" }
+
+func (ChromeRenderer) Render(emails []jmap.Email, opts PDFOptions) ([]byte, error) {
+	content, err := pdfHTML(emails, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Use chromedp to render PDF
+	ctx, cancel := chromedp.NewContext(context.Background())
+	defer cancel()
+
+	// Set timeout
+	ctx, cancel = context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	// Chrome takes sizes in inches
+	paper, m := opts.paper(), opts.margins()
+	var pdfBuf []byte
+	if err := chromedp.Run(ctx,
+		chromedp.Navigate("about:blank"),
+		chromedp.ActionFunc(func(ctx context.Context) error {
+			frameTree, err := page.GetFrameTree().Do(ctx)
+			if err != nil {
+				return err
+			}
+			return page.SetDocumentContent(frameTree.Frame.ID, content).Do(ctx)
+		}),
+		chromedp.ActionFunc(func(ctx context.Context) error {
+			var err error
+			pdfBuf, _, err = page.PrintToPDF().
+				WithPrintBackground(true).
+				WithMarginTop(m.Top / 72).
+				WithMarginBottom(m.Bottom / 72).
+				WithMarginLeft(m.Left / 72).
+				WithMarginRight(m.Right / 72).
+				WithPaperWidth(paper.Width / 72).
+				WithPaperHeight(paper.Height / 72).
+				Do(ctx)
+			return err
+		}),
+	); err != nil {
+		return nil, fmt.Errorf("failed to generate PDF: %w", err)
+	}
+	return pdfBuf, nil
+}
+
+// ChromeAvailable reports whether chromedp can find a Chrome or Chromium to
+// run, looking where it does
+func ChromeAvailable() bool {
+	var locations []string
+	switch runtime.GOOS {
+	case "darwin":
+		locations = []string{
+			"/Applications/Chromium.app/Contents/MacOS/Chromium",
+			"/Applications/Google Chrome.app/Contents/MacOS/Google Chrome",
+		}
+	case "windows":
+		locations = []string{
+			"chrome",
+			"chrome.exe",
+			`C:\Program Files (x86)\Google\Chrome\Application\chrome.exe`,
+			`C:\Program Files\Google\Chrome\Application\chrome.exe`,
+			filepath.Join(os.Getenv("USERPROFILE"), `AppData\Local\Google\Chrome\Application\chrome.exe`),
+			filepath.Join(os.Getenv("USERPROFILE"), `AppData\Local\Chromium\Application\chrome.exe`),
+		}
+	default:
+		locations = []string{
+			"headless_shell", "headless-shell", "chromium", "chromium-browser",
+			"google-chrome", "google-chrome-stable", "google-chrome-beta", "google-chrome-unstable",
+			"/usr/bin/google-chrome", "/usr/local/bin/chrome", "/snap/bin/chromium", "chrome",
+		}
+	}
+	for _, path := range locations {
+		if _, err := exec.LookPath(path); err == nil {
+			return true
+		}
+	}
+	return false
+}
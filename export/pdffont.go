@@ -0,0 +1,127 @@
+package export
+
+import (
+	"fmt"
+	"strings"
+)
+
+// helveticaWidths are the advance widths of Helvetica, one of the standard
+// fonts every PDF reader has, in thousandths of the font size, for the
+// printable ASCII codes 32 to 126
+var helveticaWidths = [95]int{
+	278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278, // space to /
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556, // 0 to ?
+	1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778, // @ to O
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556, // P to _
+	333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556, // ` to o
+	556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584, // p to ~
+}
+
+// timesWidths are the widths of Times-Roman, as helveticaWidths
+var timesWidths = [95]int{
+	250, 333, 408, 500, 500, 833, 778, 180, 333, 333, 500, 564, 250, 333, 250, 278, // space to /
+	500, 500, 500, 500, 500, 500, 500, 500, 500, 500, 278, 278, 564, 564, 564, 444, // 0 to ?
+	921, 722, 667, 667, 722, 611, 556, 722, 722, 333, 389, 722, 611, 889, 722, 722, // @ to O
+	556, 722, 667, 556, 611, 722, 722, 944, 722, 722, 611, 333, 278, 333, 469, 500, // P to _
+	333, 444, 500, 444, 500, 444, 333, 500, 500, 278, 278, 500, 278, 778, 500, 500, // ` to o
+	500, 500, 333, 389, 278, 500, 500, 722, 500, 500, 444, 480, 200, 480, 541, // p to ~
+}
+
+// pdfFont is one of the standard PDF fonts, which every reader provides, so
+// nothing has to be embedded. They cover WinAnsi (Western European) text.
+type pdfFont struct {
+	name   string       // BaseFont
+	widths *[95]int     // for ASCII 32 to 126; nil for a fixed-width font
+	other  int          // width of everything else
+	wide   map[byte]int // widths above ASCII that differ from other
+}
+
+// pdfFonts are the font families the built-in renderer can set text in
+var pdfFonts = map[string]*pdfFont{
+	"helvetica": {name: "Helvetica", widths: &helveticaWidths, other: 556, wide: helveticaWideWidths},
+	"times":     {name: "Times-Roman", widths: &timesWidths, other: 500},
+	"courier":   {name: "Courier", other: 600},
+}
+
+// width returns the width of s set in f at size points
+func (f *pdfFont) width(s string, size float64) float64 {
+	total := 0
+	for _, b := range winAnsi(s) {
+		switch {
+		case f.widths != nil && b >= 32 && b <= 126:
+			total += f.widths[b-32]
+		case f.wide[b] > 0:
+			total += f.wide[b]
+		default:
+			total += f.other
+		}
+	}
+	return float64(total) * size / 1000
+}
+
+// helveticaWideWidths are the WinAnsi codes above ASCII whose widths differ
+// much from a typical letter's
+var helveticaWideWidths = map[byte]int{
+	0x85: 1000, 0x89: 1000, 0x91: 222, 0x92: 222, 0x93: 333, 0x94: 333, 0x95: 350,
+	0x97: 1000, 0x99: 1000, 0xA0: 278, 0xA9: 737, 0xAE: 737, 0xB0: 400, 0xB6: 537,
+}
+
+// winAnsiSpecials are the characters WinAnsiEncoding places at 0x80 to 0x9F;
+// from 0xA0 it matches Latin-1
+var winAnsiSpecials = map[rune]byte{
+	'€': 0x80, '‚': 0x82, 'ƒ': 0x83, '„': 0x84, '…': 0x85, '†': 0x86, '‡': 0x87,
+	'ˆ': 0x88, '‰': 0x89, 'Š': 0x8A, '‹': 0x8B, 'Œ': 0x8C, 'Ž': 0x8E, '‘': 0x91,
+	'’': 0x92, '“': 0x93, '”': 0x94, '•': 0x95, '–': 0x96, '—': 0x97, '˜': 0x98,
+	'™': 0x99, 'š': 0x9A, '›': 0x9B, 'œ': 0x9C, 'ž': 0x9E, 'Ÿ': 0x9F,
+}
+
+// winAnsi encodes s for a standard font, replacing characters it cannot
+// show with ?
+func winAnsi(s string) []byte {
+	out := make([]byte, 0, len(s))
+	for _, r := range s {
+		b, ok := winAnsiByte(r)
+		if !ok {
+			b = '?'
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// winAnsiByte encodes one character for a standard font, reporting false if
+// it has no code there
+func winAnsiByte(r rune) (byte, bool) {
+	switch {
+	case r == '\t':
+		return ' ', true
+	case r >= 0x20 && r < 0x7F, r >= 0xA0 && r <= 0xFF:
+		return byte(r), true
+	}
+	b, ok := winAnsiSpecials[r]
+	return b, ok
+}
+
+// textWidth returns the width of s set in Helvetica at size points
+func textWidth(s string, size float64) float64 {
+	return pdfFonts["helvetica"].width(s, size)
+}
+
+// pdfString formats s as a PDF literal string in WinAnsi
+func pdfString(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('(')
+	for _, b := range winAnsi(s) {
+		switch {
+		case b == '(' || b == ')' || b == '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(b)
+		case b >= 0x80:
+			fmt.Fprintf(&sb, "\\%03o", b)
+		default:
+			sb.WriteByte(b)
+		}
+	}
+	sb.WriteByte(')')
+	return sb.String()
+}
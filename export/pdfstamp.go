@@ -0,0 +1,673 @@
+package export
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Page furniture is stamped onto a finished PDF as an incremental update:
+// the original bytes are kept, and each page is rewritten to draw one more
+// content stream after its own. Only what that needs is read: the
+// cross-reference table, the page tree and the pages' resources.
+
+// pdfValue is a parsed PDF object: a pdfName, pdfRef, pdfArray, *pdfDict, or
+// a pdfRaw for anything that is copied through as written
+type pdfValue interface{}
+
+type (
+	pdfName  string // without the leading /
+	pdfRaw   string // a number, string, boolean or null, as written
+	pdfArray []pdfValue
+)
+
+// pdfRef is an indirect reference, n g R
+type pdfRef struct{ num, gen int }
+
+// pdfDict is a dictionary that keeps its keys in order
+type pdfDict struct {
+	keys []pdfName
+	vals map[pdfName]pdfValue
+}
+
+func newPDFDict() *pdfDict {
+	return &pdfDict{vals: make(map[pdfName]pdfValue)}
+}
+
+func (d *pdfDict) get(key pdfName) pdfValue {
+	return d.vals[key]
+}
+
+func (d *pdfDict) set(key pdfName, v pdfValue) {
+	if _, ok := d.vals[key]; !ok {
+		d.keys = append(d.keys, key)
+	}
+	d.vals[key] = v
+}
+
+// clone copies the dictionary; its values are shared
+func (d *pdfDict) clone() *pdfDict {
+	c := newPDFDict()
+	for _, k := range d.keys {
+		c.set(k, d.vals[k])
+	}
+	return c
+}
+
+// writePDFValue serializes v
+func writePDFValue(sb *strings.Builder, v pdfValue) {
+	switch v := v.(type) {
+	case pdfName:
+		sb.WriteString("/" + string(v))
+	case pdfRaw:
+		sb.WriteString(string(v))
+	case pdfRef:
+		fmt.Fprintf(sb, "%d %d R", v.num, v.gen)
+	case pdfArray:
+		sb.WriteByte('[')
+		for i, e := range v {
+			if i > 0 {
+				sb.WriteByte(' ')
+			}
+			writePDFValue(sb, e)
+		}
+		sb.WriteByte(']')
+	case *pdfDict:
+		sb.WriteString("<<")
+		for i, k := range v.keys {
+			if i > 0 {
+				sb.WriteByte(' ')
+			}
+			sb.WriteString("/" + string(k) + " ")
+			writePDFValue(sb, v.vals[k])
+		}
+		sb.WriteString(">>")
+	default:
+		sb.WriteString("null")
+	}
+}
+
+// pdfParser reads PDF objects from data
+type pdfParser struct {
+	data []byte
+	pos  int
+}
+
+func isPDFSpace(c byte) bool {
+	return c == 0 || c == '\t' || c == '\n' || c == '\f' || c == '\r' || c == ' '
+}
+
+func isPDFDelimiter(c byte) bool {
+	return strings.IndexByte("()<>[]{}/%", c) >= 0
+}
+
+// skipSpace skips whitespace and comments
+func (p *pdfParser) skipSpace() {
+	for p.pos < len(p.data) {
+		switch c := p.data[p.pos]; {
+		case isPDFSpace(c):
+			p.pos++
+		case c == '%':
+			for p.pos < len(p.data) && p.data[p.pos] != '\n' && p.data[p.pos] != '\r' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// token reads a run of regular characters: a number or a keyword
+func (p *pdfParser) token() string {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.data) && !isPDFSpace(p.data[p.pos]) && !isPDFDelimiter(p.data[p.pos]) {
+		p.pos++
+	}
+	return string(p.data[start:p.pos])
+}
+
+// int reads an integer token
+func (p *pdfParser) int() (int, error) {
+	tok := p.token()
+	n, err := strconv.Atoi(tok)
+	if err != nil {
+		return 0, fmt.Errorf("expected an integer at offset %d, found %q", p.pos, tok)
+	}
+	return n, nil
+}
+
+// value reads one object
+func (p *pdfParser) value() (pdfValue, error) {
+	p.skipSpace()
+	if p.pos >= len(p.data) {
+		return nil, errors.New("unexpected end of PDF")
+	}
+	switch c := p.data[p.pos]; {
+	case c == '/':
+		p.pos++
+		start := p.pos
+		for p.pos < len(p.data) && !isPDFSpace(p.data[p.pos]) && !isPDFDelimiter(p.data[p.pos]) {
+			p.pos++
+		}
+		return pdfName(p.data[start:p.pos]), nil
+
+	case c == '[':
+		p.pos++
+		arr := pdfArray{}
+		for {
+			p.skipSpace()
+			if p.pos < len(p.data) && p.data[p.pos] == ']' {
+				p.pos++
+				return arr, nil
+			}
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+
+	case c == '<' && p.pos+1 < len(p.data) && p.data[p.pos+1] == '<':
+		p.pos += 2
+		dict := newPDFDict()
+		for {
+			p.skipSpace()
+			if bytes.HasPrefix(p.data[p.pos:], []byte(">>")) {
+				p.pos += 2
+				return dict, nil
+			}
+			key, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			name, ok := key.(pdfName)
+			if !ok {
+				return nil, fmt.Errorf("dictionary key at offset %d is not a name", p.pos)
+			}
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			dict.set(name, v)
+		}
+
+	case c == '<':
+		end := bytes.IndexByte(p.data[p.pos:], '>')
+		if end < 0 {
+			return nil, errors.New("unterminated hex string")
+		}
+		raw := p.data[p.pos : p.pos+end+1]
+		p.pos += end + 1
+		return pdfRaw(raw), nil
+
+	case c == '(':
+		start, depth := p.pos, 0
+		for ; p.pos < len(p.data); p.pos++ {
+			switch p.data[p.pos] {
+			case '\\':
+				p.pos++
+			case '(':
+				depth++
+			case ')':
+				depth--
+				if depth == 0 {
+					p.pos++
+					return pdfRaw(p.data[start:p.pos]), nil
+				}
+			}
+		}
+		return nil, errors.New("unterminated string")
+	}
+
+	tok := p.token()
+	if tok == "" {
+		return nil, fmt.Errorf("unexpected %q at offset %d", p.data[p.pos], p.pos)
+	}
+	// An integer may start a reference: n g R
+	if num, err := strconv.Atoi(tok); err == nil {
+		save := p.pos
+		if gen, err := strconv.Atoi(p.token()); err == nil && p.token() == "R" {
+			return pdfRef{num, gen}, nil
+		}
+		p.pos = save
+	}
+	return pdfRaw(tok), nil
+}
+
+// pdfFile is a parsed PDF: where its objects are and its trailer
+type pdfFile struct {
+	data      []byte
+	offsets   map[int]int // object number to offset; -1 when free
+	trailer   *pdfDict
+	startxref int
+}
+
+// parsePDF reads the cross-reference tables of data. Files that keep them
+// in cross-reference streams are not supported.
+func parsePDF(data []byte) (*pdfFile, error) {
+	i := bytes.LastIndex(data, []byte("startxref"))
+	if i < 0 {
+		return nil, errors.New("not a PDF: no startxref")
+	}
+	p := &pdfParser{data: data, pos: i + len("startxref")}
+	start, err := p.int()
+	if err != nil {
+		return nil, err
+	}
+
+	f := &pdfFile{data: data, offsets: make(map[int]int), startxref: start}
+	for off, n := start, 0; ; n++ {
+		if n > 1000 || off < 0 || off >= len(data) {
+			return nil, errors.New("broken cross-reference chain")
+		}
+		prev, err := f.readXref(off)
+		if err != nil {
+			return nil, err
+		}
+		if prev < 0 {
+			break
+		}
+		off = prev
+	}
+	if f.trailer == nil || f.trailer.get("Root") == nil {
+		return nil, errors.New("PDF trailer has no Root")
+	}
+	return f, nil
+}
+
+// readXref reads the cross-reference section at off and returns the offset
+// of the one before it, or -1. Later sections are read first, so an object
+// already listed is left alone.
+func (f *pdfFile) readXref(off int) (int, error) {
+	p := &pdfParser{data: f.data, pos: off}
+	if p.token() != "xref" {
+		return 0, errors.New("PDFs with cross-reference streams are not supported")
+	}
+	for {
+		save := p.pos
+		if p.token() == "trailer" {
+			break
+		}
+		p.pos = save
+		first, err := p.int()
+		if err != nil {
+			return 0, err
+		}
+		count, err := p.int()
+		if err != nil {
+			return 0, err
+		}
+		for num := first; num < first+count; num++ {
+			offset, err := p.int()
+			if err != nil {
+				return 0, err
+			}
+			if _, err := p.int(); err != nil {
+				return 0, err
+			}
+			kind := p.token()
+			if _, seen := f.offsets[num]; seen {
+				continue
+			}
+			if kind == "n" {
+				f.offsets[num] = offset
+			} else {
+				f.offsets[num] = -1
+			}
+		}
+	}
+
+	v, err := p.value()
+	if err != nil {
+		return 0, err
+	}
+	trailer, ok := v.(*pdfDict)
+	if !ok {
+		return 0, errors.New("PDF trailer is not a dictionary")
+	}
+	if f.trailer == nil {
+		f.trailer = trailer
+	}
+	if prev, ok := trailer.get("Prev").(pdfRaw); ok {
+		return strconv.Atoi(string(prev))
+	}
+	return -1, nil
+}
+
+// object reads the object numbered num
+func (f *pdfFile) object(num int) (pdfValue, error) {
+	off, ok := f.offsets[num]
+	if !ok || off < 0 || off >= len(f.data) {
+		return nil, fmt.Errorf("PDF object %d not found", num)
+	}
+	p := &pdfParser{data: f.data, pos: off}
+	if n, err := p.int(); err != nil || n != num {
+		return nil, fmt.Errorf("PDF object %d is not at its offset", num)
+	}
+	if _, err := p.int(); err != nil {
+		return nil, err
+	}
+	if p.token() != "obj" {
+		return nil, fmt.Errorf("PDF object %d is malformed", num)
+	}
+	return p.value()
+}
+
+// resolve follows v if it is a reference
+func (f *pdfFile) resolve(v pdfValue) (pdfValue, error) {
+	if ref, ok := v.(pdfRef); ok {
+		return f.object(ref.num)
+	}
+	return v, nil
+}
+
+// dict resolves v to a dictionary, or nil if it is absent
+func (f *pdfFile) dict(v pdfValue) (*pdfDict, error) {
+	if v == nil {
+		return nil, nil
+	}
+	v, err := f.resolve(v)
+	if err != nil {
+		return nil, err
+	}
+	d, ok := v.(*pdfDict)
+	if !ok {
+		return nil, errors.New("expected a PDF dictionary")
+	}
+	return d, nil
+}
+
+// pdfPage is a page and what it inherits from the page tree
+type pdfPage struct {
+	ref       pdfRef
+	dict      *pdfDict
+	resources pdfValue
+	box       [4]float64 // visible area: left, bottom, right, top
+}
+
+// pages lists the pages in order
+func (f *pdfFile) pages() ([]pdfPage, error) {
+	root, err := f.dict(f.trailer.get("Root"))
+	if err != nil {
+		return nil, err
+	}
+	ref, ok := root.get("Pages").(pdfRef)
+	if !ok {
+		return nil, errors.New("PDF has no page tree")
+	}
+	var pages []pdfPage
+	if err := f.walkPages(ref, map[pdfName]pdfValue{}, &pages, 0); err != nil {
+		return nil, err
+	}
+	return pages, nil
+}
+
+// inheritable are the page attributes a page takes from its ancestors
+var inheritable = []pdfName{"Resources", "MediaBox", "CropBox"}
+
+func (f *pdfFile) walkPages(ref pdfRef, inherited map[pdfName]pdfValue, pages *[]pdfPage, depth int) error {
+	if depth > 64 {
+		return errors.New("PDF page tree is too deep")
+	}
+	node, err := f.dict(ref)
+	if err != nil {
+		return err
+	}
+	attrs := make(map[pdfName]pdfValue, len(inheritable))
+	for _, k := range inheritable {
+		attrs[k] = inherited[k]
+		if v := node.get(k); v != nil {
+			attrs[k] = v
+		}
+	}
+
+	if node.get("Type") == pdfName("Pages") {
+		kids, err := f.resolve(node.get("Kids"))
+		if err != nil {
+			return err
+		}
+		arr, _ := kids.(pdfArray)
+		for _, kid := range arr {
+			kidRef, ok := kid.(pdfRef)
+			if !ok {
+				return errors.New("PDF page tree kid is not a reference")
+			}
+			if err := f.walkPages(kidRef, attrs, pages, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	box := attrs["CropBox"]
+	if box == nil {
+		box = attrs["MediaBox"]
+	}
+	rect, err := f.rect(box)
+	if err != nil {
+		return fmt.Errorf("page %d: %w", len(*pages)+1, err)
+	}
+	*pages = append(*pages, pdfPage{ref: ref, dict: node, resources: attrs["Resources"], box: rect})
+	return nil
+}
+
+// rect reads a rectangle, normalized to left, bottom, right, top
+func (f *pdfFile) rect(v pdfValue) ([4]float64, error) {
+	var r [4]float64
+	v, err := f.resolve(v)
+	if err != nil {
+		return r, err
+	}
+	arr, ok := v.(pdfArray)
+	if !ok || len(arr) != 4 {
+		return r, errors.New("PDF page has no size")
+	}
+	for i, e := range arr {
+		if e, err = f.resolve(e); err != nil {
+			return r, err
+		}
+		raw, _ := e.(pdfRaw)
+		if r[i], err = strconv.ParseFloat(string(raw), 64); err != nil {
+			return r, errors.New("PDF page size is not a number")
+		}
+	}
+	if r[0] > r[2] {
+		r[0], r[2] = r[2], r[0]
+	}
+	if r[1] > r[3] {
+		r[1], r[3] = r[3], r[1]
+	}
+	return r, nil
+}
+
+// pdfUpdate appends objects to a PDF as an incremental update
+type pdfUpdate struct {
+	f       *pdfFile
+	buf     bytes.Buffer
+	next    int            // next free object number
+	written map[int][2]int // object number to offset and generation
+}
+
+func newPDFUpdate(f *pdfFile) (*pdfUpdate, error) {
+	size, ok := f.trailer.get("Size").(pdfRaw)
+	if !ok {
+		return nil, errors.New("PDF trailer has no Size")
+	}
+	next, err := strconv.Atoi(string(size))
+	if err != nil {
+		return nil, err
+	}
+	u := &pdfUpdate{f: f, next: next, written: make(map[int][2]int)}
+	u.buf.Write(f.data)
+	if !bytes.HasSuffix(f.data, []byte("\n")) {
+		u.buf.WriteByte('\n')
+	}
+	return u, nil
+}
+
+// add writes a new object and returns a reference to it
+func (u *pdfUpdate) add(v pdfValue) pdfRef {
+	ref := pdfRef{u.next, 0}
+	u.next++
+	u.replace(ref, v)
+	return ref
+}
+
+// addStream writes a new stream object
+func (u *pdfUpdate) addStream(content string) pdfRef {
+	ref := pdfRef{u.next, 0}
+	u.next++
+	u.written[ref.num] = [2]int{u.buf.Len(), 0}
+	fmt.Fprintf(&u.buf, "%d 0 obj\n<</Length %d>>\nstream\n%s\nendstream\nendobj\n", ref.num, len(content), content)
+	return ref
+}
+
+// replace writes a new version of the object ref
+func (u *pdfUpdate) replace(ref pdfRef, v pdfValue) {
+	var sb strings.Builder
+	writePDFValue(&sb, v)
+	u.written[ref.num] = [2]int{u.buf.Len(), ref.gen}
+	fmt.Fprintf(&u.buf, "%d %d obj\n%s\nendobj\n", ref.num, ref.gen, sb.String())
+}
+
+// finish writes the cross-reference section and trailer of the update
+func (u *pdfUpdate) finish() []byte {
+	nums := make([]int, 0, len(u.written))
+	for num := range u.written {
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+
+	xref := u.buf.Len()
+	u.buf.WriteString("xref\n")
+	for i := 0; i < len(nums); {
+		j := i
+		for j+1 < len(nums) && nums[j+1] == nums[j]+1 {
+			j++
+		}
+		fmt.Fprintf(&u.buf, "%d %d\n", nums[i], j-i+1)
+		for _, num := range nums[i : j+1] {
+			fmt.Fprintf(&u.buf, "%010d %05d n \n", u.written[num][0], u.written[num][1])
+		}
+		i = j + 1
+	}
+
+	trailer := newPDFDict()
+	trailer.set("Size", pdfRaw(strconv.Itoa(u.next)))
+	for _, k := range []pdfName{"Root", "Info", "ID"} {
+		if v := u.f.trailer.get(k); v != nil {
+			trailer.set(k, v)
+		}
+	}
+	trailer.set("Prev", pdfRaw(strconv.Itoa(u.f.startxref)))
+	var sb strings.Builder
+	writePDFValue(&sb, trailer)
+	fmt.Fprintf(&u.buf, "trailer\n%s\nstartxref\n%d\n%%%%EOF\n", sb.String(), xref)
+	return u.buf.Bytes()
+}
+
+// PDFPageCount returns the number of pages in a PDF
+func PDFPageCount(data []byte) (int, error) {
+	f, err := parsePDF(data)
+	if err != nil {
+		return 0, err
+	}
+	pages, err := f.pages()
+	return len(pages), err
+}
+
+// StampPDF draws opts' page furniture (header, footer, Bates number and
+// exhibit label) onto every page of a PDF, and returns the stamped PDF and
+// its number of pages. The original content is left byte for byte as it
+// was; the stamps are appended as an incremental update. With nothing to
+// stamp, a PDF that can't be parsed, such as one with cross-reference
+// streams, is returned as it is with 0 for its unknown page count.
+func StampPDF(data []byte, opts PDFOptions) ([]byte, int, error) {
+	f, err := parsePDF(data)
+	if err != nil && !opts.stamped() {
+		return data, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	pages, err := f.pages()
+	if err != nil {
+		return nil, 0, err
+	}
+	if !opts.stamped() {
+		return data, len(pages), nil
+	}
+
+	u, err := newPDFUpdate(f)
+	if err != nil {
+		return nil, 0, err
+	}
+	font := u.add(pdfDictOf("Type", pdfName("Font"), "Subtype", pdfName("Type1"),
+		"BaseFont", pdfName("Helvetica"), "Encoding", pdfName("WinAnsiEncoding")))
+	save := u.addStream("q")
+
+	for i, page := range pages {
+		resources, fontName, err := f.addFont(page.resources, font)
+		if err != nil {
+			return nil, 0, fmt.Errorf("page %d: %w", i+1, err)
+		}
+		stamp := u.addStream("Q\n" + opts.stampOps(i, len(pages), page.box, fontName))
+
+		// The page's own content runs inside q ... Q, so whatever graphics
+		// state it leaves behind does not move the stamps
+		contents := pdfArray{save}
+		switch c := page.dict.get("Contents").(type) {
+		case pdfRef:
+			contents = append(contents, c)
+		case pdfArray:
+			contents = append(contents, c...)
+		}
+		dict := page.dict.clone()
+		dict.set("Contents", append(contents, stamp))
+		dict.set("Resources", resources)
+		u.replace(page.ref, dict)
+	}
+	return u.finish(), len(pages), nil
+}
+
+// addFont returns a copy of a page's resources with font added, and the name
+// it is added under
+func (f *pdfFile) addFont(resources pdfValue, font pdfRef) (*pdfDict, pdfName, error) {
+	res, err := f.dict(resources)
+	if err != nil {
+		return nil, "", err
+	}
+	if res == nil {
+		res = newPDFDict()
+	}
+	fonts, err := f.dict(res.get("Font"))
+	if err != nil {
+		return nil, "", err
+	}
+	if fonts == nil {
+		fonts = newPDFDict()
+	}
+
+	name := pdfName("FStamp")
+	for n := 1; fonts.get(name) != nil; n++ {
+		name = pdfName("FStamp" + strconv.Itoa(n))
+	}
+	fonts = fonts.clone()
+	fonts.set(name, font)
+	res = res.clone()
+	res.set("Font", fonts)
+	return res, name, nil
+}
+
+// pdfDictOf builds a dictionary from alternating keys and values
+func pdfDictOf(kv ...interface{}) *pdfDict {
+	d := newPDFDict()
+	for i := 0; i+1 < len(kv); i += 2 {
+		d.set(pdfName(kv[i].(string)), kv[i+1])
+	}
+	return d
+}
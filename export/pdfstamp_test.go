@@ -0,0 +1,117 @@
+package export
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// testPDF builds a PDF of blank US Letter pages with a classic
+// cross-reference table
+func testPDF(pages int) []byte {
+	var buf bytes.Buffer
+	var offsets []int
+	obj := func(body string) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	buf.WriteString("%PDF-1.4\n")
+	obj("<< /Type /Catalog /Pages 2 0 R >>")
+	kids := make([]string, pages)
+	for i := range kids {
+		kids[i] = fmt.Sprintf("%d 0 R", 3+2*i)
+	}
+	obj(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), pages))
+	for i := 0; i < pages; i++ {
+		obj(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Resources << >> /Contents %d 0 R >>", 4+2*i))
+		obj("<< /Length 0 >>\nstream\n\nendstream")
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return buf.Bytes()
+}
+
+func TestStampPDF(t *testing.T) {
+	data := testPDF(3)
+	pages, err := PDFPageCount(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pages != 3 {
+		t.Fatalf("counted %d pages, want 3", pages)
+	}
+
+	opts := PDFOptions{BatesPrefix: "ACME", BatesStart: 41, Footer: "Page {page} of {pages}"}
+	stamped, n, err := StampPDF(data, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != pages {
+		t.Errorf("StampPDF counted %d pages, PDFPageCount %d", n, pages)
+	}
+	// Stamps are an incremental update after the untouched original
+	if !bytes.HasPrefix(stamped, data) {
+		t.Error("the original PDF was changed")
+	}
+	if again, err := PDFPageCount(stamped); err != nil || again != pages {
+		t.Errorf("stamped PDF has %d pages (%v), want %d", again, err, pages)
+	}
+
+	first, last := opts.BatesRange(pages)
+	if first != "ACME000041" || last != "ACME000043" {
+		t.Errorf("Bates range %s to %s", first, last)
+	}
+	for _, s := range []string{first, last, "Page 3 of 3"} {
+		if !bytes.Contains(stamped[len(data):], []byte(s)) {
+			t.Errorf("%s is not stamped", s)
+		}
+	}
+}
+
+func TestStampPDFNothingToStamp(t *testing.T) {
+	data := testPDF(2)
+	out, n, err := StampPDF(data, PDFOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, data) || n != 2 {
+		t.Errorf("unstamped PDF changed, or counted %d of 2 pages", n)
+	}
+
+	// A PDF the parser can't read, such as one with cross-reference
+	// streams, passes through with an unknown page count
+	unreadable := []byte("%PDF-1.5\n1 0 obj\n<< /Type /XRef >>\nstream\nendstream\nendobj\n%%EOF\n")
+	out, n, err = StampPDF(unreadable, PDFOptions{})
+	if err != nil || n != 0 || !bytes.Equal(out, unreadable) {
+		t.Errorf("unreadable PDF: %d pages, %v", n, err)
+	}
+	if _, _, err := StampPDF(unreadable, PDFOptions{BatesPrefix: "ACME"}); err == nil {
+		t.Error("stamped Bates numbers onto a PDF it can't read")
+	}
+}
+
+func TestBatesRange(t *testing.T) {
+	tests := []struct {
+		opts        PDFOptions
+		pages       int
+		first, last string
+	}{
+		{PDFOptions{}, 3, "", ""},
+		{PDFOptions{BatesPrefix: "X"}, 3, "X000001", "X000003"},
+		{PDFOptions{BatesStart: 99, BatesDigits: 3}, 2, "099", "100"},
+		{PDFOptions{BatesPrefix: "X"}, 0, "", ""},
+	}
+	for _, tt := range tests {
+		first, last := tt.opts.BatesRange(tt.pages)
+		if first != tt.first || last != tt.last {
+			t.Errorf("%+v over %d pages: %q to %q, want %q to %q", tt.opts, tt.pages, first, last, tt.first, tt.last)
+		}
+	}
+}
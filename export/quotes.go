@@ -1,8 +1,11 @@
 package export
 
 import (
+	"fmt"
 	"regexp"
 	"strings"
+
+	"github.com/stevemurr/fastmail-agent/jmap"
 )
 
 // Quote detection patterns
@@ -107,3 +110,28 @@ func StripQuotesFromHTML(html string) string {
 
 	return html
 }
+
+// QuoteReply returns body followed by an attribution line and the newest
+// part of orig quoted with "> ", as mail clients do when replying. Quotes and
+// signatures already in orig are dropped so the quote stays short.
+func QuoteReply(body string, orig jmap.Email) string {
+	quoted := CleanBody(orig.GetBodyText(), DefaultLLMOptions())
+
+	from := "someone"
+	if len(orig.From) > 0 {
+		from = orig.From[0].String()
+	}
+
+	var sb strings.Builder
+	sb.WriteString(strings.TrimRight(body, "\n"))
+	sb.WriteString("\n\n")
+	sb.WriteString(fmt.Sprintf("On %s, %s wrote:\n", formatDate(orig.ReceivedAt), from))
+	for _, line := range strings.Split(quoted, "\n") {
+		if line == "" {
+			sb.WriteString(">\n")
+		} else {
+			sb.WriteString("> " + line + "\n")
+		}
+	}
+	return sb.String()
+}
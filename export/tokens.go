@@ -0,0 +1,306 @@
+package export
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Tokenizer counts the tokens a model would see in a piece of text
+type Tokenizer interface {
+	Name() string
+	CountTokens(s string) int
+}
+
+// CharTokenizer estimates one token per four characters. It is the fallback
+// for models whose vocabulary is not known.
+type CharTokenizer struct{}
+
+func (CharTokenizer) Name() string { return "chars/4" }
+
+func (CharTokenizer) CountTokens(s string) int {
+	return (utf8.RuneCountInString(s) + 3) / 4
+}
+
+// CL100KEstimator estimates cl100k token counts without the vocabulary:
+// text is split into pieces with the cl100k pattern and each piece's cost is
+// estimated from its kind and length, which tracks cl100k closely for
+// English prose. Counts are padded by estimateHeadroom so that text cut to a
+// budget by the estimate still fits it exactly; load a .tiktoken file with
+// LoadTiktoken for exact counts.
+type CL100KEstimator struct{}
+
+// estimateHeadroom is the fraction CL100KEstimator adds to its estimates
+const estimateHeadroom = 0.1
+
+// NewCL100KEstimator returns the built-in cl100k estimator
+func NewCL100KEstimator() CL100KEstimator {
+	return CL100KEstimator{}
+}
+
+func (CL100KEstimator) Name() string { return "cl100k-estimate" }
+
+func (CL100KEstimator) CountTokens(s string) int {
+	n := 0
+	for _, piece := range splitCL100K(s) {
+		n += estimatePieceTokens(piece)
+	}
+	return n + int(math.Ceil(float64(n)*estimateHeadroom))
+}
+
+// BPETokenizer counts tokens the way cl100k-style byte-pair encoders do:
+// text is split into pieces with the cl100k pattern, then each piece is
+// encoded with the merge ranks
+type BPETokenizer struct {
+	name  string
+	ranks map[string]int // token bytes to merge rank
+}
+
+// LoadTiktoken reads a tiktoken rank file (a base64 token and its rank per
+// line), such as cl100k_base.tiktoken, for exact counts
+func LoadTiktoken(path string) (*BPETokenizer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ranks := make(map[string]int)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a token and a rank", path, line)
+		}
+		token, err := base64.StdEncoding.DecodeString(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		rank, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		ranks[string(token)] = rank
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(ranks) == 0 {
+		return nil, fmt.Errorf("%s: no tokens", path)
+	}
+
+	name := strings.TrimSuffix(path[strings.LastIndexAny(path, `/\`)+1:], ".tiktoken")
+	return &BPETokenizer{name: name, ranks: ranks}, nil
+}
+
+func (t *BPETokenizer) Name() string { return t.name }
+
+func (t *BPETokenizer) CountTokens(s string) int {
+	n := 0
+	for _, piece := range splitCL100K(s) {
+		n += t.encodedLen(piece)
+	}
+	return n
+}
+
+// encodedLen byte-pair encodes piece, merging the lowest ranked adjacent
+// pair until no pair is a token, and returns the number of tokens left
+func (t *BPETokenizer) encodedLen(piece string) int {
+	if _, ok := t.ranks[piece]; ok {
+		return 1
+	}
+
+	// parts[i] is the start of token i; the last entry marks the end
+	parts := make([]int, len(piece)+1)
+	for i := range parts {
+		parts[i] = i
+	}
+	for len(parts) > 2 {
+		best, bestRank := -1, 0
+		for i := 0; i+2 < len(parts); i++ {
+			rank, ok := t.ranks[piece[parts[i]:parts[i+2]]]
+			if ok && (best < 0 || rank < bestRank) {
+				best, bestRank = i, rank
+			}
+		}
+		if best < 0 {
+			break
+		}
+		parts = append(parts[:best+1], parts[best+2:]...)
+	}
+	return len(parts) - 1
+}
+
+// estimatePieceTokens estimates the cl100k tokens in one piece. Common words
+// with their leading space are a single token; longer and non-Latin words
+// take more.
+func estimatePieceTokens(piece string) int {
+	runes := []rune(piece)
+	switch first := runes[0]; {
+	case unicode.IsSpace(first) && strings.TrimSpace(piece) == "":
+		return 1 + len(runes)/16
+	case unicode.IsNumber(first):
+		return 1
+	case first == '\'' && len(runes) <= 3:
+		return 1
+	}
+
+	letters, other := 0, 0
+	for _, r := range runes {
+		switch {
+		case r < utf8.RuneSelf && unicode.IsLetter(r):
+			letters++
+		case unicode.Is(unicode.Latin, r):
+			letters += 2
+		case unicode.IsLetter(r):
+			other++
+		}
+	}
+	if letters == 0 && other == 0 {
+		// Punctuation, which merges into runs of two or three
+		return (len(runes) + 2) / 3
+	}
+
+	n := other
+	switch {
+	case letters == 0:
+	case letters <= 8:
+		n++
+	default:
+		n += (letters + 5) / 6
+	}
+	return n
+}
+
+// splitCL100K splits s the way the cl100k pattern does:
+//
+//	(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}|
+//	 ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+(?!\S)|\s+
+//
+// It is written out by hand because the pattern uses a lookahead, which
+// regexp does not support.
+func splitCL100K(s string) []string {
+	runes := []rune(s)
+	var pieces []string
+	for i := 0; i < len(runes); {
+		n := matchCL100K(runes[i:])
+		pieces = append(pieces, string(runes[i:i+n]))
+		i += n
+	}
+	return pieces
+}
+
+// contractions are the suffixes the cl100k pattern splits off first
+var contractions = []string{"s", "t", "re", "ve", "m", "ll", "d"}
+
+// matchCL100K returns the length of the piece at the start of r, trying the
+// alternatives of the pattern in order
+func matchCL100K(r []rune) int {
+	isNewline := func(c rune) bool { return c == '\r' || c == '\n' }
+	isWord := func(c rune) bool { return unicode.IsLetter(c) || unicode.IsNumber(c) }
+	letters := func(from int) int {
+		for from < len(r) && unicode.IsLetter(r[from]) {
+			from++
+		}
+		return from
+	}
+
+	// 's, 't, 're, 've, 'm, 'll, 'd
+	if r[0] == '\'' {
+		for _, c := range contractions {
+			if len(r) > len(c) && strings.EqualFold(string(r[1:1+len(c)]), c) {
+				return 1 + len(c)
+			}
+		}
+	}
+
+	// [^\r\n\p{L}\p{N}]?\p{L}+
+	if unicode.IsLetter(r[0]) {
+		return letters(1)
+	}
+	if !isNewline(r[0]) && !isWord(r[0]) && len(r) > 1 && unicode.IsLetter(r[1]) {
+		return letters(2)
+	}
+
+	// \p{N}{1,3}
+	if unicode.IsNumber(r[0]) {
+		n := 1
+		for n < 3 && n < len(r) && unicode.IsNumber(r[n]) {
+			n++
+		}
+		return n
+	}
+
+	//  ?[^\s\p{L}\p{N}]+[\r\n]*
+	start := 0
+	if r[0] == ' ' {
+		start = 1
+	}
+	n := start
+	for n < len(r) && !unicode.IsSpace(r[n]) && !isWord(r[n]) {
+		n++
+	}
+	if n > start {
+		for n < len(r) && isNewline(r[n]) {
+			n++
+		}
+		return n
+	}
+
+	// The rest start with whitespace
+	end := 0
+	lastNewline := -1
+	for end < len(r) && unicode.IsSpace(r[end]) {
+		if isNewline(r[end]) {
+			lastNewline = end
+		}
+		end++
+	}
+
+	// \s*[\r\n]+
+	if lastNewline >= 0 {
+		return lastNewline + 1
+	}
+	// \s+(?!\S), leaving the last space to go with the word that follows
+	if end == len(r) || end == 1 {
+		return end
+	}
+	return end - 1
+}
+
+// TokenizerFor returns the tokenizer for name: cl100k for the built-in
+// estimate, chars for the four-characters-per-token estimate, a model name, or
+// the path of a .tiktoken rank file. Models without a known vocabulary fall
+// back to chars.
+func TokenizerFor(name string) (Tokenizer, error) {
+	lower := strings.ToLower(name)
+	switch {
+	case lower == "" || lower == "cl100k" || lower == "cl100k_base":
+		return NewCL100KEstimator(), nil
+	case lower == "chars":
+		return CharTokenizer{}, nil
+	case strings.HasSuffix(lower, ".tiktoken") || strings.ContainsAny(name, `/\`):
+		return LoadTiktoken(name)
+	}
+	if lower == "gpt-4" {
+		return NewCL100KEstimator(), nil
+	}
+	for _, prefix := range cl100kModels {
+		if strings.HasPrefix(lower, prefix) {
+			return NewCL100KEstimator(), nil
+		}
+	}
+	return CharTokenizer{}, nil
+}
+
+// cl100kModels are prefixes of the names of models that use cl100k
+var cl100kModels = []string{"gpt-4-", "gpt-3.5", "gpt-35", "text-embedding-3", "text-embedding-ada-002"}
@@ -0,0 +1,68 @@
+package export
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitCL100K(t *testing.T) {
+	got := splitCL100K("Hello world's 12345 !!\n")
+	want := []string{"Hello", " world", "'s", " ", "123", "45", " !!\n"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("pieces = %q, want %q", got, want)
+	}
+}
+
+func TestLoadTiktoken(t *testing.T) {
+	var sb strings.Builder
+	for rank, token := range []string{"a", "b", " ", "ab"} {
+		fmt.Fprintf(&sb, "%s %d\n", base64.StdEncoding.EncodeToString([]byte(token)), rank)
+	}
+	path := filepath.Join(t.TempDir(), "tiny.tiktoken")
+	if err := os.WriteFile(path, []byte(sb.String()), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tok, err := TokenizerFor(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.Name() != "tiny" {
+		t.Errorf("name = %q", tok.Name())
+	}
+	// "ab" is one token; " ba" has no merges, so it stays three
+	if n := tok.CountTokens("ab ba"); n != 4 {
+		t.Errorf("CountTokens = %d, want 4", n)
+	}
+
+	if err := os.WriteFile(path, []byte("not-base64 x\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadTiktoken(path); err == nil {
+		t.Error("loaded a malformed rank file")
+	}
+}
+
+func TestTokenizerFor(t *testing.T) {
+	for name, want := range map[string]string{
+		"":              NewCL100KEstimator().Name(),
+		"chars":         "chars/4",
+		"gpt-4":         NewCL100KEstimator().Name(),
+		"gpt-3.5-turbo": NewCL100KEstimator().Name(),
+		"unknown-model": "chars/4",
+	} {
+		tok, err := TokenizerFor(name)
+		if err != nil {
+			t.Errorf("TokenizerFor(%q): %v", name, err)
+			continue
+		}
+		if tok.Name() != want {
+			t.Errorf("TokenizerFor(%q) = %s, want %s", name, tok.Name(), want)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package jmap
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrCannotCalculateChanges is returned when the server can no longer
+// compute changes from a state, e.g. because it is too old. Callers should
+// fall back to a full resync.
+var ErrCannotCalculateChanges = errors.New("server cannot calculate changes from this state")
+
+// maxChangesPerCall bounds the size of each Foo/changes response
+const maxChangesPerCall = 500
+
+// Changes lists the objects of one type that changed since a state
+type Changes struct {
+	OldState  string
+	NewState  string
+	Created   []string
+	Updated   []string
+	Destroyed []string
+}
+
+// Empty reports whether nothing changed
+func (c *Changes) Empty() bool {
+	return len(c.Created) == 0 && len(c.Updated) == 0 && len(c.Destroyed) == 0
+}
+
+// changesResponse is the response from a Foo/changes method
+type changesResponse struct {
+	OldState       string   `json:"oldState"`
+	NewState       string   `json:"newState"`
+	HasMoreChanges bool     `json:"hasMoreChanges"`
+	Created        []string `json:"created"`
+	Updated        []string `json:"updated"`
+	Destroyed      []string `json:"destroyed"`
+}
+
+// EmailChanges returns the emails created, updated or destroyed since state
+func (c *Client) EmailChanges(state string) (*Changes, error) {
+	return c.EmailChangesContext(context.Background(), state)
+}
+
+// EmailChangesContext is like EmailChanges but stops when ctx is done
+func (c *Client) EmailChangesContext(ctx context.Context, state string) (*Changes, error) {
+	return c.changes(ctx, "Email/changes", state)
+}
+
+// MailboxChanges returns the mailboxes created, updated or destroyed since
+// state
+func (c *Client) MailboxChanges(state string) (*Changes, error) {
+	return c.MailboxChangesContext(context.Background(), state)
+}
+
+// MailboxChangesContext is like MailboxChanges but stops when ctx is done
+func (c *Client) MailboxChangesContext(ctx context.Context, state string) (*Changes, error) {
+	changes, err := c.changes(ctx, "Mailbox/changes", state)
+	if err == nil && !changes.Empty() {
+		// Cached names and roles may be stale now
+		c.forgetMailboxes()
+	}
+	return changes, err
+}
+
+// ThreadChanges returns the threads created, updated or destroyed since state
+func (c *Client) ThreadChanges(state string) (*Changes, error) {
+	return c.ThreadChangesContext(context.Background(), state)
+}
+
+// ThreadChangesContext is like ThreadChanges but stops when ctx is done
+func (c *Client) ThreadChangesContext(ctx context.Context, state string) (*Changes, error) {
+	return c.changes(ctx, "Thread/changes", state)
+}
+
+// changes calls a Foo/changes method until the server has no more changes
+// to report
+func (c *Client) changes(ctx context.Context, method, state string) (*Changes, error) {
+	result := &Changes{OldState: state}
+
+	for {
+		resp, err := c.CallContext(ctx, []Invocation{
+			NewInvocation(method, map[string]interface{}{
+				"accountId":  c.accountID,
+				"sinceState": state,
+				"maxChanges": maxChangesPerCall,
+			}, "0"),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if len(resp.MethodResponses) < 1 {
+			return nil, fmt.Errorf("unexpected response")
+		}
+
+		mr, err := ParseMethodResponse(resp.MethodResponses[0])
+		if err != nil {
+			return nil, err
+		}
+
+		// A cannotCalculateChanges error matches ErrCannotCalculateChanges
+		if err := mr.Err(); err != nil {
+			return nil, err
+		}
+
+		var changesResp changesResponse
+		if err := json.Unmarshal(mr.Args, &changesResp); err != nil {
+			return nil, err
+		}
+
+		result.Created = append(result.Created, changesResp.Created...)
+		result.Updated = append(result.Updated, changesResp.Updated...)
+		result.Destroyed = append(result.Destroyed, changesResp.Destroyed...)
+		result.NewState = changesResp.NewState
+
+		if !changesResp.HasMoreChanges || changesResp.NewState == state {
+			return result, nil
+		}
+		state = changesResp.NewState
+	}
+}
+
+// CurrentStates returns the current Email, Mailbox and Thread state strings
+// without fetching any objects
+func (c *Client) CurrentStates() (email, mailbox, thread string, err error) {
+	return c.CurrentStatesContext(context.Background())
+}
+
+// CurrentStatesContext is like CurrentStates but stops when ctx is done
+func (c *Client) CurrentStatesContext(ctx context.Context) (email, mailbox, thread string, err error) {
+	resp, err := c.CallContext(ctx, []Invocation{
+		NewInvocation("Email/get", map[string]interface{}{
+			"accountId": c.accountID, "ids": []string{},
+		}, "0"),
+		NewInvocation("Mailbox/get", map[string]interface{}{
+			"accountId": c.accountID, "ids": []string{},
+		}, "1"),
+		NewInvocation("Thread/get", map[string]interface{}{
+			"accountId": c.accountID, "ids": []string{},
+		}, "2"),
+	})
+	if err != nil {
+		return "", "", "", err
+	}
+
+	if len(resp.MethodResponses) < 3 {
+		return "", "", "", fmt.Errorf("unexpected response")
+	}
+
+	states := make([]string, 3)
+	for i, raw := range resp.MethodResponses[:3] {
+		mr, err := ParseMethodResponse(raw)
+		if err != nil {
+			return "", "", "", err
+		}
+		if err := mr.Err(); err != nil {
+			return "", "", "", err
+		}
+
+		var getResp struct {
+			State string `json:"state"`
+		}
+		if err := json.Unmarshal(mr.Args, &getResp); err != nil {
+			return "", "", "", err
+		}
+		states[i] = getResp.State
+	}
+
+	return states[0], states[1], states[2], nil
+}
+
+// AllEmailIDs lists the ID of every email in the account, newest first
+func (c *Client) AllEmailIDs() ([]string, error) {
+	return c.AllEmailIDsContext(context.Background())
+}
+
+// AllEmailIDsContext is like AllEmailIDs but stops when ctx is done
+func (c *Client) AllEmailIDsContext(ctx context.Context) ([]string, error) {
+	const pageSize = 1000
+
+	var ids []string
+	for {
+		resp, err := c.CallContext(ctx, []Invocation{
+			NewInvocation("Email/query", map[string]interface{}{
+				"accountId": c.accountID,
+				"sort": []map[string]interface{}{
+					{"property": "receivedAt", "isAscending": false},
+				},
+				"position":       len(ids),
+				"limit":          pageSize,
+				"calculateTotal": true,
+			}, "0"),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if len(resp.MethodResponses) < 1 {
+			return nil, fmt.Errorf("unexpected response")
+		}
+
+		mr, err := ParseMethodResponse(resp.MethodResponses[0])
+		if err != nil {
+			return nil, err
+		}
+
+		if err := mr.Err(); err != nil {
+			return nil, err
+		}
+
+		var queryResp EmailQueryResponse
+		if err := json.Unmarshal(mr.Args, &queryResp); err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, queryResp.IDs...)
+		if len(queryResp.IDs) == 0 || len(ids) >= queryResp.Total {
+			return ids, nil
+		}
+	}
+}
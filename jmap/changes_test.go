@@ -0,0 +1,100 @@
+package jmap_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/stevemurr/fastmail-agent/jmap"
+	"github.com/stevemurr/fastmail-agent/jmaptest"
+)
+
+func TestChanges(t *testing.T) {
+	srv, client := newTestClient(t)
+
+	emailState, mailboxState, threadState, err := client.CurrentStates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	arrived := jmaptest.SampleFixture().Emails[3]
+	arrived.ID, arrived.ThreadID = "M6", "T6"
+	srv.AddEmail(arrived, nil)
+	if _, err := client.MarkRead([]string{"M4"}, true, jmap.SetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.TrashEmails([]string{"M5"}, jmap.SetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.DestroyEmails([]string{"M5"}, jmap.SetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	emails, err := client.EmailChanges(emailState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := jmap.Changes{OldState: emailState, NewState: emails.NewState,
+		Created: []string{"M6"}, Updated: []string{"M4"}, Destroyed: []string{"M5"}}
+	if !reflect.DeepEqual(*emails, want) {
+		t.Errorf("email changes = %+v, want %+v", *emails, want)
+	}
+
+	threads, err := client.ThreadChanges(threadState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(threads.Created, []string{"T6"}) || !reflect.DeepEqual(threads.Updated, []string{"T2"}) ||
+		!reflect.DeepEqual(threads.Destroyed, []string{"T3"}) {
+		t.Errorf("thread changes = %+v", *threads)
+	}
+
+	mailboxes, err := client.MailboxChanges(mailboxState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"inbox", "junk", "trash"}; !reflect.DeepEqual(mailboxes.Updated, want) {
+		t.Errorf("mailboxes updated = %v, want %v", mailboxes.Updated, want)
+	}
+
+	// Nothing has changed since the newest state
+	again, err := client.EmailChanges(emails.NewState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !again.Empty() || again.NewState != emails.NewState {
+		t.Errorf("changes since the newest state = %+v", *again)
+	}
+}
+
+func TestChangesCreatedAndDestroyed(t *testing.T) {
+	srv, client := newTestClient(t)
+
+	state, _, _, err := client.CurrentStates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	arrived := jmaptest.SampleFixture().Emails[3]
+	arrived.ID, arrived.ThreadID = "M6", "T6"
+	srv.AddEmail(arrived, nil)
+	if _, err := client.DestroyEmails([]string{"M6"}, jmap.SetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// An email that came and went since the state is not reported at all
+	changes, err := client.EmailChanges(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changes.Empty() || changes.NewState == state {
+		t.Errorf("changes = %+v", *changes)
+	}
+}
+
+func TestChangesUnknownState(t *testing.T) {
+	_, client := newTestClient(t)
+
+	if _, err := client.EmailChanges("999"); !errors.Is(err, jmap.ErrCannotCalculateChanges) {
+		t.Errorf("changes from an unknown state: %v, want ErrCannotCalculateChanges", err)
+	}
+}
@@ -2,41 +2,91 @@ package jmap
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
+	"time"
 )
 
 const (
+	// FastmailSessionURL is the session resource used when none is configured
 	FastmailSessionURL = "https://api.fastmail.com/jmap/session"
 )
 
 // Client is a JMAP client for Fastmail
 type Client struct {
 	token      string
+	sessionURL string
 	httpClient *http.Client
-	session    *Session
+	transport  *http.Transport
+	timeout    time.Duration // bounds each API call; see SetTimeout
+	retry      RetryPolicy
 	accountID  string
+
+	sessionMu sync.RWMutex
+	session   *Session
+
+	mu        sync.Mutex
+	mailboxes []Mailbox // cached Mailbox/get result
 }
 
-// NewClient creates a new JMAP client
+// NewClient creates a new JMAP client for Fastmail
 func NewClient(token string) *Client {
+	return NewClientWithSessionURL(token, FastmailSessionURL)
+}
+
+// NewClientWithSessionURL creates a client for any JMAP server, given its
+// session resource, e.g. https://mail.example.com/.well-known/jmap. An empty
+// URL means Fastmail.
+func NewClientWithSessionURL(token, sessionURL string) *Client {
+	if sessionURL == "" {
+		sessionURL = FastmailSessionURL
+	}
+	// No overall http.Client timeout: it would cut off large blob downloads,
+	// which only the caller's context should bound
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = DefaultTimeout
 	return &Client{
 		token:      token,
-		httpClient: &http.Client{},
+		sessionURL: sessionURL,
+		httpClient: &http.Client{Transport: transport},
+		transport:  transport,
+		timeout:    DefaultTimeout,
+		retry:      DefaultRetryPolicy,
 	}
 }
 
-// Connect establishes a session with Fastmail
+// SetTimeout bounds each attempt at an API or session request, including
+// reading the response, and how long any request, blob downloads included,
+// waits for the server to start responding. Blob bodies are only bounded by
+// the caller's context. Zero means no limit.
+func (c *Client) SetTimeout(d time.Duration) {
+	c.timeout = d
+	c.transport.ResponseHeaderTimeout = d
+}
+
+// SetRetryPolicy replaces DefaultRetryPolicy
+func (c *Client) SetRetryPolicy(p RetryPolicy) {
+	c.retry = p
+}
+
+// Connect establishes a session with the server
 func (c *Client) Connect() error {
-	session, err := c.getSession()
+	return c.ConnectContext(context.Background())
+}
+
+// ConnectContext is like Connect but stops when ctx is done
+func (c *Client) ConnectContext(ctx context.Context) error {
+	session, err := c.getSession(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to get session: %w", err)
 	}
-	c.session = session
+	c.setSession(session)
 
 	// Get the primary account for mail
 	accountID, ok := session.PrimaryAccount["urn:ietf:params:jmap:mail"]
@@ -49,23 +99,17 @@ func (c *Client) Connect() error {
 }
 
 // getSession fetches the JMAP session
-func (c *Client) getSession() (*Session, error) {
-	req, err := http.NewRequest("GET", FastmailSessionURL, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	req.Header.Set("Authorization", "Bearer "+c.token)
-
-	resp, err := c.httpClient.Do(req)
+func (c *Client) getSession(ctx context.Context) (*Session, error) {
+	resp, err := c.do(ctx, func() (*http.Request, error) {
+		return http.NewRequest("GET", c.sessionURL, nil)
+	}, true, c.timeout)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("session request failed: %s - %s", resp.Status, string(body))
+		return nil, fmt.Errorf("session request failed: %w", newRequestError(resp))
 	}
 
 	var session Session
@@ -76,42 +120,151 @@ func (c *Client) getSession() (*Session, error) {
 	return &session, nil
 }
 
-// Call makes a JMAP API call
-func (c *Client) Call(methodCalls []Invocation) (*Response, error) {
-	if c.session == nil {
-		return nil, fmt.Errorf("not connected")
+// currentSession returns the session, which may be replaced at any time by
+// refreshSession
+func (c *Client) currentSession() *Session {
+	c.sessionMu.RLock()
+	defer c.sessionMu.RUnlock()
+	return c.session
+}
+
+func (c *Client) setSession(session *Session) {
+	c.sessionMu.Lock()
+	c.session = session
+	c.sessionMu.Unlock()
+}
+
+// refreshSession re-fetches the session when an API response reports a
+// sessionState other than the one we hold, e.g. after the server moved the
+// API or download URL. Failures keep the old session; the next response
+// tries again.
+func (c *Client) refreshSession(ctx context.Context, state string) {
+	current := c.currentSession()
+	if state == "" || current == nil || current.State == "" || state == current.State {
+		return
 	}
 
-	request := Request{
-		Using: []string{
-			"urn:ietf:params:jmap:core",
-			"urn:ietf:params:jmap:mail",
-		},
+	session, err := c.getSession(ctx)
+	if err != nil {
+		return
+	}
+	c.setSession(session)
+}
+
+// Call makes a JMAP API call using the core and mail capabilities
+func (c *Client) Call(methodCalls []Invocation) (*Response, error) {
+	return c.CallContext(context.Background(), methodCalls)
+}
+
+// CallContext is like Call but stops when ctx is done
+func (c *Client) CallContext(ctx context.Context, methodCalls []Invocation) (*Response, error) {
+	return c.SendContext(ctx, NewRequest(methodCalls))
+}
+
+// NewRequest builds a request using the core and mail capabilities plus any
+// extra ones the method calls need
+func NewRequest(methodCalls []Invocation, extraCapabilities ...string) Request {
+	return Request{
+		Using:       append([]string{CapabilityCore, CapabilityMail}, extraCapabilities...),
 		MethodCalls: methodCalls,
 	}
+}
+
+// HasCapability reports whether the connected account supports a capability
+// such as CapabilitySubmission. API tokens created without a scope don't get
+// the matching account capability.
+func (c *Client) HasCapability(uri string) bool {
+	session := c.currentSession()
+	if session == nil {
+		return false
+	}
+	if account, ok := session.Accounts[c.accountID]; ok && account.AccountCapabilities != nil {
+		_, ok := account.AccountCapabilities[uri]
+		return ok
+	}
+	_, ok := session.Capabilities[uri]
+	return ok
+}
+
+// Send makes a JMAP API call with a prepared request. Transient failures are
+// retried according to the client's RetryPolicy; requests that only read are
+// also retried when a method fails with serverUnavailable or rateLimit.
+func (c *Client) Send(request Request) (*Response, error) {
+	return c.SendContext(context.Background(), request)
+}
+
+// SendContext is like Send but stops when ctx is done
+func (c *Client) SendContext(ctx context.Context, request Request) (*Response, error) {
+	session := c.currentSession()
+	if session == nil {
+		return nil, fmt.Errorf("not connected")
+	}
 
 	body, err := json.Marshal(request)
 	if err != nil {
 		return nil, err
 	}
-
-	req, err := http.NewRequest("POST", c.session.APIURL, bytes.NewReader(body))
-	if err != nil {
+	if err := c.checkLimits(request, body); err != nil {
 		return nil, err
 	}
 
-	req.Header.Set("Authorization", "Bearer "+c.token)
-	req.Header.Set("Content-Type", "application/json")
+	idempotent := request.readOnly()
+	for attempt := 0; ; attempt++ {
+		response, err := c.post(ctx, session.APIURL, body, idempotent)
+		if err != nil {
+			return nil, err
+		}
+		c.refreshSession(ctx, response.SessionState)
+
+		if idempotent && attempt < c.retry.MaxRetries && response.retryableError() != "" {
+			if err := sleep(ctx, c.retry.backoff(attempt)); err != nil {
+				return nil, err
+			}
+			session = c.currentSession()
+			continue
+		}
+		return response, nil
+	}
+}
+
+// checkLimits rejects a request the server would refuse for exceeding its
+// maxCallsInRequest or maxSizeRequest, with the error the server would send
+func (c *Client) checkLimits(request Request, body []byte) error {
+	limits := c.Limits()
+	limitErr := &RequestError{
+		Status: http.StatusBadRequest,
+		Type:   "urn:ietf:params:jmap:error:limit",
+	}
+	switch {
+	case len(request.MethodCalls) > limits.MaxCallsInRequest:
+		limitErr.Limit = "maxCallsInRequest"
+		limitErr.Detail = fmt.Sprintf("request has %d method calls; the server accepts %d", len(request.MethodCalls), limits.MaxCallsInRequest)
+	case int64(len(body)) > limits.MaxSizeRequest:
+		limitErr.Limit = "maxSizeRequest"
+		limitErr.Detail = fmt.Sprintf("request is %d bytes; the server accepts %d", len(body), limits.MaxSizeRequest)
+	default:
+		return nil
+	}
+	return limitErr
+}
 
-	resp, err := c.httpClient.Do(req)
+// post sends one encoded request to the API endpoint
+func (c *Client) post(ctx context.Context, apiURL string, body []byte, idempotent bool) (*Response, error) {
+	resp, err := c.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequest("POST", apiURL, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	}, idempotent, c.timeout)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		respBody, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("API call failed: %s - %s", resp.Status, string(respBody))
+		return nil, fmt.Errorf("API call failed: %w", newRequestError(resp))
 	}
 
 	var response Response
@@ -129,40 +282,57 @@ func (c *Client) AccountID() string {
 
 // Session returns the current session
 func (c *Client) Session() *Session {
-	return c.session
+	return c.currentSession()
 }
 
 // DownloadBlob downloads an attachment blob by ID
 func (c *Client) DownloadBlob(blobID, name, mimeType string) ([]byte, error) {
-	if c.session == nil {
+	return c.DownloadBlobContext(context.Background(), blobID, name, mimeType)
+}
+
+// DownloadBlobContext is like DownloadBlob but stops when ctx is done
+func (c *Client) DownloadBlobContext(ctx context.Context, blobID, name, mimeType string) ([]byte, error) {
+	body, err := c.OpenBlobContext(ctx, blobID, name, mimeType)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	return io.ReadAll(body)
+}
+
+// OpenBlob starts downloading a blob and returns its body for streaming. The
+// caller must close it.
+func (c *Client) OpenBlob(blobID, name, mimeType string) (io.ReadCloser, error) {
+	return c.OpenBlobContext(context.Background(), blobID, name, mimeType)
+}
+
+// OpenBlobContext is like OpenBlob but stops when ctx is done
+func (c *Client) OpenBlobContext(ctx context.Context, blobID, name, mimeType string) (io.ReadCloser, error) {
+	session := c.currentSession()
+	if session == nil {
 		return nil, fmt.Errorf("not connected")
 	}
 
 	// Build download URL from session template
 	// Template format: https://www.fastmailusercontent.com/jmap/download/{accountId}/{blobId}/{name}?type={type}
-	downloadURL := c.session.DownloadURL
+	downloadURL := session.DownloadURL
 	downloadURL = strings.ReplaceAll(downloadURL, "{accountId}", c.accountID)
 	downloadURL = strings.ReplaceAll(downloadURL, "{blobId}", blobID)
 	downloadURL = strings.ReplaceAll(downloadURL, "{name}", url.PathEscape(name))
 	downloadURL = strings.ReplaceAll(downloadURL, "{type}", url.QueryEscape(mimeType))
 
-	req, err := http.NewRequest("GET", downloadURL, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	req.Header.Set("Authorization", "Bearer "+c.token)
-
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(ctx, func() (*http.Request, error) {
+		return http.NewRequest("GET", downloadURL, nil)
+	}, true, 0)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("download failed: %s - %s", resp.Status, string(body))
+		defer resp.Body.Close()
+		return nil, fmt.Errorf("download failed: %w", newRequestError(resp))
 	}
 
-	return io.ReadAll(resp.Body)
+	return resp.Body, nil
 }
@@ -0,0 +1,194 @@
+package jmap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// replyPrefix matches an existing Re: so replies don't stack them
+var replyPrefix = regexp.MustCompile(`(?i)^re:\s*`)
+
+// Draft is an outgoing plain-text message
+type Draft struct {
+	From       EmailAddress
+	To         []EmailAddress
+	CC         []EmailAddress
+	BCC        []EmailAddress
+	Subject    string
+	Body       string
+	InReplyTo  []string // Message-IDs of the message being replied to
+	References []string // Message-IDs of the whole conversation
+}
+
+// NewReply builds a reply to orig. The recipients come from Reply-To (or
+// From); with replyAll the other To/CC addresses are copied too, minus the
+// sender's own address. If orig was sent by the user, from or one of the
+// addresses in own, it goes to orig's To instead, as when following up on a
+// sent message. In-Reply-To and References are set so clients thread the
+// reply under orig.
+func NewReply(orig Email, from EmailAddress, body string, replyAll bool, own ...string) Draft {
+	mine := map[string]bool{strings.ToLower(from.Email): true}
+	for _, addr := range own {
+		mine[strings.ToLower(addr)] = true
+	}
+
+	to := orig.ReplyTo
+	if len(to) == 0 {
+		to = orig.From
+	}
+	if len(orig.From) > 0 && mine[strings.ToLower(orig.From[0].Email)] && len(orig.To) > 0 {
+		to = orig.To
+	}
+
+	d := Draft{
+		From:    from,
+		To:      to,
+		Subject: "Re: " + replyPrefix.ReplaceAllString(orig.Subject, ""),
+		Body:    body,
+	}
+
+	if replyAll {
+		skip := make(map[string]bool)
+		for addr := range mine {
+			skip[addr] = true
+		}
+		for _, addr := range to {
+			skip[strings.ToLower(addr.Email)] = true
+		}
+		for _, addr := range append(append([]EmailAddress{}, orig.To...), orig.CC...) {
+			if !skip[strings.ToLower(addr.Email)] {
+				skip[strings.ToLower(addr.Email)] = true
+				d.CC = append(d.CC, addr)
+			}
+		}
+	}
+
+	// References is the parent's References (or In-Reply-To if it had none)
+	// followed by the parent's own Message-ID, per RFC 5322 section 3.6.4
+	d.InReplyTo = orig.MessageID
+	refs := orig.References
+	if len(refs) == 0 {
+		refs = orig.InReplyTo
+	}
+	d.References = append(append([]string{}, refs...), orig.MessageID...)
+
+	return d
+}
+
+// ReplyTarget returns the message of thread, oldest first, that a reply
+// answers: the newest one that is not a draft. Drafts have the $draft
+// keyword or are in the mailbox draftsID, if that is not empty. It reports
+// false if every message is a draft.
+func ReplyTarget(thread []Email, draftsID string) (Email, bool) {
+	for i := len(thread) - 1; i >= 0; i-- {
+		email := thread[i]
+		if email.HasKeyword(KeywordDraft) || (draftsID != "" && email.MailboxIDs[draftsID]) {
+			continue
+		}
+		return email, true
+	}
+	return Email{}, false
+}
+
+// ReplyTargetContext is like ReplyTarget, looking up the account's Drafts
+// mailbox
+func (c *Client) ReplyTargetContext(ctx context.Context, thread []Email) (Email, bool) {
+	draftsID, _ := c.resolveMailboxID(ctx, "drafts")
+	return ReplyTarget(thread, draftsID)
+}
+
+// emailCreate returns the Email/set create object for the draft, filed in
+// the given mailbox
+func (d Draft) emailCreate(mailboxID string) map[string]interface{} {
+	email := map[string]interface{}{
+		"mailboxIds": map[string]bool{mailboxID: true},
+		"keywords":   map[string]bool{KeywordDraft: true, KeywordSeen: true},
+		"from":       []EmailAddress{d.From},
+		"subject":    d.Subject,
+		"bodyValues": map[string]interface{}{
+			"body": map[string]interface{}{"value": d.Body},
+		},
+		"textBody": []map[string]interface{}{
+			{"partId": "body", "type": "text/plain"},
+		},
+	}
+	if len(d.To) > 0 {
+		email["to"] = d.To
+	}
+	if len(d.CC) > 0 {
+		email["cc"] = d.CC
+	}
+	if len(d.BCC) > 0 {
+		email["bcc"] = d.BCC
+	}
+	if len(d.InReplyTo) > 0 {
+		email["inReplyTo"] = d.InReplyTo
+	}
+	if len(d.References) > 0 {
+		email["references"] = d.References
+	}
+	return email
+}
+
+// CreateDraft stores the draft in the Drafts mailbox without sending it and
+// returns the new email's ID
+func (c *Client) CreateDraft(d Draft) (string, error) {
+	return c.CreateDraftContext(context.Background(), d)
+}
+
+// CreateDraftContext is like CreateDraft but stops when ctx is done
+func (c *Client) CreateDraftContext(ctx context.Context, d Draft) (string, error) {
+	draftsID, err := c.resolveMailboxID(ctx, "drafts")
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := c.CallContext(ctx, []Invocation{
+		NewInvocation("Email/set", map[string]interface{}{
+			"accountId": c.accountID,
+			"create":    map[string]interface{}{"draft": d.emailCreate(draftsID)},
+		}, "0"),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if len(resp.MethodResponses) < 1 {
+		return "", fmt.Errorf("unexpected response")
+	}
+
+	return createdID(resp.MethodResponses[0], "draft")
+}
+
+// createdID extracts the server-assigned ID of a created object from a
+// Foo/set response
+func createdID(raw json.RawMessage, key string) (string, error) {
+	mr, err := ParseMethodResponse(raw)
+	if err != nil {
+		return "", err
+	}
+
+	if err := mr.Err(); err != nil {
+		return "", err
+	}
+
+	var setResp setResponse
+	if err := json.Unmarshal(mr.Args, &setResp); err != nil {
+		return "", err
+	}
+
+	if setErr, ok := setResp.NotCreated[key]; ok {
+		return "", fmt.Errorf("%s failed: %w", mr.Method, setErr)
+	}
+
+	var created struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(setResp.Created[key], &created); err != nil || created.ID == "" {
+		return "", fmt.Errorf("%s did not create %s", mr.Method, key)
+	}
+	return created.ID, nil
+}
@@ -0,0 +1,91 @@
+package jmap_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/stevemurr/fastmail-agent/jmap"
+)
+
+func TestNewReply(t *testing.T) {
+	me := jmap.EmailAddress{Name: "Test User", Email: "test@example.com"}
+	alice := jmap.EmailAddress{Name: "Alice", Email: "alice@example.com"}
+	bob := jmap.EmailAddress{Email: "bob@example.com"}
+	carol := jmap.EmailAddress{Email: "carol@example.com"}
+	orig := jmap.Email{
+		From:       []jmap.EmailAddress{alice},
+		To:         []jmap.EmailAddress{me, bob},
+		CC:         []jmap.EmailAddress{carol, alice},
+		Subject:    "RE: Quarterly invoice",
+		MessageID:  []string{"m2@example.com"},
+		InReplyTo:  []string{"m1@example.com"},
+		References: []string{"m0@example.com", "m1@example.com"},
+	}
+
+	d := jmap.NewReply(orig, me, "Thanks", false)
+	if !reflect.DeepEqual(d.To, []jmap.EmailAddress{alice}) || len(d.CC) != 0 {
+		t.Errorf("reply to %v cc %v, want only Alice", d.To, d.CC)
+	}
+	if d.Subject != "Re: Quarterly invoice" {
+		t.Errorf("subject = %q", d.Subject)
+	}
+	if !reflect.DeepEqual(d.InReplyTo, []string{"m2@example.com"}) {
+		t.Errorf("In-Reply-To = %v", d.InReplyTo)
+	}
+	if want := []string{"m0@example.com", "m1@example.com", "m2@example.com"}; !reflect.DeepEqual(d.References, want) {
+		t.Errorf("References = %v, want %v", d.References, want)
+	}
+
+	// Reply-all copies the others once, leaving out the sender's own address
+	d = jmap.NewReply(orig, me, "Thanks", true)
+	if want := []jmap.EmailAddress{bob, carol}; !reflect.DeepEqual(d.CC, want) {
+		t.Errorf("reply-all cc = %v, want %v", d.CC, want)
+	}
+
+	// Reply-To wins over From
+	orig.ReplyTo = []jmap.EmailAddress{bob}
+	if d := jmap.NewReply(orig, me, "", false); !reflect.DeepEqual(d.To, []jmap.EmailAddress{bob}) {
+		t.Errorf("reply to %v, want the Reply-To address", d.To)
+	}
+}
+
+func TestNewReplyToOwnMessage(t *testing.T) {
+	me := jmap.EmailAddress{Email: "test@example.com"}
+	alias := jmap.EmailAddress{Email: "alias@example.com"}
+	alice := jmap.EmailAddress{Email: "alice@example.com"}
+	bob := jmap.EmailAddress{Email: "bob@example.com"}
+
+	// Following up on a message the user sent, from another of their
+	// addresses, goes to its recipients rather than back to the user
+	sent := jmap.Email{
+		From: []jmap.EmailAddress{alias},
+		To:   []jmap.EmailAddress{alice},
+		CC:   []jmap.EmailAddress{bob, me},
+	}
+	d := jmap.NewReply(sent, me, "", true, alias.Email)
+	if !reflect.DeepEqual(d.To, []jmap.EmailAddress{alice}) {
+		t.Errorf("reply to %v, want Alice", d.To)
+	}
+	if !reflect.DeepEqual(d.CC, []jmap.EmailAddress{bob}) {
+		t.Errorf("cc %v, want only Bob", d.CC)
+	}
+}
+
+func TestReplyTarget(t *testing.T) {
+	thread := []jmap.Email{
+		{ID: "M1", MailboxIDs: map[string]bool{"inbox": true}},
+		{ID: "M2", MailboxIDs: map[string]bool{"sent": true}},
+		{ID: "M3", MailboxIDs: map[string]bool{"drafts": true}},
+		{ID: "M4", MailboxIDs: map[string]bool{"inbox": true}, Keywords: map[string]bool{jmap.KeywordDraft: true}},
+	}
+	if got, ok := jmap.ReplyTarget(thread, "drafts"); !ok || got.ID != "M2" {
+		t.Errorf("reply target = %s, %v; want M2", got.ID, ok)
+	}
+	// Without a Drafts mailbox only the keyword marks drafts
+	if got, ok := jmap.ReplyTarget(thread, ""); !ok || got.ID != "M3" {
+		t.Errorf("reply target without drafts mailbox = %s, %v; want M3", got.ID, ok)
+	}
+	if _, ok := jmap.ReplyTarget(thread[3:], "drafts"); ok {
+		t.Error("found a target in a thread of drafts")
+	}
+}
@@ -1,34 +1,112 @@
 package jmap
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
 	"sort"
 )
 
-// SearchEmails searches for emails matching the query
-func (c *Client) SearchEmails(query string, limit int) ([]Email, error) {
-	if limit <= 0 {
-		limit = 50
+// SearchOptions selects which page of results SearchEmails returns
+type SearchOptions struct {
+	Limit    int    // page size, defaults to 50
+	Position int    // zero-based index of the first result
+	Anchor   string // email ID to continue after; takes precedence over Position
+
+	InMailbox        string   // only search this mailbox (name or role)
+	ExcludeMailboxes []string // skip these mailboxes unless the query has in:
+}
+
+// SearchResult is one page of search results
+type SearchResult struct {
+	Query    string
+	Options  SearchOptions // options the page was fetched with
+	Emails   []Email
+	Position int    // index of the first email in this page
+	Total    int    // total number of matching emails on the server
+	State    string // Email state, usable as SetOptions.IfInState
+}
+
+// HasMore reports whether there are results beyond this page
+func (r *SearchResult) HasMore() bool {
+	return r.Position+len(r.Emails) < r.Total
+}
+
+// NextCursor returns an opaque cursor for the following page, or "" if this
+// is the last page
+func (r *SearchResult) NextCursor() string {
+	if !r.HasMore() || len(r.Emails) == 0 {
+		return ""
+	}
+	return SearchCursor{
+		Query:    r.Query,
+		Anchor:   r.Emails[len(r.Emails)-1].ID,
+		Position: r.Position + len(r.Emails),
+		In:       r.Options.InMailbox,
+		Exclude:  r.Options.ExcludeMailboxes,
+	}.String()
+}
+
+// SearchEmails searches for emails matching the query, one page at a time
+func (c *Client) SearchEmails(query string, opts SearchOptions) (*SearchResult, error) {
+	return c.SearchEmailsContext(context.Background(), query, opts)
+}
+
+// SearchEmailsContext is like SearchEmails but stops when ctx is done
+func (c *Client) SearchEmailsContext(ctx context.Context, query string, opts SearchOptions) (*SearchResult, error) {
+	if opts.Limit <= 0 {
+		opts.Limit = 50
+	}
+	// The page is fetched by one Email/get; larger pages come back short,
+	// with HasMore set
+	if limit := c.Limits().MaxObjectsInGet; opts.Limit > limit {
+		opts.Limit = limit
+	}
+
+	// Compile the search syntax into a JMAP filter tree
+	parsed, err := ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := parsed.Compile(func(name string) (string, error) {
+		return c.resolveMailboxID(ctx, name)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	scope, err := c.mailboxScope(ctx, parsed, opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(scope) > 0 {
+		if len(filter) > 0 {
+			scope = append([]interface{}{filter}, scope...)
+		}
+		filter = combineFilters("AND", scope)
 	}
 
-	// Build filter - search all mail with text query
-	filter := map[string]interface{}{}
-	if query != "" {
-		filter["text"] = query
+	queryArgs := map[string]interface{}{
+		"accountId": c.accountID,
+		"filter":    filter,
+		"sort": []map[string]interface{}{
+			{"property": "receivedAt", "isAscending": false},
+		},
+		"limit":          opts.Limit,
+		"calculateTotal": true,
+	}
+	if opts.Anchor != "" {
+		// Continue after the anchor so concurrent deliveries don't shift the page
+		queryArgs["anchor"] = opts.Anchor
+		queryArgs["anchorOffset"] = 1
+	} else {
+		queryArgs["position"] = opts.Position
 	}
 
 	// Query for email IDs
 	calls := []Invocation{
-		NewInvocation("Email/query", map[string]interface{}{
-			"accountId": c.accountID,
-			"filter":    filter,
-			"sort": []map[string]interface{}{
-				{"property": "receivedAt", "isAscending": false},
-			},
-			"limit": limit,
-		}, "0"),
+		NewInvocation("Email/query", queryArgs, "0"),
 		NewInvocation("Email/get", map[string]interface{}{
 			"accountId": c.accountID,
 			"#ids": map[string]interface{}{
@@ -36,14 +114,11 @@ func (c *Client) SearchEmails(query string, limit int) ([]Email, error) {
 				"name":     "Email/query",
 				"path":     "/ids",
 			},
-			"properties": []string{
-				"id", "threadId", "mailboxIds", "from", "to", "cc",
-				"subject", "receivedAt", "preview",
-			},
+			"properties": emailSummaryProperties,
 		}, "1"),
 	}
 
-	resp, err := c.Call(calls)
+	resp, err := c.CallContext(ctx, calls)
 	if err != nil {
 		return nil, err
 	}
@@ -52,14 +127,35 @@ func (c *Client) SearchEmails(query string, limit int) ([]Email, error) {
 		return nil, fmt.Errorf("unexpected response")
 	}
 
+	// Parse Email/query response for paging info
+	mr, err := ParseMethodResponse(resp.MethodResponses[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if err := mr.Err(); err != nil {
+		// The anchor email may have been deleted since the cursor was issued
+		var methodErr *MethodError
+		if opts.Anchor != "" && errors.As(err, &methodErr) && methodErr.Type == "anchorNotFound" {
+			opts.Anchor = ""
+			return c.SearchEmailsContext(ctx, query, opts)
+		}
+		return nil, err
+	}
+
+	var queryResp EmailQueryResponse
+	if err := json.Unmarshal(mr.Args, &queryResp); err != nil {
+		return nil, err
+	}
+
 	// Parse Email/get response
-	mr, err := ParseMethodResponse(resp.MethodResponses[1])
+	mr, err = ParseMethodResponse(resp.MethodResponses[1])
 	if err != nil {
 		return nil, err
 	}
 
-	if mr.Method == "error" {
-		return nil, fmt.Errorf("JMAP error: %s", string(mr.Args))
+	if err := mr.Err(); err != nil {
+		return nil, err
 	}
 
 	var emailResp EmailGetResponse
@@ -67,68 +163,124 @@ func (c *Client) SearchEmails(query string, limit int) ([]Email, error) {
 		return nil, err
 	}
 
-	return emailResp.List, nil
+	c.annotateMailboxes(ctx, emailResp.List)
+
+	return &SearchResult{
+		Query:    query,
+		Options:  opts,
+		Emails:   emailResp.List,
+		Position: queryResp.Position,
+		Total:    queryResp.Total,
+		State:    emailResp.State,
+	}, nil
+}
+
+// emailSummaryProperties are the Email properties fetched for result lists
+var emailSummaryProperties = []string{
+	"id", "blobId", "threadId", "mailboxIds", "keywords", "from", "to", "cc",
+	"subject", "receivedAt", "preview",
+}
+
+// emailBodyProperties are the Email properties fetched when full message
+// content is needed
+var emailBodyProperties = []string{
+	"id", "blobId", "threadId", "mailboxIds", "keywords", "from", "to", "cc", "replyTo",
+	"subject", "receivedAt", "preview",
+	"textBody", "htmlBody", "bodyValues",
+	"attachments", "hasAttachment",
+	"messageId", "inReplyTo", "references",
 }
 
 // GetThread fetches a thread and all its emails
 func (c *Client) GetThread(threadID string) ([]Email, error) {
-	// First get the thread to get email IDs
+	return c.GetThreadContext(context.Background(), threadID)
+}
+
+// GetThreadContext is like GetThread but stops when ctx is done
+func (c *Client) GetThreadContext(ctx context.Context, threadID string) ([]Email, error) {
+	return c.GetThreadsContext(ctx, []string{threadID})
+}
+
+// GetThreads fetches every email in the given threads, including messages
+// that did not match the search that found the thread. Emails are returned
+// oldest first.
+func (c *Client) GetThreads(threadIDs []string) ([]Email, error) {
+	return c.GetThreadsContext(context.Background(), threadIDs)
+}
+
+// GetThreadsContext is like GetThreads but stops when ctx is done
+func (c *Client) GetThreadsContext(ctx context.Context, threadIDs []string) ([]Email, error) {
+	// Too many threads for one Thread/get: list their emails in chunks,
+	// then fetch those in chunks
+	if len(threadIDs) > c.Limits().MaxObjectsInGet {
+		ids, err := c.ThreadEmailIDsContext(ctx, ThreadHandle{ThreadIDs: threadIDs})
+		if err != nil {
+			return nil, err
+		}
+		return c.GetEmailsContext(ctx, ids)
+	}
+
 	calls := []Invocation{
 		NewInvocation("Thread/get", map[string]interface{}{
 			"accountId": c.accountID,
-			"ids":       []string{threadID},
+			"ids":       threadIDs,
 		}, "0"),
+		NewInvocation("Email/get", map[string]interface{}{
+			"accountId": c.accountID,
+			"#ids": map[string]interface{}{
+				"resultOf": "0",
+				"name":     "Thread/get",
+				"path":     "/list/*/emailIds",
+			},
+			"properties":          emailBodyProperties,
+			"fetchTextBodyValues": true,
+			"fetchHTMLBodyValues": true,
+		}, "1"),
 	}
 
-	resp, err := c.Call(calls)
+	resp, err := c.CallContext(ctx, calls)
 	if err != nil {
 		return nil, err
 	}
 
+	if len(resp.MethodResponses) < 2 {
+		return nil, fmt.Errorf("unexpected response")
+	}
+
 	mr, err := ParseMethodResponse(resp.MethodResponses[0])
 	if err != nil {
 		return nil, err
 	}
 
+	if err := mr.Err(); err != nil {
+		return nil, err
+	}
+
 	var threadResp ThreadGetResponse
 	if err := json.Unmarshal(mr.Args, &threadResp); err != nil {
 		return nil, err
 	}
 
 	if len(threadResp.List) == 0 {
-		return nil, fmt.Errorf("thread not found")
-	}
-
-	thread := threadResp.List[0]
-	if f, err := os.OpenFile("debug.log", os.O_APPEND|os.O_WRONLY, 0644); err == nil {
-		fmt.Fprintf(f, "Thread %s has %d emailIds: %v\n", thread.ID, len(thread.EmailIDs), thread.EmailIDs)
-		f.Close()
-	}
-
-	// Now get all emails in the thread with full body
-	calls = []Invocation{
-		NewInvocation("Email/get", map[string]interface{}{
-			"accountId": c.accountID,
-			"ids":       thread.EmailIDs,
-			"properties": []string{
-				"id", "threadId", "from", "to", "cc",
-				"subject", "receivedAt", "preview",
-				"textBody", "htmlBody", "bodyValues",
-				"attachments", "hasAttachment",
-				"messageId", "inReplyTo", "references",
-			},
-			"fetchTextBodyValues": true,
-			"fetchHTMLBodyValues": true,
-		}, "0"),
+		return nil, fmt.Errorf("thread %w", ErrNotFound)
 	}
 
-	resp, err = c.Call(calls)
+	mr, err = ParseMethodResponse(resp.MethodResponses[1])
 	if err != nil {
 		return nil, err
 	}
 
-	mr, err = ParseMethodResponse(resp.MethodResponses[0])
-	if err != nil {
+	// Threads with more emails than one Email/get may return are fetched
+	// again in chunks
+	if err := mr.Err(); err != nil {
+		var methodErr *MethodError
+		if errors.As(err, &methodErr) && methodErr.Type == "requestTooLarge" {
+			var ids []string
+			for _, t := range threadResp.List {
+				ids = append(ids, t.EmailIDs...)
+			}
+			return c.GetEmailsContext(ctx, ids)
+		}
 		return nil, err
 	}
 
@@ -137,80 +289,93 @@ func (c *Client) GetThread(threadID string) ([]Email, error) {
 		return nil, err
 	}
 
+	c.annotateMailboxes(ctx, emailResp.List)
+	sortOldestFirst(emailResp.List)
 	return emailResp.List, nil
 }
 
-// getInboxID returns the inbox mailbox ID
-func (c *Client) getInboxID() (string, error) {
-	calls := []Invocation{
-		NewInvocation("Mailbox/get", map[string]interface{}{
-			"accountId": c.accountID,
-		}, "0"),
-	}
+// GetEmails fetches emails by ID with full body content
+func (c *Client) GetEmails(ids []string) ([]Email, error) {
+	return c.GetEmailsContext(context.Background(), ids)
+}
 
-	resp, err := c.Call(calls)
+// GetEmailsContext is like GetEmails but stops when ctx is done
+func (c *Client) GetEmailsContext(ctx context.Context, ids []string) ([]Email, error) {
+	emails, err := getInChunks(ctx, c, ids, func(ctx context.Context, chunk []string) ([]Email, error) {
+		return c.fetchEmails(ctx, chunk, emailBodyProperties, true)
+	})
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	mr, err := ParseMethodResponse(resp.MethodResponses[0])
-	if err != nil {
-		return "", err
-	}
+	c.annotateMailboxes(ctx, emails)
+	sortOldestFirst(emails)
+	return emails, nil
+}
 
-	var mailboxResp MailboxGetResponse
-	if err := json.Unmarshal(mr.Args, &mailboxResp); err != nil {
-		return "", err
-	}
+// GetEmailSummaries fetches emails by ID with the same properties as search
+// results, i.e. without bodies. Emails are returned oldest first.
+func (c *Client) GetEmailSummaries(ids []string) ([]Email, error) {
+	return c.GetEmailSummariesContext(context.Background(), ids)
+}
 
-	for _, mb := range mailboxResp.List {
-		if mb.Role == "inbox" {
-			return mb.ID, nil
-		}
+// GetEmailSummariesContext is like GetEmailSummaries but stops when ctx is done
+func (c *Client) GetEmailSummariesContext(ctx context.Context, ids []string) ([]Email, error) {
+	emails, err := getInChunks(ctx, c, ids, func(ctx context.Context, chunk []string) ([]Email, error) {
+		return c.fetchEmails(ctx, chunk, emailSummaryProperties, false)
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return "", fmt.Errorf("inbox not found")
+	c.annotateMailboxes(ctx, emails)
+	sortOldestFirst(emails)
+	return emails, nil
 }
 
-// GetEmails fetches emails by ID with full body content
-func (c *Client) GetEmails(ids []string) ([]Email, error) {
-	calls := []Invocation{
-		NewInvocation("Email/get", map[string]interface{}{
-			"accountId": c.accountID,
-			"ids":       ids,
-			"properties": []string{
-				"id", "threadId", "from", "to", "cc",
-				"subject", "receivedAt", "preview",
-				"textBody", "htmlBody", "bodyValues",
-				"attachments", "hasAttachment",
-				"messageId", "inReplyTo", "references",
-			},
-			"fetchTextBodyValues": true,
-			"fetchHTMLBodyValues": true,
-		}, "0"),
+// fetchEmails sends one Email/get for ids, which must fit the server's
+// limits. bodies also fetches the text and HTML body values.
+func (c *Client) fetchEmails(ctx context.Context, ids []string, properties []string, bodies bool) ([]Email, error) {
+	args := map[string]interface{}{
+		"accountId":  c.accountID,
+		"ids":        ids,
+		"properties": properties,
+	}
+	if bodies {
+		args["fetchTextBodyValues"] = true
+		args["fetchHTMLBodyValues"] = true
 	}
 
-	resp, err := c.Call(calls)
+	resp, err := c.CallContext(ctx, []Invocation{NewInvocation("Email/get", args, "0")})
 	if err != nil {
 		return nil, err
 	}
 
+	if len(resp.MethodResponses) < 1 {
+		return nil, fmt.Errorf("unexpected response")
+	}
+
 	mr, err := ParseMethodResponse(resp.MethodResponses[0])
 	if err != nil {
 		return nil, err
 	}
 
+	if err := mr.Err(); err != nil {
+		return nil, err
+	}
+
 	var emailResp EmailGetResponse
 	if err := json.Unmarshal(mr.Args, &emailResp); err != nil {
 		return nil, err
 	}
+	return emailResp.List, nil
+}
 
-	// Sort by received date (oldest first)
-	sort.Slice(emailResp.List, func(i, j int) bool {
-		return emailResp.List[i].ReceivedAt < emailResp.List[j].ReceivedAt
+// sortOldestFirst sorts emails by received date, oldest first
+func sortOldestFirst(emails []Email) {
+	sort.Slice(emails, func(i, j int) bool {
+		return emails[i].ReceivedAt < emails[j].ReceivedAt
 	})
-
-	return emailResp.List, nil
 }
 
 // GetEmailBody returns the body text for an email
@@ -0,0 +1,183 @@
+package jmap_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/stevemurr/fastmail-agent/jmap"
+	"github.com/stevemurr/fastmail-agent/jmaptest"
+)
+
+// newTestClient starts a fake server with the sample fixture and connects
+// to it
+func newTestClient(t *testing.T) (*jmaptest.Server, *jmap.Client) {
+	t.Helper()
+	srv := jmaptest.NewServer(jmaptest.SampleFixture())
+	t.Cleanup(srv.Close)
+	client, err := srv.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv, client
+}
+
+func emailIDs(emails []jmap.Email) []string {
+	ids := make([]string, len(emails))
+	for i, e := range emails {
+		ids[i] = e.ID
+	}
+	return ids
+}
+
+// nextPage fetches the page after res through its cursor, as a caller
+// holding only the cursor string would
+func nextPage(t *testing.T, client *jmap.Client, res *jmap.SearchResult) *jmap.SearchResult {
+	t.Helper()
+	cursor, err := jmap.ParseSearchCursor(res.NextCursor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := client.SearchEmails(cursor.Query, cursor.Options(res.Options.Limit))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return next
+}
+
+func TestNextCursor(t *testing.T) {
+	page := &jmap.SearchResult{
+		Query:    "from:alice",
+		Options:  jmap.SearchOptions{InMailbox: "inbox", ExcludeMailboxes: []string{"spam"}},
+		Emails:   []jmap.Email{{ID: "M5"}, {ID: "M4"}},
+		Position: 2,
+		Total:    5,
+	}
+	cursor, err := jmap.ParseSearchCursor(page.NextCursor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The cursor keeps the page's mailbox scope as well as its place
+	want := jmap.SearchCursor{Query: "from:alice", Anchor: "M4", Position: 4, In: "inbox", Exclude: []string{"spam"}}
+	if !reflect.DeepEqual(cursor, want) {
+		t.Errorf("cursor = %+v, want %+v", cursor, want)
+	}
+	if opts := cursor.Options(2); opts.Anchor != "M4" || opts.Position != 4 || opts.Limit != 2 || opts.InMailbox != "inbox" {
+		t.Errorf("options = %+v", opts)
+	}
+
+	// The last page has no cursor
+	page.Emails = append(page.Emails, jmap.Email{ID: "M3"})
+	if got := page.NextCursor(); got != "" {
+		t.Errorf("cursor after the last page = %q", got)
+	}
+}
+
+func TestSearchPaging(t *testing.T) {
+	srv, client := newTestClient(t)
+
+	page, err := client.SearchEmails("", jmap.SearchOptions{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := emailIDs(page.Emails); !reflect.DeepEqual(got, []string{"M5", "M4"}) {
+		t.Fatalf("first page = %v", got)
+	}
+	if page.Total != 5 || !page.HasMore() {
+		t.Fatalf("total %d, has more %v", page.Total, page.HasMore())
+	}
+
+	page = nextPage(t, client, page)
+	if got := emailIDs(page.Emails); !reflect.DeepEqual(got, []string{"M3", "M2"}) {
+		t.Fatalf("second page = %v", got)
+	}
+
+	// Mail arriving between pages must not shift the next one: the cursor
+	// continues after its anchor, not from a position
+	arrived := jmaptest.SampleFixture().Emails[3]
+	arrived.ID, arrived.ThreadID, arrived.ReceivedAt = "M6", "T6", "2024-03-06T00:00:00Z"
+	srv.AddEmail(arrived, nil)
+
+	page = nextPage(t, client, page)
+	if got := emailIDs(page.Emails); !reflect.DeepEqual(got, []string{"M1"}) {
+		t.Fatalf("third page = %v", got)
+	}
+	if page.HasMore() || page.NextCursor() != "" {
+		t.Errorf("last page has more: %v, cursor %q", page.HasMore(), page.NextCursor())
+	}
+}
+
+func TestSearchCursorKeepsScope(t *testing.T) {
+	_, client := newTestClient(t)
+
+	opts := jmap.SearchOptions{Limit: 1, InMailbox: "inbox", ExcludeMailboxes: []string{"spam"}}
+	page, err := client.SearchEmails("", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for {
+		got = append(got, emailIDs(page.Emails)...)
+		if !page.HasMore() {
+			break
+		}
+		page = nextPage(t, client, page)
+	}
+	if want := []string{"M4", "M3", "M1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("paged through %v, want %v", got, want)
+	}
+}
+
+func TestSearchAnchorGone(t *testing.T) {
+	_, client := newTestClient(t)
+
+	page, err := client.SearchEmails("", jmap.SearchOptions{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The anchor is deleted before the next page is asked for; the search
+	// falls back to the cursor's position in what is left
+	if _, err := client.DestroyEmails([]string{"M4"}, jmap.SetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	page = nextPage(t, client, page)
+	if got := emailIDs(page.Emails); !reflect.DeepEqual(got, []string{"M2", "M1"}) {
+		t.Errorf("page after a deleted anchor = %v, want [M2 M1]", got)
+	}
+}
+
+func TestParseSearchCursorErrors(t *testing.T) {
+	for _, s := range []string{"", "th_abc", "cur_!!!", "cur_bm90IGpzb24"} {
+		if _, err := jmap.ParseSearchCursor(s); err == nil {
+			t.Errorf("ParseSearchCursor(%q) succeeded", s)
+		}
+	}
+}
+
+func TestGetThreadByHandle(t *testing.T) {
+	_, client := newTestClient(t)
+
+	emails, err := client.GetThreadByHandle(jmap.ThreadHandle{ThreadIDs: []string{"T1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := emailIDs(emails); !reflect.DeepEqual(got, []string{"M1", "M2", "M3"}) {
+		t.Errorf("thread T1 = %v", got)
+	}
+
+	h, err := jmap.ParseThreadHandle(jmap.ThreadHandle{EmailIDs: []string{"M4"}}.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	emails, err = client.GetThreadByHandle(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := emailIDs(emails); !reflect.DeepEqual(got, []string{"M4"}) {
+		t.Errorf("handle for M4 = %v", got)
+	}
+
+	if _, err := client.GetThreadByHandle(jmap.ThreadHandle{ThreadIDs: []string{"T9"}}); !errors.Is(err, jmap.ErrNotFound) {
+		t.Errorf("missing thread: %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,113 @@
+package jmap
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ErrNotFound is returned when a requested thread or email does not exist
+var ErrNotFound = errors.New("not found")
+
+// MethodError is a method-level error: the server rejected one method call
+// of a request (RFC 8620 section 3.6.2). Use errors.As to inspect it.
+type MethodError struct {
+	CallID      string   `json:"-"`                     // call that failed
+	Type        string   `json:"type"`                  // e.g. invalidArguments, forbidden
+	Description string   `json:"description,omitempty"` // human-readable detail, if any
+	Properties  []string `json:"properties,omitempty"`  // arguments at fault, for invalidArguments and the like
+}
+
+// Error implements the error interface
+func (e *MethodError) Error() string {
+	msg := "JMAP " + e.Type
+	if e.Description != "" {
+		msg += ": " + e.Description
+	}
+	if len(e.Properties) > 0 {
+		msg += " (" + strings.Join(e.Properties, ", ") + ")"
+	}
+	return msg
+}
+
+// Is lets errors.Is match method errors against the package's sentinels
+func (e *MethodError) Is(target error) bool {
+	switch target {
+	case ErrCannotCalculateChanges:
+		return e.Type == "cannotCalculateChanges"
+	case ErrStateMismatch:
+		return e.Type == "stateMismatch"
+	case ErrNotFound:
+		return e.Type == "notFound"
+	}
+	return false
+}
+
+// Err returns the response as a *MethodError if it is an "error" response,
+// and nil otherwise
+func (mr *MethodResponse) Err() error {
+	if mr.Method != "error" {
+		return nil
+	}
+	e := &MethodError{CallID: mr.CallID}
+	if err := json.Unmarshal(mr.Args, e); err != nil || e.Type == "" {
+		e.Type = "serverFail"
+		e.Description = string(mr.Args)
+	}
+	return e
+}
+
+// RequestError is a request-level error: the server rejected a whole
+// request or download with a non-200 status, usually with an RFC 7807
+// problem document (RFC 8620 section 3.6.1). Use errors.As to inspect it.
+type RequestError struct {
+	Status int    `json:"status"`           // HTTP status code
+	Type   string `json:"type,omitempty"`   // problem type, e.g. urn:ietf:params:jmap:error:limit
+	Title  string `json:"title,omitempty"`  // short summary, if any
+	Detail string `json:"detail,omitempty"` // human-readable detail, or the raw body
+	Limit  string `json:"limit,omitempty"`  // the limit exceeded, for limit errors
+}
+
+// Error implements the error interface
+func (e *RequestError) Error() string {
+	msg := fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status))
+	if e.Type != "" && e.Type != "about:blank" {
+		msg += " (" + e.Type + ")"
+	}
+	if detail := e.Detail; detail != "" || e.Title != "" {
+		if detail == "" {
+			detail = e.Title
+		}
+		msg += ": " + detail
+	}
+	if e.Limit != "" {
+		msg += " [limit " + e.Limit + "]"
+	}
+	return msg
+}
+
+// Unauthorized reports whether the server rejected the credentials, for
+// example because the API token was revoked or has expired
+func (e *RequestError) Unauthorized() bool {
+	return e.Status == http.StatusUnauthorized || e.Status == http.StatusForbidden
+}
+
+// maxErrorBody caps how much of an unexpected error body is kept
+const maxErrorBody = 4096
+
+// newRequestError builds a RequestError from a non-200 response, parsing
+// its body as a problem document when it is one
+func newRequestError(resp *http.Response) *RequestError {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+
+	e := &RequestError{Status: resp.StatusCode}
+	if json.Unmarshal(body, e) == nil && (e.Type != "" || e.Detail != "" || e.Title != "") {
+		e.Status = resp.StatusCode // the header is authoritative
+		return e
+	}
+	*e = RequestError{Status: resp.StatusCode, Detail: strings.TrimSpace(string(body))}
+	return e
+}
@@ -0,0 +1,46 @@
+package jmap_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stevemurr/fastmail-agent/jmap"
+	"github.com/stevemurr/fastmail-agent/jmaptest"
+)
+
+func TestMethodErrorIs(t *testing.T) {
+	tests := []struct {
+		typ  string
+		want error
+	}{
+		{"stateMismatch", jmap.ErrStateMismatch},
+		{"cannotCalculateChanges", jmap.ErrCannotCalculateChanges},
+		{"notFound", jmap.ErrNotFound},
+	}
+	for _, tt := range tests {
+		err := error(&jmap.MethodError{Type: tt.typ})
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s does not match %v", tt.typ, tt.want)
+		}
+		if errors.Is(&jmap.MethodError{Type: "forbidden"}, tt.want) {
+			t.Errorf("forbidden matches %v", tt.want)
+		}
+	}
+
+	err := &jmap.MethodError{Type: "invalidArguments", Description: "bad filter", Properties: []string{"filter"}}
+	if got, want := err.Error(), "JMAP invalidArguments: bad filter (filter)"; got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+}
+
+func TestUnauthorized(t *testing.T) {
+	srv := jmaptest.NewServer(jmaptest.SampleFixture())
+	defer srv.Close()
+
+	client := jmap.NewClientWithSessionURL("wrong-token", srv.SessionURL())
+	err := client.Connect()
+	var reqErr *jmap.RequestError
+	if !errors.As(err, &reqErr) || !reqErr.Unauthorized() {
+		t.Errorf("connecting with a bad token: %v, want an unauthorized RequestError", err)
+	}
+}
@@ -0,0 +1,118 @@
+package jmap
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const (
+	// handlePrefix marks a string as a thread handle rather than a result index
+	handlePrefix = "th_"
+
+	// cursorPrefix marks a string as a search cursor
+	cursorPrefix = "cur_"
+)
+
+// ThreadHandle identifies a conversation independently of any query result.
+// It is encoded into an opaque string so callers can pass it back verbatim.
+type ThreadHandle struct {
+	ThreadIDs []string `json:"t,omitempty"`
+	EmailIDs  []string `json:"e,omitempty"`
+}
+
+// String encodes the handle as an opaque, URL-safe string
+func (h ThreadHandle) String() string {
+	data, _ := json.Marshal(h)
+	return handlePrefix + base64.RawURLEncoding.EncodeToString(data)
+}
+
+// IsThreadHandle reports whether s looks like an encoded thread handle
+func IsThreadHandle(s string) bool {
+	return strings.HasPrefix(s, handlePrefix)
+}
+
+// ParseThreadHandle decodes a handle produced by ThreadHandle.String
+func ParseThreadHandle(s string) (ThreadHandle, error) {
+	var h ThreadHandle
+	if !IsThreadHandle(s) {
+		return h, fmt.Errorf("invalid thread handle %q", s)
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, handlePrefix))
+	if err != nil {
+		return h, fmt.Errorf("invalid thread handle %q: %w", s, err)
+	}
+	if err := json.Unmarshal(data, &h); err != nil {
+		return h, fmt.Errorf("invalid thread handle %q: %w", s, err)
+	}
+	if len(h.ThreadIDs) == 0 && len(h.EmailIDs) == 0 {
+		return h, fmt.Errorf("thread handle %q is empty", s)
+	}
+
+	return h, nil
+}
+
+// SearchCursor records where the next page of a search starts. Like thread
+// handles it is passed around as an opaque string.
+type SearchCursor struct {
+	Query    string `json:"q"`
+	Anchor   string `json:"a,omitempty"`
+	Position int    `json:"p"`
+
+	In      string   `json:"i,omitempty"`
+	Exclude []string `json:"x,omitempty"`
+}
+
+// String encodes the cursor as an opaque, URL-safe string
+func (c SearchCursor) String() string {
+	data, _ := json.Marshal(c)
+	return cursorPrefix + base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Options returns the SearchOptions that continue from this cursor
+func (c SearchCursor) Options(limit int) SearchOptions {
+	return SearchOptions{
+		Limit:    limit,
+		Position: c.Position,
+		Anchor:   c.Anchor,
+
+		InMailbox:        c.In,
+		ExcludeMailboxes: c.Exclude,
+	}
+}
+
+// ParseSearchCursor decodes a cursor produced by SearchCursor.String
+func ParseSearchCursor(s string) (SearchCursor, error) {
+	var c SearchCursor
+	if !strings.HasPrefix(s, cursorPrefix) {
+		return c, fmt.Errorf("invalid cursor %q", s)
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, cursorPrefix))
+	if err != nil {
+		return c, fmt.Errorf("invalid cursor %q: %w", s, err)
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, fmt.Errorf("invalid cursor %q: %w", s, err)
+	}
+
+	return c, nil
+}
+
+// GetThreadByHandle fetches the emails a handle refers to, oldest first.
+// Handles carrying thread IDs return the whole server thread; handles that
+// only list email IDs return exactly those emails.
+func (c *Client) GetThreadByHandle(h ThreadHandle) ([]Email, error) {
+	return c.GetThreadByHandleContext(context.Background(), h)
+}
+
+// GetThreadByHandleContext is like GetThreadByHandle but stops when ctx is done
+func (c *Client) GetThreadByHandleContext(ctx context.Context, h ThreadHandle) ([]Email, error) {
+	if len(h.ThreadIDs) > 0 {
+		return c.GetThreadsContext(ctx, h.ThreadIDs)
+	}
+	return c.GetEmailsContext(ctx, h.EmailIDs)
+}
@@ -0,0 +1,29 @@
+package jmap_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/stevemurr/fastmail-agent/jmap"
+)
+
+func TestParseThreadHandle(t *testing.T) {
+	h := jmap.ThreadHandle{ThreadIDs: []string{"T1", "T2"}, EmailIDs: []string{"M1"}}
+	s := h.String()
+	if !jmap.IsThreadHandle(s) {
+		t.Fatalf("%q is not recognized as a handle", s)
+	}
+	got, err := jmap.ParseThreadHandle(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, h) {
+		t.Errorf("round trip = %+v, want %+v", got, h)
+	}
+
+	for _, s := range []string{"", "3", "th_!!!", jmap.ThreadHandle{}.String()} {
+		if _, err := jmap.ParseThreadHandle(s); err == nil {
+			t.Errorf("ParseThreadHandle(%q) succeeded", s)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package jmap
+
+import (
+	"context"
+	"sync"
+)
+
+// DefaultLimits are used for any limit the server does not advertise. They
+// are the values RFC 8620 suggests as minimums.
+var DefaultLimits = CoreCapability{
+	MaxSizeUpload:         50000000,
+	MaxConcurrentUpload:   4,
+	MaxSizeRequest:        10000000,
+	MaxConcurrentRequests: 4,
+	MaxCallsInRequest:     16,
+	MaxObjectsInGet:       500,
+	MaxObjectsInSet:       500,
+}
+
+// Limits returns the server's core limits, with DefaultLimits standing in
+// for any it does not advertise
+func (c *Client) Limits() CoreCapability {
+	limits := DefaultLimits
+	session := c.currentSession()
+	if session == nil {
+		return limits
+	}
+
+	core := session.Core()
+	if core.MaxSizeUpload > 0 {
+		limits.MaxSizeUpload = core.MaxSizeUpload
+	}
+	if core.MaxConcurrentUpload > 0 {
+		limits.MaxConcurrentUpload = core.MaxConcurrentUpload
+	}
+	if core.MaxSizeRequest > 0 {
+		limits.MaxSizeRequest = core.MaxSizeRequest
+	}
+	if core.MaxConcurrentRequests > 0 {
+		limits.MaxConcurrentRequests = core.MaxConcurrentRequests
+	}
+	if core.MaxCallsInRequest > 0 {
+		limits.MaxCallsInRequest = core.MaxCallsInRequest
+	}
+	if core.MaxObjectsInGet > 0 {
+		limits.MaxObjectsInGet = core.MaxObjectsInGet
+	}
+	if core.MaxObjectsInSet > 0 {
+		limits.MaxObjectsInSet = core.MaxObjectsInSet
+	}
+	return limits
+}
+
+// requestOverhead is room left in maxSizeRequest for everything in a /get
+// call besides its IDs
+const requestOverhead = 4096
+
+// chunkIDs splits ids into chunks of at most maxCount IDs whose encoded size
+// stays within maxBytes
+func chunkIDs(ids []string, maxCount int, maxBytes int64) [][]string {
+	var chunks [][]string
+	start := 0
+	var size int64
+	for i, id := range ids {
+		idSize := int64(len(id)) + 3 // quotes and comma
+		if i > start && (i-start >= maxCount || size+idSize > maxBytes) {
+			chunks = append(chunks, ids[start:i])
+			start, size = i, 0
+		}
+		size += idSize
+	}
+	if start < len(ids) {
+		chunks = append(chunks, ids[start:])
+	}
+	return chunks
+}
+
+// getInChunks fetches objects by ID in chunks the server accepts, with up to
+// maxConcurrentRequests requests in flight, and returns the results in chunk
+// order. get fetches one chunk. The first error cancels the rest.
+func getInChunks[T any](ctx context.Context, c *Client, ids []string, get func(ctx context.Context, chunk []string) ([]T, error)) ([]T, error) {
+	limits := c.Limits()
+	chunks := chunkIDs(ids, limits.MaxObjectsInGet, limits.MaxSizeRequest-requestOverhead)
+	if len(chunks) <= 1 {
+		return get(ctx, ids)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([][]T, len(chunks))
+	sem := make(chan struct{}, limits.MaxConcurrentRequests)
+	var wg sync.WaitGroup
+	var failed sync.Once
+	var firstErr error
+	for i, chunk := range chunks {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			list, err := get(ctx, chunk)
+			if err != nil {
+				failed.Do(func() {
+					firstErr = err
+					cancel()
+				})
+				return
+			}
+			results[i] = list
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var all []T
+	for _, r := range results {
+		all = append(all, r...)
+	}
+	return all, nil
+}
@@ -0,0 +1,138 @@
+package jmap_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/stevemurr/fastmail-agent/jmap"
+	"github.com/stevemurr/fastmail-agent/jmaptest"
+)
+
+// newLimitedClient starts a fake server advertising limits changed by
+// change from the defaults, and connects to it
+func newLimitedClient(t *testing.T, change func(*jmap.CoreCapability)) (*jmaptest.Server, *jmap.Client) {
+	t.Helper()
+	srv := jmaptest.NewServer(jmaptest.SampleFixture())
+	t.Cleanup(srv.Close)
+	limits := jmap.DefaultLimits
+	change(&limits)
+	srv.SetLimits(limits)
+	client, err := srv.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv, client
+}
+
+// maxGetIDs returns the most IDs any Email/get the server received asked
+// for by value
+func maxGetIDs(srv *jmaptest.Server) int {
+	most := 0
+	for _, req := range srv.Requests() {
+		for _, call := range req.MethodCalls {
+			args, _ := call[1].(map[string]interface{})
+			if ids, ok := args["ids"].([]interface{}); ok && call[0] == "Email/get" && len(ids) > most {
+				most = len(ids)
+			}
+		}
+	}
+	return most
+}
+
+func TestLimitsAdvertised(t *testing.T) {
+	_, client := newLimitedClient(t, func(l *jmap.CoreCapability) { l.MaxObjectsInGet = 7 })
+	if got := client.Limits().MaxObjectsInGet; got != 7 {
+		t.Errorf("MaxObjectsInGet = %d, want 7", got)
+	}
+}
+
+func TestChunkedGet(t *testing.T) {
+	srv, client := newLimitedClient(t, func(l *jmap.CoreCapability) { l.MaxObjectsInGet = 2 })
+
+	// The thread's three emails are too many for one Email/get
+	emails, err := client.GetThread("T1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := emailIDs(emails); !reflect.DeepEqual(got, []string{"M1", "M2", "M3"}) {
+		t.Errorf("thread = %v", got)
+	}
+
+	emails, err = client.GetEmails([]string{"M5", "M4", "M3", "M2", "M1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(emails) != 5 {
+		t.Errorf("got %d of 5 emails", len(emails))
+	}
+	if most := maxGetIDs(srv); most > 2 {
+		t.Errorf("an Email/get asked for %d IDs, over the limit of 2", most)
+	}
+}
+
+func TestChunkedGetByRequestSize(t *testing.T) {
+	// Room for the request overhead and a few IDs per request
+	srv, client := newLimitedClient(t, func(l *jmap.CoreCapability) { l.MaxSizeRequest = 4096 + 12 })
+
+	emails, err := client.GetEmails([]string{"M1", "M2", "M3", "M4", "M5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(emails) != 5 {
+		t.Errorf("got %d of 5 emails", len(emails))
+	}
+	if most := maxGetIDs(srv); most > 2 {
+		t.Errorf("an Email/get asked for %d IDs, more than fit the request size", most)
+	}
+}
+
+func TestSearchPageCappedByGetLimit(t *testing.T) {
+	_, client := newLimitedClient(t, func(l *jmap.CoreCapability) { l.MaxObjectsInGet = 2 })
+
+	res, err := client.SearchEmails("", jmap.SearchOptions{Limit: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Emails) != 2 || !res.HasMore() {
+		t.Errorf("page of %d emails, has more %v; want 2 and more", len(res.Emails), res.HasMore())
+	}
+}
+
+func TestTooManyCalls(t *testing.T) {
+	srv, client := newLimitedClient(t, func(l *jmap.CoreCapability) { l.MaxCallsInRequest = 2 })
+
+	// CurrentStates asks for three states in one request; the client
+	// refuses it as the server would, without sending it
+	_, _, _, err := client.CurrentStates()
+	var reqErr *jmap.RequestError
+	if !errors.As(err, &reqErr) || reqErr.Limit != "maxCallsInRequest" {
+		t.Fatalf("CurrentStates: %v, want a maxCallsInRequest limit error", err)
+	}
+	if n := methodCalls(srv, "Thread/get"); n != 0 {
+		t.Errorf("the request was sent anyway")
+	}
+}
+
+func TestChunkedSet(t *testing.T) {
+	srv, client := newLimitedClient(t, func(l *jmap.CoreCapability) { l.MaxObjectsInSet = 1 })
+
+	search, err := client.SearchEmails("", jmap.SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each batch is conditional on the state the one before it left
+	res, err := client.MarkRead([]string{"M3", "M4", "M5"}, false, jmap.SetOptions{IfInState: search.State})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res.Updated, []string{"M3", "M4", "M5"}) {
+		t.Errorf("updated %v", res.Updated)
+	}
+	if n := methodCalls(srv, "Email/set"); n != 3 {
+		t.Errorf("%d Email/set calls, want 3", n)
+	}
+	if res.OldState != search.State || res.NewState == search.State {
+		t.Errorf("states %s -> %s from %s", res.OldState, res.NewState, search.State)
+	}
+}
@@ -0,0 +1,223 @@
+package jmap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DefaultExcludedMailboxes are left out of searches unless the query names a
+// mailbox with in:
+var DefaultExcludedMailboxes = []string{"junk", "trash"}
+
+// GetMailboxes returns every mailbox in the account, ordered the way the
+// Fastmail UI shows them: by sortOrder, then name
+func (c *Client) GetMailboxes() ([]Mailbox, error) {
+	return c.GetMailboxesContext(context.Background())
+}
+
+// GetMailboxesContext is like GetMailboxes but stops when ctx is done
+func (c *Client) GetMailboxesContext(ctx context.Context) ([]Mailbox, error) {
+	// Always fetched, since counts change with every new message
+	mailboxes, err := c.fetchMailboxes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	sorted := make([]Mailbox, len(mailboxes))
+	copy(sorted, mailboxes)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].SortOrder != sorted[j].SortOrder {
+			return sorted[i].SortOrder < sorted[j].SortOrder
+		}
+		return strings.ToLower(sorted[i].Name) < strings.ToLower(sorted[j].Name)
+	})
+	return sorted, nil
+}
+
+// getMailboxes returns all mailboxes, fetching them only when none are
+// cached. Use it for names and roles; counts in it may be stale.
+func (c *Client) getMailboxes(ctx context.Context) ([]Mailbox, error) {
+	c.mu.Lock()
+	mailboxes := c.mailboxes
+	c.mu.Unlock()
+
+	if mailboxes != nil {
+		return mailboxes, nil
+	}
+	return c.fetchMailboxes(ctx)
+}
+
+// fetchMailboxes gets all mailboxes from the server and caches them
+func (c *Client) fetchMailboxes(ctx context.Context) ([]Mailbox, error) {
+	calls := []Invocation{
+		NewInvocation("Mailbox/get", map[string]interface{}{
+			"accountId": c.accountID,
+		}, "0"),
+	}
+
+	resp, err := c.CallContext(ctx, calls)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.MethodResponses) < 1 {
+		return nil, fmt.Errorf("unexpected response")
+	}
+
+	mr, err := ParseMethodResponse(resp.MethodResponses[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if err := mr.Err(); err != nil {
+		return nil, err
+	}
+
+	var mailboxResp MailboxGetResponse
+	if err := json.Unmarshal(mr.Args, &mailboxResp); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.mailboxes = mailboxResp.List
+	c.mu.Unlock()
+	return mailboxResp.List, nil
+}
+
+// forgetMailboxes drops the cached mailboxes, so the next lookup fetches them
+func (c *Client) forgetMailboxes() {
+	c.mu.Lock()
+	c.mailboxes = nil
+	c.mu.Unlock()
+}
+
+// resolveMailboxID finds a mailbox of the account by role or name. A name
+// not in the cache is looked up again on the server, in case the mailbox
+// was created since.
+func (c *Client) resolveMailboxID(ctx context.Context, name string) (string, error) {
+	mailboxes, err := c.getMailboxes(ctx)
+	if err != nil {
+		return "", err
+	}
+	if id, err := FindMailbox(mailboxes, name); err == nil {
+		return id, nil
+	}
+
+	if mailboxes, err = c.fetchMailboxes(ctx); err != nil {
+		return "", err
+	}
+	return FindMailbox(mailboxes, name)
+}
+
+// FindMailbox finds a mailbox by role (inbox, trash, junk, ...) or by name,
+// ignoring case, and returns its ID
+func FindMailbox(mailboxes []Mailbox, name string) (string, error) {
+	// "spam" is what people type; "junk" is the JMAP role
+	role := strings.ToLower(name)
+	if role == "spam" {
+		role = "junk"
+	}
+
+	for _, mb := range mailboxes {
+		if mb.Role != "" && mb.Role == role {
+			return mb.ID, nil
+		}
+	}
+	for _, mb := range mailboxes {
+		if strings.EqualFold(mb.Name, name) {
+			return mb.ID, nil
+		}
+	}
+
+	return "", fmt.Errorf("mailbox %q not found", name)
+}
+
+// MailboxScope is the mailbox restriction of a search, by mailbox ID
+type MailboxScope struct {
+	In      string   // only emails in this mailbox
+	Exclude []string // only emails in some mailbox other than these
+}
+
+// ResolveMailboxScope resolves the mailbox options of a search for query q.
+// ExcludeMailboxes are defaults: they are dropped when the query names a
+// mailbox with an in: term that isn't negated, and InMailbox is never
+// excluded, so -in spam finds spam. Excluded mailboxes that don't exist in
+// the account are ignored, so the defaults work on accounts without e.g. a
+// junk folder.
+func ResolveMailboxScope(q Query, opts SearchOptions, resolve MailboxResolver) (MailboxScope, error) {
+	var scope MailboxScope
+	if opts.InMailbox != "" {
+		id, err := resolve(opts.InMailbox)
+		if err != nil {
+			return scope, err
+		}
+		scope.In = id
+	}
+
+	for _, clause := range q.Clauses {
+		for _, term := range clause {
+			if term.Field == "in" && !term.Negate {
+				return scope, nil
+			}
+		}
+	}
+	for _, name := range opts.ExcludeMailboxes {
+		if id, err := resolve(name); err == nil && id != scope.In {
+			scope.Exclude = append(scope.Exclude, id)
+		}
+	}
+	return scope, nil
+}
+
+// mailboxScope turns the mailbox options of a search into filter conditions
+func (c *Client) mailboxScope(ctx context.Context, q Query, opts SearchOptions) ([]interface{}, error) {
+	scope, err := ResolveMailboxScope(q, opts, func(name string) (string, error) {
+		return c.resolveMailboxID(ctx, name)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var conditions []interface{}
+	if scope.In != "" {
+		conditions = append(conditions, map[string]interface{}{"inMailbox": scope.In})
+	}
+	if len(scope.Exclude) > 0 {
+		conditions = append(conditions, map[string]interface{}{"inMailboxOtherThan": scope.Exclude})
+	}
+	return conditions, nil
+}
+
+// annotateMailboxes fills in Email.MailboxNames. Lookup failures leave the
+// names empty rather than failing the fetch.
+func (c *Client) annotateMailboxes(ctx context.Context, emails []Email) {
+	mailboxes, err := c.getMailboxes(ctx)
+	if err != nil {
+		return
+	}
+	AnnotateMailboxes(emails, mailboxes)
+}
+
+// AnnotateMailboxes fills in Email.MailboxNames from a mailbox list
+func AnnotateMailboxes(emails []Email, mailboxes []Mailbox) {
+	names := make(map[string]string, len(mailboxes))
+	for _, mb := range mailboxes {
+		names[mb.ID] = mb.Name
+	}
+
+	for i := range emails {
+		emails[i].MailboxNames = nil
+		for id, in := range emails[i].MailboxIDs {
+			if !in {
+				continue
+			}
+			if name, ok := names[id]; ok {
+				emails[i].MailboxNames = append(emails[i].MailboxNames, name)
+			}
+		}
+		sort.Strings(emails[i].MailboxNames)
+	}
+}
@@ -0,0 +1,46 @@
+package jmap_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/stevemurr/fastmail-agent/jmap"
+)
+
+func TestGetMailboxesFetchesAgain(t *testing.T) {
+	srv, client := newTestClient(t)
+
+	before, err := client.GetMailboxes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.AddMailbox(jmap.Mailbox{ID: "receipts", Name: "Receipts", SortOrder: 10})
+	after, err := client.GetMailboxes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(before)+1 || after[len(after)-1].Name != "Receipts" {
+		t.Errorf("mailboxes after one was created = %+v", after)
+	}
+}
+
+func TestResolveNewMailbox(t *testing.T) {
+	srv, client := newTestClient(t)
+
+	// The first search caches the mailboxes
+	if _, err := client.SearchEmails("", jmap.SearchOptions{InMailbox: "inbox"}); err != nil {
+		t.Fatal(err)
+	}
+	srv.AddMailbox(jmap.Mailbox{ID: "receipts", Name: "Receipts", SortOrder: 10})
+
+	if _, err := client.MoveEmails([]string{"M1"}, "Receipts", jmap.SetOptions{}); err != nil {
+		t.Fatalf("moving to a new mailbox: %v", err)
+	}
+	res, err := client.SearchEmails("in:receipts", jmap.SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := emailIDs(res.Emails); !reflect.DeepEqual(got, []string{"M1"}) {
+		t.Errorf("Receipts holds %v, want [M1]", got)
+	}
+}
@@ -0,0 +1,247 @@
+package jmap
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// QueryTerm is a single search condition such as from:alice, -is:unread or a
+// bare word
+type QueryTerm struct {
+	Field  string // empty for free text, otherwise from, to, cc, bcc, subject, has, before, after, in, is
+	Value  string
+	Phrase bool // value was quoted
+	Negate bool
+}
+
+// Query is a parsed search expression. Terms are grouped into clauses that
+// are ANDed together; the terms inside a clause are ORed.
+type Query struct {
+	Clauses [][]QueryTerm
+}
+
+// MailboxResolver maps a mailbox name or role (as written in in:<mailbox>) to
+// its JMAP mailbox ID
+type MailboxResolver func(name string) (string, error)
+
+// queryFields lists the field prefixes understood by ParseQuery. Anything else
+// containing a colon (e.g. a URL) is treated as free text.
+var queryFields = map[string]bool{
+	"from": true, "to": true, "cc": true, "bcc": true, "subject": true,
+	"has": true, "before": true, "after": true, "in": true, "is": true,
+}
+
+// dateLayouts are the accepted formats for before: and after:
+var dateLayouts = []string{"2006-01-02", "2006/01/02", time.RFC3339}
+
+// ParseQuery parses a search string such as
+//
+//	from:alice@example.com subject:"q3 report" -in:spam invoice OR receipt
+//
+// Adjacent terms are ANDed; OR binds the terms on either side of it. A leading
+// "-" negates a term and double quotes group words into a phrase.
+func ParseQuery(input string) (Query, error) {
+	tokens, err := tokenizeQuery(input)
+	if err != nil {
+		return Query{}, err
+	}
+
+	var q Query
+	joinNext := false
+	for _, tok := range tokens {
+		if tok == "OR" {
+			joinNext = len(q.Clauses) > 0
+			continue
+		}
+
+		term, err := parseQueryTerm(tok)
+		if err != nil {
+			return Query{}, err
+		}
+
+		if joinNext {
+			last := len(q.Clauses) - 1
+			q.Clauses[last] = append(q.Clauses[last], term)
+			joinNext = false
+		} else {
+			q.Clauses = append(q.Clauses, []QueryTerm{term})
+		}
+	}
+
+	return q, nil
+}
+
+// tokenizeQuery splits on whitespace, keeping quoted sections together. The
+// quotes are kept in the token so parseQueryTerm can tell phrases apart.
+func tokenizeQuery(input string) ([]string, error) {
+	var tokens []string
+	var cur strings.Builder
+	inQuote := false
+
+	for _, r := range input {
+		switch {
+		case r == '"':
+			inQuote = !inQuote
+			cur.WriteRune(r)
+		case unicode.IsSpace(r) && !inQuote:
+			if cur.Len() > 0 {
+				tokens = append(tokens, cur.String())
+				cur.Reset()
+			}
+		default:
+			cur.WriteRune(r)
+		}
+	}
+
+	if inQuote {
+		return nil, fmt.Errorf("unterminated quote in query %q", input)
+	}
+	if cur.Len() > 0 {
+		tokens = append(tokens, cur.String())
+	}
+
+	return tokens, nil
+}
+
+// parseQueryTerm parses one token into a term
+func parseQueryTerm(tok string) (QueryTerm, error) {
+	var term QueryTerm
+
+	if len(tok) > 1 && tok[0] == '-' {
+		term.Negate = true
+		tok = tok[1:]
+	}
+
+	if idx := strings.Index(tok, ":"); idx > 0 && !strings.HasPrefix(tok, `"`) {
+		field := strings.ToLower(tok[:idx])
+		if queryFields[field] {
+			term.Field = field
+			tok = tok[idx+1:]
+			if tok == "" {
+				return term, fmt.Errorf("missing value for %s:", field)
+			}
+		}
+	}
+
+	if len(tok) >= 2 && strings.HasPrefix(tok, `"`) && strings.HasSuffix(tok, `"`) {
+		term.Phrase = true
+		tok = tok[1 : len(tok)-1]
+	}
+	term.Value = tok
+
+	return term, nil
+}
+
+// Compile converts the query into a JMAP FilterCondition/FilterOperator tree
+// for Email/query. resolve is only called for in: terms and may be nil if the
+// query has none.
+func (q Query) Compile(resolve MailboxResolver) (map[string]interface{}, error) {
+	var conditions []interface{}
+
+	for _, clause := range q.Clauses {
+		var alternatives []interface{}
+		for _, term := range clause {
+			cond, err := term.compile(resolve)
+			if err != nil {
+				return nil, err
+			}
+			alternatives = append(alternatives, cond)
+		}
+		conditions = append(conditions, combineFilters("OR", alternatives))
+	}
+
+	return combineFilters("AND", conditions), nil
+}
+
+// combineFilters wraps conditions in a FilterOperator, collapsing the
+// trivial cases
+func combineFilters(operator string, conditions []interface{}) map[string]interface{} {
+	switch len(conditions) {
+	case 0:
+		return map[string]interface{}{}
+	case 1:
+		return conditions[0].(map[string]interface{})
+	}
+	return map[string]interface{}{
+		"operator":   operator,
+		"conditions": conditions,
+	}
+}
+
+// compile converts a single term into a FilterCondition
+func (t QueryTerm) compile(resolve MailboxResolver) (map[string]interface{}, error) {
+	var cond map[string]interface{}
+
+	switch t.Field {
+	case "":
+		value := t.Value
+		if t.Phrase {
+			value = `"` + value + `"`
+		}
+		cond = map[string]interface{}{"text": value}
+
+	case "from", "to", "cc", "bcc", "subject":
+		cond = map[string]interface{}{t.Field: t.Value}
+
+	case "has":
+		if !strings.EqualFold(t.Value, "attachment") {
+			return nil, fmt.Errorf("unsupported has:%s (only has:attachment)", t.Value)
+		}
+		cond = map[string]interface{}{"hasAttachment": !t.Negate}
+		return cond, nil
+
+	case "before", "after":
+		date, err := ParseQueryDate(t.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: date %q", t.Field, t.Value)
+		}
+		cond = map[string]interface{}{t.Field: date.UTC().Format(time.RFC3339)}
+
+	case "in":
+		if resolve == nil {
+			return nil, fmt.Errorf("in:%s requires mailbox lookup", t.Value)
+		}
+		id, err := resolve(t.Value)
+		if err != nil {
+			return nil, err
+		}
+		if t.Negate {
+			return map[string]interface{}{"inMailboxOtherThan": []string{id}}, nil
+		}
+		return map[string]interface{}{"inMailbox": id}, nil
+
+	case "is":
+		switch strings.ToLower(t.Value) {
+		case "unread":
+			cond = map[string]interface{}{"notKeyword": "$seen"}
+		case "read":
+			cond = map[string]interface{}{"hasKeyword": "$seen"}
+		case "flagged", "starred":
+			cond = map[string]interface{}{"hasKeyword": "$flagged"}
+		default:
+			return nil, fmt.Errorf("unsupported is:%s (use unread, read or flagged)", t.Value)
+		}
+	}
+
+	if t.Negate {
+		return map[string]interface{}{
+			"operator":   "NOT",
+			"conditions": []interface{}{cond},
+		}, nil
+	}
+	return cond, nil
+}
+
+// ParseQueryDate parses a before:/after: value in local time
+func ParseQueryDate(value string) (time.Time, error) {
+	var err error
+	for _, layout := range dateLayouts {
+		var t time.Time
+		if t, err = time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
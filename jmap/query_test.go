@@ -0,0 +1,186 @@
+package jmap_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stevemurr/fastmail-agent/jmap"
+)
+
+func TestParseQuery(t *testing.T) {
+	q, err := jmap.ParseQuery(`from:alice@example.com subject:"q3 report" -in:spam invoice OR receipt https://example.com/a:b`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]jmap.QueryTerm{
+		{{Field: "from", Value: "alice@example.com"}},
+		{{Field: "subject", Value: "q3 report", Phrase: true}},
+		{{Field: "in", Value: "spam", Negate: true}},
+		{{Value: "invoice"}, {Value: "receipt"}},
+		{{Value: "https://example.com/a:b"}},
+	}
+	if !reflect.DeepEqual(q.Clauses, want) {
+		t.Errorf("clauses = %+v, want %+v", q.Clauses, want)
+	}
+}
+
+func TestResolveMailboxScope(t *testing.T) {
+	resolve := func(name string) (string, error) {
+		if name == "nowhere" {
+			return "", fmt.Errorf("no mailbox %q", name)
+		}
+		return "mb-" + name, nil
+	}
+	defaults := []string{"spam", "trash", "nowhere"}
+
+	tests := []struct {
+		query string
+		in    string
+		want  jmap.MailboxScope
+	}{
+		{"invoice", "", jmap.MailboxScope{Exclude: []string{"mb-spam", "mb-trash"}}},
+		{"invoice", "inbox", jmap.MailboxScope{In: "mb-inbox", Exclude: []string{"mb-spam", "mb-trash"}}},
+		// The searched mailbox is never excluded
+		{"invoice", "spam", jmap.MailboxScope{In: "mb-spam", Exclude: []string{"mb-trash"}}},
+		// in: in the query drops the defaults, but -in: doesn't
+		{"in:spam", "", jmap.MailboxScope{}},
+		{"-in:inbox", "", jmap.MailboxScope{Exclude: []string{"mb-spam", "mb-trash"}}},
+	}
+	for _, tt := range tests {
+		q, err := jmap.ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := jmap.ResolveMailboxScope(q, jmap.SearchOptions{InMailbox: tt.in, ExcludeMailboxes: defaults}, resolve)
+		if err != nil {
+			t.Errorf("%q in %q: %v", tt.query, tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q in %q = %+v, want %+v", tt.query, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	for _, input := range []string{`subject:"unterminated`, `from:`} {
+		if _, err := jmap.ParseQuery(input); err == nil {
+			t.Errorf("ParseQuery(%q) succeeded", input)
+		}
+	}
+}
+
+func TestCompile(t *testing.T) {
+	resolve := func(name string) (string, error) {
+		if name == "inbox" {
+			return "mb-inbox", nil
+		}
+		return "", fmt.Errorf("no mailbox %q", name)
+	}
+	after, _ := time.ParseInLocation("2006-01-02", "2024-03-01", time.Local)
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{`invoice`, `{"text":"invoice"}`},
+		{`"quarterly invoice"`, `{"text":"\"quarterly invoice\""}`},
+		{`from:alice to:bob`, `{"conditions":[{"from":"alice"},{"to":"bob"}],"operator":"AND"}`},
+		{`lunch OR invoice`, `{"conditions":[{"text":"lunch"},{"text":"invoice"}],"operator":"OR"}`},
+		{`-from:bob`, `{"conditions":[{"from":"bob"}],"operator":"NOT"}`},
+		{`has:attachment`, `{"hasAttachment":true}`},
+		{`-has:attachment`, `{"hasAttachment":false}`},
+		{`is:unread`, `{"notKeyword":"$seen"}`},
+		{`is:starred`, `{"hasKeyword":"$flagged"}`},
+		{`in:inbox`, `{"inMailbox":"mb-inbox"}`},
+		{`-in:inbox`, `{"inMailboxOtherThan":["mb-inbox"]}`},
+		{`after:2024-03-01`, `{"after":"` + after.UTC().Format(time.RFC3339) + `"}`},
+		{``, `{}`},
+	}
+	for _, tt := range tests {
+		q, err := jmap.ParseQuery(tt.query)
+		if err != nil {
+			t.Fatalf("ParseQuery(%q): %v", tt.query, err)
+		}
+		filter, err := q.Compile(resolve)
+		if err != nil {
+			t.Errorf("Compile(%q): %v", tt.query, err)
+			continue
+		}
+		got, _ := json.Marshal(filter)
+		if string(got) != tt.want {
+			t.Errorf("Compile(%q) = %s, want %s", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, query := range []string{`has:pdf`, `is:bogus`, `before:yesterday`, `in:nowhere`} {
+		q, err := jmap.ParseQuery(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resolve := func(name string) (string, error) { return "", fmt.Errorf("no mailbox %q", name) }
+		if _, err := q.Compile(resolve); err == nil {
+			t.Errorf("Compile(%q) succeeded", query)
+		}
+	}
+	q, _ := jmap.ParseQuery("in:inbox")
+	if _, err := q.Compile(nil); err == nil || !strings.Contains(err.Error(), "mailbox lookup") {
+		t.Errorf("Compile without a resolver: %v", err)
+	}
+}
+
+// TestSearchFilters runs compiled queries against the fake server
+func TestSearchFilters(t *testing.T) {
+	_, client := newTestClient(t)
+
+	tests := []struct {
+		query   string
+		exclude []string
+		want    []string
+	}{
+		{"from:alice", nil, []string{"M3", "M1"}},
+		{"has:attachment", nil, []string{"M1"}},
+		{"is:flagged", nil, []string{"M3"}},
+		{"is:unread", nil, []string{"M5", "M4"}},
+		{"in:inbox -from:alice", nil, []string{"M4"}},
+		{"lunch OR invoice", nil, []string{"M4", "M3", "M2", "M1"}},
+		{`"paid today"`, nil, []string{"M2"}},
+		{"after:2024-03-03", nil, []string{"M5", "M4"}},
+		{"in:junk", nil, []string{"M5"}},
+		{"", []string{"spam", "trash"}, []string{"M4", "M3", "M2", "M1"}},
+		{"in:spam", []string{"spam", "trash"}, []string{"M5"}},
+		{"-in:inbox", []string{"spam", "trash"}, []string{"M2"}},
+	}
+	for _, tt := range tests {
+		res, err := client.SearchEmails(tt.query, jmap.SearchOptions{ExcludeMailboxes: tt.exclude})
+		if err != nil {
+			t.Errorf("SearchEmails(%q): %v", tt.query, err)
+			continue
+		}
+		if got := emailIDs(res.Emails); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SearchEmails(%q) = %v, want %v", tt.query, got, tt.want)
+		}
+		if res.Total != len(tt.want) {
+			t.Errorf("SearchEmails(%q) total = %d, want %d", tt.query, res.Total, len(tt.want))
+		}
+	}
+}
+
+func TestSearchExcludedMailbox(t *testing.T) {
+	_, client := newTestClient(t)
+
+	// Searching Spam itself finds spam despite the default exclusions
+	res, err := client.SearchEmails("", jmap.SearchOptions{InMailbox: "spam", ExcludeMailboxes: []string{"spam", "trash"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := emailIDs(res.Emails); !reflect.DeepEqual(got, []string{"M5"}) {
+		t.Errorf("spam holds %v, want [M5]", got)
+	}
+}
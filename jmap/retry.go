@@ -0,0 +1,192 @@
+package jmap
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultTimeout bounds each API request, including reading the response,
+// and how long blob downloads wait for the server to respond
+const DefaultTimeout = 60 * time.Second
+
+// RetryPolicy controls how the client retries requests that failed for
+// reasons likely to be temporary
+type RetryPolicy struct {
+	MaxRetries    int           // retries after the first attempt; 0 disables retrying
+	BaseDelay     time.Duration // delay before the first retry, doubled for each one after
+	MaxDelay      time.Duration // cap on the doubled delay
+	MaxRetryAfter time.Duration // longest Retry-After the client waits before giving up
+}
+
+// DefaultRetryPolicy retries for up to about half a minute
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries:    4,
+	BaseDelay:     500 * time.Millisecond,
+	MaxDelay:      15 * time.Second,
+	MaxRetryAfter: 2 * time.Minute,
+}
+
+// backoff returns the delay before retry number attempt (0-based): the
+// doubled base delay with jitter, so clients that failed together don't
+// retry together
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.BaseDelay << attempt
+	if d <= 0 || d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	// Somewhere between half and all of d
+	half := int64(d / 2)
+	return time.Duration(half + rand.Int64N(half+1))
+}
+
+// retryAfter parses a Retry-After header, in seconds or as an HTTP date. It
+// returns 0 when the header is missing or invalid.
+func retryAfter(h http.Header) time.Duration {
+	v := strings.TrimSpace(h.Get("Retry-After"))
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// retryableStatus reports whether a status is worth retrying. 429 and 503
+// mean the server did not process the request, so they are safe to retry
+// for any request; other 5xx errors only for idempotent ones.
+func retryableStatus(status int, idempotent bool) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return true
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusGatewayTimeout:
+		return idempotent
+	}
+	return false
+}
+
+// do sends the request built by newRequest, retrying transient failures
+// according to the client's policy. Transport errors are only retried for
+// idempotent requests, since the server may have acted on the first one. On
+// the final attempt the response is returned as is for the caller to report.
+// Each attempt, reading the response body included, is bounded by timeout
+// unless it is zero.
+func (c *Client) do(ctx context.Context, newRequest func() (*http.Request, error), idempotent bool, timeout time.Duration) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		var attemptCtx context.Context
+		var cancel context.CancelFunc
+		if timeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, timeout)
+		} else {
+			attemptCtx, cancel = context.WithCancel(ctx)
+		}
+		req = req.WithContext(attemptCtx)
+		req.Header.Set("Authorization", "Bearer "+c.token)
+
+		last := attempt >= c.retry.MaxRetries
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			cancel()
+			if last || !idempotent || ctx.Err() != nil {
+				return nil, err
+			}
+			if err := sleep(ctx, c.retry.backoff(attempt)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		resp.Body = cancelOnClose{resp.Body, cancel}
+
+		if last || !retryableStatus(resp.StatusCode, idempotent) {
+			return resp, nil
+		}
+
+		delay := c.retry.backoff(attempt)
+		if after := retryAfter(resp.Header); after > 0 {
+			if after > c.retry.MaxRetryAfter {
+				return resp, nil
+			}
+			delay = after
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if err := sleep(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// cancelOnClose releases an attempt's context once its response body is done
+// with
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// sleep waits for d, returning early with ctx's error if it is done first
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// retryableMethodErrors are method-level errors that mean "try again later"
+var retryableMethodErrors = map[string]bool{
+	"serverUnavailable": true,
+	"rateLimit":         true,
+}
+
+// retryableError returns the type of the first method error in the response
+// that is worth retrying, or ""
+func (r *Response) retryableError() string {
+	for _, raw := range r.MethodResponses {
+		mr, err := ParseMethodResponse(raw)
+		if err != nil {
+			continue
+		}
+		var methodErr *MethodError
+		if errors.As(mr.Err(), &methodErr) && retryableMethodErrors[methodErr.Type] {
+			return methodErr.Type
+		}
+	}
+	return ""
+}
+
+// readOnly reports whether every method in the request only reads, so the
+// whole request can be sent again safely
+func (r Request) readOnly() bool {
+	for _, call := range r.MethodCalls {
+		name, _ := call[0].(string)
+		switch {
+		case strings.HasSuffix(name, "/get"), strings.HasSuffix(name, "/query"),
+			strings.HasSuffix(name, "/changes"), strings.HasSuffix(name, "/queryChanges"):
+		default:
+			return false
+		}
+	}
+	return true
+}
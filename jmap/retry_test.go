@@ -0,0 +1,149 @@
+package jmap_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stevemurr/fastmail-agent/jmap"
+	"github.com/stevemurr/fastmail-agent/jmaptest"
+)
+
+// fastRetries makes client retry without the default's long delays
+func fastRetries(client *jmap.Client, retries int) {
+	client.SetRetryPolicy(jmap.RetryPolicy{
+		MaxRetries:    retries,
+		BaseDelay:     time.Millisecond,
+		MaxDelay:      5 * time.Millisecond,
+		MaxRetryAfter: time.Second,
+	})
+}
+
+// failedWith reports whether err is a request error with status
+func failedWith(err error, status int) bool {
+	var reqErr *jmap.RequestError
+	return errors.As(err, &reqErr) && reqErr.Status == status
+}
+
+// methodCalls counts the calls of a method the server received
+func methodCalls(srv *jmaptest.Server, method string) int {
+	n := 0
+	for _, req := range srv.Requests() {
+		for _, call := range req.MethodCalls {
+			if call[0] == method {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func TestRetryTransientFailures(t *testing.T) {
+	for _, status := range []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusBadGateway} {
+		srv, client := newTestClient(t)
+		fastRetries(client, 3)
+
+		srv.FailNext(2, status, 0)
+		res, err := client.SearchEmails("from:alice", jmap.SearchOptions{})
+		if err != nil {
+			t.Fatalf("status %d: %v", status, err)
+		}
+		if len(res.Emails) != 2 {
+			t.Errorf("status %d: %d emails, want 2", status, len(res.Emails))
+		}
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	srv, client := newTestClient(t)
+	fastRetries(client, 2)
+
+	srv.FailNext(3, http.StatusServiceUnavailable, 0)
+	if _, err := client.SearchEmails("", jmap.SearchOptions{}); !failedWith(err, http.StatusServiceUnavailable) {
+		t.Fatalf("after the last retry: %v, want the 503", err)
+	}
+
+	// Every attempt was used up, so the next request goes through
+	if _, err := client.SearchEmails("", jmap.SearchOptions{}); err != nil {
+		t.Errorf("after the failures: %v", err)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	srv, client := newTestClient(t)
+	fastRetries(client, 2)
+
+	srv.FailNext(1, http.StatusTooManyRequests, time.Second)
+	start := time.Now()
+	if _, err := client.SearchEmails("", jmap.SearchOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(start); waited < time.Second {
+		t.Errorf("retried after %v, before Retry-After", waited)
+	}
+
+	// A Retry-After longer than the policy allows is reported at once
+	client.SetRetryPolicy(jmap.RetryPolicy{MaxRetries: 2, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, MaxRetryAfter: 500 * time.Millisecond})
+	srv.FailNext(1, http.StatusTooManyRequests, 2*time.Second)
+	start = time.Now()
+	if _, err := client.SearchEmails("", jmap.SearchOptions{}); !failedWith(err, http.StatusTooManyRequests) {
+		t.Fatalf("long Retry-After: %v, want the 429", err)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("waited %v for a Retry-After past the limit", waited)
+	}
+}
+
+func TestRetryWrites(t *testing.T) {
+	srv, client := newTestClient(t)
+	fastRetries(client, 3)
+
+	// A 500 may come after the server acted, so a write is not sent again
+	srv.FailNext(1, http.StatusInternalServerError, 0)
+	if _, err := client.MarkRead([]string{"M4"}, true, jmap.SetOptions{}); !failedWith(err, http.StatusInternalServerError) {
+		t.Fatalf("write after a 500: %v, want the 500", err)
+	}
+	if n := methodCalls(srv, "Email/set"); n != 0 {
+		t.Errorf("Email/set reached the server %d times", n)
+	}
+
+	// 503 means the server did nothing, so even a write is retried
+	srv.FailNext(2, http.StatusServiceUnavailable, 0)
+	res, err := client.MarkRead([]string{"M4"}, true, jmap.SetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Updated) != 1 || methodCalls(srv, "Email/set") != 1 {
+		t.Errorf("updated %v with %d Email/set calls", res.Updated, methodCalls(srv, "Email/set"))
+	}
+}
+
+func TestNoRetries(t *testing.T) {
+	srv, client := newTestClient(t)
+	fastRetries(client, 0)
+
+	srv.FailNext(1, http.StatusServiceUnavailable, 0)
+	if _, err := client.SearchEmails("", jmap.SearchOptions{}); err == nil {
+		t.Error("succeeded with retries off")
+	}
+}
+
+func TestRetryStopsWithContext(t *testing.T) {
+	srv, client := newTestClient(t)
+	fastRetries(client, 2)
+
+	// The context ends while the client waits out the Retry-After
+	srv.FailNext(1, http.StatusServiceUnavailable, time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := client.SearchEmailsContext(ctx, "", jmap.SearchOptions{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("%v, want the context's deadline", err)
+	}
+	if waited := time.Since(start); waited > 500*time.Millisecond {
+		t.Errorf("returned after %v, not when the context ended", waited)
+	}
+}
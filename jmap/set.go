@@ -0,0 +1,306 @@
+package jmap
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Standard JMAP keywords
+const (
+	KeywordSeen    = "$seen"
+	KeywordFlagged = "$flagged"
+	KeywordDraft   = "$draft"
+)
+
+// setBatchSize caps how many emails one Email/set call touches, further
+// capped by the server's maxObjectsInSet. Larger batches are sent as
+// consecutive requests, each conditional on the state left by the previous
+// one.
+const setBatchSize = 100
+
+// ErrStateMismatch is returned when ifInState no longer matches the server,
+// i.e. the mailbox changed since the caller last looked at it
+var ErrStateMismatch = errors.New("email state changed on the server")
+
+// SetOptions controls an Email/set call
+type SetOptions struct {
+	// IfInState makes the change conditional on the account's Email state,
+	// as reported by SearchResult.State. Empty means unconditional.
+	IfInState string
+}
+
+// SetError describes why a single email could not be changed
+type SetError struct {
+	Type        string `json:"type"`
+	Description string `json:"description,omitempty"`
+}
+
+// Error implements the error interface
+func (e SetError) Error() string {
+	if e.Description != "" {
+		return e.Type + ": " + e.Description
+	}
+	return e.Type
+}
+
+// SetResult summarizes the outcome of a batched Email/set
+type SetResult struct {
+	Updated   []string
+	Destroyed []string
+	Failed    map[string]SetError // email ID -> reason
+	OldState  string
+	NewState  string
+}
+
+// setResponse is the response from a Foo/set method such as Email/set
+type setResponse struct {
+	AccountID    string                     `json:"accountId"`
+	OldState     string                     `json:"oldState"`
+	NewState     string                     `json:"newState"`
+	Created      map[string]json.RawMessage `json:"created"`
+	Updated      map[string]json.RawMessage `json:"updated"`
+	Destroyed    []string                   `json:"destroyed"`
+	NotCreated   map[string]SetError        `json:"notCreated"`
+	NotUpdated   map[string]SetError        `json:"notUpdated"`
+	NotDestroyed map[string]SetError        `json:"notDestroyed"`
+}
+
+// SetKeyword adds or removes a keyword such as $seen or $flagged on every
+// given email
+func (c *Client) SetKeyword(ids []string, keyword string, value bool, opts SetOptions) (*SetResult, error) {
+	return c.SetKeywordContext(context.Background(), ids, keyword, value, opts)
+}
+
+// SetKeywordContext is like SetKeyword but stops when ctx is done
+func (c *Client) SetKeywordContext(ctx context.Context, ids []string, keyword string, value bool, opts SetOptions) (*SetResult, error) {
+	patch := map[string]interface{}{"keywords/" + keyword: nil}
+	if value {
+		patch["keywords/"+keyword] = true
+	}
+	return c.updateEmails(ctx, ids, patch, opts)
+}
+
+// MarkRead sets or clears $seen
+func (c *Client) MarkRead(ids []string, read bool, opts SetOptions) (*SetResult, error) {
+	return c.MarkReadContext(context.Background(), ids, read, opts)
+}
+
+// MarkReadContext is like MarkRead but stops when ctx is done
+func (c *Client) MarkReadContext(ctx context.Context, ids []string, read bool, opts SetOptions) (*SetResult, error) {
+	return c.SetKeywordContext(ctx, ids, KeywordSeen, read, opts)
+}
+
+// SetFlagged sets or clears $flagged
+func (c *Client) SetFlagged(ids []string, flagged bool, opts SetOptions) (*SetResult, error) {
+	return c.SetFlaggedContext(context.Background(), ids, flagged, opts)
+}
+
+// SetFlaggedContext is like SetFlagged but stops when ctx is done
+func (c *Client) SetFlaggedContext(ctx context.Context, ids []string, flagged bool, opts SetOptions) (*SetResult, error) {
+	return c.SetKeywordContext(ctx, ids, KeywordFlagged, flagged, opts)
+}
+
+// MoveEmails moves emails into a single mailbox, given by name or role,
+// removing them from every other mailbox
+func (c *Client) MoveEmails(ids []string, mailbox string, opts SetOptions) (*SetResult, error) {
+	return c.MoveEmailsContext(context.Background(), ids, mailbox, opts)
+}
+
+// MoveEmailsContext is like MoveEmails but stops when ctx is done
+func (c *Client) MoveEmailsContext(ctx context.Context, ids []string, mailbox string, opts SetOptions) (*SetResult, error) {
+	id, err := c.resolveMailboxID(ctx, mailbox)
+	if err != nil {
+		return nil, err
+	}
+	patch := map[string]interface{}{
+		"mailboxIds": map[string]bool{id: true},
+	}
+	return c.updateEmails(ctx, ids, patch, opts)
+}
+
+// ArchiveEmails moves emails to the mailbox with the archive role
+func (c *Client) ArchiveEmails(ids []string, opts SetOptions) (*SetResult, error) {
+	return c.ArchiveEmailsContext(context.Background(), ids, opts)
+}
+
+// ArchiveEmailsContext is like ArchiveEmails but stops when ctx is done
+func (c *Client) ArchiveEmailsContext(ctx context.Context, ids []string, opts SetOptions) (*SetResult, error) {
+	return c.MoveEmailsContext(ctx, ids, "archive", opts)
+}
+
+// TrashEmails moves emails to the mailbox with the trash role
+func (c *Client) TrashEmails(ids []string, opts SetOptions) (*SetResult, error) {
+	return c.TrashEmailsContext(context.Background(), ids, opts)
+}
+
+// TrashEmailsContext is like TrashEmails but stops when ctx is done
+func (c *Client) TrashEmailsContext(ctx context.Context, ids []string, opts SetOptions) (*SetResult, error) {
+	return c.MoveEmailsContext(ctx, ids, "trash", opts)
+}
+
+// DestroyEmails permanently deletes emails. Prefer TrashEmails unless the
+// caller really means it.
+func (c *Client) DestroyEmails(ids []string, opts SetOptions) (*SetResult, error) {
+	return c.DestroyEmailsContext(context.Background(), ids, opts)
+}
+
+// DestroyEmailsContext is like DestroyEmails but stops when ctx is done
+func (c *Client) DestroyEmailsContext(ctx context.Context, ids []string, opts SetOptions) (*SetResult, error) {
+	return c.setEmails(ctx, ids, opts, func(batch []string) map[string]interface{} {
+		return map[string]interface{}{"destroy": batch}
+	})
+}
+
+// updateEmails applies the same patch to every email
+func (c *Client) updateEmails(ctx context.Context, ids []string, patch map[string]interface{}, opts SetOptions) (*SetResult, error) {
+	return c.setEmails(ctx, ids, opts, func(batch []string) map[string]interface{} {
+		update := make(map[string]interface{}, len(batch))
+		for _, id := range batch {
+			update[id] = patch
+		}
+		return map[string]interface{}{"update": update}
+	})
+}
+
+// setEmails sends Email/set in batches. args builds the update or destroy
+// arguments for one batch. Each batch is conditional on the state the
+// previous one produced, so a concurrent change aborts the rest.
+func (c *Client) setEmails(ctx context.Context, ids []string, opts SetOptions, args func(batch []string) map[string]interface{}) (*SetResult, error) {
+	result := &SetResult{Failed: make(map[string]SetError)}
+	// Sorted on every return, since a failed batch still returns the ones before it
+	defer func() { sort.Strings(result.Updated) }()
+	if len(ids) == 0 {
+		return result, nil
+	}
+	// Moves and destroys change mailbox counts
+	defer c.forgetMailboxes()
+
+	batchSize := setBatchSize
+	if limit := c.Limits().MaxObjectsInSet; batchSize > limit {
+		batchSize = limit
+	}
+
+	state := opts.IfInState
+	for start := 0; start < len(ids); start += batchSize {
+		end := start + batchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		callArgs := args(ids[start:end])
+		callArgs["accountId"] = c.accountID
+		if state != "" {
+			callArgs["ifInState"] = state
+		}
+
+		resp, err := c.CallContext(ctx, []Invocation{NewInvocation("Email/set", callArgs, "0")})
+		if err != nil {
+			return result, err
+		}
+
+		if len(resp.MethodResponses) < 1 {
+			return result, fmt.Errorf("unexpected response")
+		}
+
+		mr, err := ParseMethodResponse(resp.MethodResponses[0])
+		if err != nil {
+			return result, err
+		}
+
+		// A stateMismatch error matches ErrStateMismatch
+		if err := mr.Err(); err != nil {
+			return result, err
+		}
+
+		var setResp setResponse
+		if err := json.Unmarshal(mr.Args, &setResp); err != nil {
+			return result, err
+		}
+
+		if result.OldState == "" {
+			result.OldState = setResp.OldState
+		}
+		result.NewState = setResp.NewState
+		for id := range setResp.Updated {
+			result.Updated = append(result.Updated, id)
+		}
+		result.Destroyed = append(result.Destroyed, setResp.Destroyed...)
+		for id, e := range setResp.NotUpdated {
+			result.Failed[id] = e
+		}
+		for id, e := range setResp.NotDestroyed {
+			result.Failed[id] = e
+		}
+
+		// Chain the next batch only when the caller asked for concurrency control
+		if state != "" {
+			state = setResp.NewState
+		}
+	}
+
+	return result, nil
+}
+
+// ThreadEmailIDs returns the IDs of every email a handle refers to without
+// fetching message content
+func (c *Client) ThreadEmailIDs(h ThreadHandle) ([]string, error) {
+	return c.ThreadEmailIDsContext(context.Background(), h)
+}
+
+// ThreadEmailIDsContext is like ThreadEmailIDs but stops when ctx is done
+func (c *Client) ThreadEmailIDsContext(ctx context.Context, h ThreadHandle) ([]string, error) {
+	if len(h.ThreadIDs) == 0 {
+		return h.EmailIDs, nil
+	}
+
+	threads, err := getInChunks(ctx, c, h.ThreadIDs, c.fetchThreads)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(threads) == 0 {
+		return nil, fmt.Errorf("thread %w", ErrNotFound)
+	}
+
+	var ids []string
+	for _, t := range threads {
+		ids = append(ids, t.EmailIDs...)
+	}
+	return ids, nil
+}
+
+// fetchThreads sends one Thread/get for ids, which must fit the server's
+// limits
+func (c *Client) fetchThreads(ctx context.Context, ids []string) ([]Thread, error) {
+	resp, err := c.CallContext(ctx, []Invocation{
+		NewInvocation("Thread/get", map[string]interface{}{
+			"accountId": c.accountID,
+			"ids":       ids,
+		}, "0"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.MethodResponses) < 1 {
+		return nil, fmt.Errorf("unexpected response")
+	}
+
+	mr, err := ParseMethodResponse(resp.MethodResponses[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if err := mr.Err(); err != nil {
+		return nil, err
+	}
+
+	var threadResp ThreadGetResponse
+	if err := json.Unmarshal(mr.Args, &threadResp); err != nil {
+		return nil, err
+	}
+	return threadResp.List, nil
+}
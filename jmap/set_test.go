@@ -0,0 +1,136 @@
+package jmap_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/stevemurr/fastmail-agent/jmap"
+	"github.com/stevemurr/fastmail-agent/jmaptest"
+)
+
+// getEmail fetches one email, failing the test if it is missing
+func getEmail(t *testing.T, client *jmap.Client, id string) jmap.Email {
+	t.Helper()
+	emails, err := client.GetEmails([]string{id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(emails) != 1 {
+		t.Fatalf("email %s not found", id)
+	}
+	return emails[0]
+}
+
+func TestSetKeywords(t *testing.T) {
+	_, client := newTestClient(t)
+
+	if _, err := client.MarkRead([]string{"M4"}, true, jmap.SetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.SetFlagged([]string{"M3"}, false, jmap.SetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if m4 := getEmail(t, client, "M4"); !m4.HasKeyword(jmap.KeywordSeen) {
+		t.Error("M4 still unread")
+	}
+	if m3 := getEmail(t, client, "M3"); m3.HasKeyword(jmap.KeywordFlagged) || !m3.HasKeyword(jmap.KeywordSeen) {
+		t.Errorf("M3 keywords = %v", m3.Keywords)
+	}
+}
+
+func TestMoveEmails(t *testing.T) {
+	_, client := newTestClient(t)
+
+	if _, err := client.ArchiveEmails([]string{"M1", "M3"}, jmap.SetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	res, err := client.SearchEmails("in:archive", jmap.SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := emailIDs(res.Emails); !reflect.DeepEqual(got, []string{"M3", "M1"}) {
+		t.Errorf("archive holds %v", got)
+	}
+	if got := getEmail(t, client, "M1").MailboxIDs; !reflect.DeepEqual(got, map[string]bool{"archive": true}) {
+		t.Errorf("M1 is in %v, want only the archive", got)
+	}
+
+	if _, err := client.MoveEmails([]string{"M4"}, "Projects", jmap.SetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.MoveEmails([]string{"M4"}, "Nowhere", jmap.SetOptions{}); err == nil {
+		t.Error("moved to a mailbox that doesn't exist")
+	}
+}
+
+func TestDestroyEmails(t *testing.T) {
+	_, client := newTestClient(t)
+
+	res, err := client.DestroyEmails([]string{"M5", "M9"}, jmap.SetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res.Destroyed, []string{"M5"}) {
+		t.Errorf("destroyed %v", res.Destroyed)
+	}
+	if e, ok := res.Failed["M9"]; !ok || e.Type != "notFound" {
+		t.Errorf("failed = %v, want M9 notFound", res.Failed)
+	}
+	if emails, _ := client.GetEmails([]string{"M5"}); len(emails) != 0 {
+		t.Error("M5 is still there")
+	}
+}
+
+func TestSetIfInState(t *testing.T) {
+	_, client := newTestClient(t)
+
+	search, err := client.SearchEmails("is:unread", jmap.SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Something else changes the mailbox after the search
+	if _, err := client.MarkRead([]string{"M5"}, true, jmap.SetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.MarkRead(emailIDs(search.Emails), true, jmap.SetOptions{IfInState: search.State})
+	if !errors.Is(err, jmap.ErrStateMismatch) {
+		t.Fatalf("change from a stale state: %v, want ErrStateMismatch", err)
+	}
+	if m4 := getEmail(t, client, "M4"); m4.HasKeyword(jmap.KeywordSeen) {
+		t.Error("M4 was changed despite the state mismatch")
+	}
+}
+
+func TestSetPartialBatches(t *testing.T) {
+	srv, client := newLimitedClient(t, func(l *jmap.CoreCapability) { l.MaxObjectsInSet = 1 })
+
+	search, err := client.SearchEmails("", jmap.SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// New mail arrives between the first batch and the second
+	sets := 0
+	srv.OnRequest(func(req jmap.Request) {
+		if req.MethodCalls[0][0] == "Email/set" {
+			if sets++; sets == 2 {
+				arrived := jmaptest.SampleFixture().Emails[3]
+				arrived.ID, arrived.ThreadID = "M6", "T6"
+				srv.AddEmail(arrived, nil)
+			}
+		}
+	})
+
+	res, err := client.MarkRead([]string{"M1", "M2", "M3"}, false, jmap.SetOptions{IfInState: search.State})
+	if !errors.Is(err, jmap.ErrStateMismatch) {
+		t.Fatalf("%v, want ErrStateMismatch", err)
+	}
+	// The first batch stays applied and is reported with the error
+	if res == nil || !reflect.DeepEqual(res.Updated, []string{"M1"}) || res.NewState == search.State {
+		t.Fatalf("result with the error = %+v", res)
+	}
+	if m2 := getEmail(t, client, "M2"); !m2.HasKeyword(jmap.KeywordSeen) {
+		t.Error("M2 was changed after the mismatch")
+	}
+}
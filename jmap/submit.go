@@ -0,0 +1,183 @@
+package jmap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ErrNoSubmission is returned when the account or API token cannot send
+// mail, e.g. a token created without the submission scope
+var ErrNoSubmission = fmt.Errorf("sending is not permitted: the API token lacks the %s capability", CapabilitySubmission)
+
+// SendOptions controls SendEmail
+type SendOptions struct {
+	// DryRun builds the request but does not send it
+	DryRun bool
+}
+
+// SendResult describes a sent (or, for a dry run, prepared) email
+type SendResult struct {
+	Request      Request // the exact JMAP request
+	EmailID      string
+	SubmissionID string
+	Sent         bool
+}
+
+// GetIdentities returns the identities the user may send from
+func (c *Client) GetIdentities() ([]Identity, error) {
+	return c.GetIdentitiesContext(context.Background())
+}
+
+// GetIdentitiesContext is like GetIdentities but stops when ctx is done
+func (c *Client) GetIdentitiesContext(ctx context.Context) ([]Identity, error) {
+	if !c.HasCapability(CapabilitySubmission) {
+		return nil, ErrNoSubmission
+	}
+
+	resp, err := c.SendContext(ctx, NewRequest([]Invocation{
+		NewInvocation("Identity/get", map[string]interface{}{
+			"accountId": c.accountID,
+		}, "0"),
+	}, CapabilitySubmission))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.MethodResponses) < 1 {
+		return nil, fmt.Errorf("unexpected response")
+	}
+
+	mr, err := ParseMethodResponse(resp.MethodResponses[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if err := mr.Err(); err != nil {
+		return nil, err
+	}
+
+	var identityResp struct {
+		List []Identity `json:"list"`
+	}
+	if err := json.Unmarshal(mr.Args, &identityResp); err != nil {
+		return nil, err
+	}
+
+	return identityResp.List, nil
+}
+
+// FindIdentity returns the identity for an address, or the first identity
+// if address is empty
+func (c *Client) FindIdentity(address string) (Identity, error) {
+	return c.FindIdentityContext(context.Background(), address)
+}
+
+// FindIdentityContext is like FindIdentity but stops when ctx is done
+func (c *Client) FindIdentityContext(ctx context.Context, address string) (Identity, error) {
+	identities, err := c.GetIdentitiesContext(ctx)
+	if err != nil {
+		return Identity{}, err
+	}
+	if len(identities) == 0 {
+		return Identity{}, fmt.Errorf("account has no sending identities")
+	}
+
+	if address == "" {
+		return identities[0], nil
+	}
+	for _, id := range identities {
+		if strings.EqualFold(id.Email, address) {
+			return id, nil
+		}
+	}
+
+	return Identity{}, fmt.Errorf("no identity for %s", address)
+}
+
+// OwnAddressesContext returns the user's addresses: the account username
+// and, if the token can read them, the sending identities
+func (c *Client) OwnAddressesContext(ctx context.Context) []string {
+	var addrs []string
+	if session := c.currentSession(); session != nil && session.Username != "" {
+		addrs = append(addrs, session.Username)
+	}
+	identities, _ := c.GetIdentitiesContext(ctx)
+	for _, id := range identities {
+		addrs = append(addrs, id.Email)
+	}
+	return addrs
+}
+
+// SendEmail creates the draft and submits it in one request. On success the
+// server moves the message from Drafts to Sent and clears $draft.
+func (c *Client) SendEmail(d Draft, identity Identity, opts SendOptions) (*SendResult, error) {
+	return c.SendEmailContext(context.Background(), d, identity, opts)
+}
+
+// SendEmailContext is like SendEmail but stops when ctx is done
+func (c *Client) SendEmailContext(ctx context.Context, d Draft, identity Identity, opts SendOptions) (*SendResult, error) {
+	if !c.HasCapability(CapabilitySubmission) {
+		return nil, ErrNoSubmission
+	}
+
+	draftsID, err := c.resolveMailboxID(ctx, "drafts")
+	if err != nil {
+		return nil, err
+	}
+
+	// Once sent, file the message in Sent. Without a Sent mailbox it stays
+	// in Drafts but is no longer marked as a draft.
+	onSuccess := map[string]interface{}{
+		"keywords/" + KeywordDraft: nil,
+	}
+	if sentID, err := c.resolveMailboxID(ctx, "sent"); err == nil {
+		onSuccess["mailboxIds/"+draftsID] = nil
+		onSuccess["mailboxIds/"+sentID] = true
+	}
+
+	d.From = identity.Address()
+	request := NewRequest([]Invocation{
+		NewInvocation("Email/set", map[string]interface{}{
+			"accountId": c.accountID,
+			"create":    map[string]interface{}{"draft": d.emailCreate(draftsID)},
+		}, "0"),
+		NewInvocation("EmailSubmission/set", map[string]interface{}{
+			"accountId": c.accountID,
+			"create": map[string]interface{}{
+				"send": map[string]interface{}{
+					"identityId": identity.ID,
+					"emailId":    "#draft",
+				},
+			},
+			"onSuccessUpdateEmail": map[string]interface{}{
+				"#send": onSuccess,
+			},
+		}, "1"),
+	}, CapabilitySubmission)
+
+	result := &SendResult{Request: request}
+	if opts.DryRun {
+		return result, nil
+	}
+
+	resp, err := c.SendContext(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.MethodResponses) < 2 {
+		return nil, fmt.Errorf("unexpected response")
+	}
+
+	if result.EmailID, err = createdID(resp.MethodResponses[0], "draft"); err != nil {
+		return nil, err
+	}
+	if result.SubmissionID, err = createdID(resp.MethodResponses[1], "send"); err != nil {
+		return result, err
+	}
+
+	result.Sent = true
+	return result, nil
+}
@@ -1,19 +1,54 @@
 package jmap
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// JMAP capability URIs
+const (
+	CapabilityCore       = "urn:ietf:params:jmap:core"
+	CapabilityMail       = "urn:ietf:params:jmap:mail"
+	CapabilitySubmission = "urn:ietf:params:jmap:submission"
+)
 
 // Session represents the JMAP session response
 type Session struct {
-	Accounts       map[string]Account `json:"accounts"`
-	PrimaryAccount map[string]string  `json:"primaryAccounts"`
-	APIURL         string             `json:"apiUrl"`
-	DownloadURL    string             `json:"downloadUrl"`
-	Username       string             `json:"username"`
+	Capabilities   map[string]json.RawMessage `json:"capabilities"`
+	Accounts       map[string]Account         `json:"accounts"`
+	PrimaryAccount map[string]string          `json:"primaryAccounts"`
+	APIURL         string                     `json:"apiUrl"`
+	DownloadURL    string                     `json:"downloadUrl"`
+	Username       string                     `json:"username"`
+	State          string                     `json:"state"`
+}
+
+// CoreCapability holds the server limits advertised by the session's core
+// capability (RFC 8620 section 2). Zero means the server did not say.
+type CoreCapability struct {
+	MaxSizeUpload         int64 `json:"maxSizeUpload"`
+	MaxConcurrentUpload   int   `json:"maxConcurrentUpload"`
+	MaxSizeRequest        int64 `json:"maxSizeRequest"`
+	MaxConcurrentRequests int   `json:"maxConcurrentRequests"`
+	MaxCallsInRequest     int   `json:"maxCallsInRequest"`
+	MaxObjectsInGet       int   `json:"maxObjectsInGet"`
+	MaxObjectsInSet       int   `json:"maxObjectsInSet"`
+}
+
+// Core parses the session's core capability
+func (s *Session) Core() CoreCapability {
+	var core CoreCapability
+	if raw, ok := s.Capabilities[CapabilityCore]; ok {
+		json.Unmarshal(raw, &core)
+	}
+	return core
 }
 
 // Account represents a JMAP account
 type Account struct {
-	Name string `json:"name"`
+	Name                string                     `json:"name"`
+	IsReadOnly          bool                       `json:"isReadOnly"`
+	AccountCapabilities map[string]json.RawMessage `json:"accountCapabilities"`
 }
 
 // Request represents a JMAP request
@@ -49,6 +84,9 @@ func ParseMethodResponse(raw json.RawMessage) (*MethodResponse, error) {
 	if err := json.Unmarshal(raw, &arr); err != nil {
 		return nil, err
 	}
+	if len(arr) != 3 {
+		return nil, fmt.Errorf("malformed method response: %d elements", len(arr))
+	}
 
 	var method, callID string
 	if err := json.Unmarshal(arr[0], &method); err != nil {
@@ -68,11 +106,14 @@ func ParseMethodResponse(raw json.RawMessage) (*MethodResponse, error) {
 // Email represents a JMAP email object
 type Email struct {
 	ID            string               `json:"id"`
+	BlobID        string               `json:"blobId"` // the original RFC 5322 message
 	ThreadID      string               `json:"threadId"`
 	MailboxIDs    map[string]bool      `json:"mailboxIds"`
+	Keywords      map[string]bool      `json:"keywords"`
 	From          []EmailAddress       `json:"from"`
 	To            []EmailAddress       `json:"to"`
 	CC            []EmailAddress       `json:"cc"`
+	ReplyTo       []EmailAddress       `json:"replyTo"`
 	Subject       string               `json:"subject"`
 	ReceivedAt    string               `json:"receivedAt"`
 	Preview       string               `json:"preview"`
@@ -84,6 +125,14 @@ type Email struct {
 	MessageID     []string             `json:"messageId"`
 	InReplyTo     []string             `json:"inReplyTo"`
 	References    []string             `json:"references"`
+
+	// MailboxNames holds the names of MailboxIDs, filled in by the client
+	MailboxNames []string `json:"-"`
+}
+
+// HasKeyword reports whether the email has a keyword such as $seen
+func (e *Email) HasKeyword(keyword string) bool {
+	return e.Keywords[keyword]
 }
 
 // Attachment represents an email attachment
@@ -129,9 +178,15 @@ type Thread struct {
 
 // Mailbox represents a JMAP mailbox object
 type Mailbox struct {
-	ID   string `json:"id"`
-	Name string `json:"name"`
-	Role string `json:"role"`
+	ID            string `json:"id"`
+	Name          string `json:"name"`
+	ParentID      string `json:"parentId"`
+	Role          string `json:"role"`
+	SortOrder     int    `json:"sortOrder"`
+	TotalEmails   int    `json:"totalEmails"`
+	UnreadEmails  int    `json:"unreadEmails"`
+	TotalThreads  int    `json:"totalThreads"`
+	UnreadThreads int    `json:"unreadThreads"`
 }
 
 // EmailQueryResponse represents the response from Email/query
@@ -158,6 +213,20 @@ type ThreadGetResponse struct {
 	NotFound  []string `json:"notFound"`
 }
 
+// Identity represents a JMAP identity, an address the user may send from
+type Identity struct {
+	ID      string         `json:"id"`
+	Name    string         `json:"name"`
+	Email   string         `json:"email"`
+	ReplyTo []EmailAddress `json:"replyTo"`
+	Bcc     []EmailAddress `json:"bcc"`
+}
+
+// Address returns the identity as an email address
+func (i Identity) Address() EmailAddress {
+	return EmailAddress{Name: i.Name, Email: i.Email}
+}
+
 // MailboxGetResponse represents the response from Mailbox/get
 type MailboxGetResponse struct {
 	AccountID string    `json:"accountId"`
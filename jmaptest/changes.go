@@ -0,0 +1,118 @@
+package jmaptest
+
+import (
+	"sort"
+	"strconv"
+)
+
+// changeSet lists the objects of one type a change touched
+type changeSet struct {
+	created   []string
+	updated   []string
+	destroyed []string
+}
+
+// change is what one state advance did
+type change struct {
+	emails    changeSet
+	threads   changeSet
+	mailboxes changeSet // whose emails changed
+}
+
+// state returns the current state string, shared by every object type. The
+// caller holds s.data.
+func (s *Server) state() string {
+	return strconv.Itoa(len(s.changes) + 1)
+}
+
+// record advances the state by a change to emails. threads and mailboxes
+// hold those of the emails, before and after the change; before is
+// s.threads() as it was. The caller holds s.data.
+func (s *Server) record(emails changeSet, before map[string][]string, threads, mailboxes map[string]bool) {
+	c := change{emails: emails}
+	after := s.threads()
+	for id := range threads {
+		_, was := before[id]
+		_, is := after[id]
+		switch {
+		case !was && is:
+			c.threads.created = append(c.threads.created, id)
+		case was && !is:
+			c.threads.destroyed = append(c.threads.destroyed, id)
+		case is:
+			c.threads.updated = append(c.threads.updated, id)
+		}
+	}
+	for id := range mailboxes {
+		c.mailboxes.updated = append(c.mailboxes.updated, id)
+	}
+	s.changes = append(s.changes, c)
+}
+
+// objectChanges implements Email/changes, Mailbox/changes and
+// Thread/changes. Every change since sinceState is returned at once, so
+// hasMoreChanges is always false.
+func (s *Server) objectChanges(typ string, args map[string]interface{}) (interface{}, error) {
+	since, _ := args["sinceState"].(string)
+	n, err := strconv.Atoi(since)
+	if err != nil || n < 1 || n > len(s.changes)+1 {
+		return nil, &methodError{Type: "cannotCalculateChanges", Description: "unknown state " + since}
+	}
+
+	// An object's first and last change decide how it is reported: one
+	// created and destroyed since the state is left out altogether
+	first := make(map[string]string)
+	last := make(map[string]string)
+	var order []string
+	note := func(id, kind string) {
+		if _, ok := first[id]; !ok {
+			first[id] = kind
+			order = append(order, id)
+		}
+		last[id] = kind
+	}
+	for _, c := range s.changes[n-1:] {
+		set := c.emails
+		switch typ {
+		case "Thread":
+			set = c.threads
+		case "Mailbox":
+			set = c.mailboxes
+		}
+		for _, id := range set.created {
+			note(id, "created")
+		}
+		for _, id := range set.updated {
+			note(id, "updated")
+		}
+		for _, id := range set.destroyed {
+			note(id, "destroyed")
+		}
+	}
+
+	created, updated, destroyed := []string{}, []string{}, []string{}
+	for _, id := range order {
+		switch {
+		case first[id] == "created" && last[id] == "destroyed":
+		case first[id] == "created":
+			created = append(created, id)
+		case last[id] == "destroyed":
+			destroyed = append(destroyed, id)
+		default:
+			updated = append(updated, id)
+		}
+	}
+	sort.Strings(created)
+	sort.Strings(updated)
+	sort.Strings(destroyed)
+
+	return map[string]interface{}{
+		"accountId":      AccountID,
+		"oldState":       since,
+		"newState":       s.state(),
+		"hasMoreChanges": false,
+		"created":        created,
+		"updated":        updated,
+		"destroyed":      destroyed,
+	}, nil
+}
@@ -0,0 +1,151 @@
+package jmaptest
+
+import (
+	"strings"
+	"time"
+
+	"github.com/stevemurr/fastmail-agent/jmap"
+)
+
+// matchFilter evaluates an Email/query filter against one email. Text
+// conditions are case-insensitive substring matches; quoted phrases match
+// literally.
+func (s *Server) matchFilter(email jmap.Email, filter interface{}) (bool, error) {
+	if filter == nil {
+		return true, nil
+	}
+	f, ok := filter.(map[string]interface{})
+	if !ok {
+		return false, invalidArguments("filter must be an object")
+	}
+
+	if op, isOperator := f["operator"]; isOperator {
+		conditions, _ := f["conditions"].([]interface{})
+		switch op {
+		case "AND":
+			for _, c := range conditions {
+				if ok, err := s.matchFilter(email, c); err != nil || !ok {
+					return false, err
+				}
+			}
+			return true, nil
+		case "OR":
+			for _, c := range conditions {
+				if ok, err := s.matchFilter(email, c); err != nil || ok {
+					return ok, err
+				}
+			}
+			return false, nil
+		case "NOT":
+			for _, c := range conditions {
+				if ok, err := s.matchFilter(email, c); err != nil || ok {
+					return false, err
+				}
+			}
+			return true, nil
+		default:
+			return false, invalidArguments("unknown filter operator %v", op)
+		}
+	}
+
+	for key, value := range f {
+		ok, err := s.matchCondition(email, key, value)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// matchCondition evaluates one property of a FilterCondition
+func (s *Server) matchCondition(email jmap.Email, key string, value interface{}) (bool, error) {
+	str, _ := value.(string)
+
+	switch key {
+	case "text":
+		return containsText(emailText(email), str), nil
+	case "from":
+		return containsText(addressText(email.From), str), nil
+	case "to":
+		return containsText(addressText(email.To), str), nil
+	case "cc":
+		return containsText(addressText(email.CC), str), nil
+	case "bcc":
+		return false, nil // fixtures carry no Bcc header
+	case "subject":
+		return containsText(email.Subject, str), nil
+	case "body":
+		return containsText(bodyText(email), str), nil
+	case "hasAttachment":
+		want, _ := value.(bool)
+		return email.HasAttachment == want, nil
+	case "before", "after":
+		t, err := time.Parse(time.RFC3339, str)
+		if err != nil {
+			return false, invalidArguments("%s: %v", key, err)
+		}
+		if key == "before" {
+			return receivedAt(email).Before(t), nil
+		}
+		return !receivedAt(email).Before(t), nil
+	case "inMailbox":
+		return email.MailboxIDs[str], nil
+	case "inMailboxOtherThan":
+		ids, _, ok := stringList(map[string]interface{}{key: value}, key)
+		if !ok {
+			return false, invalidArguments("inMailboxOtherThan must be a list of strings")
+		}
+		for id := range email.MailboxIDs {
+			excluded := false
+			for _, other := range ids {
+				if id == other {
+					excluded = true
+				}
+			}
+			if !excluded {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "hasKeyword":
+		return email.HasKeyword(str), nil
+	case "notKeyword":
+		return !email.HasKeyword(str), nil
+	}
+	return false, &methodError{Type: "unsupportedFilter", Description: key}
+}
+
+// containsText reports whether haystack contains needle, ignoring case and
+// the quotes around phrases
+func containsText(haystack, needle string) bool {
+	needle = strings.Trim(needle, `"`)
+	return strings.Contains(strings.ToLower(haystack), strings.ToLower(needle))
+}
+
+func addressText(addrs []jmap.EmailAddress) string {
+	parts := make([]string, len(addrs))
+	for i, a := range addrs {
+		parts[i] = a.String()
+	}
+	return strings.Join(parts, ", ")
+}
+
+func bodyText(email jmap.Email) string {
+	var parts []string
+	for _, v := range email.BodyValues {
+		parts = append(parts, v.Value)
+	}
+	return strings.Join(parts, "\n")
+}
+
+// emailText is everything the "text" condition searches
+func emailText(email jmap.Email) string {
+	parts := []string{
+		addressText(email.From), addressText(email.To), addressText(email.CC),
+		email.Subject, email.Preview, bodyText(email),
+	}
+	for _, att := range email.Attachments {
+		parts = append(parts, att.Name)
+	}
+	return strings.Join(parts, "\n")
+}
@@ -0,0 +1,131 @@
+package jmaptest
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/stevemurr/fastmail-agent/jmap"
+)
+
+// SampleFixture returns a small mailbox: the standard role mailboxes, a
+// three-message thread with an attachment, a standalone unread message and
+// one message in Junk.
+func SampleFixture() Fixture {
+	alice := jmap.EmailAddress{Name: "Alice Example", Email: "alice@example.com"}
+	bob := jmap.EmailAddress{Name: "Bob Example", Email: "bob@example.com"}
+	me := jmap.EmailAddress{Name: "Test User", Email: "test@example.com"}
+	spammer := jmap.EmailAddress{Email: "offers@spam.example"}
+
+	text := func(body string) ([]jmap.BodyPart, map[string]jmap.BodyValue) {
+		return []jmap.BodyPart{{PartID: "1", Type: "text/plain"}},
+			map[string]jmap.BodyValue{"1": {Value: body}}
+	}
+	email := func(id, thread, mailbox string, from, to jmap.EmailAddress, subject, date, body string, keywords ...string) jmap.Email {
+		parts, values := text(body)
+		kw := map[string]bool{}
+		for _, k := range keywords {
+			kw[k] = true
+		}
+		preview := body
+		if len(preview) > 80 {
+			preview = preview[:80]
+		}
+		return jmap.Email{
+			ID:         id,
+			BlobID:     "R" + id,
+			ThreadID:   thread,
+			MailboxIDs: map[string]bool{mailbox: true},
+			Keywords:   kw,
+			From:       []jmap.EmailAddress{from},
+			To:         []jmap.EmailAddress{to},
+			Subject:    subject,
+			ReceivedAt: date,
+			Preview:    preview,
+			TextBody:   parts,
+			HTMLBody:   parts,
+			BodyValues: values,
+			MessageID:  []string{id + "@example.com"},
+		}
+	}
+
+	first := email("M1", "T1", "inbox", alice, me, "Quarterly invoice",
+		"2024-03-01T09:00:00Z", "Hi,\n\nThe invoice for Q1 is attached.\n\nAlice", jmap.KeywordSeen)
+	first.HasAttachment = true
+	first.Attachments = []jmap.Attachment{
+		{BlobID: "B1", Type: "text/csv", Name: "invoice-q1.csv", Size: 38},
+	}
+
+	reply := email("M2", "T1", "sent", me, alice, "Re: Quarterly invoice",
+		"2024-03-01T10:30:00Z", "Thanks, paid today.\n\nOn Fri, Alice wrote:\n> The invoice for Q1 is attached.", jmap.KeywordSeen)
+	reply.InReplyTo = []string{"M1@example.com"}
+	reply.References = []string{"M1@example.com"}
+
+	last := email("M3", "T1", "inbox", alice, me, "Re: Quarterly invoice",
+		"2024-03-02T08:15:00Z", "Received, thank you!", jmap.KeywordSeen, jmap.KeywordFlagged)
+	last.InReplyTo = []string{"M2@example.com"}
+	last.References = []string{"M1@example.com", "M2@example.com"}
+
+	fixture := Fixture{
+		Username: me.Email,
+		Mailboxes: []jmap.Mailbox{
+			{ID: "inbox", Name: "Inbox", Role: "inbox", SortOrder: 1, TotalEmails: 3, UnreadEmails: 1, TotalThreads: 2, UnreadThreads: 1},
+			{ID: "archive", Name: "Archive", Role: "archive", SortOrder: 2},
+			{ID: "drafts", Name: "Drafts", Role: "drafts", SortOrder: 3},
+			{ID: "sent", Name: "Sent", Role: "sent", SortOrder: 4, TotalEmails: 1, TotalThreads: 1},
+			{ID: "junk", Name: "Spam", Role: "junk", SortOrder: 5, TotalEmails: 1, UnreadEmails: 1, TotalThreads: 1, UnreadThreads: 1},
+			{ID: "trash", Name: "Trash", Role: "trash", SortOrder: 6},
+			{ID: "projects", Name: "Projects", SortOrder: 10},
+		},
+		Emails: []jmap.Email{
+			first, reply, last,
+			email("M4", "T2", "inbox", bob, me, "Lunch on Friday?",
+				"2024-03-04T12:00:00Z", "Are you free for lunch on Friday?\n\n--\nBob"),
+			email("M5", "T3", "junk", spammer, me, "You have won",
+				"2024-03-05T00:00:00Z", "Claim your prize now."),
+		},
+		Blobs: map[string][]byte{
+			"B1": []byte("item,amount\nconsulting,1200\nhosting,80\n"),
+		},
+	}
+	for _, e := range fixture.Emails {
+		fixture.Blobs[e.BlobID] = rawMessage(e)
+	}
+	return fixture
+}
+
+// rawMessage renders an email as the RFC 5322 message a server would have
+// received, for its BlobID
+func rawMessage(e jmap.Email) []byte {
+	addrs := func(list []jmap.EmailAddress) string {
+		s := make([]string, len(list))
+		for i, a := range list {
+			s[i] = a.String()
+		}
+		return strings.Join(s, ", ")
+	}
+	ids := func(list []string) string {
+		s := make([]string, len(list))
+		for i, id := range list {
+			s[i] = "<" + id + ">"
+		}
+		return strings.Join(s, " ")
+	}
+
+	var sb strings.Builder
+	date, _ := time.Parse(time.RFC3339, e.ReceivedAt)
+	fmt.Fprintf(&sb, "Received: from mx.example.com by mail.example.com; %s\r\n", date.Format(time.RFC1123Z))
+	fmt.Fprintf(&sb, "From: %s\r\n", addrs(e.From))
+	fmt.Fprintf(&sb, "To: %s\r\n", addrs(e.To))
+	fmt.Fprintf(&sb, "Subject: %s\r\n", e.Subject)
+	fmt.Fprintf(&sb, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	fmt.Fprintf(&sb, "Message-ID: %s\r\n", ids(e.MessageID))
+	if len(e.InReplyTo) > 0 {
+		fmt.Fprintf(&sb, "In-Reply-To: %s\r\n", ids(e.InReplyTo))
+		fmt.Fprintf(&sb, "References: %s\r\n", ids(e.References))
+	}
+	sb.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	sb.WriteString(strings.ReplaceAll(e.GetBodyText(), "\n", "\r\n"))
+	sb.WriteString("\r\n")
+	return []byte(sb.String())
+}
@@ -0,0 +1,392 @@
+package jmaptest
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stevemurr/fastmail-agent/jmap"
+)
+
+// resolveReferences replaces "#name" arguments with the value they point at
+// in an earlier response (RFC 8620 section 3.7)
+func resolveReferences(args map[string]interface{}, done []response) (map[string]interface{}, *methodError) {
+	resolved := make(map[string]interface{}, len(args))
+	for key, value := range args {
+		if !strings.HasPrefix(key, "#") {
+			resolved[key] = value
+			continue
+		}
+
+		ref, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, &methodError{Type: "invalidResultReference", Description: key + " is not a result reference"}
+		}
+		resultOf, _ := ref["resultOf"].(string)
+		name, _ := ref["name"].(string)
+		path, _ := ref["path"].(string)
+
+		var target interface{}
+		found := false
+		for _, r := range done {
+			if r.id == resultOf && r.name == name {
+				target, found = toJSONValue(r.result), true
+				break
+			}
+		}
+		if !found {
+			return nil, &methodError{Type: "invalidResultReference", Description: "no " + name + " response with id " + resultOf}
+		}
+
+		v, ok := evalPointer(target, path)
+		if !ok {
+			return nil, &methodError{Type: "invalidResultReference", Description: "path " + path + " not found"}
+		}
+		resolved[strings.TrimPrefix(key, "#")] = v
+	}
+	return resolved, nil
+}
+
+// toJSONValue converts a response struct into plain maps and slices
+func toJSONValue(v interface{}) interface{} {
+	data, _ := json.Marshal(v)
+	var out interface{}
+	json.Unmarshal(data, &out)
+	return out
+}
+
+// evalPointer evaluates a JSON pointer with the JMAP "*" extension, which
+// maps over an array and flattens array results
+func evalPointer(v interface{}, path string) (interface{}, bool) {
+	if path == "" || path == "/" {
+		return v, true
+	}
+	parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)
+	token := strings.NewReplacer("~1", "/", "~0", "~").Replace(parts[0])
+	rest := ""
+	if len(parts) == 2 {
+		rest = "/" + parts[1]
+	}
+
+	switch node := v.(type) {
+	case map[string]interface{}:
+		child, ok := node[token]
+		if !ok {
+			return nil, false
+		}
+		return evalPointer(child, rest)
+
+	case []interface{}:
+		if token == "*" {
+			out := []interface{}{}
+			for _, item := range node {
+				r, ok := evalPointer(item, rest)
+				if !ok {
+					return nil, false
+				}
+				if arr, isArr := r.([]interface{}); isArr {
+					out = append(out, arr...)
+				} else {
+					out = append(out, r)
+				}
+			}
+			return out, true
+		}
+		i, err := strconv.Atoi(token)
+		if err != nil || i < 0 || i >= len(node) {
+			return nil, false
+		}
+		return evalPointer(node[i], rest)
+	}
+	return nil, false
+}
+
+// stringList reads an optional string array argument. ok is false when the
+// argument is present but not a list of strings.
+func stringList(args map[string]interface{}, key string) (list []string, present, ok bool) {
+	raw, present := args[key]
+	if !present || raw == nil {
+		return nil, false, true
+	}
+	items, isList := raw.([]interface{})
+	if !isList {
+		return nil, true, false
+	}
+	for _, item := range items {
+		s, isString := item.(string)
+		if !isString {
+			return nil, true, false
+		}
+		list = append(list, s)
+	}
+	return list, true, true
+}
+
+func (s *Server) emailQuery(args map[string]interface{}) (interface{}, error) {
+	var matches []jmap.Email
+	for _, email := range s.fixture.Emails {
+		ok, err := s.matchFilter(email, args["filter"])
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matches = append(matches, email)
+		}
+	}
+
+	ascending := false
+	if sorts, ok := args["sort"].([]interface{}); ok && len(sorts) > 0 {
+		comparator, _ := sorts[0].(map[string]interface{})
+		if comparator["property"] != "receivedAt" {
+			return nil, &methodError{Type: "unsupportedSort", Description: "only receivedAt is supported"}
+		}
+		ascending, _ = comparator["isAscending"].(bool)
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		if ascending {
+			return receivedAt(matches[i]).Before(receivedAt(matches[j]))
+		}
+		return receivedAt(matches[i]).After(receivedAt(matches[j]))
+	})
+
+	if collapse, _ := args["collapseThreads"].(bool); collapse {
+		seen := make(map[string]bool)
+		collapsed := matches[:0:0]
+		for _, email := range matches {
+			if !seen[email.ThreadID] {
+				seen[email.ThreadID] = true
+				collapsed = append(collapsed, email)
+			}
+		}
+		matches = collapsed
+	}
+
+	position := intArg(args, "position")
+	if anchor, ok := args["anchor"].(string); ok {
+		found := -1
+		for i, email := range matches {
+			if email.ID == anchor {
+				found = i
+				break
+			}
+		}
+		if found < 0 {
+			return nil, &methodError{Type: "anchorNotFound"}
+		}
+		position = found + intArg(args, "anchorOffset")
+	} else if position < 0 {
+		position += len(matches)
+	}
+	if position < 0 {
+		position = 0
+	}
+	if position > len(matches) {
+		position = len(matches)
+	}
+
+	end := len(matches)
+	if limit := intArg(args, "limit"); limit > 0 && position+limit < end {
+		end = position + limit
+	}
+
+	ids := []string{}
+	for _, email := range matches[position:end] {
+		ids = append(ids, email.ID)
+	}
+
+	result := map[string]interface{}{
+		"accountId":           AccountID,
+		"queryState":          s.state(),
+		"canCalculateChanges": false,
+		"position":            position,
+		"ids":                 ids,
+	}
+	if calculate, _ := args["calculateTotal"].(bool); calculate {
+		result["total"] = len(matches)
+	}
+	return result, nil
+}
+
+func intArg(args map[string]interface{}, key string) int {
+	f, _ := args[key].(float64)
+	return int(f)
+}
+
+func receivedAt(email jmap.Email) time.Time {
+	t, _ := time.Parse(time.RFC3339, email.ReceivedAt)
+	return t
+}
+
+func (s *Server) emailGet(args map[string]interface{}) (interface{}, error) {
+	ids, present, ok := stringList(args, "ids")
+	if !ok {
+		return nil, invalidArguments("ids must be a list of strings")
+	}
+	if err := s.checkGetSize(ids); err != nil {
+		return nil, err
+	}
+	properties, _, ok := stringList(args, "properties")
+	if !ok {
+		return nil, invalidArguments("properties must be a list of strings")
+	}
+
+	byID := make(map[string]jmap.Email, len(s.fixture.Emails))
+	for _, email := range s.fixture.Emails {
+		byID[email.ID] = email
+	}
+
+	list := []interface{}{}
+	notFound := []string{}
+	if !present {
+		for _, email := range s.fixture.Emails {
+			list = append(list, pick(email, properties))
+		}
+	}
+	for _, id := range ids {
+		email, ok := byID[id]
+		if !ok {
+			notFound = append(notFound, id)
+			continue
+		}
+		list = append(list, pick(email, properties))
+	}
+
+	return map[string]interface{}{
+		"accountId": AccountID,
+		"state":     s.state(),
+		"list":      list,
+		"notFound":  notFound,
+	}, nil
+}
+
+// checkGetSize rejects a /get for more objects than maxObjectsInGet
+func (s *Server) checkGetSize(ids []string) error {
+	if limit := s.currentLimits().MaxObjectsInGet; len(ids) > limit {
+		return &methodError{Type: "requestTooLarge",
+			Description: fmt.Sprintf("%d ids exceed maxObjectsInGet of %d", len(ids), limit)}
+	}
+	return nil
+}
+
+// pick returns only the requested properties of v, plus its id
+func pick(v interface{}, properties []string) interface{} {
+	obj, _ := toJSONValue(v).(map[string]interface{})
+	if properties == nil {
+		return obj
+	}
+	out := map[string]interface{}{"id": obj["id"]}
+	for _, p := range properties {
+		if value, ok := obj[p]; ok {
+			out[p] = value
+		}
+	}
+	return out
+}
+
+func (s *Server) threadGet(args map[string]interface{}) (interface{}, error) {
+	ids, present, ok := stringList(args, "ids")
+	if !ok {
+		return nil, invalidArguments("ids must be a list of strings")
+	}
+	if err := s.checkGetSize(ids); err != nil {
+		return nil, err
+	}
+
+	threads := s.threads()
+	if !present {
+		for id := range threads {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+	}
+
+	list := []jmap.Thread{}
+	notFound := []string{}
+	for _, id := range ids {
+		emailIDs, ok := threads[id]
+		if !ok {
+			notFound = append(notFound, id)
+			continue
+		}
+		list = append(list, jmap.Thread{ID: id, EmailIDs: emailIDs})
+	}
+
+	return map[string]interface{}{
+		"accountId": AccountID,
+		"state":     s.state(),
+		"list":      list,
+		"notFound":  notFound,
+	}, nil
+}
+
+// threads maps thread IDs to their email IDs, oldest first
+func (s *Server) threads() map[string][]string {
+	emails := append([]jmap.Email(nil), s.fixture.Emails...)
+	sort.SliceStable(emails, func(i, j int) bool {
+		return receivedAt(emails[i]).Before(receivedAt(emails[j]))
+	})
+
+	threads := make(map[string][]string)
+	for _, email := range emails {
+		threads[email.ThreadID] = append(threads[email.ThreadID], email.ID)
+	}
+	return threads
+}
+
+func (s *Server) mailboxGet(args map[string]interface{}) (interface{}, error) {
+	ids, present, ok := stringList(args, "ids")
+	if !ok {
+		return nil, invalidArguments("ids must be a list of strings")
+	}
+	if err := s.checkGetSize(ids); err != nil {
+		return nil, err
+	}
+	properties, _, ok := stringList(args, "properties")
+	if !ok {
+		return nil, invalidArguments("properties must be a list of strings")
+	}
+
+	list := []interface{}{}
+	notFound := []string{}
+	if !present {
+		for _, m := range s.fixture.Mailboxes {
+			list = append(list, pick(mailboxJSON(m), properties))
+		}
+	}
+	for _, id := range ids {
+		found := false
+		for _, m := range s.fixture.Mailboxes {
+			if m.ID == id {
+				list = append(list, pick(mailboxJSON(m), properties))
+				found = true
+				break
+			}
+		}
+		if !found {
+			notFound = append(notFound, id)
+		}
+	}
+
+	return map[string]interface{}{
+		"accountId": AccountID,
+		"state":     s.state(),
+		"list":      list,
+		"notFound":  notFound,
+	}, nil
+}
+
+// mailboxJSON renders a mailbox as a server would, with null for a missing
+// parent or role
+func mailboxJSON(m jmap.Mailbox) map[string]interface{} {
+	obj := toJSONValue(m).(map[string]interface{})
+	if m.ParentID == "" {
+		obj["parentId"] = nil
+	}
+	if m.Role == "" {
+		obj["role"] = nil
+	}
+	return obj
+}
@@ -0,0 +1,421 @@
+// Package jmaptest runs an in-process JMAP server over fixture data, so the
+// client, CLI, TUI and exports can be exercised end to end without Fastmail.
+//
+// It implements the session resource, Email/query, Email/get, Thread/get,
+// Mailbox/get, blob download, Email/set updates and destroys, and
+// Email/changes, Mailbox/changes and Thread/changes. Every object type
+// shares one state string, which Email/set and AddEmail advance. Creating
+// emails with Email/set, EmailSubmission, uploads and push are out of scope.
+package jmaptest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stevemurr/fastmail-agent/jmap"
+)
+
+// Token is the bearer token the server accepts
+const Token = "jmaptest-token"
+
+// AccountID is the ID of the single account the server exposes
+const AccountID = "u1"
+
+// sessionState is the state of the session resource, which never changes
+const sessionState = "1"
+
+// Fixture is the data a server serves. Threads are derived from the emails'
+// ThreadID; blobs are looked up by the BlobID of attachments.
+type Fixture struct {
+	Username  string            `json:"username"`
+	Mailboxes []jmap.Mailbox    `json:"mailboxes"`
+	Emails    []jmap.Email      `json:"emails"`
+	Blobs     map[string][]byte `json:"blobs"`
+}
+
+// LoadFixture reads a Fixture from a JSON file
+func LoadFixture(path string) (Fixture, error) {
+	var f Fixture
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return f, err
+	}
+	if err := json.Unmarshal(data, &f); err != nil {
+		return f, fmt.Errorf("%s: %w", path, err)
+	}
+	return f, nil
+}
+
+// Server is a running fake JMAP server
+type Server struct {
+	fixture Fixture
+	http    *httptest.Server
+
+	mu        sync.Mutex
+	requests  []jmap.Request
+	limits    jmap.CoreCapability
+	onRequest func(jmap.Request)
+
+	// Injected failures, see FailNext
+	failures   int
+	failStatus int
+	failAfter  time.Duration
+
+	// data guards the fixture's emails and blobs and the change log, which
+	// Email/set and AddEmail modify. A request's method calls all run under
+	// it, so a request sees one state.
+	data    sync.Mutex
+	changes []change // one per state after the first
+}
+
+// NewServer starts a server for f. Call Close when done.
+func NewServer(f Fixture) *Server {
+	if f.Username == "" {
+		f.Username = "test@example.com"
+	}
+	// Email/set and AddEmail change the emails and blobs, not the caller's
+	f.Emails = append([]jmap.Email(nil), f.Emails...)
+	blobs := make(map[string][]byte, len(f.Blobs))
+	for id, data := range f.Blobs {
+		blobs[id] = data
+	}
+	f.Blobs = blobs
+	s := &Server{fixture: f, limits: jmap.DefaultLimits}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /jmap/session", s.handleSession)
+	mux.HandleFunc("POST /jmap/api", s.handleAPI)
+	mux.HandleFunc("GET /jmap/download/{account}/{blob}/{name}", s.handleDownload)
+	s.http = httptest.NewServer(s.authorized(mux))
+
+	return s
+}
+
+// Close shuts the server down
+func (s *Server) Close() {
+	s.http.Close()
+}
+
+// URL returns the base URL of the server
+func (s *Server) URL() string {
+	return s.http.URL
+}
+
+// SessionURL returns the session resource, for config.Config.SessionURL or
+// jmap.NewClientWithSessionURL
+func (s *Server) SessionURL() string {
+	return s.http.URL + "/jmap/session"
+}
+
+// Client returns a client connected to the server
+func (s *Server) Client() (*jmap.Client, error) {
+	client := jmap.NewClientWithSessionURL(Token, s.SessionURL())
+	if err := client.Connect(); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// Requests returns every API request received so far, oldest first
+func (s *Server) Requests() []jmap.Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]jmap.Request(nil), s.requests...)
+}
+
+// FailNext makes the next n HTTP requests fail with status, sending a
+// Retry-After header when retryAfter is positive, to exercise client retries
+func (s *Server) FailNext(n, status int, retryAfter time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = n
+	s.failStatus = status
+	s.failAfter = retryAfter
+}
+
+// OnRequest calls hook with every API request before it is run, for example
+// to change the data between the requests a client sends for one call.
+// hook may call AddEmail.
+func (s *Server) OnRequest(hook func(jmap.Request)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onRequest = hook
+}
+
+// SetLimits changes the core capability limits the session advertises and
+// the server enforces: maxCallsInRequest, maxObjectsInGet and
+// maxObjectsInSet
+func (s *Server) SetLimits(limits jmap.CoreCapability) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limits = limits
+}
+
+// currentLimits returns the limits set by SetLimits
+func (s *Server) currentLimits() jmap.CoreCapability {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.limits
+}
+
+// injectFailure writes an injected failure if one is pending
+func (s *Server) injectFailure(w http.ResponseWriter) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures == 0 {
+		return false
+	}
+	s.failures--
+
+	if s.failAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(s.failAfter.Seconds())))
+	}
+	http.Error(w, http.StatusText(s.failStatus), s.failStatus)
+	return true
+}
+
+// authorized rejects requests without the bearer token
+func (s *Server) authorized(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.injectFailure(w) {
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer "+Token {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleSession(w http.ResponseWriter, r *http.Request) {
+	mailCapability := map[string]interface{}{
+		"maxMailboxesPerEmail":       nil,
+		"maxMailboxDepth":            nil,
+		"maxSizeMailboxName":         490,
+		"maxSizeAttachmentsPerEmail": 50000000,
+		"emailQuerySortOptions":      []string{"receivedAt"},
+		"mayCreateTopLevelMailbox":   true,
+	}
+
+	limits := s.currentLimits()
+	writeJSON(w, map[string]interface{}{
+		"capabilities": map[string]interface{}{
+			jmap.CapabilityCore: map[string]interface{}{
+				"maxSizeUpload":         limits.MaxSizeUpload,
+				"maxConcurrentUpload":   limits.MaxConcurrentUpload,
+				"maxSizeRequest":        limits.MaxSizeRequest,
+				"maxConcurrentRequests": limits.MaxConcurrentRequests,
+				"maxCallsInRequest":     limits.MaxCallsInRequest,
+				"maxObjectsInGet":       limits.MaxObjectsInGet,
+				"maxObjectsInSet":       limits.MaxObjectsInSet,
+				"collationAlgorithms":   []string{"i;unicode-casemap"},
+			},
+			jmap.CapabilityMail: mailCapability,
+		},
+		"accounts": map[string]interface{}{
+			AccountID: map[string]interface{}{
+				"name":       s.fixture.Username,
+				"isPersonal": true,
+				"isReadOnly": false,
+				"accountCapabilities": map[string]interface{}{
+					jmap.CapabilityMail: mailCapability,
+				},
+			},
+		},
+		"primaryAccounts": map[string]string{
+			jmap.CapabilityMail: AccountID,
+		},
+		"username":       s.fixture.Username,
+		"apiUrl":         s.http.URL + "/jmap/api",
+		"downloadUrl":    s.http.URL + "/jmap/download/{accountId}/{blobId}/{name}?type={type}",
+		"uploadUrl":      s.http.URL + "/jmap/upload/{accountId}/",
+		"eventSourceUrl": s.http.URL + "/jmap/eventsource",
+		"state":          sessionState,
+	})
+}
+
+func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request) {
+	if r.PathValue("account") != AccountID {
+		http.NotFound(w, r)
+		return
+	}
+	s.data.Lock()
+	data, ok := s.fixture.Blobs[r.PathValue("blob")]
+	s.data.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	if t := r.URL.Query().Get("type"); t != "" {
+		w.Header().Set("Content-Type", t)
+	}
+	if name, err := url.PathUnescape(r.PathValue("name")); err == nil {
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	}
+	w.Write(data)
+}
+
+func (s *Server) handleAPI(w http.ResponseWriter, r *http.Request) {
+	var req jmap.Request
+	var raw struct {
+		Using       []string            `json:"using"`
+		MethodCalls [][]json.RawMessage `json:"methodCalls"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+		writeProblem(w, "urn:ietf:params:jmap:error:notJSON", err.Error())
+		return
+	}
+	req.Using = raw.Using
+
+	calls := make([]call, len(raw.MethodCalls))
+	for i, mc := range raw.MethodCalls {
+		if len(mc) != 3 {
+			writeProblem(w, "urn:ietf:params:jmap:error:notRequest", "method calls must have three elements")
+			return
+		}
+		var c call
+		if err := json.Unmarshal(mc[0], &c.name); err != nil {
+			writeProblem(w, "urn:ietf:params:jmap:error:notRequest", err.Error())
+			return
+		}
+		if err := json.Unmarshal(mc[1], &c.args); err != nil {
+			writeProblem(w, "urn:ietf:params:jmap:error:notRequest", err.Error())
+			return
+		}
+		if err := json.Unmarshal(mc[2], &c.id); err != nil {
+			writeProblem(w, "urn:ietf:params:jmap:error:notRequest", err.Error())
+			return
+		}
+		calls[i] = c
+		req.MethodCalls = append(req.MethodCalls, jmap.Invocation{c.name, c.args, c.id})
+	}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, req)
+	hook := s.onRequest
+	s.mu.Unlock()
+	if hook != nil {
+		hook(req)
+	}
+
+	if limit := s.currentLimits().MaxCallsInRequest; len(calls) > limit {
+		writeProblem(w, "urn:ietf:params:jmap:error:limit",
+			fmt.Sprintf("%d method calls exceed maxCallsInRequest of %d", len(calls), limit))
+		return
+	}
+
+	for _, using := range req.Using {
+		if using != jmap.CapabilityCore && using != jmap.CapabilityMail {
+			writeProblem(w, "urn:ietf:params:jmap:error:unknownCapability",
+				fmt.Sprintf("capability %s is not supported", using))
+			return
+		}
+	}
+
+	var responses []interface{}
+	var done []response
+	s.data.Lock()
+	for _, c := range calls {
+		name, result := s.dispatch(c, done)
+		done = append(done, response{name: name, id: c.id, result: result})
+		responses = append(responses, []interface{}{name, result, c.id})
+	}
+	s.data.Unlock()
+
+	writeJSON(w, map[string]interface{}{
+		"methodResponses": responses,
+		"sessionState":    sessionState,
+	})
+}
+
+// call is one parsed method call
+type call struct {
+	name string
+	args map[string]interface{}
+	id   string
+}
+
+// response is one method response, kept for back-references
+type response struct {
+	name   string
+	id     string
+	result interface{}
+}
+
+// methodError is returned by method handlers to produce an "error" response
+type methodError struct {
+	Type        string `json:"type"`
+	Description string `json:"description,omitempty"`
+}
+
+func (e *methodError) Error() string {
+	return e.Type + ": " + e.Description
+}
+
+func invalidArguments(format string, args ...interface{}) *methodError {
+	return &methodError{Type: "invalidArguments", Description: fmt.Sprintf(format, args...)}
+}
+
+// dispatch runs one method call and returns the response name and arguments
+func (s *Server) dispatch(c call, done []response) (string, interface{}) {
+	args, refErr := resolveReferences(c.args, done)
+	if refErr != nil {
+		return "error", refErr
+	}
+
+	if id, ok := args["accountId"]; ok && id != AccountID {
+		return "error", &methodError{Type: "accountNotFound"}
+	}
+
+	var result interface{}
+	var err error
+	switch c.name {
+	case "Email/query":
+		result, err = s.emailQuery(args)
+	case "Email/get":
+		result, err = s.emailGet(args)
+	case "Thread/get":
+		result, err = s.threadGet(args)
+	case "Mailbox/get":
+		result, err = s.mailboxGet(args)
+	case "Email/set":
+		result, err = s.emailSet(args)
+	case "Email/changes", "Mailbox/changes", "Thread/changes":
+		result, err = s.objectChanges(strings.TrimSuffix(c.name, "/changes"), args)
+	default:
+		err = &methodError{Type: "unknownMethod", Description: c.name}
+	}
+	if err != nil {
+		if me, ok := err.(*methodError); ok {
+			return "error", me
+		}
+		return "error", &methodError{Type: "serverFail", Description: err.Error()}
+	}
+	return c.name, result
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeProblem rejects a whole request with an RFC 7807 problem document
+func writeProblem(w http.ResponseWriter, typ, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"type":   typ,
+		"status": http.StatusBadRequest,
+		"detail": detail,
+	})
+}
@@ -0,0 +1,212 @@
+package jmaptest
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/stevemurr/fastmail-agent/jmap"
+)
+
+// AddEmail delivers an email as if it had just arrived, advancing the state
+// so that Email/changes reports it as created. raw, if not nil, is served as
+// its BlobID.
+func (s *Server) AddEmail(email jmap.Email, raw []byte) {
+	s.data.Lock()
+	defer s.data.Unlock()
+
+	before := s.threads()
+	s.fixture.Emails = append(s.fixture.Emails, email)
+	if raw != nil {
+		s.fixture.Blobs[email.BlobID] = raw
+	}
+	s.record(changeSet{created: []string{email.ID}}, before,
+		map[string]bool{email.ThreadID: true}, email.MailboxIDs)
+}
+
+// AddMailbox creates a mailbox as if another client had, advancing the state
+// so that Mailbox/changes reports it as created
+func (s *Server) AddMailbox(mailbox jmap.Mailbox) {
+	s.data.Lock()
+	defer s.data.Unlock()
+
+	s.fixture.Mailboxes = append(s.fixture.Mailboxes, mailbox)
+	s.changes = append(s.changes, change{mailboxes: changeSet{created: []string{mailbox.ID}}})
+}
+
+// emailSet implements Email/set for updates and destroys. Updates may set
+// keywords and mailboxIds whole or patch single entries of them.
+func (s *Server) emailSet(args map[string]interface{}) (interface{}, error) {
+	if create, _ := args["create"].(map[string]interface{}); len(create) > 0 {
+		return nil, invalidArguments("creating emails is not supported")
+	}
+	update, _ := args["update"].(map[string]interface{})
+	destroy, _, ok := stringList(args, "destroy")
+	if !ok {
+		return nil, invalidArguments("destroy must be a list of strings")
+	}
+	if limit := s.currentLimits().MaxObjectsInSet; len(update)+len(destroy) > limit {
+		return nil, &methodError{Type: "requestTooLarge",
+			Description: fmt.Sprintf("%d objects exceed maxObjectsInSet of %d", len(update)+len(destroy), limit)}
+	}
+	oldState := s.state()
+	if ifInState, ok := args["ifInState"].(string); ok && ifInState != oldState {
+		return nil, &methodError{Type: "stateMismatch"}
+	}
+
+	index := make(map[string]int, len(s.fixture.Emails))
+	for i, email := range s.fixture.Emails {
+		index[email.ID] = i
+	}
+	before := s.threads()
+	var changed changeSet
+	threads := make(map[string]bool)
+	mailboxes := make(map[string]bool)
+	touch := func(email jmap.Email) {
+		threads[email.ThreadID] = true
+		for id := range email.MailboxIDs {
+			mailboxes[id] = true
+		}
+	}
+
+	updated := map[string]interface{}{}
+	notUpdated := map[string]interface{}{}
+	for id, value := range update {
+		i, ok := index[id]
+		if !ok {
+			notUpdated[id] = jmap.SetError{Type: "notFound"}
+			continue
+		}
+		patch, _ := value.(map[string]interface{})
+		email, err := s.applyPatch(s.fixture.Emails[i], patch)
+		if err != nil {
+			notUpdated[id] = jmap.SetError{Type: "invalidProperties", Description: err.Error()}
+			continue
+		}
+		touch(s.fixture.Emails[i])
+		touch(email)
+		s.fixture.Emails[i] = email
+		updated[id] = nil
+		changed.updated = append(changed.updated, id)
+	}
+
+	destroyed := []string{}
+	notDestroyed := map[string]interface{}{}
+	gone := make(map[string]bool)
+	for _, id := range destroy {
+		i, ok := index[id]
+		if !ok || gone[id] {
+			notDestroyed[id] = jmap.SetError{Type: "notFound"}
+			continue
+		}
+		touch(s.fixture.Emails[i])
+		gone[id] = true
+		destroyed = append(destroyed, id)
+	}
+	if len(gone) > 0 {
+		kept := s.fixture.Emails[:0]
+		for _, email := range s.fixture.Emails {
+			if !gone[email.ID] {
+				kept = append(kept, email)
+			}
+		}
+		s.fixture.Emails = kept
+		changed.destroyed = destroyed
+	}
+
+	if len(changed.updated)+len(changed.destroyed) > 0 {
+		s.record(changed, before, threads, mailboxes)
+	}
+	return map[string]interface{}{
+		"accountId":    AccountID,
+		"oldState":     oldState,
+		"newState":     s.state(),
+		"updated":      updated,
+		"destroyed":    destroyed,
+		"notUpdated":   notUpdated,
+		"notDestroyed": notDestroyed,
+	}, nil
+}
+
+// applyPatch returns email with an Email/set patch applied, leaving the
+// original's maps alone
+func (s *Server) applyPatch(email jmap.Email, patch map[string]interface{}) (jmap.Email, error) {
+	keywords := copySet(email.Keywords)
+	mailboxIDs := copySet(email.MailboxIDs)
+	for path, value := range patch {
+		var err error
+		switch {
+		case path == "keywords":
+			keywords, err = setValue(value)
+		case path == "mailboxIds":
+			mailboxIDs, err = setValue(value)
+		case strings.HasPrefix(path, "keywords/"):
+			err = patchSet(keywords, strings.TrimPrefix(path, "keywords/"), value)
+		case strings.HasPrefix(path, "mailboxIds/"):
+			err = patchSet(mailboxIDs, strings.TrimPrefix(path, "mailboxIds/"), value)
+		default:
+			err = fmt.Errorf("%s can't be changed", path)
+		}
+		if err != nil {
+			return email, err
+		}
+	}
+
+	if len(mailboxIDs) == 0 {
+		return email, fmt.Errorf("an email must be in at least one mailbox")
+	}
+	for id := range mailboxIDs {
+		if !s.hasMailbox(id) {
+			return email, fmt.Errorf("mailbox %s does not exist", id)
+		}
+	}
+	email.Keywords = keywords
+	email.MailboxIDs = mailboxIDs
+	return email, nil
+}
+
+// hasMailbox reports whether the fixture has a mailbox with id
+func (s *Server) hasMailbox(id string) bool {
+	for _, m := range s.fixture.Mailboxes {
+		if m.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func copySet(set map[string]bool) map[string]bool {
+	c := make(map[string]bool, len(set))
+	for k, v := range set {
+		c[k] = v
+	}
+	return c
+}
+
+// setValue reads a whole keywords or mailboxIds value
+func setValue(value interface{}) (map[string]bool, error) {
+	obj, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected an object, got %v", value)
+	}
+	set := make(map[string]bool, len(obj))
+	for k, v := range obj {
+		if v != true {
+			return nil, fmt.Errorf("%s must be true", k)
+		}
+		set[k] = true
+	}
+	return set, nil
+}
+
+// patchSet sets key in set for true and removes it for null
+func patchSet(set map[string]bool, key string, value interface{}) error {
+	switch value {
+	case true:
+		set[key] = true
+	case nil:
+		delete(set, key)
+	default:
+		return fmt.Errorf("%s must be true or null", key)
+	}
+	return nil
+}
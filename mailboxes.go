@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/stevemurr/fastmail-agent/jmap"
+)
+
+// MailboxInfo represents a mailbox in CLI output
+type MailboxInfo struct {
+	ID            string `json:"id"`
+	Name          string `json:"name"`
+	Role          string `json:"role,omitempty"`
+	ParentID      string `json:"parent_id,omitempty"`
+	Parent        string `json:"parent,omitempty"`
+	TotalEmails   int    `json:"total_emails"`
+	UnreadEmails  int    `json:"unread_emails"`
+	TotalThreads  int    `json:"total_threads"`
+	UnreadThreads int    `json:"unread_threads"`
+	SortOrder     int    `json:"sort_order"`
+}
+
+// runMailboxes lists every mailbox in the account as JSON
+func runMailboxes(args []string) {
+	fs := flag.NewFlagSet("mailboxes", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: fastmail-agent mailboxes")
+		fmt.Fprintln(os.Stderr, "\nLists every mailbox with its role, parent, unread/total counts and sort order.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	client := connect()
+
+	mailboxes, err := client.GetMailboxesContext(cmdCtx)
+	if err != nil {
+		fatal("listing mailboxes", err)
+	}
+
+	result := mailboxInfos(mailboxes)
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(result)
+}
+
+// mailboxInfos converts mailboxes for output, resolving parent names
+func mailboxInfos(mailboxes []jmap.Mailbox) []MailboxInfo {
+	names := make(map[string]string, len(mailboxes))
+	for _, mb := range mailboxes {
+		names[mb.ID] = mb.Name
+	}
+
+	result := make([]MailboxInfo, len(mailboxes))
+	for i, mb := range mailboxes {
+		result[i] = MailboxInfo{
+			ID:            mb.ID,
+			Name:          mb.Name,
+			Role:          mb.Role,
+			ParentID:      mb.ParentID,
+			Parent:        names[mb.ParentID],
+			TotalEmails:   mb.TotalEmails,
+			UnreadEmails:  mb.UnreadEmails,
+			TotalThreads:  mb.TotalThreads,
+			UnreadThreads: mb.UnreadThreads,
+			SortOrder:     mb.SortOrder,
+		}
+	}
+	return result
+}
@@ -0,0 +1,75 @@
+package mailsync
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// State is the last synced JMAP state of each object type. The strings are
+// opaque server tokens passed back to the Foo/changes methods.
+type State struct {
+	AccountID string    `json:"account_id"`
+	Email     string    `json:"email"`
+	Mailbox   string    `json:"mailbox"`
+	Thread    string    `json:"thread"`
+	SyncedAt  time.Time `json:"synced_at"`
+}
+
+// LoadState reads a state file. A missing file yields an empty state, which
+// makes the next sync a full one.
+func LoadState(path string) (State, error) {
+	var st State
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return st, err
+	}
+	err = json.Unmarshal(data, &st)
+	return st, err
+}
+
+// Save writes the state file via rename so concurrent readers never see a
+// half-written file
+func (st State) Save(path string) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".sync-*.json")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	tmp.Close()
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// DefaultStatePath returns where the state for a named sync consumer lives.
+// Separate names keep independent "new since last run" cursors.
+func DefaultStatePath(name string) string {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		cacheDir = os.TempDir()
+	}
+	if name == "" {
+		name = "default"
+	}
+	return filepath.Join(cacheDir, "fastmail-agent", "sync", name+".json")
+}
@@ -0,0 +1,130 @@
+// Package mailsync keeps track of what changed in a Fastmail account between
+// runs, using the JMAP Foo/changes methods and a persisted state.
+package mailsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/stevemurr/fastmail-agent/jmap"
+)
+
+// Result describes one sync run
+type Result struct {
+	// FullResync is set when there was no usable previous state. Emails.Created
+	// then lists every email in the account.
+	FullResync bool
+
+	Emails    jmap.Changes
+	Mailboxes jmap.Changes
+	Threads   jmap.Changes
+}
+
+// Syncer pulls changes since the last persisted state
+type Syncer struct {
+	client    *jmap.Client
+	statePath string
+}
+
+// New creates a syncer that persists its state at statePath
+func New(client *jmap.Client, statePath string) *Syncer {
+	return &Syncer{client: client, statePath: statePath}
+}
+
+// State returns the persisted state
+func (s *Syncer) State() (State, error) {
+	return LoadState(s.statePath)
+}
+
+// Sync fetches the changes since the previous run. It does not persist the
+// new state; call Commit once the result has been processed, so a crash
+// halfway through doesn't lose changes.
+func (s *Syncer) Sync() (*Result, State, error) {
+	return s.SyncContext(context.Background())
+}
+
+// SyncContext is like Sync but stops when ctx is done
+func (s *Syncer) SyncContext(ctx context.Context) (*Result, State, error) {
+	prev, err := LoadState(s.statePath)
+	if err != nil {
+		return nil, State{}, fmt.Errorf("reading sync state: %w", err)
+	}
+
+	// State strings are only meaningful for the account that issued them
+	if prev.AccountID != s.client.AccountID() {
+		prev = State{}
+	}
+
+	result, err := s.incremental(ctx, prev)
+	if errors.Is(err, jmap.ErrCannotCalculateChanges) || (err == nil && result == nil) {
+		result, err = s.full(ctx)
+	}
+	if err != nil {
+		return nil, State{}, err
+	}
+
+	next := State{
+		AccountID: s.client.AccountID(),
+		Email:     result.Emails.NewState,
+		Mailbox:   result.Mailboxes.NewState,
+		Thread:    result.Threads.NewState,
+		SyncedAt:  time.Now().UTC(),
+	}
+	return result, next, nil
+}
+
+// Commit persists a state returned by Sync
+func (s *Syncer) Commit(st State) error {
+	return st.Save(s.statePath)
+}
+
+// incremental pulls changes since prev. It returns a nil result if prev is
+// incomplete, meaning a full resync is needed.
+func (s *Syncer) incremental(ctx context.Context, prev State) (*Result, error) {
+	if prev.Email == "" || prev.Mailbox == "" || prev.Thread == "" {
+		return nil, nil
+	}
+
+	result := &Result{}
+	emails, err := s.client.EmailChangesContext(ctx, prev.Email)
+	if err != nil {
+		return nil, err
+	}
+	mailboxes, err := s.client.MailboxChangesContext(ctx, prev.Mailbox)
+	if err != nil {
+		return nil, err
+	}
+	threads, err := s.client.ThreadChangesContext(ctx, prev.Thread)
+	if err != nil {
+		return nil, err
+	}
+
+	result.Emails = *emails
+	result.Mailboxes = *mailboxes
+	result.Threads = *threads
+	return result, nil
+}
+
+// full records the current states and lists every email. The states are
+// taken before listing, so anything arriving meanwhile shows up again as a
+// change next time rather than being missed.
+func (s *Syncer) full(ctx context.Context) (*Result, error) {
+	emailState, mailboxState, threadState, err := s.client.CurrentStatesContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ids, err := s.client.AllEmailIDsContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Result{
+		FullResync: true,
+		Emails:     jmap.Changes{NewState: emailState, Created: ids},
+		Mailboxes:  jmap.Changes{NewState: mailboxState},
+		Threads:    jmap.Changes{NewState: threadState},
+	}, nil
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
 	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
@@ -16,30 +20,98 @@ import (
 	"github.com/stevemurr/fastmail-agent/tui"
 )
 
+// version is reported to MCP clients and recorded in export manifests.
+// Release builds set it with -ldflags "-X main.version=...".
+var version = "dev"
+
 // ThreadInfo represents a thread in CLI query output
 type ThreadInfo struct {
 	ID         int      `json:"id"`
+	Handle     string   `json:"handle"`
+	ThreadID   string   `json:"thread_id,omitempty"`
 	Subject    string   `json:"subject"`
 	From       string   `json:"from"`
 	Date       string   `json:"date"`
 	EmailCount int      `json:"email_count"`
 	Preview    string   `json:"preview"`
 	EmailIDs   []string `json:"email_ids"`
+	Mailboxes  []string `json:"mailboxes,omitempty"`
 }
 
 // QueryResult represents the full query response
 type QueryResult struct {
-	Query   string       `json:"query"`
-	Count   int          `json:"count"`
-	Threads []ThreadInfo `json:"threads"`
+	Query        string       `json:"query"`
+	Count        int          `json:"count"`         // threads in this page
+	TotalMatches int          `json:"total_matches"` // matching emails on the server
+	Position     int          `json:"position"`      // offset of this page's first email
+	HasMore      bool         `json:"has_more"`
+	NextCursor   string       `json:"next_cursor,omitempty"`
+	State        string       `json:"state,omitempty"` // pass to -if-in-state of mutating commands
+	Threads      []ThreadInfo `json:"threads"`
+}
+
+// commands maps subcommand names to their entry points. Each one parses its
+// own flags from the arguments that follow the command name.
+var commands = map[string]func(args []string){
+	"mailboxes": runMailboxes,
+	"read":      mutateCommand("read"),
+	"unread":    mutateCommand("unread"),
+	"flag":      mutateCommand("flag"),
+	"unflag":    mutateCommand("unflag"),
+	"archive":   mutateCommand("archive"),
+	"move":      mutateCommand("move"),
+	"trash":     mutateCommand("trash"),
+	"delete":    mutateCommand("delete"),
+	"reply":     runReply,
+	"send":      runSend,
+	"draft":     runDraft,
+	"whoami":    runWhoami,
+	"sync":      runSync,
+	"index":     runIndex,
+	"serve-mcp": runServeMCP,
+	"serve":     runServe,
+	"export":    runExport,
+	"verify":    runVerify,
 }
 
+// cmdCtx bounds the work of a CLI command. The global -timeout gives it a
+// deadline; the long-running servers apply it per request instead.
+var cmdCtx = context.Background()
+
+// timeout is the global -timeout, 0 for none
+var timeout time.Duration
+
 func main() {
+	export.ToolVersion = version
+	args := parseGlobalFlags(os.Args[1:])
+	if len(args) > 0 {
+		if cmd, ok := commands[args[0]]; ok {
+			defer startTimeout()()
+			cmd(args[1:])
+			return
+		}
+	}
+
 	// Define CLI flags
 	query := flag.String("q", "", "Search query - returns list of threads as JSON with IDs")
-	threadID := flag.Int("t", 0, "Thread ID from query results - returns full thread content")
+	threadRef := flag.String("t", "", "Thread handle (or result index) from query results - returns full thread content")
 	outputJSON := flag.Bool("json", false, "Output thread content as JSON (only for -t, -q always outputs JSON)")
 	outputPDF := flag.Bool("pdf", false, "Export thread as PDF (only for -t)")
+	outputMarkdown := flag.Bool("md", false, "Output thread content as Markdown (only for -t)")
+	outputEML := flag.Bool("eml", false, "Save each message's original as a byte-exact .eml file, with SHA256SUMS (only for -t)")
+	outputMbox := flag.Bool("mbox", false, "Save the thread's original messages in one mboxrd file with checksums (only for -t)")
+	pdfOpts := pdfFlags(flag.CommandLine, "only for -pdf")
+	maxTokens := flag.Int("max-tokens", 0, "Cut thread text down to this many tokens, reporting what was left out (only for -t); counts are estimates unless -tokenizer is a .tiktoken file")
+	tokenizer := flag.String("tokenizer", "cl100k", "How -max-tokens counts: cl100k (a built-in estimate), chars (length/4), a model name, or a .tiktoken file")
+	limit := flag.Int("limit", 50, "Maximum number of emails per page (only for -q)")
+	offset := flag.Int("offset", 0, "Zero-based position of the first email (only for -q)")
+	cursor := flag.String("cursor", "", "Continue from the next_cursor of a previous -q result")
+	group := flag.String("group", "thread", "How to group results into threads: thread (server threadId) or subject")
+	inMailbox := flag.String("in", "", "Only search this mailbox, by name or role (only for -q)")
+	exclude := flag.String("exclude", "spam,trash", "Comma-separated mailboxes to leave out of searches unless the query uses in:")
+	source := flag.String("source", "remote", "Where -q and -t read mail: remote (Fastmail), local (the index) or auto")
+	offline := flag.Bool("offline", false, "Same as -source=local; never touches the network")
+	flag.DurationVar(&timeout, "timeout", timeout, "Give up on the command after this long, e.g. 30s (may also precede a subcommand)")
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, `fastmail-agent - Search and export Fastmail emails
@@ -47,142 +119,302 @@ func main() {
 USAGE:
   fastmail-agent                    Launch interactive TUI
   fastmail-agent -q "search terms"  Search and list threads (JSON output)
-  fastmail-agent -t <id>            Fetch thread by ID (text output, LLM-optimized)
-  fastmail-agent -t <id> -json      Fetch thread by ID (JSON output)
-  fastmail-agent -t <id> -pdf       Export thread as PDF
+  fastmail-agent -cursor <cursor>   Fetch the next page of a previous search
+  fastmail-agent -t <handle>        Fetch thread by handle (text output, LLM-optimized)
+  fastmail-agent -t <handle> -json  Fetch thread by handle (JSON output)
+  fastmail-agent -t <handle> -pdf   Export thread as PDF
+  fastmail-agent -t <handle> -md    Fetch thread by handle (Markdown output)
+  fastmail-agent -t <handle> -eml   Save the original messages as .eml files
+  fastmail-agent -t <handle> -mbox  Save the original messages as an mbox file
+  fastmail-agent export -q "..." -out <dir>
+                                    Export every matching thread (pdf, txt, md, folder)
+  fastmail-agent verify <export>    Check an export against its manifest
+  fastmail-agent mailboxes          List mailboxes with roles and counts (JSON output)
+  fastmail-agent <action> <handle>  Change threads: read, unread, flag, unflag,
+                                    archive, move -to <mailbox>, trash, delete
+  fastmail-agent reply -t <handle>  Reply to the newest message of a thread
+  fastmail-agent send -to <addr>    Send a new message
+  fastmail-agent draft -t <handle>  Save a reply in Drafts without sending it
+  fastmail-agent whoami             Show the account and what the token may do
+  fastmail-agent sync               List mail that is new or changed since the last sync
+  fastmail-agent index              Download mail into the local store for -offline
+  fastmail-agent serve-mcp          Serve the tools over MCP (stdio) for AI agents
+  fastmail-agent serve              Serve an HTTP/JSON API for local tools
+
+SEARCH SYNTAX:
+  from: to: cc: bcc: subject:    Match a header field
+  has:attachment                 Only emails with attachments
+  before:YYYY-MM-DD after:...    Received date range
+  in:<mailbox>                   Mailbox name or role (inbox, sent, spam, ...)
+  is:unread is:read is:flagged   Keyword state
+  "exact phrase"                 Quoted phrase
+  -term                          Negate a term
+  a OR b                         Match either term (terms are ANDed otherwise)
+
+  Spam and Trash are skipped unless the query uses in: or -exclude is changed.
 
 AGENT WORKFLOW:
   1. Search for threads:
      $ fastmail-agent -q "from:alice@example.com invoice"
-     Returns JSON with thread IDs, subjects, dates, and previews
+     Returns JSON with thread handles, subjects, dates, and previews
+
+     If "has_more" is true, pass "next_cursor" to -cursor for the next page
 
   2. Fetch specific thread content:
-     $ fastmail-agent -t 3
+     $ fastmail-agent -t th_eyJ0IjpbIlQxIl19
      Returns the full email thread in LLM-optimized text format
 
+     Add -max-tokens 8000 to fit a context window: older messages are
+     shortened, then the middle of the thread is left out, and the output
+     starts with a summary of what was cut. It exits non-zero if the thread
+     cannot be cut that far. Token counts are estimates unless -tokenizer
+     names a .tiktoken rank file
+
   3. Export thread as PDF:
-     $ fastmail-agent -t 3 -pdf
+     $ fastmail-agent -t th_eyJ0IjpbIlQxIl19 -pdf
      Exports thread as a PDF file suitable for legal/court use
 
+     Add -bates ACME, -header, -footer, -exhibit "Exhibit 3" or -cover to
+     stamp Bates numbers and labels on the pages
+
+  Handles are stable across queries, so parallel agents cannot fetch each
+  other's threads. A plain number (-t 3) still selects by position in the
+  most recent query result, but that result is shared by every caller.
+
+OFFLINE SEARCH:
+  Run "fastmail-agent index" to copy the account into a local store, and
+  again to pick up changes. -offline (or -source=local) then answers -q and
+  -t from the store in milliseconds without the network. -source=auto uses
+  the store if it was indexed in the last 15 minutes.
+
+THREADING:
+  Results are grouped by the server's thread ID and -t returns every message
+  in the thread, including ones that did not match the search. Use
+  -group subject to merge results by normalized subject instead.
+
 FLAGS:
 `)
 		flag.PrintDefaults()
 	}
 
-	flag.Parse()
+	flag.CommandLine.Parse(args)
+	defer startTimeout()()
 
-	// Load configuration
-	cfg, err := config.Load()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
-		fmt.Fprintln(os.Stderr, "\nPlease set FASTMAIL_API_TOKEN environment variable")
-		fmt.Fprintln(os.Stderr, "or create ~/.config/fastmail-agent/config.json with:")
-		fmt.Fprintln(os.Stderr, `  {"api_token": "fmu1-xxxxx"}`)
-		os.Exit(1)
+	if *offline {
+		*source = "local"
 	}
 
-	// Create JMAP client and connect
-	client := jmap.NewClient(cfg.APIToken)
-	if err := client.Connect(); err != nil {
-		fmt.Fprintf(os.Stderr, "Error connecting to Fastmail: %v\n", err)
-		os.Exit(1)
+	groupMode, err := tui.ParseGroupMode(*group)
+	if err != nil {
+		fatal("", usageError{err})
 	}
 
 	// CLI mode: query for threads
-	if *query != "" {
-		runQuery(client, *query)
+	if *query != "" || *cursor != "" {
+		opts := jmap.SearchOptions{
+			Limit:            *limit,
+			Position:         *offset,
+			InMailbox:        *inMailbox,
+			ExcludeMailboxes: splitList(*exclude),
+		}
+		src, release := openSource(*source)
+		defer release()
+		runQuery(src, *query, *cursor, opts, groupMode)
 		return
 	}
 
 	// CLI mode: fetch specific thread
-	if *threadID > 0 {
-		runFetchThread(client, *threadID, *outputJSON, *outputPDF)
+	if *threadRef != "" {
+		// Original messages are only on the server
+		if *outputEML || *outputMbox {
+			if *source == "local" {
+				fatal("", errOriginalsOffline)
+			}
+			*source = "remote"
+		}
+		src, release := openSource(*source)
+		defer release()
+		format := "text"
+		switch {
+		case *outputPDF:
+			format = "pdf"
+		case *outputJSON:
+			format = "json"
+		case *outputMarkdown:
+			format = "md"
+		case *outputEML:
+			format = "eml"
+		case *outputMbox:
+			format = "mbox"
+		}
+		opts := export.DefaultLLMOptions()
+		opts.MaxTokens = *maxTokens
+		if opts.MaxTokens > 0 {
+			if format != "text" {
+				fatal("", usageError{fmt.Errorf("-max-tokens only applies to the text format, not -%s", format)})
+			}
+			tok, err := export.TokenizerFor(*tokenizer)
+			if err != nil {
+				fatal("", usageError{fmt.Errorf("loading tokenizer: %w", err)})
+			}
+			opts.Tokenizer = tok
+		}
+		runFetchThread(src, *threadRef, format, opts, pdfOpts())
 		return
 	}
 
-	// Interactive TUI mode
+	client := connect()
+
+	// Interactive TUI mode; -timeout bounds each load there
+	model := tui.New(client, groupMode)
+	model.SetLoadTimeout(timeout)
 	p := tea.NewProgram(
-		tui.New(client),
+		model,
 		tea.WithAltScreen(),
 	)
 
 	if _, err := p.Run(); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+		fatal("", err)
 	}
 }
 
-// runQuery searches for emails and outputs grouped threads
-func runQuery(client *jmap.Client, query string) {
-	emails, err := client.SearchEmails(query, 50)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error searching: %v\n", err)
-		os.Exit(1)
-	}
+// parseGlobalFlags consumes the flags that may precede a subcommand, so
+// "fastmail-agent -timeout 30s sync" works, and returns the rest
+func parseGlobalFlags(args []string) []string {
+	for len(args) > 0 {
+		var value string
+		switch {
+		case args[0] == "-timeout" || args[0] == "--timeout":
+			if len(args) < 2 {
+				fatal("", usageError{fmt.Errorf("-timeout needs a duration, e.g. 30s")})
+			}
+			value, args = args[1], args[2:]
+		case strings.HasPrefix(args[0], "-timeout=") || strings.HasPrefix(args[0], "--timeout="):
+			value, args = args[0][strings.Index(args[0], "=")+1:], args[1:]
+		default:
+			return args
+		}
 
-	if len(emails) == 0 {
-		result := QueryResult{
-			Query:   query,
-			Count:   0,
-			Threads: []ThreadInfo{},
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			fatal("", usageError{fmt.Errorf("invalid -timeout %q: %w", value, err)})
 		}
-		outputJSONResult(result)
-		return
+		timeout = d
 	}
+	return args
+}
 
-	// Group emails by subject (same logic as TUI)
-	threads := groupEmailsBySubject(emails)
+// startTimeout applies -timeout to cmdCtx and returns the function that
+// releases it
+func startTimeout() context.CancelFunc {
+	var cancel context.CancelFunc
+	cmdCtx, cancel = withTimeout(context.Background())
+	return cancel
+}
 
-	// Build result
-	result := QueryResult{
-		Query:   query,
-		Count:   len(threads),
-		Threads: threads,
+// withTimeout bounds parent by -timeout, if one was given
+func withTimeout(parent context.Context) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(parent)
 	}
+	return context.WithTimeout(parent, timeout)
+}
 
-	outputJSONResult(result)
+// connect loads the configuration and connects to Fastmail, exiting on
+// failure
+func connect() *jmap.Client {
+	return connectWith(loadConfig())
 }
 
-// runFetchThread fetches and outputs a specific thread by its query result ID
-func runFetchThread(client *jmap.Client, threadID int, asJSON bool, asPDF bool) {
-	// We need to re-run a broad search and find the thread by index
-	// This is a limitation - we could cache results, but for agent use
-	// the typical workflow is: query -> pick thread -> fetch thread
-	// all in quick succession
+// loadConfig loads the configuration, exiting with setup instructions on
+// failure
+func loadConfig() *config.Config {
+	cfg, err := config.Load()
+	if err != nil && stderrIsTerminal() {
+		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+		fmt.Fprintln(os.Stderr, "\nPlease set FASTMAIL_API_TOKEN environment variable")
+		fmt.Fprintln(os.Stderr, "or create ~/.config/fastmail-agent/config.json with:")
+		fmt.Fprintln(os.Stderr, `  {"api_token": "fmu1-xxxxx"}`)
+		os.Exit(describeError(err).ExitCode)
+	}
+	if err != nil {
+		fatal("loading config", err)
+	}
+	return cfg
+}
 
-	// Read thread data from stdin if piped, otherwise error
-	// For now, require the user to pass the email IDs directly via a state file
-	// or re-query
+// connectWith creates a JMAP client for cfg and connects, exiting on failure
+func connectWith(cfg *config.Config) *jmap.Client {
+	client := jmap.NewClientWithSessionURL(cfg.APIToken, cfg.SessionURL)
+	if d := cfg.RequestTimeout(); d > 0 {
+		client.SetTimeout(d)
+	}
+	if cfg.MaxRetries != nil {
+		policy := jmap.DefaultRetryPolicy
+		policy.MaxRetries = *cfg.MaxRetries
+		client.SetRetryPolicy(policy)
+	}
+	if err := client.ConnectContext(cmdCtx); err != nil {
+		fatal("connecting to Fastmail", err)
+	}
+	return client
+}
 
-	// Actually, let's store the last query result in a temp file
-	stateFile := getStateFilePath()
+// runQuery searches for emails and outputs one page of grouped threads
+func runQuery(src mailSource, query, cursor string, opts jmap.SearchOptions, mode tui.GroupMode) {
+	if cursor != "" {
+		c, err := jmap.ParseSearchCursor(cursor)
+		if err != nil {
+			fatal("", usageError{err})
+		}
+		if query != "" && query != c.Query {
+			fatal("", usageError{fmt.Errorf("cursor belongs to query %q, not %q", c.Query, query)})
+		}
+		query = c.Query
+		opts = c.Options(opts.Limit)
+	}
 
-	data, err := os.ReadFile(stateFile)
+	page, err := src.SearchEmailsContext(cmdCtx, query, opts)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: No previous query results found.\n")
-		fmt.Fprintf(os.Stderr, "Run a query first with: fastmail-agent -q \"search terms\"\n")
-		os.Exit(1)
+		fatal("searching", err)
 	}
 
-	var lastResult QueryResult
-	if err := json.Unmarshal(data, &lastResult); err != nil {
-		fmt.Fprintf(os.Stderr, "Error reading state: %v\n", err)
-		os.Exit(1)
+	result := QueryResult{
+		Query:        query,
+		TotalMatches: page.Total,
+		Position:     page.Position,
+		HasMore:      page.HasMore(),
+		NextCursor:   page.NextCursor(),
+		State:        page.State,
+		Threads:      []ThreadInfo{},
 	}
 
-	// Find the thread by ID (1-indexed for user friendliness)
-	if threadID < 1 || threadID > len(lastResult.Threads) {
-		fmt.Fprintf(os.Stderr, "Error: Thread ID %d not found. Valid range: 1-%d\n", threadID, len(lastResult.Threads))
-		os.Exit(1)
+	if len(page.Emails) > 0 {
+		// Group emails into threads (same logic as TUI)
+		result.Threads = groupThreads(page.Emails, mode)
+		result.Count = len(result.Threads)
 	}
 
-	thread := lastResult.Threads[threadID-1]
+	outputJSONResult(result)
+}
+
+// runFetchThread fetches and outputs a thread by handle or query result index
+// in format: text, json, md, pdf, eml or mbox
+func runFetchThread(src mailSource, ref string, format string, opts export.ExportOptions, pdfOpts export.PDFOptions) {
+	handle, err := resolveThreadRef(ref)
+	if err != nil {
+		fatal("", err)
+	}
 
 	// Fetch full email content
-	emails, err := client.GetEmails(thread.EmailIDs)
+	emails, err := src.GetThreadByHandleContext(cmdCtx, handle)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error fetching emails: %v\n", err)
-		os.Exit(1)
+		fatal("fetching emails", err)
+	}
+	prov := export.Provenance{Handles: []string{handle.String()}, RetrievedAt: time.Now()}
+
+	if len(emails) == 0 {
+		fatal("", fmt.Errorf("thread %s %w", ref, jmap.ErrNotFound))
 	}
 
 	// Sort by date (oldest first for reading)
@@ -192,64 +424,184 @@ func runFetchThread(client *jmap.Client, threadID int, asJSON bool, asPDF bool)
 		return ti.Before(tj)
 	})
 
-	if asPDF {
-		filename := export.GeneratePDFFilename(thread.Subject)
-		if err := export.ExportToPDF(emails, filename); err != nil {
-			fmt.Fprintf(os.Stderr, "Error exporting PDF: %v\n", err)
-			os.Exit(1)
+	// Use the newest email's subject, as the thread list does
+	subject := emails[len(emails)-1].Subject
+
+	switch format {
+	case "pdf":
+		// Attachments come from the server; mail from the local store is
+		// rendered without them
+		client, _ := src.(*jmap.Client)
+		filename := export.GeneratePDFFilename(subject)
+		pdfOpts.Hashes = make(export.BlobHashes)
+		prov.Hashes = pdfOpts.Hashes
+		pages, err := export.WritePDFContext(cmdCtx, filename, emails, client, pdfOpts)
+		if err != nil {
+			fatal("exporting PDF", err)
+		}
+		if first, last := pdfOpts.BatesRange(pages); first != "" {
+			fmt.Printf("Bates: %s-%s\n", first, last)
 		}
-		fmt.Printf("Exported: %s\n", filename)
-	} else if asJSON {
-		outputThreadJSON(emails, thread.Subject)
-	} else {
+		writeManifest(src, emails, filename, prov)
+	case "json":
+		outputThreadJSON(emails, subject)
+	case "md":
+		fmt.Print(export.FormatThreadMarkdown(emails, opts))
+	case "eml":
+		client := originalsClient(src)
+		dir, err := export.ExportToEML(cmdCtx, emails, client)
+		if err != nil {
+			fatal("exporting messages", err)
+		}
+		writeManifest(client, emails, dir, prov)
+	case "mbox":
+		client := originalsClient(src)
+		dir, sum, err := export.ExportToMbox(cmdCtx, emails, client)
+		if err != nil {
+			fatal("exporting messages", err)
+		}
+		fmt.Printf("SHA-256: %s\n", sum)
+		writeManifest(client, emails, dir, prov)
+	default:
 		// Output in LLM-optimized text format
-		opts := export.DefaultLLMOptions()
-		fmt.Print(export.FormatThreadForLLM(emails, opts))
+		if opts.MaxTokens <= 0 {
+			fmt.Print(export.FormatThreadForLLM(emails, opts))
+			break
+		}
+		text, report := export.FormatThreadForLLMBudget(emails, opts)
+		fmt.Print(text)
+		if report.OverBudget {
+			fatal("", fmt.Errorf("thread is %d tokens (%s) with everything cut that can be, over -max-tokens %d",
+				report.Tokens, report.Tokenizer, report.MaxTokens))
+		}
 	}
 }
 
-// outputThreadJSON outputs thread content as JSON
-func outputThreadJSON(emails []jmap.Email, subject string) {
-	type EmailContent struct {
-		From    string `json:"from"`
-		To      string `json:"to"`
-		CC      string `json:"cc,omitempty"`
-		Date    string `json:"date"`
-		Subject string `json:"subject"`
-		Body    string `json:"body"`
+// pdfFlagNames are the flags pdfFlags defines
+var pdfFlagNames = map[string]bool{
+	"bates": true, "bates-start": true, "bates-digits": true, "header": true, "footer": true,
+	"exhibit": true, "cover": true, "pdf-renderer": true, "paper": true, "margin": true,
+	"font": true, "font-size": true, "snapshot-images": true,
+}
+
+// pdfFlags defines the flags for PDF layout and page furniture on fs, noting
+// when they apply, and returns a function that reads them once fs is parsed.
+// It exits with a usage error if one is invalid.
+func pdfFlags(fs *flag.FlagSet, when string) func() export.PDFOptions {
+	bates := fs.String("bates", "", "Stamp a Bates number with this prefix on every PDF page ("+when+")")
+	batesStart := fs.Int("bates-start", 0, "Bates number of the first page; 1 if only -bates is given ("+when+")")
+	batesDigits := fs.Int("bates-digits", 6, "Zero-padded width of Bates numbers ("+when+")")
+	header := fs.String("header", "", "Text at the top of every PDF page, e.g. a matter name; {page}, {pages} and {bates} are filled in ("+when+")")
+	footer := fs.String("footer", "", "Text at the bottom of every PDF page, like -header ("+when+")")
+	exhibit := fs.String("exhibit", "", "Exhibit label stamped on the first PDF page, e.g. \"Exhibit 12\" ("+when+")")
+	cover := fs.Bool("cover", false, "Start the PDF with a cover page linking to each message ("+when+")")
+	renderer := fs.String("pdf-renderer", "auto", "How to make PDFs: chrome, builtin (no browser needed; plain-text bodies; non-Western characters print as ?), or auto for chrome if it is installed, else builtin, failing on characters it can't show ("+when+")")
+	paper := fs.String("paper", "letter", "PDF paper size: letter, legal or a4 ("+when+")")
+	margin := fs.String("margin", "0.5in", "PDF page margins, one to four lengths as in CSS, e.g. \"1in 0.75in\" or 20mm ("+when+")")
+	font := fs.String("font", "", "PDF body font: helvetica, times or courier, or with chrome any installed font ("+when+")")
+	fontSize := fs.Float64("font-size", 11, "PDF body font size in points ("+when+")")
+	snapshot := fs.Bool("snapshot-images", false, "Download the remote images messages show and embed them in the PDF, instead of leaving them out ("+when+")")
+	return func() export.PDFOptions {
+		opts := export.PDFOptions{
+			BatesPrefix: *bates,
+			BatesStart:  *batesStart,
+			BatesDigits: *batesDigits,
+			Header:      *header,
+			Footer:      *footer,
+			Exhibit:     *exhibit,
+			Cover:       *cover,
+			Font:        *font,
+			FontSize:    *fontSize,
+
+			SnapshotImages: *snapshot,
+		}
+		var err error
+		if opts.Renderer, err = export.PDFRendererFor(*renderer); err == nil {
+			if opts.Paper, err = export.ParsePageSize(*paper); err == nil {
+				opts.Margins, err = export.ParseMargins(*margin)
+			}
+		}
+		if err == nil && opts.FontSize <= 0 {
+			err = fmt.Errorf("invalid font size %v", opts.FontSize)
+		}
+		if err != nil {
+			fatal("", usageError{err})
+		}
+		return opts
+	}
+}
+
+// writeManifest records the provenance of an export beside it and reports
+// both. Mail from the local store is recorded without attachment hashes,
+// since those need the server.
+func writeManifest(src mailSource, emails []jmap.Email, output string, prov export.Provenance) {
+	client, _ := src.(*jmap.Client)
+	path, err := export.WriteManifest(cmdCtx, client, emails, output, prov)
+	if err != nil {
+		fatal("writing manifest", err)
+	}
+	fmt.Printf("Exported: %s\nManifest: %s\n", output, path)
+}
+
+// errOriginalsOffline rejects -eml and -mbox with the local store, which
+// keeps only parsed fields
+var errOriginalsOffline = usageError{fmt.Errorf("original messages are only on the server; -eml and -mbox can't be used with -offline or -source=local")}
+
+// originalsClient returns the client to download original messages with,
+// which main has made sure src is
+func originalsClient(src mailSource) *jmap.Client {
+	client, ok := src.(*jmap.Client)
+	if !ok {
+		fatal("", errOriginalsOffline)
+	}
+	return client
+}
+
+// resolveThreadRef turns a -t argument into a thread handle. Handles are
+// self-contained; a bare number falls back to indexing into the last saved
+// query result. A malformed reference is a usageError; an index past the
+// last result is jmap.ErrNotFound.
+func resolveThreadRef(ref string) (jmap.ThreadHandle, error) {
+	if jmap.IsThreadHandle(ref) {
+		h, err := jmap.ParseThreadHandle(ref)
+		if err != nil {
+			return h, usageError{err}
+		}
+		return h, nil
+	}
+
+	index, err := strconv.Atoi(ref)
+	if err != nil {
+		return jmap.ThreadHandle{}, usageError{fmt.Errorf("%q is neither a thread handle nor a result index", ref)}
+	}
+
+	data, err := os.ReadFile(getStateFilePath())
+	if err != nil {
+		return jmap.ThreadHandle{}, usageError{fmt.Errorf("no previous query results found; run a query first with: fastmail-agent -q \"search terms\"")}
+	}
+
+	var lastResult QueryResult
+	if err := json.Unmarshal(data, &lastResult); err != nil {
+		return jmap.ThreadHandle{}, fmt.Errorf("reading state: %w", err)
 	}
 
-	type ThreadContent struct {
-		Subject string         `json:"subject"`
-		Count   int            `json:"count"`
-		Emails  []EmailContent `json:"emails"`
+	// Find the thread by ID (1-indexed for user friendliness)
+	if index < 1 || index > len(lastResult.Threads) {
+		return jmap.ThreadHandle{}, fmt.Errorf("thread ID %d %w, valid range: 1-%d", index, jmap.ErrNotFound, len(lastResult.Threads))
 	}
 
+	return jmap.ParseThreadHandle(lastResult.Threads[index-1].Handle)
+}
+
+// outputThreadJSON outputs thread content as JSON
+func outputThreadJSON(emails []jmap.Email, subject string) {
 	result := ThreadContent{
 		Subject: subject,
 		Count:   len(emails),
 		Emails:  make([]EmailContent, len(emails)),
 	}
-
-	opts := export.DefaultLLMOptions()
 	for i, email := range emails {
-		body := email.GetBodyText()
-		// Clean body same as LLM export
-		body = export.CleanBody(body, opts)
-
-		cc := ""
-		if len(email.CC) > 0 {
-			cc = formatEmailsOnly(email.CC)
-		}
-
-		result.Emails[i] = EmailContent{
-			From:    formatEmailsOnly(email.From),
-			To:      formatEmailsOnly(email.To),
-			CC:      cc,
-			Date:    formatDate(email.ReceivedAt),
-			Subject: email.Subject,
-			Body:    body,
-		}
+		result.Emails[i] = newEmailContent(email)
 	}
 
 	enc := json.NewEncoder(os.Stdout)
@@ -257,17 +609,49 @@ func outputThreadJSON(emails []jmap.Email, subject string) {
 	enc.Encode(result)
 }
 
-// groupEmailsBySubject groups emails by normalized subject
-func groupEmailsBySubject(emails []jmap.Email) []ThreadInfo {
-	threads := tui.GroupEmailsBySubject(emails)
+// ThreadContent is the JSON form of a fetched thread
+type ThreadContent struct {
+	Subject string         `json:"subject"`
+	Count   int            `json:"count"`
+	Emails  []EmailContent `json:"emails"`
+}
+
+// EmailContent is one message of a ThreadContent
+type EmailContent struct {
+	From      string   `json:"from"`
+	To        string   `json:"to"`
+	CC        string   `json:"cc,omitempty"`
+	Date      string   `json:"date"`
+	Subject   string   `json:"subject"`
+	Mailboxes []string `json:"mailboxes,omitempty"`
+	Body      string   `json:"body"`
+}
+
+// newEmailContent converts an email, cleaning the body the same way as the
+// LLM export
+func newEmailContent(email jmap.Email) EmailContent {
+	cc := ""
+	if len(email.CC) > 0 {
+		cc = formatEmailsOnly(email.CC)
+	}
+
+	return EmailContent{
+		From:      formatEmailsOnly(email.From),
+		To:        formatEmailsOnly(email.To),
+		CC:        cc,
+		Date:      formatDate(email.ReceivedAt),
+		Subject:   email.Subject,
+		Mailboxes: email.MailboxNames,
+		Body:      export.CleanBody(email.GetBodyText(), export.DefaultLLMOptions()),
+	}
+}
+
+// groupThreads groups emails into threads for CLI output
+func groupThreads(emails []jmap.Email, mode tui.GroupMode) []ThreadInfo {
+	threads := tui.GroupEmails(emails, mode)
 
 	result := make([]ThreadInfo, len(threads))
 	for i, t := range threads {
-		emailIDs := make([]string, len(t.Emails))
-		for j, e := range t.Emails {
-			emailIDs[j] = e.ID
-		}
-
 		from := t.From
 		if from == "" && len(t.Emails) > 0 && len(t.Emails[0].From) > 0 {
 			from = t.Emails[0].From[0].Email
@@ -275,24 +659,50 @@ func groupEmailsBySubject(emails []jmap.Email) []ThreadInfo {
 
 		result[i] = ThreadInfo{
 			ID:         i + 1, // 1-indexed for user friendliness
+			Handle:     t.Handle().String(),
+			ThreadID:   t.ThreadID,
 			Subject:    t.Subject,
 			From:       from,
 			Date:       t.Date.Format("2006-01-02 15:04"),
 			EmailCount: t.EmailCount,
 			Preview:    truncate(t.Preview, 100),
-			EmailIDs:   emailIDs,
+			EmailIDs:   t.EmailIDs(),
+			Mailboxes:  threadMailboxes(t.Emails),
 		}
 	}
 
 	return result
 }
 
+// threadMailboxes returns the names of every mailbox holding an email of the
+// thread, in first-seen order
+func threadMailboxes(emails []jmap.Email) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, email := range emails {
+		for _, name := range email.MailboxNames {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
 // outputJSONResult outputs the query result and saves state
 func outputJSONResult(result QueryResult) {
-	// Save state for subsequent -t calls
+	// Save state for subsequent index-based -t calls. Write via rename so a
+	// concurrent reader never sees a half-written file.
 	stateFile := getStateFilePath()
 	data, _ := json.Marshal(result)
-	os.WriteFile(stateFile, data, 0600)
+	if tmp, err := os.CreateTemp(filepath.Dir(stateFile), "last_query-*.json"); err == nil {
+		tmp.Write(data)
+		tmp.Close()
+		if err := os.Rename(tmp.Name(), stateFile); err != nil {
+			os.Remove(tmp.Name())
+		}
+	}
 
 	// Output to stdout
 	enc := json.NewEncoder(os.Stdout)
@@ -311,6 +721,17 @@ func getStateFilePath() string {
 	return stateDir + "/last_query.json"
 }
 
+// splitList splits a comma-separated flag value, dropping empty entries
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 // truncate truncates a string to max length
 func truncate(s string, max int) string {
 	if len(s) <= max {
@@ -0,0 +1,285 @@
+// Package mcp implements a Model Context Protocol server over stdio, so AI
+// agents can call fastmail-agent as a set of tools instead of parsing CLI
+// output.
+package mcp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// protocolVersions are the MCP revisions this server speaks, newest first
+var protocolVersions = []string{"2025-06-18", "2025-03-26", "2024-11-05"}
+
+// JSON-RPC error codes
+const (
+	codeParseError     = -32700
+	codeInvalidRequest = -32600
+	codeMethodNotFound = -32601
+	codeInvalidParams  = -32602
+)
+
+// Tool is a callable tool with JSON schemas for its input and output
+type Tool struct {
+	Name         string
+	Description  string
+	InputSchema  map[string]interface{}
+	OutputSchema map[string]interface{} // nil for tools returning plain text
+
+	// Handler runs the tool. Tools with an OutputSchema return a value
+	// matching it; the others return a string. ctx is cancelled when the
+	// client cancels the call.
+	Handler func(ctx context.Context, args json.RawMessage) (interface{}, error)
+}
+
+// Server dispatches JSON-RPC requests read from one stream and writes
+// responses to another. Requests are handled concurrently; responses may be
+// written in any order, as JSON-RPC allows.
+type Server struct {
+	name    string
+	version string
+	tools   []Tool
+	byName  map[string]int // index into tools
+
+	writeMu sync.Mutex
+	out     io.Writer
+
+	mu       sync.Mutex
+	inflight map[string]context.CancelFunc // by request ID
+}
+
+// NewServer creates a server that identifies itself as name/version
+func NewServer(name, version string) *Server {
+	return &Server{
+		name:     name,
+		version:  version,
+		byName:   make(map[string]int),
+		inflight: make(map[string]context.CancelFunc),
+	}
+}
+
+// AddTool registers a tool. Tools are listed in registration order. All
+// tools must be added before Serve is called.
+func (s *Server) AddTool(t Tool) {
+	s.byName[t.Name] = len(s.tools)
+	s.tools = append(s.tools, t)
+}
+
+type request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// Serve reads newline-delimited JSON-RPC messages from in until EOF, as the
+// MCP stdio transport specifies, and waits for in-flight requests to finish
+func (s *Server) Serve(in io.Reader, out io.Writer) error {
+	s.out = out
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	var wg sync.WaitGroup
+	for scanner.Scan() {
+		line := append([]byte(nil), scanner.Bytes()...)
+		if len(line) == 0 {
+			continue
+		}
+
+		var req request
+		if err := json.Unmarshal(line, &req); err != nil {
+			s.write(response{JSONRPC: "2.0", ID: json.RawMessage("null"),
+				Error: &rpcError{Code: codeParseError, Message: err.Error()}})
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.handle(req)
+		}()
+	}
+
+	wg.Wait()
+	return scanner.Err()
+}
+
+// handle answers one request. Notifications (no ID) and cancelled requests
+// get no response.
+func (s *Server) handle(req request) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if len(req.ID) > 0 {
+		s.mu.Lock()
+		s.inflight[string(req.ID)] = cancel
+		s.mu.Unlock()
+		defer func() {
+			s.mu.Lock()
+			delete(s.inflight, string(req.ID))
+			s.mu.Unlock()
+		}()
+	}
+
+	result, rerr := s.dispatch(ctx, req)
+	if len(req.ID) == 0 || ctx.Err() != nil {
+		return
+	}
+
+	resp := response{JSONRPC: "2.0", ID: req.ID}
+	if rerr != nil {
+		resp.Error = rerr
+	} else {
+		resp.Result = result
+	}
+	s.write(resp)
+}
+
+func (s *Server) dispatch(ctx context.Context, req request) (interface{}, *rpcError) {
+	if req.JSONRPC != "2.0" {
+		return nil, &rpcError{Code: codeInvalidRequest, Message: "jsonrpc must be 2.0"}
+	}
+
+	switch req.Method {
+	case "initialize":
+		var params struct {
+			ProtocolVersion string `json:"protocolVersion"`
+		}
+		json.Unmarshal(req.Params, &params)
+		return map[string]interface{}{
+			"protocolVersion": negotiateVersion(params.ProtocolVersion),
+			"capabilities": map[string]interface{}{
+				"tools": map[string]interface{}{},
+			},
+			"serverInfo": map[string]interface{}{
+				"name":    s.name,
+				"version": s.version,
+			},
+		}, nil
+
+	case "ping":
+		return map[string]interface{}{}, nil
+
+	case "tools/list":
+		tools := make([]map[string]interface{}, len(s.tools))
+		for i, t := range s.tools {
+			tools[i] = map[string]interface{}{
+				"name":        t.Name,
+				"description": t.Description,
+				"inputSchema": t.InputSchema,
+			}
+			if t.OutputSchema != nil {
+				tools[i]["outputSchema"] = t.OutputSchema
+			}
+		}
+		return map[string]interface{}{"tools": tools}, nil
+
+	case "tools/call":
+		var params struct {
+			Name      string          `json:"name"`
+			Arguments json.RawMessage `json:"arguments"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, &rpcError{Code: codeInvalidParams, Message: err.Error()}
+		}
+		idx, ok := s.byName[params.Name]
+		if !ok {
+			return nil, &rpcError{Code: codeInvalidParams, Message: fmt.Sprintf("unknown tool %q", params.Name)}
+		}
+		if len(params.Arguments) == 0 {
+			params.Arguments = json.RawMessage("{}")
+		}
+		return callTool(ctx, s.tools[idx], params.Arguments), nil
+
+	case "notifications/cancelled":
+		var params struct {
+			RequestID json.RawMessage `json:"requestId"`
+		}
+		json.Unmarshal(req.Params, &params)
+		s.mu.Lock()
+		if cancel, ok := s.inflight[string(params.RequestID)]; ok {
+			cancel()
+		}
+		s.mu.Unlock()
+		return nil, nil
+	}
+
+	if len(req.ID) == 0 {
+		// Unknown notifications such as notifications/initialized are ignored
+		return nil, nil
+	}
+	return nil, &rpcError{Code: codeMethodNotFound, Message: fmt.Sprintf("method %q not found", req.Method)}
+}
+
+// callTool runs a tool and wraps its output in a CallToolResult. Tool
+// failures are reported in the result, not as protocol errors, so the model
+// can see them.
+func callTool(ctx context.Context, tool Tool, args json.RawMessage) map[string]interface{} {
+	value, err := tool.Handler(ctx, args)
+	if err != nil {
+		return map[string]interface{}{
+			"content": []map[string]interface{}{{"type": "text", "text": err.Error()}},
+			"isError": true,
+		}
+	}
+
+	if text, ok := value.(string); ok && tool.OutputSchema == nil {
+		return map[string]interface{}{
+			"content": []map[string]interface{}{{"type": "text", "text": text}},
+		}
+	}
+
+	// Structured results are also serialized as text for older clients
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return map[string]interface{}{
+			"content": []map[string]interface{}{{"type": "text", "text": err.Error()}},
+			"isError": true,
+		}
+	}
+	return map[string]interface{}{
+		"content":           []map[string]interface{}{{"type": "text", "text": string(data)}},
+		"structuredContent": value,
+	}
+}
+
+// write sends one message; writes are serialized so concurrent responses
+// don't interleave
+func (s *Server) write(resp response) {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		data, _ = json.Marshal(response{JSONRPC: "2.0", ID: resp.ID,
+			Error: &rpcError{Code: codeInvalidRequest, Message: err.Error()}})
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.out.Write(append(data, '\n'))
+}
+
+// negotiateVersion returns the client's protocol version if supported, and
+// the newest supported version otherwise
+func negotiateVersion(requested string) string {
+	for _, v := range protocolVersions {
+		if v == requested {
+			return v
+		}
+	}
+	return protocolVersions[0]
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/stevemurr/fastmail-agent/export"
+	"github.com/stevemurr/fastmail-agent/jmap"
+	"github.com/stevemurr/fastmail-agent/tui"
+)
+
+//go:embed openapi.json
+var openAPIDoc []byte
+
+// streamBatchSize is how many emails of a thread are fetched per request
+// while streaming it
+const streamBatchSize = 10
+
+// apiServer serves the HTTP API from one shared, connected client
+type apiServer struct {
+	client *jmap.Client
+	token  string
+}
+
+// runServe serves the HTTP API until the process is stopped
+func runServe(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:8080", "Address to listen on")
+	token := fs.String("token", "", "Bearer token callers must send (default: serve_token from config, else a random one)")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: fastmail-agent serve [-addr host:port] [-token <token>]")
+		fmt.Fprintln(os.Stderr, "\nServes search, thread fetch, attachments and exports over HTTP.")
+		fmt.Fprintln(os.Stderr, "The OpenAPI document is at /openapi.json.")
+		fmt.Fprintln(os.Stderr)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	cfg := loadConfig()
+	if *token == "" {
+		*token = cfg.ServeToken
+	}
+	if *token == "" {
+		*token = randomToken()
+		fmt.Fprintf(os.Stderr, "No serve_token configured; callers must send:\n  Authorization: Bearer %s\n", *token)
+	}
+
+	s := &apiServer{client: connectWith(cfg), token: *token}
+
+	server := &http.Server{
+		Addr:              *addr,
+		Handler:           s.routes(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	fmt.Fprintf(os.Stderr, "Listening on http://%s\n", *addr)
+	if err := server.ListenAndServe(); err != nil {
+		fatal("", err)
+	}
+}
+
+// randomToken returns a fresh 128-bit hex token
+func randomToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// routes builds the request router. Everything except the OpenAPI document
+// requires the bearer token.
+func (s *apiServer) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(openAPIDoc)
+	})
+	mux.Handle("GET /v1/search", s.auth(s.handleSearch))
+	mux.Handle("GET /v1/mailboxes", s.auth(s.handleMailboxes))
+	mux.Handle("GET /v1/threads/{handle}", s.auth(s.handleThread))
+	mux.Handle("GET /v1/threads/{handle}/pdf", s.auth(s.handlePDF))
+	mux.Handle("GET /v1/threads/{handle}/attachments", s.auth(s.handleAttachments))
+	mux.Handle("GET /v1/threads/{handle}/attachments/{index}", s.auth(s.handleAttachment))
+	return mux
+}
+
+// auth wraps h with a constant-time bearer token check. Requests are bounded
+// by -timeout and cancelled when the caller goes away.
+func (s *apiServer) auth(h http.HandlerFunc) http.Handler {
+	want := []byte("Bearer " + s.token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="fastmail-agent"`)
+			writeError(w, http.StatusUnauthorized, errors.New("missing or invalid bearer token"))
+			return
+		}
+		ctx, cancel := withTimeout(r.Context())
+		defer cancel()
+		h(w, r.WithContext(ctx))
+	})
+}
+
+// writeJSON writes v as the response body
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// writeError writes {"error": "..."} with the given status
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+// writeFetchError reports a failed call to the mail server, classified as
+// for CLI exit codes: a missing thread is a 404 and a request the server
+// rejected a 400
+func writeFetchError(w http.ResponseWriter, err error) {
+	info := describeError(err)
+	status := http.StatusBadGateway
+	switch info.ExitCode {
+	case exitNotFound:
+		status = http.StatusNotFound
+	case exitInvalid:
+		status = http.StatusBadRequest
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Error       string   `json:"error"`
+		Code        string   `json:"code"`
+		Type        string   `json:"type,omitempty"`
+		Description string   `json:"description,omitempty"`
+		Properties  []string `json:"properties,omitempty"`
+	}{err.Error(), info.Code, info.Type, info.Description, info.Properties})
+}
+
+func (s *apiServer) handleSearch(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	query := q.Get("q")
+	cursor := q.Get("cursor")
+	if query == "" && cursor == "" {
+		writeError(w, http.StatusBadRequest, errors.New("q or cursor is required"))
+		return
+	}
+
+	limit := 50
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q", v))
+			return
+		}
+		limit = n
+	}
+
+	opts := jmap.SearchOptions{
+		Limit:            limit,
+		InMailbox:        q.Get("in"),
+		ExcludeMailboxes: jmap.DefaultExcludedMailboxes,
+	}
+	if cursor != "" {
+		c, err := jmap.ParseSearchCursor(cursor)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		query = c.Query
+		opts = c.Options(limit)
+	}
+
+	page, err := s.client.SearchEmailsContext(r.Context(), query, opts)
+	if err != nil {
+		writeFetchError(w, err)
+		return
+	}
+
+	threads := groupThreads(page.Emails, tui.GroupByThread)
+	writeJSON(w, QueryResult{
+		Query:        query,
+		Count:        len(threads),
+		TotalMatches: page.Total,
+		Position:     page.Position,
+		HasMore:      page.HasMore(),
+		NextCursor:   page.NextCursor(),
+		State:        page.State,
+		Threads:      threads,
+	})
+}
+
+func (s *apiServer) handleMailboxes(w http.ResponseWriter, r *http.Request) {
+	mailboxes, err := s.client.GetMailboxesContext(r.Context())
+	if err != nil {
+		writeFetchError(w, err)
+		return
+	}
+	writeJSON(w, mailboxInfos(mailboxes))
+}
+
+// handleThread streams a thread oldest message first, fetching it in
+// batches so long threads start arriving before they are fully downloaded.
+// Formats: json (ThreadContent), ndjson (one EmailContent per line), llm
+// and text.
+func (s *apiServer) handleThread(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+
+	var contentType string
+	switch format {
+	case "json":
+		contentType = "application/json"
+	case "ndjson":
+		contentType = "application/x-ndjson"
+	case "llm", "text":
+		contentType = "text/plain; charset=utf-8"
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown format %q (use json, ndjson, llm or text)", format))
+		return
+	}
+
+	h, err := jmap.ParseThreadHandle(r.PathValue("handle"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	batches, err := s.threadBatches(r.Context(), h)
+	if err != nil {
+		writeFetchError(w, err)
+		return
+	}
+
+	// Fetch the first batch before committing to a 200 so most failures
+	// still get a proper status
+	first, err := s.client.GetEmailsContext(r.Context(), batches[0])
+	if err != nil {
+		writeFetchError(w, err)
+		return
+	}
+
+	total := 0
+	for _, b := range batches {
+		total += len(b)
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+
+	// ThreadContent is written by hand so emails can be flushed as they
+	// arrive; the subject, taken from the newest email, comes last
+	if format == "json" {
+		fmt.Fprintf(w, `{"count":%d,"emails":[`, total)
+	}
+
+	idx := 0
+	var last jmap.Email
+	emails := first
+	for i := 0; ; i++ {
+		for _, email := range emails {
+			idx++
+			switch format {
+			case "json":
+				if idx > 1 {
+					io.WriteString(w, ",")
+				}
+				enc.Encode(newEmailContent(email))
+			case "ndjson":
+				enc.Encode(newEmailContent(email))
+			case "llm":
+				io.WriteString(w, export.FormatEmailForLLM(email, idx, export.DefaultLLMOptions()))
+			case "text":
+				io.WriteString(w, export.FormatEmail(email, idx, total))
+			}
+			last = email
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		if i+1 == len(batches) {
+			break
+		}
+		if emails, err = s.client.GetEmailsContext(r.Context(), batches[i+1]); err != nil {
+			// Too late for a status code; cut the body short so the
+			// caller sees a truncated response rather than a valid one
+			fmt.Fprintf(os.Stderr, "Error streaming thread: %v\n", err)
+			panic(http.ErrAbortHandler)
+		}
+	}
+
+	if format == "json" {
+		subject, _ := json.Marshal(last.Subject)
+		fmt.Fprintf(w, `],"subject":%s}`+"\n", subject)
+	}
+}
+
+// threadBatches lists a thread's email IDs in batches to fetch one after
+// another. Thread/get returns a single thread's emails oldest first; other
+// handles are fetched as one batch so GetEmails can sort them.
+func (s *apiServer) threadBatches(ctx context.Context, h jmap.ThreadHandle) ([][]string, error) {
+	ids, err := s.client.ThreadEmailIDsContext(ctx, h)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("thread %s: %w", h, jmap.ErrNotFound)
+	}
+	if len(h.ThreadIDs) != 1 {
+		return [][]string{ids}, nil
+	}
+
+	var batches [][]string
+	for len(ids) > streamBatchSize {
+		batches = append(batches, ids[:streamBatchSize])
+		ids = ids[streamBatchSize:]
+	}
+	return append(batches, ids), nil
+}
+
+// thread fetches the whole thread named by the request path, writing the
+// error response itself on failure
+func (s *apiServer) thread(w http.ResponseWriter, r *http.Request) ([]jmap.Email, bool) {
+	h, err := jmap.ParseThreadHandle(r.PathValue("handle"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return nil, false
+	}
+
+	emails, err := s.client.GetThreadByHandleContext(r.Context(), h)
+	if err != nil {
+		writeFetchError(w, err)
+		return nil, false
+	}
+	if len(emails) == 0 {
+		writeFetchError(w, fmt.Errorf("thread %s: %w", h, jmap.ErrNotFound))
+		return nil, false
+	}
+	return emails, true
+}
+
+func (s *apiServer) handlePDF(w http.ResponseWriter, r *http.Request) {
+	emails, ok := s.thread(w, r)
+	if !ok {
+		return
+	}
+
+	// The renderer writes to a file; send it back and clean up
+	dir, err := os.MkdirTemp("", "fastmail-agent-pdf-")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	name := export.GeneratePDFFilename(emails[len(emails)-1].Subject)
+	path := filepath.Join(dir, name)
+	if _, err := export.WritePDFContext(r.Context(), path, emails, s.client, export.PDFOptions{}); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	http.ServeFile(w, r, path)
+}
+
+// AttachmentInfo is an attachment listed by the HTTP API
+type AttachmentInfo struct {
+	Index int    `json:"index"` // 1-based, as in the download URL
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Size  uint64 `json:"size"`
+	From  string `json:"from"`
+	Date  string `json:"date"`
+}
+
+func (s *apiServer) handleAttachments(w http.ResponseWriter, r *http.Request) {
+	emails, ok := s.thread(w, r)
+	if !ok {
+		return
+	}
+
+	infos := []AttachmentInfo{}
+	for _, email := range emails {
+		for _, att := range email.Attachments {
+			if att.IsInline {
+				continue
+			}
+			infos = append(infos, AttachmentInfo{
+				Index: len(infos) + 1,
+				Name:  att.Name,
+				Type:  att.Type,
+				Size:  att.Size,
+				From:  formatEmailsOnly(email.From),
+				Date:  formatDate(email.ReceivedAt),
+			})
+		}
+	}
+	writeJSON(w, infos)
+}
+
+// handleAttachment streams one attachment straight from Fastmail
+func (s *apiServer) handleAttachment(w http.ResponseWriter, r *http.Request) {
+	index, err := strconv.Atoi(r.PathValue("index"))
+	if err != nil || index <= 0 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid attachment index %q", r.PathValue("index")))
+		return
+	}
+
+	emails, ok := s.thread(w, r)
+	if !ok {
+		return
+	}
+	att, err := findAttachment(emails, "", index)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	body, err := s.client.OpenBlobContext(r.Context(), att.BlobID, att.Name, att.Type)
+	if err != nil {
+		writeFetchError(w, err)
+		return
+	}
+	defer body.Close()
+
+	w.Header().Set("Content-Type", att.Type)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", att.Name))
+	io.Copy(w, body)
+}
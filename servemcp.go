@@ -0,0 +1,601 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/stevemurr/fastmail-agent/export"
+	"github.com/stevemurr/fastmail-agent/jmap"
+	"github.com/stevemurr/fastmail-agent/mcp"
+	"github.com/stevemurr/fastmail-agent/tui"
+)
+
+// maxAttachmentText caps the text returned by get_attachment_text
+const maxAttachmentText = 200000
+
+// runServeMCP serves the MCP tools over stdin/stdout until stdin closes
+func runServeMCP(args []string) {
+	fs := flag.NewFlagSet("serve-mcp", flag.ExitOnError)
+	exportDir := fs.String("export-dir", "", "Directory export_thread writes into (default: export_dir from config, else ~/fastmail-agent-exports)")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: fastmail-agent serve-mcp [-export-dir <dir>]")
+		fmt.Fprintln(os.Stderr, "\nRuns a Model Context Protocol server on stdin/stdout exposing")
+		fmt.Fprintln(os.Stderr, "search_emails, get_thread, list_mailboxes, get_attachment_text and export_thread.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	cfg := loadConfig()
+	if *exportDir == "" {
+		*exportDir = cfg.ExportDirectory()
+	}
+	client := connectWith(cfg)
+
+	server := mcp.NewServer("fastmail-agent", version)
+	for _, tool := range mcpTools(client, *exportDir) {
+		server.AddTool(tool)
+	}
+
+	// stdout carries the protocol; anything else must go to stderr
+	if err := server.Serve(os.Stdin, os.Stdout); err != nil {
+		fatal("", err)
+	}
+}
+
+// Schema helpers for the tool definitions
+
+func schemaObject(props map[string]interface{}, required ...string) map[string]interface{} {
+	s := map[string]interface{}{
+		"type":       "object",
+		"properties": props,
+	}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
+
+func schemaString(description string) map[string]interface{} {
+	return map[string]interface{}{"type": "string", "description": description}
+}
+
+func schemaEnum(description string, values ...string) map[string]interface{} {
+	return map[string]interface{}{"type": "string", "description": description, "enum": values}
+}
+
+func schemaInt(description string) map[string]interface{} {
+	return map[string]interface{}{"type": "integer", "description": description}
+}
+
+func schemaNumber(description string) map[string]interface{} {
+	return map[string]interface{}{"type": "number", "description": description}
+}
+
+func schemaBool(description string) map[string]interface{} {
+	return map[string]interface{}{"type": "boolean", "description": description}
+}
+
+func schemaArray(items map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"type": "array", "items": items}
+}
+
+// threadInfoSchema describes ThreadInfo
+var threadInfoSchema = schemaObject(map[string]interface{}{
+	"id":          schemaInt("Position in this result, 1-based"),
+	"handle":      schemaString("Stable thread handle for get_thread and export_thread"),
+	"thread_id":   schemaString("JMAP thread ID"),
+	"subject":     schemaString("Subject of the newest email"),
+	"from":        schemaString("Sender of the newest email"),
+	"date":        schemaString("Date of the newest email"),
+	"email_count": schemaInt("Matching emails in the thread"),
+	"preview":     schemaString("Start of the newest email"),
+	"email_ids":   schemaArray(schemaString("")),
+	"mailboxes":   schemaArray(schemaString("")),
+}, "handle", "subject", "email_count")
+
+// mailboxInfoSchema describes MailboxInfo
+var mailboxInfoSchema = schemaObject(map[string]interface{}{
+	"id":             schemaString("Mailbox ID"),
+	"name":           schemaString("Mailbox name"),
+	"role":           schemaString("JMAP role such as inbox, sent, junk, trash, archive"),
+	"parent_id":      schemaString("Parent mailbox ID"),
+	"parent":         schemaString("Parent mailbox name"),
+	"total_emails":   schemaInt(""),
+	"unread_emails":  schemaInt(""),
+	"total_threads":  schemaInt(""),
+	"unread_threads": schemaInt(""),
+	"sort_order":     schemaInt(""),
+}, "id", "name")
+
+// mcpTools returns the tools served by serve-mcp; export_thread writes
+// only inside exportDir. Handlers may run concurrently; jmap.Client is safe
+// for that.
+func mcpTools(client *jmap.Client, exportDir string) []mcp.Tool {
+	return []mcp.Tool{
+		{
+			Name: "search_emails",
+			Description: "Search Fastmail and list matching threads, newest first. Supports from:, to:, cc:, " +
+				"subject:, has:attachment, before:/after:YYYY-MM-DD, in:<mailbox>, is:unread/read/flagged, " +
+				"\"phrases\", -negation and OR. Spam and Trash are skipped unless the query uses in:.",
+			InputSchema: schemaObject(map[string]interface{}{
+				"query":  schemaString("Search query"),
+				"limit":  schemaInt("Maximum emails per page (default 50)"),
+				"cursor": schemaString("next_cursor from a previous result, to fetch the next page"),
+				"in":     schemaString("Only search this mailbox, by name or role"),
+			}, "query"),
+			OutputSchema: schemaObject(map[string]interface{}{
+				"query":         schemaString(""),
+				"count":         schemaInt("Threads in this page"),
+				"total_matches": schemaInt("Matching emails on the server"),
+				"position":      schemaInt("Offset of this page's first email"),
+				"has_more":      schemaBool(""),
+				"next_cursor":   schemaString("Pass as cursor to continue"),
+				"threads":       schemaArray(threadInfoSchema),
+			}, "query", "total_matches", "has_more", "threads"),
+			Handler: func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+				ctx, cancel := withTimeout(ctx)
+				defer cancel()
+
+				var args struct {
+					Query  string `json:"query"`
+					Limit  int    `json:"limit"`
+					Cursor string `json:"cursor"`
+					In     string `json:"in"`
+				}
+				if err := json.Unmarshal(raw, &args); err != nil {
+					return nil, err
+				}
+
+				opts := jmap.SearchOptions{
+					Limit:            args.Limit,
+					InMailbox:        args.In,
+					ExcludeMailboxes: jmap.DefaultExcludedMailboxes,
+				}
+				if args.Cursor != "" {
+					c, err := jmap.ParseSearchCursor(args.Cursor)
+					if err != nil {
+						return nil, err
+					}
+					args.Query = c.Query
+					opts = c.Options(args.Limit)
+				}
+
+				page, err := client.SearchEmailsContext(ctx, args.Query, opts)
+				if err != nil {
+					return nil, err
+				}
+
+				threads := groupThreads(page.Emails, tui.GroupByThread)
+				return QueryResult{
+					Query:        args.Query,
+					Count:        len(threads),
+					TotalMatches: page.Total,
+					Position:     page.Position,
+					HasMore:      page.HasMore(),
+					NextCursor:   page.NextCursor(),
+					Threads:      threads,
+				}, nil
+			},
+		},
+		{
+			Name:        "get_thread",
+			Description: "Fetch every message of a thread as LLM-friendly text, with quotes and signatures stripped.",
+			InputSchema: schemaObject(map[string]interface{}{
+				"handle":           schemaString("Thread handle from search_emails"),
+				"with_attachments": schemaBool("Append a list of attachments"),
+				"max_tokens":       schemaInt("Cut the text down to this many tokens, counted by estimate: older messages are shortened, then the middle of the thread is left out"),
+				"tokenizer":        schemaString("How max_tokens counts: cl100k (a built-in estimate; default), chars, or a model name"),
+			}, "handle"),
+			OutputSchema: schemaObject(map[string]interface{}{
+				"subject":     schemaString(""),
+				"email_count": schemaInt(""),
+				"text":        schemaString("The thread, oldest message first"),
+				"budget": schemaObject(map[string]interface{}{
+					"max_tokens":  schemaInt(""),
+					"tokenizer":   schemaString(""),
+					"full_tokens": schemaInt("Tokens in the whole thread"),
+					"tokens":      schemaInt("Tokens in text"),
+					"elided": schemaArray(schemaObject(map[string]interface{}{
+						"message_idx": schemaInt(""),
+						"action":      schemaString("shortened, stripped, omitted or truncated"),
+					})),
+					"over_budget": schemaBool("Set if the text is still over max_tokens with everything cut that can be"),
+				}),
+			}, "subject", "email_count", "text"),
+			Handler: func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+				ctx, cancel := withTimeout(ctx)
+				defer cancel()
+
+				var args struct {
+					Handle          string `json:"handle"`
+					WithAttachments bool   `json:"with_attachments"`
+					MaxTokens       int    `json:"max_tokens"`
+					Tokenizer       string `json:"tokenizer"`
+				}
+				if err := json.Unmarshal(raw, &args); err != nil {
+					return nil, err
+				}
+
+				emails, err := fetchThread(ctx, client, args.Handle)
+				if err != nil {
+					return nil, err
+				}
+
+				result := map[string]interface{}{
+					"subject":     emails[len(emails)-1].Subject,
+					"email_count": len(emails),
+				}
+
+				opts := export.DefaultLLMOptions()
+				var text string
+				if args.MaxTokens > 0 {
+					// Files are the caller's to read; only names are accepted
+					if strings.ContainsAny(args.Tokenizer, `/\`) || strings.HasSuffix(strings.ToLower(args.Tokenizer), ".tiktoken") {
+						return nil, fmt.Errorf("unknown tokenizer %q", args.Tokenizer)
+					}
+					tok, err := export.TokenizerFor(args.Tokenizer)
+					if err != nil {
+						return nil, err
+					}
+					opts.MaxTokens, opts.Tokenizer = args.MaxTokens, tok
+					var report export.BudgetReport
+					text, report = export.FormatThreadForLLMBudget(emails, opts)
+					result["budget"] = report
+				} else {
+					text = export.FormatThreadForLLM(emails, opts)
+				}
+				if args.WithAttachments {
+					text += "\n" + export.FormatAttachmentInfo(emails)
+				}
+				result["text"] = text
+				return result, nil
+			},
+		},
+		{
+			Name:        "list_mailboxes",
+			Description: "List every mailbox with its role, parent and unread/total counts.",
+			InputSchema: schemaObject(map[string]interface{}{}),
+			OutputSchema: schemaObject(map[string]interface{}{
+				"mailboxes": schemaArray(mailboxInfoSchema),
+			}, "mailboxes"),
+			Handler: func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+				ctx, cancel := withTimeout(ctx)
+				defer cancel()
+
+				mailboxes, err := client.GetMailboxesContext(ctx)
+				if err != nil {
+					return nil, err
+				}
+				return map[string]interface{}{"mailboxes": mailboxInfos(mailboxes)}, nil
+			},
+		},
+		{
+			Name: "get_attachment_text",
+			Description: "Download an attachment of a thread and return its text. Works for text, HTML, " +
+				"CSV, JSON and XML attachments.",
+			InputSchema: schemaObject(map[string]interface{}{
+				"handle": schemaString("Thread handle from search_emails"),
+				"name":   schemaString("Attachment file name"),
+				"index":  schemaInt("Attachment number as listed by get_thread with_attachments, 1-based"),
+			}, "handle"),
+			OutputSchema: schemaObject(map[string]interface{}{
+				"name":      schemaString(""),
+				"type":      schemaString("MIME type"),
+				"size":      schemaInt("Size in bytes"),
+				"text":      schemaString(""),
+				"truncated": schemaBool("The text was cut short"),
+			}, "name", "type", "text"),
+			Handler: func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+				ctx, cancel := withTimeout(ctx)
+				defer cancel()
+
+				var args struct {
+					Handle string `json:"handle"`
+					Name   string `json:"name"`
+					Index  int    `json:"index"`
+				}
+				if err := json.Unmarshal(raw, &args); err != nil {
+					return nil, err
+				}
+
+				emails, err := fetchThread(ctx, client, args.Handle)
+				if err != nil {
+					return nil, err
+				}
+				att, err := findAttachment(emails, args.Name, args.Index)
+				if err != nil {
+					return nil, err
+				}
+				if !isTextType(att.Type) {
+					return nil, fmt.Errorf("cannot extract text from %s (%s); use export_thread with format folder to download it", att.Name, att.Type)
+				}
+
+				data, err := client.DownloadBlobContext(ctx, att.BlobID, att.Name, att.Type)
+				if err != nil {
+					return nil, err
+				}
+
+				text := string(data)
+				if strings.HasPrefix(att.Type, "text/html") {
+					text = export.HTMLToText(text)
+				}
+				truncated := len(text) > maxAttachmentText
+				if truncated {
+					// Cut before the rune that crosses the limit
+					n := maxAttachmentText
+					for n > 0 && !utf8.RuneStart(text[n]) {
+						n--
+					}
+					text = text[:n]
+				}
+				return map[string]interface{}{
+					"name":      att.Name,
+					"type":      att.Type,
+					"size":      att.Size,
+					"text":      text,
+					"truncated": truncated,
+				}, nil
+			},
+		},
+		{
+			Name: "export_thread",
+			Description: "Export a thread. Formats llm and text return the content; pdf writes a PDF file " +
+				"and folder writes thread.txt plus attachments into a new directory, both inside the server's export directory.",
+			InputSchema: schemaObject(map[string]interface{}{
+				"handle":          schemaString("Thread handle from search_emails"),
+				"format":          schemaEnum("Export format", "llm", "text", "pdf", "folder"),
+				"path":            schemaString("Output file for pdf, relative to the export directory (default: generated from the subject)"),
+				"bates_prefix":    schemaString("For pdf: stamp a Bates number with this prefix on every page"),
+				"bates_start":     schemaInt("For pdf: the first page's Bates number (default 1 with bates_prefix)"),
+				"header":          schemaString("For pdf: text at the top of every page; {page}, {pages} and {bates} are filled in"),
+				"footer":          schemaString("For pdf: text at the bottom of every page, like header"),
+				"exhibit":         schemaString("For pdf: exhibit label stamped on the first page, e.g. Exhibit 12"),
+				"cover_page":      schemaBool("For pdf: start with a cover page linking to each message"),
+				"renderer":        schemaEnum("For pdf: chrome, builtin (no browser needed; plain-text bodies; non-Western characters print as ?), or auto for chrome if installed, else builtin, failing on characters it can't show", "auto", "chrome", "builtin"),
+				"paper":           schemaEnum("For pdf: paper size (default letter)", "letter", "legal", "a4"),
+				"margins":         schemaString("For pdf: page margins as one to four CSS-style lengths, e.g. 1in 0.75in (default 0.5in)"),
+				"font":            schemaString("For pdf: body font, helvetica, times or courier, or with chrome any installed font"),
+				"font_size":       schemaNumber("For pdf: body font size in points (default 11)"),
+				"snapshot_images": schemaBool("For pdf: download the remote images messages show and embed them, instead of leaving them out"),
+			}, "handle", "format"),
+			OutputSchema: schemaObject(map[string]interface{}{
+				"format":   schemaString(""),
+				"path":     schemaString("File or directory written, for pdf and folder, including the export directory"),
+				"manifest": schemaString("Chain-of-custody manifest of what was written, for pdf and folder"),
+				"pages":    schemaInt("Pages in the PDF, when known"),
+				"bates":    schemaString("First and last Bates numbers of the PDF"),
+				"text":     schemaString("Exported content, for llm and text"),
+			}, "format"),
+			Handler: func(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+				ctx, cancel := withTimeout(ctx)
+				defer cancel()
+
+				var args struct {
+					Handle string `json:"handle"`
+					Format string `json:"format"`
+					Path   string `json:"path"`
+
+					BatesPrefix string `json:"bates_prefix"`
+					BatesStart  int    `json:"bates_start"`
+					Header      string `json:"header"`
+					Footer      string `json:"footer"`
+					Exhibit     string `json:"exhibit"`
+					CoverPage   bool   `json:"cover_page"`
+
+					Renderer string  `json:"renderer"`
+					Paper    string  `json:"paper"`
+					Margins  string  `json:"margins"`
+					Font     string  `json:"font"`
+					FontSize float64 `json:"font_size"`
+
+					SnapshotImages bool `json:"snapshot_images"`
+				}
+				if err := json.Unmarshal(raw, &args); err != nil {
+					return nil, err
+				}
+
+				emails, err := fetchThread(ctx, client, args.Handle)
+				if err != nil {
+					return nil, err
+				}
+				retrievedAt := time.Now()
+				hashes := make(export.BlobHashes)
+
+				result := map[string]interface{}{"format": args.Format}
+				switch args.Format {
+				case "llm":
+					result["text"] = export.FormatThreadForLLM(emails, export.DefaultLLMOptions())
+				case "text":
+					result["text"] = export.FormatThread(emails)
+				case "pdf":
+					name := args.Path
+					if name == "" {
+						name = export.GeneratePDFFilename(emails[len(emails)-1].Subject)
+					}
+					path, err := exportPath(exportDir, name)
+					if err != nil {
+						return nil, err
+					}
+					opts := export.PDFOptions{
+						BatesPrefix: args.BatesPrefix,
+						BatesStart:  args.BatesStart,
+						Header:      args.Header,
+						Footer:      args.Footer,
+						Exhibit:     args.Exhibit,
+						Cover:       args.CoverPage,
+						Font:        args.Font,
+						FontSize:    args.FontSize,
+
+						SnapshotImages: args.SnapshotImages,
+					}
+					if opts.Renderer, err = export.PDFRendererFor(args.Renderer); err != nil {
+						return nil, err
+					}
+					if args.Paper != "" {
+						if opts.Paper, err = export.ParsePageSize(args.Paper); err != nil {
+							return nil, err
+						}
+					}
+					if args.Margins != "" {
+						if opts.Margins, err = export.ParseMargins(args.Margins); err != nil {
+							return nil, err
+						}
+					}
+					opts.Hashes = hashes
+					pages, err := export.WritePDFContext(ctx, path, emails, client, opts)
+					if err != nil {
+						return nil, err
+					}
+					result["path"] = path
+					if pages > 0 {
+						result["pages"] = pages
+					}
+					if first, last := opts.BatesRange(pages); first != "" {
+						result["bates"] = first + "-" + last
+					}
+				case "folder":
+					dir, err := exportPath(exportDir, export.GenerateFolderName(emails[0].Subject))
+					if err != nil {
+						return nil, err
+					}
+					if err := export.WriteFolder(dir, emails, client, export.DefaultLLMOptions()); err != nil {
+						return nil, err
+					}
+					result["path"] = dir
+				default:
+					return nil, fmt.Errorf("unknown format %q (use llm, text, pdf or folder)", args.Format)
+				}
+				if path, ok := result["path"].(string); ok {
+					manifest, err := export.WriteManifest(ctx, client, emails, path, export.Provenance{Handles: []string{args.Handle}, RetrievedAt: retrievedAt, Hashes: hashes})
+					if err != nil {
+						return nil, err
+					}
+					result["manifest"] = manifest
+				}
+				return result, nil
+			},
+		},
+	}
+}
+
+// exportPath resolves a path given to export_thread inside dir, creating
+// the directories it needs. Absolute paths, .. and symlinks that lead out of
+// dir are refused, so that a caller can't write anywhere else.
+func exportPath(dir, name string) (string, error) {
+	if filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return "", fmt.Errorf("path %q must be relative to the export directory", name)
+	}
+	for _, part := range strings.Split(filepath.ToSlash(name), "/") {
+		if part == ".." {
+			return "", fmt.Errorf("path %q must not contain ..", name)
+		}
+	}
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("invalid path %q", name)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, name)
+	// Checked before creating directories, which could otherwise be made
+	// through a symlink, and again after
+	if err := checkInside(root, path); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	if err := checkInside(root, path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// checkInside fails unless path, with symlinks in the part of it that
+// exists resolved, is inside root, which is itself resolved
+func checkInside(root, path string) error {
+	existing, rest := path, ""
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			break
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = parent
+	}
+	resolved, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return fmt.Errorf("path %q: %w", path, err)
+	}
+	rel, err := filepath.Rel(root, filepath.Join(resolved, rest))
+	if err != nil || !filepath.IsLocal(rel) {
+		return fmt.Errorf("path %q leads out of the export directory", path)
+	}
+	return nil
+}
+
+// fetchThread fetches a thread by handle for the tools. Unlike -t, result
+// indexes are not accepted: they depend on state shared between callers.
+func fetchThread(ctx context.Context, client *jmap.Client, handle string) ([]jmap.Email, error) {
+	h, err := jmap.ParseThreadHandle(handle)
+	if err != nil {
+		return nil, err
+	}
+	emails, err := client.GetThreadByHandleContext(ctx, h)
+	if err != nil {
+		return nil, err
+	}
+	if len(emails) == 0 {
+		return nil, fmt.Errorf("thread %s %w", handle, jmap.ErrNotFound)
+	}
+	return emails, nil
+}
+
+// findAttachment picks a non-inline attachment by name or by its 1-based
+// position, numbered as in export.FormatAttachmentInfo
+func findAttachment(emails []jmap.Email, name string, index int) (jmap.Attachment, error) {
+	n := 0
+	for _, email := range emails {
+		for _, att := range email.Attachments {
+			if att.IsInline {
+				continue
+			}
+			n++
+			if (name != "" && att.Name == name) || (name == "" && n == index) {
+				return att, nil
+			}
+		}
+	}
+	if name != "" {
+		return jmap.Attachment{}, fmt.Errorf("no attachment named %q", name)
+	}
+	return jmap.Attachment{}, fmt.Errorf("no attachment #%d (thread has %d)", index, n)
+}
+
+// isTextType reports whether a MIME type can be returned as text
+func isTextType(mimeType string) bool {
+	mimeType = strings.ToLower(mimeType)
+	if strings.HasPrefix(mimeType, "text/") {
+		return true
+	}
+	for _, t := range []string{"application/json", "application/xml", "application/csv"} {
+		if strings.HasPrefix(mimeType, t) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/stevemurr/fastmail-agent/jmap"
+	"github.com/stevemurr/fastmail-agent/store"
+)
+
+// autoMaxAge is how stale the local store may be before -source=auto goes to
+// the server instead
+const autoMaxAge = 15 * time.Minute
+
+// mailSource is where -q and -t read mail from: the server or the local
+// store
+type mailSource interface {
+	SearchEmailsContext(ctx context.Context, query string, opts jmap.SearchOptions) (*jmap.SearchResult, error)
+	GetThreadByHandleContext(ctx context.Context, h jmap.ThreadHandle) ([]jmap.Email, error)
+}
+
+// openSource returns the mail source selected by -source, and a function
+// that releases it. auto uses the local store when it was synced recently
+// and can be opened, and the server otherwise.
+func openSource(source string) (mailSource, func()) {
+	switch source {
+	case "remote":
+		return connect(), func() {}
+
+	case "local":
+		st, err := store.Open(store.DefaultPath(), true)
+		if err != nil {
+			fatal("", err)
+		}
+		return st, func() { st.Close() }
+
+	case "auto":
+		path := store.DefaultPath()
+		if store.Exists(path) {
+			if st, err := store.Open(path, true); err == nil {
+				if syncedAt, err := st.SyncedAt(); err == nil && time.Since(syncedAt) < autoMaxAge {
+					return st, func() { st.Close() }
+				}
+				st.Close()
+			}
+		}
+		return connect(), func() {}
+	}
+
+	fatal("", usageError{fmt.Errorf("unknown source %q (use local, remote or auto)", source)})
+	return nil, nil
+}
+
+// runIndex downloads new and changed mail into the local store
+func runIndex(args []string) {
+	fs := flag.NewFlagSet("index", flag.ExitOnError)
+	quiet := fs.Bool("quiet", false, "Don't report download progress on stderr")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: fastmail-agent index [flags]")
+		fmt.Fprintln(os.Stderr, "\nSyncs mail into the local store used by -source=local and -offline.")
+		fmt.Fprintln(os.Stderr, "The first run downloads the whole account; later runs fetch only changes.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	client := connect()
+
+	st, err := store.Open(store.DefaultPath(), false)
+	if err != nil {
+		fatal("", err)
+	}
+	defer st.Close()
+
+	var progress store.Progress
+	if !*quiet {
+		progress = func(done, total int) {
+			fmt.Fprintf(os.Stderr, "\rDownloaded %d/%d emails", done, total)
+			if done == total {
+				fmt.Fprintln(os.Stderr)
+			}
+		}
+	}
+
+	stats, err := st.SyncContext(cmdCtx, client, progress)
+	if err != nil {
+		fatal("indexing", err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(stats)
+}
@@ -0,0 +1,120 @@
+package store
+
+import (
+	"strings"
+	"unicode"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/stevemurr/fastmail-agent/jmap"
+)
+
+// Field prefixes for index terms. Unprefixed terms cover subject, addresses
+// and body, like the JMAP text filter.
+const (
+	termFrom    = "f:"
+	termTo      = "t:"
+	termCC      = "c:"
+	termSubject = "s:"
+	termMailbox = "m:"
+)
+
+// fieldPrefixes maps query fields to the index prefix holding their terms
+var fieldPrefixes = map[string]string{
+	"":        "",
+	"from":    termFrom,
+	"to":      termTo,
+	"cc":      termCC,
+	"subject": termSubject,
+}
+
+// tokenize splits text into lowercase words of letters and digits. Single
+// characters are dropped as too common to be useful.
+func tokenize(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	tokens := words[:0]
+	for _, w := range words {
+		if len([]rune(w)) > 1 {
+			tokens = append(tokens, w)
+		}
+	}
+	return tokens
+}
+
+// emailTerms returns every index term for an email
+func emailTerms(header jmap.Email, body string) []string {
+	var terms []string
+	add := func(prefix, text string) {
+		for _, tok := range tokenize(text) {
+			terms = append(terms, tok)
+			if prefix != "" {
+				terms = append(terms, prefix+tok)
+			}
+		}
+	}
+
+	add(termSubject, header.Subject)
+	add(termFrom, addressText(header.From))
+	add(termTo, addressText(header.To))
+	add(termCC, addressText(header.CC))
+	add("", body)
+
+	return append(terms, mailboxTerms(header)...)
+}
+
+// mailboxTerms returns the terms for an email's mailbox membership, which
+// change when it is moved
+func mailboxTerms(header jmap.Email) []string {
+	var terms []string
+	for id, in := range header.MailboxIDs {
+		if in {
+			terms = append(terms, termMailbox+id)
+		}
+	}
+	return terms
+}
+
+// addressText flattens addresses into searchable text
+func addressText(addrs []jmap.EmailAddress) string {
+	parts := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		parts = append(parts, a.Name+" "+a.Email)
+	}
+	return strings.Join(parts, " ")
+}
+
+func addPostings(tx *bolt.Tx, id string, terms []string) error {
+	b := tx.Bucket(bucketPostings)
+	for _, term := range terms {
+		if err := b.Put(compositeKey(term, id), []byte{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func removePostings(tx *bolt.Tx, id string, terms []string) error {
+	b := tx.Bucket(bucketPostings)
+	for _, term := range terms {
+		if err := b.Delete(compositeKey(term, id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// postingsWithPrefix returns the IDs of every email indexed under a term
+// starting with prefix
+func postingsWithPrefix(tx *bolt.Tx, prefix string) map[string]bool {
+	ids := make(map[string]bool)
+	c := tx.Bucket(bucketPostings).Cursor()
+	for k, _ := c.Seek([]byte(prefix)); k != nil && strings.HasPrefix(string(k), prefix); k, _ = c.Next() {
+		if i := strings.IndexByte(string(k), 0); i >= 0 {
+			ids[string(k[i+1:])] = true
+		}
+	}
+	return ids
+}
@@ -0,0 +1,322 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/stevemurr/fastmail-agent/jmap"
+)
+
+// SearchEmailsContext is SearchEmails for callers that hold a context. The
+// store is local, so ctx is only checked before searching.
+func (s *Store) SearchEmailsContext(ctx context.Context, query string, opts jmap.SearchOptions) (*jmap.SearchResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.SearchEmails(query, opts)
+}
+
+// SearchEmails is the offline counterpart of jmap.Client.SearchEmails. It
+// understands the same query syntax and paging options.
+func (s *Store) SearchEmails(query string, opts jmap.SearchOptions) (*jmap.SearchResult, error) {
+	if opts.Limit <= 0 {
+		opts.Limit = 50
+	}
+
+	parsed, err := jmap.ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []jmap.Email
+	err = s.db.View(func(tx *bolt.Tx) error {
+		mailboxes, err := readMailboxes(tx)
+		if err != nil {
+			return err
+		}
+		resolve := func(name string) (string, error) {
+			return jmap.FindMailbox(mailboxes, name)
+		}
+
+		// Compiling validates the query exactly as a remote search would
+		if _, err := parsed.Compile(resolve); err != nil {
+			return err
+		}
+
+		resolved, err := jmap.ResolveMailboxScope(parsed, opts, resolve)
+		if err != nil {
+			return err
+		}
+
+		scope := mailboxScope(resolved)
+		m := matcher{tx: tx, resolve: resolve, indexed: make(map[string]map[string]bool)}
+		check := func(header jmap.Email) {
+			if scope.allows(header) && m.matches(header, parsed) {
+				matches = append(matches, header)
+			}
+		}
+
+		headers := tx.Bucket(bucketHeaders)
+		if candidates := candidateIDs(tx, parsed); candidates != nil {
+			for id := range candidates {
+				header, ok, err := getHeader(tx, id)
+				if err != nil {
+					return err
+				}
+				if ok {
+					check(header)
+				}
+			}
+			return nil
+		}
+
+		return headers.ForEach(func(k, v []byte) error {
+			var header jmap.Email
+			if err := json.Unmarshal(v, &header); err != nil {
+				return err
+			}
+			check(header)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Newest first, like the remote search
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].ReceivedAt != matches[j].ReceivedAt {
+			return matches[i].ReceivedAt > matches[j].ReceivedAt
+		}
+		return matches[i].ID < matches[j].ID
+	})
+
+	start := opts.Position
+	if opts.Anchor != "" {
+		for i, e := range matches {
+			if e.ID == opts.Anchor {
+				start = i + 1
+				break
+			}
+		}
+	}
+	if start > len(matches) {
+		start = len(matches)
+	}
+	end := start + opts.Limit
+	if end > len(matches) {
+		end = len(matches)
+	}
+
+	page := append([]jmap.Email(nil), matches[start:end]...)
+	if mailboxes, err := s.Mailboxes(); err == nil {
+		jmap.AnnotateMailboxes(page, mailboxes)
+	}
+
+	return &jmap.SearchResult{
+		Query:    query,
+		Options:  opts,
+		Emails:   page,
+		Position: start,
+		Total:    len(matches),
+	}, nil
+}
+
+// candidateIDs narrows a search using the index. Every clause that is a
+// single positive text or header term must match, and terms match at the
+// start of words, so the emails indexed under words starting with each of
+// its words are a superset of the results. It returns nil if no clause can be
+// used, meaning every email has to be checked.
+func candidateIDs(tx *bolt.Tx, q jmap.Query) map[string]bool {
+	var result map[string]bool
+	for _, clause := range q.Clauses {
+		if len(clause) != 1 || clause[0].Negate {
+			continue
+		}
+		prefix, ok := fieldPrefixes[clause[0].Field]
+		if !ok {
+			continue
+		}
+
+		for _, tok := range tokenize(clause[0].Value) {
+			ids := postingsWithPrefix(tx, prefix+tok)
+			if result == nil {
+				result = ids
+				continue
+			}
+			for id := range result {
+				if !ids[id] {
+					delete(result, id)
+				}
+			}
+		}
+	}
+	return result
+}
+
+// mailboxScope applies SearchOptions.InMailbox and ExcludeMailboxes, as
+// resolved by jmap.ResolveMailboxScope
+type mailboxScope jmap.MailboxScope
+
+// allows mirrors JMAP inMailbox and inMailboxOtherThan: the email must be
+// in some mailbox other than the excluded ones
+func (s mailboxScope) allows(e jmap.Email) bool {
+	if s.In != "" && !e.MailboxIDs[s.In] {
+		return false
+	}
+	if len(s.Exclude) == 0 {
+		return true
+	}
+	for id, in := range e.MailboxIDs {
+		if !in {
+			continue
+		}
+		excluded := false
+		for _, ex := range s.Exclude {
+			if id == ex {
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			return true
+		}
+	}
+	return false
+}
+
+// matcher evaluates parsed queries against stored emails
+type matcher struct {
+	tx      *bolt.Tx
+	resolve jmap.MailboxResolver
+	indexed map[string]map[string]bool // word prefix -> IDs, as looked up
+}
+
+// hasWord reports whether the email is indexed under a word starting with
+// prefix
+func (m matcher) hasWord(prefix, id string) bool {
+	ids, ok := m.indexed[prefix]
+	if !ok {
+		ids = postingsWithPrefix(m.tx, prefix)
+		m.indexed[prefix] = ids
+	}
+	return ids[id]
+}
+
+// matches reports whether every clause has at least one matching term
+func (m matcher) matches(e jmap.Email, q jmap.Query) bool {
+	for _, clause := range q.Clauses {
+		ok := false
+		for _, term := range clause {
+			if m.matchTerm(e, term) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (m matcher) matchTerm(e jmap.Email, t jmap.QueryTerm) bool {
+	return m.matchPositive(e, t) != t.Negate
+}
+
+// matchPositive evaluates a term ignoring its negation. The query has been
+// validated by Compile, so values are known to be well-formed. Words match
+// at their start, like the server's search: "invo" finds "invoice".
+func (m matcher) matchPositive(e jmap.Email, t jmap.QueryTerm) bool {
+	value := strings.ToLower(t.Value)
+
+	switch t.Field {
+	case "":
+		for _, tok := range tokenize(t.Value) {
+			if !m.hasWord(tok, e.ID) {
+				return false
+			}
+		}
+		if t.Phrase {
+			body := string(m.tx.Bucket(bucketBodies).Get([]byte(e.ID)))
+			text := strings.ToLower(e.Subject + "\n" + addressText(e.From) + "\n" + body)
+			return strings.Contains(text, value)
+		}
+		return true
+
+	case "from":
+		return matchWords(addressText(e.From), value)
+	case "to":
+		return matchWords(addressText(e.To), value)
+	case "cc":
+		return matchWords(addressText(e.CC), value)
+	case "bcc":
+		// Bcc is not synced; only the sender's own copy would have it
+		return false
+	case "subject":
+		return matchWords(e.Subject, value)
+
+	case "has":
+		return e.HasAttachment
+
+	case "before", "after":
+		date, _ := jmap.ParseQueryDate(t.Value)
+		received, err := time.Parse(time.RFC3339, e.ReceivedAt)
+		if err != nil {
+			return false
+		}
+		if t.Field == "before" {
+			return received.Before(date)
+		}
+		return !received.Before(date)
+
+	case "in":
+		id, err := m.resolve(t.Value)
+		return err == nil && e.MailboxIDs[id]
+
+	case "is":
+		switch value {
+		case "unread":
+			return !e.HasKeyword(jmap.KeywordSeen)
+		case "read":
+			return e.HasKeyword(jmap.KeywordSeen)
+		case "flagged", "starred":
+			return e.HasKeyword(jmap.KeywordFlagged)
+		}
+	}
+
+	return false
+}
+
+// matchWords reports whether every word of value starts a word of text, and
+// a value of several words, such as an address, also appears in text as a
+// whole. Values too short to be words are looked for anywhere.
+func matchWords(text, value string) bool {
+	toks := tokenize(value)
+	text = strings.ToLower(text)
+	if len(toks) == 0 || len(toks) > 1 {
+		if !strings.Contains(text, value) {
+			return false
+		}
+	}
+
+	words := tokenize(text)
+	for _, tok := range toks {
+		found := false
+		for _, w := range words {
+			if strings.HasPrefix(w, tok) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,403 @@
+// Package store keeps an offline copy of synced mail in an embedded bbolt
+// database, with a full-text index so searches work without the network.
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/stevemurr/fastmail-agent/export"
+	"github.com/stevemurr/fastmail-agent/jmap"
+)
+
+// Buckets. Composite keys join their parts with a zero byte.
+var (
+	bucketHeaders  = []byte("headers")  // email ID -> jmap.Email without bodies
+	bucketMessages = []byte("messages") // email ID -> full jmap.Email
+	bucketBodies   = []byte("bodies")   // email ID -> cleaned body text
+	bucketThreads  = []byte("threads")  // threadId, email ID -> empty
+	bucketPostings = []byte("postings") // term, email ID -> empty
+	bucketMeta     = []byte("meta")     // mailboxes and sync time
+)
+
+var (
+	metaMailboxes = []byte("mailboxes")
+	metaSyncedAt  = []byte("synced_at")
+	metaVersion   = []byte("version")
+)
+
+// storeVersion is bumped when more of each email is stored, so that Sync
+// fetches emails stored before again. Version 2 added blobId, which original
+// message exports need.
+const storeVersion = "2"
+
+var allBuckets = [][]byte{
+	bucketHeaders, bucketMessages, bucketBodies,
+	bucketThreads, bucketPostings, bucketMeta,
+}
+
+var (
+	// ErrNotIndexed means there is no store to read yet
+	ErrNotIndexed = errors.New("no local store")
+
+	// ErrBusy means another process kept the store open for longer than
+	// Open waits
+	ErrBusy = errors.New("local store is in use by another process")
+)
+
+// Store is an on-disk copy of an account's mail
+type Store struct {
+	db       *bolt.DB // nil while a sync has let go of the file between batches
+	path     string
+	readOnly bool
+}
+
+// DefaultPath returns the location of the local store in the user cache
+// directory
+func DefaultPath() string {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		cacheDir = os.TempDir()
+	}
+	return filepath.Join(cacheDir, "fastmail-agent", "mail.db")
+}
+
+// Exists reports whether a store has been created at path
+func Exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Open opens the store at path, creating it unless readOnly is set. Only one
+// process may have a store open for writing, and not while others have it
+// open to read; each waits up to a few seconds for the other. Syncs only
+// hold the file while writing a batch.
+func Open(path string, readOnly bool) (*Store, error) {
+	if readOnly && !Exists(path) {
+		return nil, fmt.Errorf("%w at %s; run: fastmail-agent index", ErrNotIndexed, path)
+	}
+	if !readOnly {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &Store{path: path, readOnly: readOnly}
+	if err := s.acquire(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// acquire opens the database file, if it is not open, creating any missing
+// buckets
+func (s *Store) acquire() error {
+	if s.db != nil {
+		return nil
+	}
+
+	db, err := bolt.Open(s.path, 0600, &bolt.Options{
+		Timeout:  5 * time.Second,
+		ReadOnly: s.readOnly,
+	})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return fmt.Errorf("opening %s: %w; try again when it is done", s.path, ErrBusy)
+	}
+	if err != nil {
+		return fmt.Errorf("opening local store: %w", err)
+	}
+
+	if !s.readOnly {
+		err = db.Update(func(tx *bolt.Tx) error {
+			for _, name := range allBuckets {
+				if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			db.Close()
+			return err
+		}
+	}
+
+	s.db = db
+	return nil
+}
+
+// release closes the database file so other processes can open it
+func (s *Store) release() error {
+	if s.db == nil {
+		return nil
+	}
+	err := s.db.Close()
+	s.db = nil
+	return err
+}
+
+// Close closes the database
+func (s *Store) Close() error {
+	return s.release()
+}
+
+// Path returns the database file path
+func (s *Store) Path() string {
+	return s.path
+}
+
+// Count returns the number of stored emails
+func (s *Store) Count() (int, error) {
+	n := 0
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(bucketHeaders); b != nil {
+			n = b.Stats().KeyN
+		}
+		return nil
+	})
+	return n, err
+}
+
+// SyncedAt returns when the store was last synced, or the zero time
+func (s *Store) SyncedAt() (time.Time, error) {
+	var t time.Time
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(bucketMeta); b != nil {
+			if v := b.Get(metaSyncedAt); v != nil {
+				return t.UnmarshalText(v)
+			}
+		}
+		return nil
+	})
+	return t, err
+}
+
+// Mailboxes returns the stored mailbox list
+func (s *Store) Mailboxes() ([]jmap.Mailbox, error) {
+	var mailboxes []jmap.Mailbox
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		mailboxes, err = readMailboxes(tx)
+		return err
+	})
+	return mailboxes, err
+}
+
+func readMailboxes(tx *bolt.Tx) ([]jmap.Mailbox, error) {
+	var mailboxes []jmap.Mailbox
+	b := tx.Bucket(bucketMeta)
+	if b == nil {
+		return nil, nil
+	}
+	if v := b.Get(metaMailboxes); v != nil {
+		if err := json.Unmarshal(v, &mailboxes); err != nil {
+			return nil, err
+		}
+	}
+	return mailboxes, nil
+}
+
+// GetEmails returns stored emails with full content, oldest first. IDs that
+// are not in the store are skipped.
+func (s *Store) GetEmails(ids []string) ([]jmap.Email, error) {
+	var emails []jmap.Email
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketMessages)
+		if b == nil {
+			return nil
+		}
+		for _, id := range ids {
+			v := b.Get([]byte(id))
+			if v == nil {
+				continue
+			}
+			var email jmap.Email
+			if err := json.Unmarshal(v, &email); err != nil {
+				return err
+			}
+			emails = append(emails, email)
+		}
+
+		mailboxes, err := readMailboxes(tx)
+		jmap.AnnotateMailboxes(emails, mailboxes)
+		return err
+	})
+
+	sortOldestFirst(emails)
+	return emails, err
+}
+
+// GetThreadByHandleContext is GetThreadByHandle for callers that hold a
+// context, which is only checked before reading
+func (s *Store) GetThreadByHandleContext(ctx context.Context, h jmap.ThreadHandle) ([]jmap.Email, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.GetThreadByHandle(h)
+}
+
+// GetThreadByHandle is the offline counterpart of jmap.Client.GetThreadByHandle
+func (s *Store) GetThreadByHandle(h jmap.ThreadHandle) ([]jmap.Email, error) {
+	if len(h.ThreadIDs) == 0 {
+		return s.GetEmails(h.EmailIDs)
+	}
+
+	var ids []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketThreads)
+		if b == nil {
+			return nil
+		}
+		for _, threadID := range h.ThreadIDs {
+			prefix := compositeKey(threadID, "")
+			c := b.Cursor()
+			for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+				ids = append(ids, string(k[len(prefix):]))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("thread %w in local store", jmap.ErrNotFound)
+	}
+
+	return s.GetEmails(ids)
+}
+
+// putEmail stores a fully fetched email and indexes it, replacing any
+// previous copy
+func putEmail(tx *bolt.Tx, email jmap.Email) error {
+	if err := removeEmail(tx, email.ID); err != nil {
+		return err
+	}
+
+	body := export.CleanBody(email.GetBodyText(), export.DefaultLLMOptions())
+
+	header := email
+	header.TextBody = nil
+	header.HTMLBody = nil
+	header.BodyValues = nil
+	header.MailboxNames = nil
+
+	if err := putJSON(tx.Bucket(bucketHeaders), email.ID, header); err != nil {
+		return err
+	}
+	if err := putJSON(tx.Bucket(bucketMessages), email.ID, email); err != nil {
+		return err
+	}
+	if err := tx.Bucket(bucketBodies).Put([]byte(email.ID), []byte(body)); err != nil {
+		return err
+	}
+	if email.ThreadID != "" {
+		if err := tx.Bucket(bucketThreads).Put(compositeKey(email.ThreadID, email.ID), []byte{}); err != nil {
+			return err
+		}
+	}
+
+	return addPostings(tx, email.ID, emailTerms(header, body))
+}
+
+// removeEmail deletes an email and its index entries. Missing emails are
+// ignored.
+func removeEmail(tx *bolt.Tx, id string) error {
+	header, ok, err := getHeader(tx, id)
+	if err != nil || !ok {
+		return err
+	}
+	body := string(tx.Bucket(bucketBodies).Get([]byte(id)))
+
+	if err := removePostings(tx, id, emailTerms(header, body)); err != nil {
+		return err
+	}
+	if header.ThreadID != "" {
+		if err := tx.Bucket(bucketThreads).Delete(compositeKey(header.ThreadID, id)); err != nil {
+			return err
+		}
+	}
+	for _, name := range [][]byte{bucketHeaders, bucketMessages, bucketBodies} {
+		if err := tx.Bucket(name).Delete([]byte(id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateMutable applies new keywords and mailboxes, the only Email
+// properties that change after delivery. It reports false if the email is not
+// stored.
+func updateMutable(tx *bolt.Tx, update jmap.Email) (bool, error) {
+	header, ok, err := getHeader(tx, update.ID)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	if err := removePostings(tx, update.ID, mailboxTerms(header)); err != nil {
+		return false, err
+	}
+	header.Keywords = update.Keywords
+	header.MailboxIDs = update.MailboxIDs
+	if err := addPostings(tx, update.ID, mailboxTerms(header)); err != nil {
+		return false, err
+	}
+	if err := putJSON(tx.Bucket(bucketHeaders), update.ID, header); err != nil {
+		return false, err
+	}
+
+	messages := tx.Bucket(bucketMessages)
+	var full jmap.Email
+	if v := messages.Get([]byte(update.ID)); v != nil {
+		if err := json.Unmarshal(v, &full); err != nil {
+			return false, err
+		}
+		full.Keywords = update.Keywords
+		full.MailboxIDs = update.MailboxIDs
+		if err := putJSON(messages, update.ID, full); err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+func getHeader(tx *bolt.Tx, id string) (jmap.Email, bool, error) {
+	var header jmap.Email
+	v := tx.Bucket(bucketHeaders).Get([]byte(id))
+	if v == nil {
+		return header, false, nil
+	}
+	err := json.Unmarshal(v, &header)
+	return header, err == nil, err
+}
+
+func putJSON(b *bolt.Bucket, key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), data)
+}
+
+// compositeKey joins key parts with a zero byte, which never occurs in JMAP
+// IDs or index terms
+func compositeKey(a, b string) []byte {
+	return []byte(a + "\x00" + b)
+}
+
+// sortOldestFirst sorts emails by received date, oldest first
+func sortOldestFirst(emails []jmap.Email) {
+	sort.Slice(emails, func(i, j int) bool {
+		return emails[i].ReceivedAt < emails[j].ReceivedAt
+	})
+}
@@ -0,0 +1,311 @@
+package store
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/stevemurr/fastmail-agent/jmap"
+	"github.com/stevemurr/fastmail-agent/jmaptest"
+)
+
+// testEmails is a small mailbox: a two-message thread, one unread message
+// and one in Spam
+func testEmails() ([]jmap.Mailbox, []jmap.Email) {
+	alice := []jmap.EmailAddress{{Name: "Alice Example", Email: "alice@example.com"}}
+	bob := []jmap.EmailAddress{{Email: "bob@example.com"}}
+	me := []jmap.EmailAddress{{Email: "test@example.com"}}
+	text := func(body string) ([]jmap.BodyPart, map[string]jmap.BodyValue) {
+		return []jmap.BodyPart{{PartID: "1", Type: "text/plain"}}, map[string]jmap.BodyValue{"1": {Value: body}}
+	}
+	email := func(id, thread, mailbox string, from, to []jmap.EmailAddress, subject, date, body string, seen bool) jmap.Email {
+		parts, values := text(body)
+		return jmap.Email{
+			ID: id, ThreadID: thread, MailboxIDs: map[string]bool{mailbox: true},
+			Keywords: map[string]bool{jmap.KeywordSeen: seen},
+			From:     from, To: to, Subject: subject, ReceivedAt: date,
+			TextBody: parts, BodyValues: values,
+		}
+	}
+
+	mailboxes := []jmap.Mailbox{
+		{ID: "inbox", Name: "Inbox", Role: "inbox"},
+		{ID: "sent", Name: "Sent", Role: "sent"},
+		{ID: "junk", Name: "Spam", Role: "junk"},
+	}
+	emails := []jmap.Email{
+		email("M1", "T1", "inbox", alice, me, "Quarterly invoice", "2024-03-01T09:00:00Z", "The invoice for Q1 is attached.", true),
+		email("M2", "T1", "sent", me, alice, "Re: Quarterly invoice", "2024-03-01T10:30:00Z", "Thanks, paid today.", true),
+		email("M3", "T2", "inbox", bob, me, "Lunch on Friday?", "2024-03-04T12:00:00Z", "Are you free for lunch?", false),
+		email("M4", "T3", "junk", []jmap.EmailAddress{{Email: "offers@spam.example"}}, me, "You have won", "2024-03-05T00:00:00Z", "Claim your prize now.", false),
+	}
+	return mailboxes, emails
+}
+
+// syncedStore syncs a new store in a temporary directory from a fake server
+// with the sample fixture
+func syncedStore(t *testing.T) (*jmaptest.Server, *jmap.Client, *Store) {
+	t.Helper()
+	srv := jmaptest.NewServer(jmaptest.SampleFixture())
+	t.Cleanup(srv.Close)
+	client, err := srv.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := Open(filepath.Join(t.TempDir(), "mail.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	if _, err := s.Sync(client, nil); err != nil {
+		t.Fatal(err)
+	}
+	return srv, client, s
+}
+
+// testStore opens a new store in a temporary directory holding testEmails
+func testStore(t *testing.T) *Store {
+	t.Helper()
+	s, err := Open(filepath.Join(t.TempDir(), "mail.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	mailboxes, emails := testEmails()
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		if err := putJSON(tx.Bucket(bucketMeta), string(metaMailboxes), mailboxes); err != nil {
+			return err
+		}
+		for _, email := range emails {
+			if err := putEmail(tx, email); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func ids(res *jmap.SearchResult) []string {
+	out := make([]string, len(res.Emails))
+	for i, e := range res.Emails {
+		out[i] = e.ID
+	}
+	return out
+}
+
+func TestSearchEmails(t *testing.T) {
+	s := testStore(t)
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"M4", "M3", "M2", "M1"}},
+		{"invoice", []string{"M2", "M1"}},
+		{"invo", []string{"M2", "M1"}},
+		{"from:alice@example.com", []string{"M1"}},
+		{"from:alice", []string{"M1"}},
+		{"from:ali", []string{"M1"}},
+		{"-from:alice", []string{"M4", "M3", "M2"}},
+		{"to:alice", []string{"M2"}},
+		{"subject:lunch", []string{"M3"}},
+		{`"paid today"`, []string{"M2"}},
+		{"lunch OR prize", []string{"M4", "M3"}},
+		{"is:unread", []string{"M4", "M3"}},
+		{"in:inbox", []string{"M3", "M1"}},
+		{"in:spam", []string{"M4"}},
+		{"after:2024-03-02", []string{"M4", "M3"}},
+		{"nothing", []string{}},
+	}
+	for _, tt := range tests {
+		res, err := s.SearchEmails(tt.query, jmap.SearchOptions{})
+		if err != nil {
+			t.Errorf("%q: %v", tt.query, err)
+			continue
+		}
+		if got := ids(res); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+
+	if _, err := s.SearchEmails("in:nowhere", jmap.SearchOptions{}); err == nil {
+		t.Error("searched a mailbox that doesn't exist")
+	}
+}
+
+func TestSearchPaging(t *testing.T) {
+	s := testStore(t)
+
+	page, err := s.SearchEmails("", jmap.SearchOptions{Limit: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(page); !reflect.DeepEqual(got, []string{"M4", "M3", "M2"}) || page.Total != 4 {
+		t.Fatalf("first page = %v of %d", got, page.Total)
+	}
+	cursor, err := jmap.ParseSearchCursor(page.NextCursor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err = s.SearchEmails(cursor.Query, cursor.Options(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(page); !reflect.DeepEqual(got, []string{"M1"}) || page.HasMore() {
+		t.Errorf("second page = %v, has more %v", got, page.HasMore())
+	}
+}
+
+func TestGetThreadByHandle(t *testing.T) {
+	s := testStore(t)
+
+	thread, err := s.GetThreadByHandle(jmap.ThreadHandle{ThreadIDs: []string{"T1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(thread) != 2 || thread[0].ID != "M1" || thread[0].GetBodyText() != "The invoice for Q1 is attached." {
+		t.Errorf("thread T1 = %+v", thread)
+	}
+}
+
+func TestSync(t *testing.T) {
+	_, _, s := syncedStore(t)
+
+	n, err := s.Count()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 5 {
+		t.Errorf("stored %d emails, want 5", n)
+	}
+	mailboxes, err := s.Mailboxes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mailboxes) != 7 {
+		t.Errorf("stored %d mailboxes, want 7", len(mailboxes))
+	}
+	thread, err := s.GetThreadByHandle(jmap.ThreadHandle{ThreadIDs: []string{"T1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(thread) != 3 || thread[0].BlobID != "RM1" {
+		t.Errorf("thread T1 = %d emails, first blob %q", len(thread), thread[0].BlobID)
+	}
+}
+
+func TestSearchMatchesServer(t *testing.T) {
+	_, client, s := syncedStore(t)
+
+	queries := []string{
+		"",
+		"from:ali",
+		"from:alice@example.com",
+		"-from:ali",
+		"to:test",
+		"invo",
+		"subject:quarter",
+		`"quarterly invoice"`,
+		"lunch OR prize",
+		"is:unread",
+		"is:flagged",
+		"has:attachment",
+		"in:inbox",
+		"in:sent invoice",
+		"after:2024-03-02",
+		"before:2024-03-02",
+	}
+	for _, q := range queries {
+		remote, err := client.SearchEmails(q, jmap.SearchOptions{})
+		if err != nil {
+			t.Fatalf("%q on the server: %v", q, err)
+		}
+		local, err := s.SearchEmails(q, jmap.SearchOptions{})
+		if err != nil {
+			t.Fatalf("%q in the store: %v", q, err)
+		}
+		if !reflect.DeepEqual(ids(local), ids(remote)) {
+			t.Errorf("%q: store found %v, server %v", q, ids(local), ids(remote))
+		}
+	}
+}
+
+func TestIncrementalSync(t *testing.T) {
+	srv, client, s := syncedStore(t)
+
+	arrived := jmaptest.SampleFixture().Emails[3]
+	arrived.ID, arrived.ThreadID, arrived.Subject = "M6", "T6", "Dinner on Saturday?"
+	srv.AddEmail(arrived, nil)
+	if _, err := client.MarkRead([]string{"M4"}, true, jmap.SetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.DestroyEmails([]string{"M5"}, jmap.SetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := s.Sync(client, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := SyncStats{Added: 1, Updated: 1, Removed: 1, Total: 5}
+	if *stats != want {
+		t.Errorf("stats = %+v, want %+v", *stats, want)
+	}
+
+	res, err := s.SearchEmails("is:unread", jmap.SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(res); !reflect.DeepEqual(got, []string{"M6"}) {
+		t.Errorf("unread after sync = %v, want [M6]", got)
+	}
+	res, err = s.SearchEmails("dinner", jmap.SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(res); !reflect.DeepEqual(got, []string{"M6"}) {
+		t.Errorf("new mail not indexed: %v", got)
+	}
+}
+
+func TestSearchDuringSync(t *testing.T) {
+	srv, client, s := syncedStore(t)
+
+	arrived := jmaptest.SampleFixture().Emails[3]
+	arrived.ID, arrived.ThreadID = "M6", "T6"
+	srv.AddEmail(arrived, nil)
+
+	// Another process searches while the sync waits on the server
+	var searchErr error
+	searched := false
+	srv.OnRequest(func(req jmap.Request) {
+		if searched || req.MethodCalls[0][0] != "Email/get" {
+			return
+		}
+		searched = true
+		reader, err := Open(s.Path(), true)
+		if err != nil {
+			searchErr = err
+			return
+		}
+		defer reader.Close()
+		_, searchErr = reader.SearchEmails("invoice", jmap.SearchOptions{})
+	})
+
+	if _, err := s.Sync(client, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !searched {
+		t.Fatal("the sync fetched nothing")
+	}
+	if searchErr != nil {
+		t.Errorf("search during the sync: %v", searchErr)
+	}
+}
@@ -0,0 +1,289 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/stevemurr/fastmail-agent/jmap"
+	"github.com/stevemurr/fastmail-agent/mailsync"
+)
+
+// Batch sizes for fetching from the server. Full emails carry bodies, so
+// they are fetched in smaller batches than summaries.
+const (
+	fetchBatchSize   = 50
+	refreshBatchSize = 500
+)
+
+// SyncStats summarizes a Sync run
+type SyncStats struct {
+	FullResync bool `json:"full_resync"`
+	Added      int  `json:"added"`
+	Updated    int  `json:"updated"`
+	Removed    int  `json:"removed"`
+	Total      int  `json:"total"`
+}
+
+// Progress is called as emails are downloaded
+type Progress func(done, total int)
+
+// Sync brings the store up to date with the server. It uses the same
+// change tracking as the sync command, with its own cursor stored next to
+// the database.
+func (s *Store) Sync(client *jmap.Client, progress Progress) (*SyncStats, error) {
+	return s.SyncContext(context.Background(), client, progress)
+}
+
+// SyncContext is like Sync but stops when ctx is done. Batches already
+// stored are kept.
+//
+// The database file is closed while mail is downloaded and opened again for
+// each batch written, so searches from other processes are not locked out
+// for the length of the sync.
+func (s *Store) SyncContext(ctx context.Context, client *jmap.Client, progress Progress) (*SyncStats, error) {
+	statePath := s.path + ".sync.json"
+
+	// A fresh or wiped database can't continue from an old cursor
+	if n, err := s.Count(); err == nil && n == 0 {
+		os.Remove(statePath)
+	}
+
+	if err := s.release(); err != nil {
+		return nil, err
+	}
+	defer s.acquire()
+
+	syncer := mailsync.New(client, statePath)
+	result, next, err := syncer.SyncContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &SyncStats{FullResync: result.FullResync}
+
+	if result.FullResync || !result.Mailboxes.Empty() {
+		if err := s.storeMailboxes(ctx, client); err != nil {
+			return nil, err
+		}
+	}
+
+	var fetch, refresh, remove []string
+	if result.FullResync {
+		fetch, refresh, remove, err = s.diff(result.Emails.Created)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		fetch = result.Emails.Created
+		refresh = result.Emails.Updated
+		remove = result.Emails.Destroyed
+	}
+
+	if err := s.update(func(tx *bolt.Tx) error {
+		for _, id := range remove {
+			if err := removeEmail(tx, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	stats.Removed = len(remove)
+
+	missing, err := s.refresh(ctx, client, refresh)
+	if err != nil {
+		return nil, err
+	}
+	stats.Updated = len(refresh) - len(missing)
+	fetch = append(fetch, missing...)
+
+	outdated, err := s.outdated(fetch)
+	if err != nil {
+		return nil, err
+	}
+	stats.Added = len(fetch)
+	refreshed := make(map[string]bool, len(refresh))
+	for _, id := range refresh {
+		refreshed[id] = true
+	}
+	for _, id := range outdated {
+		if !refreshed[id] {
+			stats.Updated++
+		}
+	}
+	fetch = append(fetch, outdated...)
+
+	if err := s.fetch(ctx, client, fetch, progress); err != nil {
+		return nil, err
+	}
+
+	if err := s.update(func(tx *bolt.Tx) error {
+		now, _ := time.Now().UTC().MarshalText()
+		if err := tx.Bucket(bucketMeta).Put(metaVersion, []byte(storeVersion)); err != nil {
+			return err
+		}
+		return tx.Bucket(bucketMeta).Put(metaSyncedAt, now)
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := syncer.Commit(next); err != nil {
+		return nil, err
+	}
+
+	if err := s.acquire(); err != nil {
+		return nil, err
+	}
+	stats.Total, err = s.Count()
+	return stats, err
+}
+
+// storeMailboxes replaces the stored mailbox list
+func (s *Store) storeMailboxes(ctx context.Context, client *jmap.Client) error {
+	mailboxes, err := client.GetMailboxesContext(ctx)
+	if err != nil {
+		return err
+	}
+	return s.update(func(tx *bolt.Tx) error {
+		return putJSON(tx.Bucket(bucketMeta), string(metaMailboxes), mailboxes)
+	})
+}
+
+// diff compares the server's full ID list with the store
+func (s *Store) diff(serverIDs []string) (fetch, refresh, remove []string, err error) {
+	onServer := make(map[string]bool, len(serverIDs))
+	for _, id := range serverIDs {
+		onServer[id] = true
+	}
+
+	err = s.view(func(tx *bolt.Tx) error {
+		headers := tx.Bucket(bucketHeaders)
+		for _, id := range serverIDs {
+			if headers.Get([]byte(id)) == nil {
+				fetch = append(fetch, id)
+			} else {
+				refresh = append(refresh, id)
+			}
+		}
+		return headers.ForEach(func(k, _ []byte) error {
+			if !onServer[string(k)] {
+				remove = append(remove, string(k))
+			}
+			return nil
+		})
+	})
+	return fetch, refresh, remove, err
+}
+
+// outdated returns the stored emails that an older version stored with less
+// than it now does, other than those in fetch already. After one successful
+// sync there are none.
+func (s *Store) outdated(fetch []string) ([]string, error) {
+	queued := make(map[string]bool, len(fetch))
+	for _, id := range fetch {
+		queued[id] = true
+	}
+
+	var ids []string
+	err := s.view(func(tx *bolt.Tx) error {
+		if string(tx.Bucket(bucketMeta).Get(metaVersion)) == storeVersion {
+			return nil
+		}
+		return tx.Bucket(bucketHeaders).ForEach(func(k, v []byte) error {
+			var header jmap.Email
+			if err := json.Unmarshal(v, &header); err != nil {
+				return err
+			}
+			if header.BlobID == "" && !queued[header.ID] {
+				ids = append(ids, header.ID)
+			}
+			return nil
+		})
+	})
+	return ids, err
+}
+
+// refresh updates keywords and mailboxes of stored emails. It returns the IDs
+// that turned out not to be stored, which need a full fetch.
+func (s *Store) refresh(ctx context.Context, client *jmap.Client, ids []string) ([]string, error) {
+	var missing []string
+	for start := 0; start < len(ids); start += refreshBatchSize {
+		end := min(start+refreshBatchSize, len(ids))
+
+		emails, err := client.GetEmailSummariesContext(ctx, ids[start:end])
+		if err != nil {
+			return nil, err
+		}
+
+		err = s.update(func(tx *bolt.Tx) error {
+			for _, email := range emails {
+				ok, err := updateMutable(tx, email)
+				if err != nil {
+					return err
+				}
+				if !ok {
+					missing = append(missing, email.ID)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return missing, nil
+}
+
+// fetch downloads full emails and stores them, one transaction per batch so
+// an interrupted sync keeps what it already has
+func (s *Store) fetch(ctx context.Context, client *jmap.Client, ids []string, progress Progress) error {
+	for start := 0; start < len(ids); start += fetchBatchSize {
+		end := min(start+fetchBatchSize, len(ids))
+
+		emails, err := client.GetEmailsContext(ctx, ids[start:end])
+		if err != nil {
+			return err
+		}
+
+		err = s.update(func(tx *bolt.Tx) error {
+			for _, email := range emails {
+				if err := putEmail(tx, email); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if progress != nil {
+			progress(end, len(ids))
+		}
+	}
+	return nil
+}
+
+// update runs fn in a write transaction with the database file open only for
+// its length
+func (s *Store) update(fn func(*bolt.Tx) error) error {
+	if err := s.acquire(); err != nil {
+		return err
+	}
+	defer s.release()
+	return s.db.Update(fn)
+}
+
+// view is update for reading
+func (s *Store) view(fn func(*bolt.Tx) error) error {
+	if err := s.acquire(); err != nil {
+		return err
+	}
+	defer s.release()
+	return s.db.View(fn)
+}
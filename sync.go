@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/stevemurr/fastmail-agent/mailsync"
+	"github.com/stevemurr/fastmail-agent/tui"
+)
+
+// SyncOutput represents the result of the sync command
+type SyncOutput struct {
+	FullResync       bool         `json:"full_resync"`
+	Since            string       `json:"since,omitempty"` // time of the previous sync
+	Created          int          `json:"created"`
+	Updated          []string     `json:"updated"`
+	Destroyed        []string     `json:"destroyed"`
+	MailboxesChanged bool         `json:"mailboxes_changed"`
+	Threads          []ThreadInfo `json:"threads"` // threads with new emails
+	Truncated        bool         `json:"truncated,omitempty"`
+}
+
+// runSync reports what changed since the previous sync with the same name
+func runSync(args []string) {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	name := fs.String("name", "default", "Sync cursor name; separate agents should use separate names")
+	peek := fs.Bool("peek", false, "Report changes without advancing the cursor")
+	limit := fs.Int("limit", 200, "Maximum number of new emails to list")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: fastmail-agent sync [flags]")
+		fmt.Fprintln(os.Stderr, "\nLists mail that arrived or changed since the last sync. The first run")
+		fmt.Fprintln(os.Stderr, "(or one after the server forgets the old state) is a full resync.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	client := connect()
+	syncer := mailsync.New(client, mailsync.DefaultStatePath(*name))
+
+	prev, _ := syncer.State()
+	result, next, err := syncer.SyncContext(cmdCtx)
+	if err != nil {
+		fatal("syncing", err)
+	}
+
+	out := SyncOutput{
+		FullResync:       result.FullResync,
+		Created:          len(result.Emails.Created),
+		Updated:          result.Emails.Updated,
+		Destroyed:        result.Emails.Destroyed,
+		MailboxesChanged: !result.Mailboxes.Empty(),
+		Threads:          []ThreadInfo{},
+	}
+	if !prev.SyncedAt.IsZero() && !result.FullResync {
+		out.Since = prev.SyncedAt.Local().Format("2006-01-02 15:04")
+	}
+	if out.Updated == nil {
+		out.Updated = []string{}
+	}
+	if out.Destroyed == nil {
+		out.Destroyed = []string{}
+	}
+
+	// A full resync lists the whole account; only report the count
+	if !result.FullResync && len(result.Emails.Created) > 0 {
+		ids := result.Emails.Created
+		if len(ids) > *limit {
+			ids = ids[:*limit]
+			out.Truncated = true
+		}
+		emails, err := client.GetEmailSummariesContext(cmdCtx, ids)
+		if err != nil {
+			fatal("fetching new emails", err)
+		}
+		out.Threads = groupThreads(emails, tui.GroupByThread)
+	}
+
+	if !*peek {
+		if err := syncer.Commit(next); err != nil {
+			fatal("saving sync state", err)
+		}
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(out)
+}
@@ -0,0 +1,177 @@
+package tui
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/charmbracelet/bubbles/key"
+	"github.com/charmbracelet/bubbles/textinput"
+	tea "github.com/charmbracelet/bubbletea"
+
+	"github.com/stevemurr/fastmail-agent/jmap"
+)
+
+type mutationMsg struct {
+	action  string
+	mailbox string
+	ids     []string
+	failed  int
+	err     error
+}
+
+func newMoveInput() textinput.Model {
+	ti := textinput.New()
+	ti.Placeholder = "mailbox name or role"
+	ti.CharLimit = 128
+	ti.Width = 30
+	return ti
+}
+
+// startAction handles the mutating keys for the selected thread, from either
+// the list or the thread view
+func (m Model) startAction(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	selected := m.threadList.Selected()
+	if selected == nil || len(selected.Emails) == 0 {
+		return m, nil
+	}
+
+	var action string
+	switch {
+	case key.Matches(msg, keys.ToggleRead):
+		action = "read"
+		if !selected.Unread {
+			action = "unread"
+		}
+	case key.Matches(msg, keys.ToggleFlag):
+		action = "flag"
+		if selected.Flagged {
+			action = "unflag"
+		}
+	case key.Matches(msg, keys.Archive):
+		action = "archive"
+	case key.Matches(msg, keys.Trash):
+		action = "trash"
+	case key.Matches(msg, keys.Move):
+		m.moving = true
+		m.moveInput.SetValue("")
+		return m, m.moveInput.Focus()
+	}
+
+	m.loading = true
+	m.status = "Applying " + action + "..."
+	return m, m.doMutate(action, "", selected.Handle())
+}
+
+// updateMove handles keys while the move prompt is open
+func (m Model) updateMove(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.Type {
+	case tea.KeyEsc:
+		m.moving = false
+		m.moveInput.Blur()
+		m.status = "Move cancelled"
+		return m, nil
+
+	case tea.KeyEnter:
+		m.moving = false
+		m.moveInput.Blur()
+		mailbox := strings.TrimSpace(m.moveInput.Value())
+		selected := m.threadList.Selected()
+		if mailbox == "" || selected == nil {
+			return m, nil
+		}
+		m.loading = true
+		m.status = "Moving to " + mailbox + "..."
+		return m, m.doMutate("move", mailbox, selected.Handle())
+	}
+
+	var cmd tea.Cmd
+	m.moveInput, cmd = m.moveInput.Update(msg)
+	return m, cmd
+}
+
+func (m Model) doMutate(action, mailbox string, handle jmap.ThreadHandle) tea.Cmd {
+	return func() tea.Msg {
+		ids, err := m.client.ThreadEmailIDs(handle)
+		if err != nil {
+			return mutationMsg{action: action, err: err}
+		}
+
+		var res *jmap.SetResult
+		opts := jmap.SetOptions{}
+		switch action {
+		case "read", "unread":
+			res, err = m.client.MarkRead(ids, action == "read", opts)
+		case "flag", "unflag":
+			res, err = m.client.SetFlagged(ids, action == "flag", opts)
+		case "archive":
+			res, err = m.client.ArchiveEmails(ids, opts)
+		case "trash":
+			res, err = m.client.TrashEmails(ids, opts)
+		case "move":
+			res, err = m.client.MoveEmails(ids, mailbox, opts)
+		}
+		if err != nil {
+			return mutationMsg{action: action, err: err}
+		}
+		return mutationMsg{action: action, mailbox: mailbox, ids: res.Updated, failed: len(res.Failed)}
+	}
+}
+
+// applyMutation mirrors a successful change in the loaded results so the list
+// reflects it without searching again
+func (m Model) applyMutation(msg mutationMsg) Model {
+	changed := make(map[string]bool, len(msg.ids))
+	for _, id := range msg.ids {
+		changed[id] = true
+	}
+
+	removed := false
+	kept := m.results[:0:0]
+	for _, email := range m.results {
+		if !changed[email.ID] {
+			kept = append(kept, email)
+			continue
+		}
+
+		switch msg.action {
+		case "archive", "trash", "move":
+			removed = true
+			continue
+		case "read", "unread":
+			email.Keywords = withKeyword(email.Keywords, jmap.KeywordSeen, msg.action == "read")
+		case "flag", "unflag":
+			email.Keywords = withKeyword(email.Keywords, jmap.KeywordFlagged, msg.action == "flag")
+		}
+		kept = append(kept, email)
+	}
+	m.results = kept
+
+	m.threadList.ReplaceItems(GroupEmails(m.results, m.groupMode))
+	if removed && m.view == viewThread {
+		m.view = viewList
+	}
+
+	m.status = fmt.Sprintf("%s: %d emails", msg.action, len(msg.ids))
+	if msg.action == "move" {
+		m.status = fmt.Sprintf("Moved %d emails to %s", len(msg.ids), msg.mailbox)
+	}
+	if msg.failed > 0 {
+		m.status += fmt.Sprintf(" (%d failed)", msg.failed)
+	}
+	return m
+}
+
+// withKeyword returns a copy of keywords with one keyword set or cleared, so
+// emails shared with other views are not changed underneath them
+func withKeyword(keywords map[string]bool, keyword string, value bool) map[string]bool {
+	updated := make(map[string]bool, len(keywords)+1)
+	for k, v := range keywords {
+		updated[k] = v
+	}
+	if value {
+		updated[keyword] = true
+	} else {
+		delete(updated, keyword)
+	}
+	return updated
+}
@@ -1,10 +1,13 @@
 package tui
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/charmbracelet/bubbles/key"
+	"github.com/charmbracelet/bubbles/textinput"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
 
@@ -12,10 +15,14 @@ import (
 	"github.com/stevemurr/fastmail-agent/jmap"
 )
 
+// debugFile receives debugLog output. It is only opened when
+// FASTMAIL_DEBUG_LOG names a file, as the TUI owns the terminal.
 var debugFile *os.File
 
 func init() {
-	debugFile, _ = os.Create("debug.log")
+	if path := os.Getenv("FASTMAIL_DEBUG_LOG"); path != "" {
+		debugFile, _ = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	}
 }
 
 func debugLog(format string, args ...interface{}) {
@@ -31,6 +38,7 @@ const (
 	viewSearch view = iota
 	viewList
 	viewThread
+	viewCompose
 )
 
 type Model struct {
@@ -39,20 +47,38 @@ type Model struct {
 	search     searchModel
 	threadList threadListModel
 	threadView threadViewModel
+	compose    composeModel
 	width      int
 	height     int
+	groupMode  GroupMode
+	query      string       // query behind the current results
+	results    []jmap.Email // every email loaded so far for query
+	lastPage   *jmap.SearchResult
+	moveInput  textinput.Model
+	moving     bool // move prompt is open
 	loading    bool
+	markdown   bool // copy and folder export produce Markdown
 	status     string
 	err        error
+
+	loadSeq     int                // identifies the newest search or thread load
+	cancelLoad  context.CancelFunc // cancels it; nil when none is in flight
+	loadTimeout time.Duration      // bound on each load, 0 for none
 }
 
+// pageSize is how many emails each search or "load more" fetches
+const pageSize = 50
+
 // Messages
 type searchResultMsg struct {
-	emails []jmap.Email
+	seq    int
+	result *jmap.SearchResult
+	more   bool // result continues the current list rather than replacing it
 	err    error
 }
 
 type threadLoadedMsg struct {
+	seq    int
 	emails []jmap.Email
 	err    error
 }
@@ -71,20 +97,72 @@ type exportPDFMsg struct {
 	err      error
 }
 
-func New(client *jmap.Client) Model {
+type exportFileMsg struct {
+	filename string
+	err      error
+}
+
+func New(client *jmap.Client, groupMode GroupMode) Model {
 	return Model{
 		client:     client,
+		groupMode:  groupMode,
 		view:       viewSearch,
 		search:     newSearchModel(),
 		threadList: newThreadListModel(),
 		threadView: newThreadViewModel(),
+		compose:    newComposeModel(),
+		moveInput:  newMoveInput(),
 	}
 }
 
+// SetLoadTimeout bounds each search and thread load; 0 means no limit
+func (m *Model) SetLoadTimeout(d time.Duration) {
+	m.loadTimeout = d
+}
+
 func (m Model) Init() tea.Cmd {
 	return nil
 }
 
+// beginLoad cancels any search or thread load in flight and starts a new
+// one. Its result carries the returned sequence number; results of older
+// loads are dropped.
+func (m *Model) beginLoad() (context.Context, int) {
+	m.stopLoad()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if m.loadTimeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), m.loadTimeout)
+	}
+	m.cancelLoad = cancel
+	m.loadSeq++
+	m.loading = true
+	return ctx, m.loadSeq
+}
+
+// stopLoad cancels the load in flight, if any
+func (m *Model) stopLoad() {
+	if m.cancelLoad != nil {
+		m.cancelLoad()
+		m.cancelLoad = nil
+		m.loadSeq++
+	}
+}
+
+// finishLoad reports whether a load result is current, releasing the load
+// if so
+func (m *Model) finishLoad(seq int) bool {
+	if seq != m.loadSeq {
+		return false
+	}
+	if m.cancelLoad != nil {
+		m.cancelLoad()
+		m.cancelLoad = nil
+	}
+	m.loading = false
+	return true
+}
+
 func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	switch msg := msg.(type) {
 	case tea.KeyMsg:
@@ -93,6 +171,18 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			return m, tea.Quit
 		}
 
+		if m.moving {
+			return m.updateMove(msg)
+		}
+
+		// Esc abandons a search or thread load in flight
+		if m.cancelLoad != nil && msg.Type == tea.KeyEsc {
+			m.stopLoad()
+			m.loading = false
+			m.status = "Cancelled"
+			return m, nil
+		}
+
 		// Handle view-specific keys
 		switch m.view {
 		case viewSearch:
@@ -101,6 +191,8 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			return m.updateList(msg)
 		case viewThread:
 			return m.updateThread(msg)
+		case viewCompose:
+			return m.updateCompose(msg)
 		}
 
 	case tea.WindowSizeMsg:
@@ -108,10 +200,13 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.height = msg.Height
 		m.threadList.SetHeight(m.height - 6)
 		m.threadView.SetSize(m.width, m.height-4)
+		m.compose.SetSize(m.width, m.height)
 		return m, nil
 
 	case searchResultMsg:
-		m.loading = false
+		if !m.finishLoad(msg.seq) {
+			return m, nil
+		}
 		if msg.err != nil {
 			m.err = msg.err
 			m.status = "Error: " + msg.err.Error()
@@ -119,25 +214,42 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		}
 
 		// Debug: log results
-		for _, email := range msg.emails {
+		for _, email := range msg.result.Emails {
 			debugLog("Search result: Subject=%q ThreadID=%s", email.Subject, email.ThreadID)
 		}
 
-		// Group emails by normalized subject
-		items := GroupEmailsBySubject(msg.emails)
+		if msg.more {
+			m.results = append(m.results, msg.result.Emails...)
+		} else {
+			m.query = msg.result.Query
+			m.results = msg.result.Emails
+		}
+		m.lastPage = msg.result
+
+		items := GroupEmails(m.results, m.groupMode)
 
 		debugLog("Grouped into %d conversations", len(items))
 		for _, item := range items {
 			debugLog("  %q: %d emails", item.Subject, item.EmailCount)
 		}
 
-		m.threadList.SetItems(items)
+		if msg.more {
+			m.threadList.ReplaceItems(items)
+		} else {
+			m.threadList.SetItems(items)
+		}
 		m.view = viewList
-		m.status = fmt.Sprintf("Found %d conversations", len(items))
+		m.status = fmt.Sprintf("Found %d conversations (%d of %d emails)",
+			len(items), len(m.results), msg.result.Total)
+		if msg.result.HasMore() {
+			m.status += " • n for more"
+		}
 		return m, nil
 
 	case threadLoadedMsg:
-		m.loading = false
+		if !m.finishLoad(msg.seq) {
+			return m, nil
+		}
 		if msg.err != nil {
 			m.err = msg.err
 			m.status = "Error: " + msg.err.Error()
@@ -155,6 +267,25 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.status = fmt.Sprintf("%d emails in thread", len(msg.emails))
 		return m, nil
 
+	case replySentMsg:
+		m.loading = false
+		if msg.err != nil {
+			m.view = viewCompose
+			m.status = "Send failed: " + msg.err.Error()
+			return m, nil
+		}
+		m.view = viewThread
+		m.status = "Reply sent to " + msg.to
+		return m, nil
+
+	case mutationMsg:
+		m.loading = false
+		if msg.err != nil {
+			m.status = msg.action + " failed: " + msg.err.Error()
+			return m, nil
+		}
+		return m.applyMutation(msg), nil
+
 	case exportFolderMsg:
 		m.loading = false
 		if msg.err != nil {
@@ -173,6 +304,15 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		}
 		return m, nil
 
+	case exportFileMsg:
+		m.loading = false
+		if msg.err != nil {
+			m.status = "Export failed: " + msg.err.Error()
+		} else {
+			m.status = fmt.Sprintf("Exported to %s", msg.filename)
+		}
+		return m, nil
+
 	case statusMsg:
 		m.status = string(msg)
 		return m, nil
@@ -190,9 +330,9 @@ func (m Model) updateSearch(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 	switch {
 	case key.Matches(msg, keys.Enter):
 		query := m.search.Value()
-		m.loading = true
+		ctx, seq := m.beginLoad()
 		m.status = "Searching..."
-		return m, m.doSearch(query)
+		return m, m.doSearch(ctx, seq, query)
 
 	case key.Matches(msg, keys.Back):
 		return m, tea.Quit
@@ -216,17 +356,35 @@ func (m Model) updateList(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 	case key.Matches(msg, keys.Enter):
 		selected := m.threadList.Selected()
 		if selected != nil && len(selected.Emails) > 0 {
-			m.loading = true
+			ctx, seq := m.beginLoad()
 			m.status = "Loading emails..."
-			// Get email IDs to fetch full bodies
-			ids := make([]string, len(selected.Emails))
-			for i, e := range selected.Emails {
-				ids[i] = e.ID
-			}
-			return m, m.loadEmails(ids)
+			return m, m.loadThread(ctx, seq, selected.Handle())
 		}
 		return m, nil
 
+	case key.Matches(msg, keys.ToggleGroup):
+		if m.groupMode == GroupByThread {
+			m.groupMode = GroupBySubject
+		} else {
+			m.groupMode = GroupByThread
+		}
+		items := GroupEmails(m.results, m.groupMode)
+		m.threadList.SetItems(items)
+		m.status = fmt.Sprintf("Grouped by %s: %d conversations", m.groupMode, len(items))
+		return m, nil
+
+	case key.Matches(msg, keys.ToggleRead, keys.ToggleFlag, keys.Archive, keys.Trash, keys.Move):
+		return m.startAction(msg)
+
+	case key.Matches(msg, keys.LoadMore):
+		if m.lastPage == nil || !m.lastPage.HasMore() {
+			m.status = "No more results"
+			return m, nil
+		}
+		ctx, seq := m.beginLoad()
+		m.status = "Loading more..."
+		return m, m.doLoadMore(ctx, seq)
+
 	case key.Matches(msg, keys.Search):
 		m.view = viewSearch
 		return m, m.search.Focus()
@@ -258,8 +416,10 @@ func (m Model) updateThread(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 
 	case key.Matches(msg, keys.Copy):
 		emails := m.threadView.Emails()
-		if err := export.CopyToClipboard(emails); err != nil {
+		if err := export.CopyThread(emails, m.exportOptions()); err != nil {
 			m.status = "Copy failed: " + err.Error()
+		} else if m.markdown {
+			m.status = "Copied to clipboard (Markdown)!"
 		} else {
 			m.status = "Copied to clipboard (LLM format)!"
 		}
@@ -276,8 +436,7 @@ func (m Model) updateThread(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 
 	case key.Matches(msg, keys.CopyFull):
 		emails := m.threadView.Emails()
-		opts := export.DefaultLLMOptions()
-		if err := export.CopyFullThread(emails, opts); err != nil {
+		if err := export.CopyFullThread(emails, m.exportOptions()); err != nil {
 			m.status = "Copy failed: " + err.Error()
 		} else {
 			m.status = "Full thread copied (with attachments)!"
@@ -290,6 +449,15 @@ func (m Model) updateThread(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 		m.status = "Exporting to folder..."
 		return m, m.doExportFolder(emails)
 
+	case key.Matches(msg, keys.ToggleMarkdown):
+		m.markdown = !m.markdown
+		if m.markdown {
+			m.status = "Copy and folder export: Markdown"
+		} else {
+			m.status = "Copy and folder export: LLM text"
+		}
+		return m, nil
+
 	case key.Matches(msg, keys.ExportPDF):
 		emails := m.threadView.Emails()
 		m.loading = true
@@ -298,12 +466,26 @@ func (m Model) updateThread(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 
 	case key.Matches(msg, keys.Export):
 		emails := m.threadView.Emails()
-		if err := export.ExportToFile(emails, ""); err != nil {
-			m.status = "Export failed: " + err.Error()
-		} else {
-			m.status = "Exported to file!"
+		m.loading = true
+		m.status = "Exporting to file..."
+		return m, m.doExportFile(emails)
+
+	case key.Matches(msg, keys.ToggleRead, keys.ToggleFlag, keys.Archive, keys.Trash, keys.Move):
+		return m.startAction(msg)
+
+	case key.Matches(msg, keys.Reply):
+		// Drafts carry $draft; the Drafts mailbox isn't looked up here
+		orig, ok := jmap.ReplyTarget(m.threadView.Emails(), "")
+		if !ok {
+			return m, nil
 		}
-		return m, nil
+		m.view = viewCompose
+		m.status = "ctrl+s send • esc cancel"
+		var own []string
+		if session := m.client.Session(); session != nil {
+			own = append(own, session.Username)
+		}
+		return m, m.compose.Start(orig, own)
 
 	case key.Matches(msg, keys.Back):
 		m.view = viewList
@@ -316,6 +498,43 @@ func (m Model) updateThread(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 	return m, cmd
 }
 
+func (m Model) updateCompose(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	if m.compose.confirming {
+		switch msg.String() {
+		case "y", "Y":
+			m.compose.confirming = false
+			m.loading = true
+			m.status = "Sending..."
+			return m, m.doSendReply(m.compose.orig, m.compose.own, m.compose.Value())
+		default:
+			m.compose.confirming = false
+			m.status = "Not sent • ctrl+s send • esc cancel"
+			return m, nil
+		}
+	}
+
+	switch {
+	case key.Matches(msg, keys.SendReply):
+		if m.compose.Value() == "" {
+			m.status = "Reply is empty"
+			return m, nil
+		}
+		m.compose.confirming = true
+		m.status = "Send this reply? y/N"
+		return m, nil
+
+	case msg.Type == tea.KeyEsc:
+		m.compose.input.Blur()
+		m.view = viewThread
+		m.status = "Reply discarded"
+		return m, nil
+	}
+
+	var cmd tea.Cmd
+	m.compose, cmd = m.compose.Update(msg)
+	return m, cmd
+}
+
 func (m Model) View() string {
 	if m.width == 0 {
 		return "Loading..."
@@ -330,12 +549,20 @@ func (m Model) View() string {
 		content = m.viewList()
 	case viewThread:
 		content = m.viewThread()
+	case viewCompose:
+		content = m.viewCompose()
 	}
 
 	// Add status bar
 	status := m.status
 	if m.loading {
 		status = "Loading..."
+		if m.cancelLoad != nil {
+			status += " • esc cancel"
+		}
+	}
+	if m.moving {
+		status = "Move to: " + m.moveInput.View()
 	}
 
 	statusBar := statusBarStyle.Render(status)
@@ -355,7 +582,7 @@ func (m Model) viewSearch() string {
 func (m Model) viewList() string {
 	title := titleStyle.Render("Threads")
 	list := m.threadList.View(m.width)
-	help := helpStyle.Render("\n↑/↓ navigate • Enter open • / search • q quit")
+	help := helpStyle.Render("\n↑/↓ navigate • Enter open • n more • g grouping • u read • s flag • y archive • d trash • m move • / search • q quit")
 
 	return lipgloss.JoinVertical(lipgloss.Left, title, list, help)
 }
@@ -368,29 +595,67 @@ func (m Model) viewThread() string {
 	}
 
 	content := m.threadView.View()
-	help := helpStyle.Render("↑/↓ scroll • c copy • a attachments • f full • j folder • p pdf • e export • q back")
+	help := helpStyle.Render("↑/↓ scroll • c copy • a attachments • f full • j folder • t md • p pdf • e export • r reply • u/s/y/d/m mark • q back")
 
 	return lipgloss.JoinVertical(lipgloss.Left, title, content, help)
 }
 
-func (m Model) doSearch(query string) tea.Cmd {
+func (m Model) viewCompose() string {
+	title := titleStyle.Render("Reply")
+	help := helpStyle.Render("ctrl+s send • esc cancel")
+
+	return lipgloss.JoinVertical(lipgloss.Left, title, m.compose.View(), help)
+}
+
+func (m Model) doSearch(ctx context.Context, seq int, query string) tea.Cmd {
+	return func() tea.Msg {
+		opts := jmap.SearchOptions{
+			Limit:            pageSize,
+			ExcludeMailboxes: jmap.DefaultExcludedMailboxes,
+		}
+		result, err := m.client.SearchEmailsContext(ctx, query, opts)
+		return searchResultMsg{seq: seq, result: result, err: err}
+	}
+}
+
+func (m Model) doLoadMore(ctx context.Context, seq int) tea.Cmd {
+	page := m.lastPage
+	opts := page.Options
+	opts.Limit = pageSize
+	opts.Position = page.Position + len(page.Emails)
+	opts.Anchor = ""
+	if len(page.Emails) > 0 {
+		opts.Anchor = page.Emails[len(page.Emails)-1].ID
+	}
+	query := m.query
 	return func() tea.Msg {
-		emails, err := m.client.SearchEmails(query, 50)
-		return searchResultMsg{emails: emails, err: err}
+		result, err := m.client.SearchEmailsContext(ctx, query, opts)
+		return searchResultMsg{seq: seq, result: result, more: true, err: err}
 	}
 }
 
-func (m Model) loadEmails(ids []string) tea.Cmd {
+func (m Model) loadThread(ctx context.Context, seq int, handle jmap.ThreadHandle) tea.Cmd {
 	return func() tea.Msg {
-		emails, err := m.client.GetEmails(ids)
-		return threadLoadedMsg{emails: emails, err: err}
+		emails, err := m.client.GetThreadByHandleContext(ctx, handle)
+		return threadLoadedMsg{seq: seq, emails: emails, err: err}
 	}
 }
 
+// exportOptions are the options for copying and folder export, in the format
+// chosen with ToggleMarkdown
+func (m Model) exportOptions() export.ExportOptions {
+	opts := export.DefaultLLMOptions()
+	opts.Markdown = m.markdown
+	return opts
+}
+
 func (m Model) doExportFolder(emails []jmap.Email) tea.Cmd {
+	opts := m.exportOptions()
 	return func() tea.Msg {
-		opts := export.DefaultLLMOptions()
 		dirName, err := export.ExportToFolder(emails, m.client, opts)
+		if err == nil {
+			_, err = export.WriteManifest(context.Background(), m.client, emails, dirName, export.Provenance{})
+		}
 		return exportFolderMsg{dirName: dirName, err: err}
 	}
 }
@@ -402,7 +667,25 @@ func (m Model) doExportPDF(emails []jmap.Email) tea.Cmd {
 		if len(emails) > 0 {
 			filename = export.GeneratePDFFilename(emails[0].Subject)
 		}
-		err := export.ExportToPDF(emails, filename)
+		hashes := make(export.BlobHashes)
+		_, err := export.WritePDFContext(context.Background(), filename, emails, m.client, export.PDFOptions{Hashes: hashes})
+		if err == nil {
+			_, err = export.WriteManifest(context.Background(), m.client, emails, filename, export.Provenance{Hashes: hashes})
+		}
 		return exportPDFMsg{filename: filename, err: err}
 	}
 }
+
+func (m Model) doExportFile(emails []jmap.Email) tea.Cmd {
+	return func() tea.Msg {
+		filename := ""
+		if len(emails) > 0 {
+			filename = export.GenerateTextFilename(emails[0].Subject)
+		}
+		err := export.ExportToFile(emails, filename)
+		if err == nil {
+			_, err = export.WriteManifest(context.Background(), m.client, emails, filename, export.Provenance{})
+		}
+		return exportFileMsg{filename: filename, err: err}
+	}
+}
@@ -0,0 +1,81 @@
+package tui
+
+import (
+	"fmt"
+
+	"github.com/charmbracelet/bubbles/textarea"
+	tea "github.com/charmbracelet/bubbletea"
+
+	"github.com/stevemurr/fastmail-agent/jmap"
+)
+
+// composeModel is the reply editor. Sending always goes through a y/n
+// confirmation step.
+type composeModel struct {
+	input      textarea.Model
+	orig       jmap.Email // message being replied to
+	own        []string   // the user's addresses, for replies to sent mail
+	confirming bool
+}
+
+type replySentMsg struct {
+	to  string
+	err error
+}
+
+func newComposeModel() composeModel {
+	ta := textarea.New()
+	ta.Placeholder = "Write your reply..."
+	ta.ShowLineNumbers = false
+	ta.CharLimit = 0
+
+	return composeModel{
+		input: ta,
+	}
+}
+
+// Start opens the editor for a reply to orig
+func (m *composeModel) Start(orig jmap.Email, own []string) tea.Cmd {
+	m.orig = orig
+	m.own = own
+	m.confirming = false
+	m.input.Reset()
+	return m.input.Focus()
+}
+
+func (m *composeModel) SetSize(width, height int) {
+	m.input.SetWidth(width - 4)
+	m.input.SetHeight(height - 10)
+}
+
+func (m composeModel) Update(msg tea.Msg) (composeModel, tea.Cmd) {
+	var cmd tea.Cmd
+	m.input, cmd = m.input.Update(msg)
+	return m, cmd
+}
+
+func (m composeModel) View() string {
+	// Preview the headers NewReply will produce
+	draft := jmap.NewReply(m.orig, jmap.EmailAddress{}, "", false, m.own...)
+	header := fmt.Sprintf("To: %s\nSubject: %s\n", formatAddresses(draft.To), draft.Subject)
+	return header + "\n" + m.input.View()
+}
+
+func (m composeModel) Value() string {
+	return m.input.Value()
+}
+
+func (m Model) doSendReply(orig jmap.Email, own []string, body string) tea.Cmd {
+	return func() tea.Msg {
+		identity, err := m.client.FindIdentity("")
+		if err != nil {
+			return replySentMsg{err: err}
+		}
+
+		draft := jmap.NewReply(orig, identity.Address(), body, false, own...)
+		if _, err := m.client.SendEmail(draft, identity, jmap.SendOptions{}); err != nil {
+			return replySentMsg{err: err}
+		}
+		return replySentMsg{to: formatAddresses(draft.To)}
+	}
+}
@@ -9,12 +9,22 @@ type keyMap struct {
 	Back            key.Binding
 	Quit            key.Binding
 	Search          key.Binding
+	LoadMore        key.Binding
+	ToggleGroup     key.Binding
+	ToggleRead      key.Binding
+	ToggleFlag      key.Binding
+	Archive         key.Binding
+	Trash           key.Binding
+	Move            key.Binding
+	Reply           key.Binding
+	SendReply       key.Binding
 	Export          key.Binding
 	Copy            key.Binding
 	CopyAttachments key.Binding
 	CopyFull        key.Binding
 	ExportFolder    key.Binding
 	ExportPDF       key.Binding
+	ToggleMarkdown  key.Binding
 	PageUp          key.Binding
 	PageDown        key.Binding
 }
@@ -44,6 +54,42 @@ var keys = keyMap{
 		key.WithKeys("/"),
 		key.WithHelp("/", "search"),
 	),
+	LoadMore: key.NewBinding(
+		key.WithKeys("n"),
+		key.WithHelp("n", "load more"),
+	),
+	ToggleGroup: key.NewBinding(
+		key.WithKeys("g"),
+		key.WithHelp("g", "toggle grouping"),
+	),
+	ToggleRead: key.NewBinding(
+		key.WithKeys("u"),
+		key.WithHelp("u", "toggle read"),
+	),
+	ToggleFlag: key.NewBinding(
+		key.WithKeys("s"),
+		key.WithHelp("s", "toggle flag"),
+	),
+	Archive: key.NewBinding(
+		key.WithKeys("y"),
+		key.WithHelp("y", "archive"),
+	),
+	Trash: key.NewBinding(
+		key.WithKeys("d"),
+		key.WithHelp("d", "trash"),
+	),
+	Move: key.NewBinding(
+		key.WithKeys("m"),
+		key.WithHelp("m", "move"),
+	),
+	Reply: key.NewBinding(
+		key.WithKeys("r"),
+		key.WithHelp("r", "reply"),
+	),
+	SendReply: key.NewBinding(
+		key.WithKeys("ctrl+s"),
+		key.WithHelp("ctrl+s", "send"),
+	),
 	Export: key.NewBinding(
 		key.WithKeys("e"),
 		key.WithHelp("e", "export"),
@@ -68,6 +114,10 @@ var keys = keyMap{
 		key.WithKeys("p"),
 		key.WithHelp("p", "export PDF"),
 	),
+	ToggleMarkdown: key.NewBinding(
+		key.WithKeys("t"),
+		key.WithHelp("t", "toggle Markdown"),
+	),
 	PageUp: key.NewBinding(
 		key.WithKeys("pgup", "ctrl+u"),
 		key.WithHelp("pgup", "page up"),
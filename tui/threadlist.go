@@ -10,14 +10,46 @@ import (
 	"github.com/stevemurr/fastmail-agent/jmap"
 )
 
+// GroupMode selects how search results are folded into conversations
+type GroupMode int
+
+const (
+	// GroupByThread uses the server's threadId
+	GroupByThread GroupMode = iota
+	// GroupBySubject merges emails whose normalized subjects match
+	GroupBySubject
+)
+
+// String returns the mode name as used on the command line
+func (g GroupMode) String() string {
+	if g == GroupBySubject {
+		return "subject"
+	}
+	return "thread"
+}
+
+// ParseGroupMode parses "thread" or "subject"
+func ParseGroupMode(s string) (GroupMode, error) {
+	switch strings.ToLower(s) {
+	case "thread", "":
+		return GroupByThread, nil
+	case "subject":
+		return GroupBySubject, nil
+	}
+	return GroupByThread, fmt.Errorf("unknown grouping %q (use thread or subject)", s)
+}
+
 // ThreadItem represents a thread/conversation in the list
 type ThreadItem struct {
+	ThreadID          string // empty when grouped by subject
 	NormalizedSubject string
 	Subject           string
 	From              string
 	Date              time.Time
 	Preview           string
 	EmailCount        int
+	Unread            bool         // at least one email lacks $seen
+	Flagged           bool         // at least one email has $flagged
 	Emails            []jmap.Email // All emails in this conversation
 }
 
@@ -39,6 +71,38 @@ func NormalizeSubject(subject string) string {
 	return strings.ToLower(normalized)
 }
 
+// GroupEmails groups emails into conversations using the given mode
+func GroupEmails(emails []jmap.Email, mode GroupMode) []ThreadItem {
+	if mode == GroupBySubject {
+		return GroupEmailsBySubject(emails)
+	}
+	return GroupEmailsByThread(emails)
+}
+
+// GroupEmailsByThread groups emails by their JMAP threadId
+func GroupEmailsByThread(emails []jmap.Email) []ThreadItem {
+	groups := make(map[string][]jmap.Email)
+	var order []string
+
+	for _, email := range emails {
+		key := email.ThreadID
+		if key == "" {
+			// Servers always set threadId, but don't merge emails if one doesn't
+			key = "email:" + email.ID
+		}
+		if _, exists := groups[key]; !exists {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], email)
+	}
+
+	items := buildThreadItems(order, groups)
+	for i := range items {
+		items[i].ThreadID = items[i].Emails[0].ThreadID
+	}
+	return items
+}
+
 // GroupEmailsBySubject groups emails by normalized subject
 func GroupEmailsBySubject(emails []jmap.Email) []ThreadItem {
 	// Group by normalized subject
@@ -53,7 +117,11 @@ func GroupEmailsBySubject(emails []jmap.Email) []ThreadItem {
 		groups[key] = append(groups[key], email)
 	}
 
-	// Build thread items
+	return buildThreadItems(order, groups)
+}
+
+// buildThreadItems turns grouped emails into list items, keeping group order
+func buildThreadItems(order []string, groups map[string][]jmap.Email) []ThreadItem {
 	items := make([]ThreadItem, 0, len(order))
 	for _, key := range order {
 		groupEmails := groups[key]
@@ -79,13 +147,21 @@ func GroupEmailsBySubject(emails []jmap.Email) []ThreadItem {
 
 		date, _ := time.Parse(time.RFC3339, newest.ReceivedAt)
 
+		unread, flagged := false, false
+		for _, e := range groupEmails {
+			unread = unread || !e.HasKeyword(jmap.KeywordSeen)
+			flagged = flagged || e.HasKeyword(jmap.KeywordFlagged)
+		}
+
 		items = append(items, ThreadItem{
-			NormalizedSubject: key,
+			NormalizedSubject: NormalizeSubject(newest.Subject),
 			Subject:           newest.Subject,
 			From:              from,
 			Date:              date,
 			Preview:           newest.Preview,
 			EmailCount:        len(groupEmails),
+			Unread:            unread,
+			Flagged:           flagged,
 			Emails:            groupEmails,
 		})
 	}
@@ -93,6 +169,25 @@ func GroupEmailsBySubject(emails []jmap.Email) []ThreadItem {
 	return items
 }
 
+// EmailIDs returns the IDs of the emails loaded for this item
+func (t ThreadItem) EmailIDs() []string {
+	ids := make([]string, len(t.Emails))
+	for i, e := range t.Emails {
+		ids[i] = e.ID
+	}
+	return ids
+}
+
+// Handle returns a stable handle for the item. Server threads are referenced
+// by threadId so fetching them returns every message; subject groups can
+// span several threads and are referenced by their email IDs.
+func (t ThreadItem) Handle() jmap.ThreadHandle {
+	if t.ThreadID != "" {
+		return jmap.ThreadHandle{ThreadIDs: []string{t.ThreadID}}
+	}
+	return jmap.ThreadHandle{EmailIDs: t.EmailIDs()}
+}
+
 type threadListModel struct {
 	items  []ThreadItem
 	cursor int
@@ -115,6 +210,21 @@ func (m *threadListModel) SetItems(items []ThreadItem) {
 	m.offset = 0
 }
 
+// ReplaceItems swaps in a new item list but keeps the cursor where it was,
+// e.g. after more results have been loaded
+func (m *threadListModel) ReplaceItems(items []ThreadItem) {
+	m.items = items
+	if m.cursor >= len(m.items) {
+		m.cursor = len(m.items) - 1
+	}
+	if m.cursor < 0 {
+		m.cursor = 0
+	}
+	if m.offset > m.cursor {
+		m.offset = m.cursor
+	}
+}
+
 func (m *threadListModel) SetHeight(h int) {
 	// Reserve space for borders and padding
 	m.height = h - 4
@@ -183,7 +293,7 @@ func (m *threadListModel) View(width int) string {
 		}
 
 		// Truncate subject if needed
-		maxSubjectLen := width - 35 - len(countStr)
+		maxSubjectLen := width - 38 - len(countStr)
 		if maxSubjectLen < 20 {
 			maxSubjectLen = 20
 		}
@@ -197,7 +307,20 @@ func (m *threadListModel) View(width int) string {
 			from = from[:17] + "..."
 		}
 
-		line := fmt.Sprintf("%-20s  %s  %s%s",
+		marks := ""
+		if item.Unread {
+			marks += "●"
+		} else {
+			marks += " "
+		}
+		if item.Flagged {
+			marks += "★"
+		} else {
+			marks += " "
+		}
+
+		line := fmt.Sprintf("%s %-20s  %s  %s%s",
+			marks,
 			from,
 			dateStyle.Render(dateStr),
 			subject,
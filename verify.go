@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/stevemurr/fastmail-agent/export"
+)
+
+// runVerify re-hashes exports against their manifests
+func runVerify(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: fastmail-agent verify <export>...")
+		fmt.Fprintln(os.Stderr, "\nChecks exported files against the SHA-256 in their manifests. An export is")
+		fmt.Fprintln(os.Stderr, "a directory, an exported file or a manifest. For a directory, every manifest")
+		fmt.Fprintln(os.Stderr, "inside it is checked too, and files added since the export are reported.")
+		fmt.Fprintln(os.Stderr, "Exits 1 if anything was modified, missing or added.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+
+	var manifests []string
+	for _, arg := range fs.Args() {
+		found, err := findManifests(arg)
+		if err != nil {
+			fatal("", err)
+		}
+		manifests = append(manifests, found...)
+	}
+
+	results := make([]*export.VerifyResult, 0, len(manifests))
+	ok := true
+	for _, path := range manifests {
+		result, err := export.VerifyManifest(path)
+		if err != nil {
+			fatal("verifying "+path, err)
+		}
+		results = append(results, result)
+		ok = ok && result.OK
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(struct {
+		OK        bool                   `json:"ok"`
+		Manifests []*export.VerifyResult `json:"manifests"`
+	}{ok, results})
+
+	if !ok {
+		os.Exit(exitFailure)
+	}
+}
+
+// findManifests returns the manifests of an export: a file's manifest, or
+// every manifest in a directory, its own first
+func findManifests(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		if strings.HasSuffix(path, export.ManifestSuffix) || filepath.Base(path) == export.ManifestFile {
+			return []string{path}, nil
+		}
+		return []string{export.ManifestPath(path)}, nil
+	}
+
+	var manifests []string
+	err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if d.Name() == export.ManifestFile || strings.HasSuffix(d.Name(), export.ManifestSuffix) {
+			manifests = append(manifests, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(manifests) == 0 {
+		return nil, errors.New("no manifest found in " + path)
+	}
+
+	own := filepath.Join(path, export.ManifestFile)
+	for i, m := range manifests {
+		if m == own {
+			manifests = append([]string{own}, append(manifests[:i:i], manifests[i+1:]...)...)
+			break
+		}
+	}
+	return manifests, nil
+}